@@ -0,0 +1,153 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/muka/go-bluetooth/api"
+	"github.com/muka/go-bluetooth/bluez/profile/adapter"
+	"github.com/muka/go-bluetooth/bluez/profile/device"
+)
+
+// abortConnect cancels a pending connection attempt, which BlueZ does when
+// disconnecting a device it hasn't replied to Connect for yet.
+func abortConnect(address string) error {
+	path, err := devicePath(address)
+	if err != nil {
+		return err
+	}
+	dev, err := device.NewDevice1(path)
+	if err != nil {
+		return err
+	}
+	return dev.Disconnect()
+}
+
+func adapterPowered() (bool, error) {
+	a, err := api.GetDefaultAdapter()
+	if err != nil {
+		return false, err
+	}
+	return a.GetPowered()
+}
+
+// resetAdapter unblocks the radio in case it got soft blocked, and power
+// cycles the adapter through BlueZ.
+func resetAdapter() error {
+	// rfkill may not be installed, in which case the power toggle alone has
+	// to do.
+	exec.Command("rfkill", "unblock", "bluetooth").Run()
+	a, err := api.GetDefaultAdapter()
+	if err != nil {
+		return err
+	}
+	a.SetPowered(false)
+	time.Sleep(time.Second)
+	return a.SetPowered(true)
+}
+
+// setAdapterPower powers the adapter on or off through BlueZ, unblocking the
+// radio first when powering it on.
+func setAdapterPower(on bool) error {
+	if on {
+		exec.Command("rfkill", "unblock", "bluetooth").Run()
+	}
+	a, err := api.GetDefaultAdapter()
+	if err != nil {
+		return err
+	}
+	return a.SetPowered(on)
+}
+
+func adapterAddress() (string, error) {
+	addr, err := Adapter.Adapter.Address()
+	if err != nil {
+		return "", err
+	}
+	return addr.String(), nil
+}
+
+// adapterID is the adapter in use.
+func adapterID() string {
+	return adapter.GetDefaultAdapterID()
+}
+
+// adapterDetails asks BlueZ about the adapter in use.
+func adapterDetails() (AdapterDetails, error) {
+	a, err := api.GetDefaultAdapter()
+	if err != nil {
+		return AdapterDetails{}, err
+	}
+	props, err := a.GetProperties()
+	if err != nil {
+		return AdapterDetails{}, err
+	}
+	details := AdapterDetails{
+		ID: adapterID(),
+		Address: props.Address,
+		AddressType: props.AddressType,
+		Name: props.Name,
+		Alias: props.Alias,
+		Class: props.Class,
+		Modalias: props.Modalias,
+		Powered: props.Powered,
+		Discoverable: props.Discoverable,
+		Pairable: props.Pairable,
+		Discovering: props.Discovering,
+		Roles: props.Roles,
+		UUIDs: props.UUIDs,
+		Capabilities: []string{},
+	}
+	if len(props.Roles) > 0 {
+		details.Capabilities = append(details.Capabilities, "le")
+	}
+	if props.Class != 0 {
+		details.Capabilities = append(details.Capabilities, "bredr")
+	}
+	return details, nil
+}
+
+// listAdapters lists the controllers the kernel knows about, with what
+// BlueZ reports for the ones it has registered.
+func listAdapters() ([]AdapterInfo, error) {
+	entries, err := os.ReadDir("/sys/class/bluetooth")
+	if errors.Is(err, fs.ErrNotExist) {
+		return []AdapterInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	adapters := []AdapterInfo{}
+	for _, e := range entries {
+		// Connections show up as hciN:handle next to their controller.
+		if strings.Contains(e.Name(), ":") {
+			continue
+		}
+		info := AdapterInfo{ID: e.Name(), InUse: e.Name() == adapterID()}
+		if a, err := adapter.GetAdapter(e.Name()); err == nil {
+			info.Address = a.Properties.Address
+			info.Powered = a.Properties.Powered
+		}
+		adapters = append(adapters, info)
+	}
+	return adapters, nil
+}
+
+// useAdapter makes id the adapter enabled at start, and after hotplug.
+func useAdapter(id string) error {
+	exists, err := adapter.AdapterExists(id)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.New("adapter " + id + " not found")
+	}
+	adapter.SetDefaultAdapterID(id)
+	return nil
+}
@@ -0,0 +1,55 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// adapterAddress isn't available from the other backends, which is reported
+// as an empty address rather than an error.
+func adapterAddress() (string, error) {
+	return "", nil
+}
+
+func adapterPowered() (bool, error) {
+	return true, nil
+}
+
+// abortConnect can't reach into a pending attempt on the other backends,
+// which is left to finish and disconnected if it succeeds.
+func abortConnect(address string) error {
+	return errUnsupported
+}
+
+func resetAdapter() error {
+	return errors.New("adapter reset is only supported on Linux")
+}
+
+func adapterID() string {
+	return "default"
+}
+
+// adapterDetails only knows the other backends scan for and connect to BLE
+// devices.
+func adapterDetails() (AdapterDetails, error) {
+	addr, err := adapterAddress()
+	if err != nil {
+		return AdapterDetails{}, err
+	}
+	return AdapterDetails{ID: "default", Address: addr, Powered: true, Capabilities: []string{"le"}}, nil
+}
+
+func setAdapterPower(on bool) error {
+	return errors.New("adapter power control is only supported on Linux")
+}
+
+// listAdapters reports the one adapter the other backends expose.
+func listAdapters() ([]AdapterInfo, error) {
+	return []AdapterInfo{{ID: "default", Powered: true, InUse: true}}, nil
+}
+
+func useAdapter(id string) error {
+	if id != "default" {
+		return errors.New("only the default adapter is supported on this platform")
+	}
+	return nil
+}
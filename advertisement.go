@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// ManufacturerData is a manufacturer specific data field of an
+// advertisement, identifying its company and with a payload in hex.
+type ManufacturerData struct {
+	CompanyID uint16
+	Data      string
+}
+
+// ServiceData is the data a device advertises for one of its services, in
+// hex.
+type ServiceData struct {
+	UUID string
+	Data string
+}
+
+// Scan results arrive for every advertisement heard, hundreds a second in
+// busy places, so handling them avoids allocating whenever nothing changed.
+
+// addressCache keeps the string form of scanned addresses, which the
+// library builds with an allocation per character.
+type addressCache struct {
+	mu    sync.Mutex
+	names map[bluetooth.Address]string
+}
+
+// maxCachedAddresses bounds the cache against devices rotating random
+// addresses.
+const maxCachedAddresses = 4096
+
+var scanAddresses = addressCache{names: map[bluetooth.Address]string{}}
+
+func (ac *addressCache) String(address bluetooth.Address) string {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if name, ok := ac.names[address]; ok {
+		return name
+	}
+	if len(ac.names) >= maxCachedAddresses {
+		ac.names = map[bluetooth.Address]string{}
+	}
+	name := address.String()
+	ac.names[address] = name
+	return name
+}
+
+// parseManufacturer copies the manufacturer data of an advertisement, only
+// valid during the scan callback, sorted by company.
+func parseManufacturer(data map[uint16][]byte) []ManufacturerData {
+	if len(data) == 0 {
+		return nil
+	}
+	manufacturer := []ManufacturerData{}
+	for id, payload := range data {
+		manufacturer = append(manufacturer, ManufacturerData{id, hex.EncodeToString(payload)})
+	}
+	slices.SortFunc(manufacturer, func (a, b ManufacturerData) int {
+		return int(a.CompanyID) - int(b.CompanyID)
+	})
+	return manufacturer
+}
+
+const hexDigits = "0123456789abcdef"
+
+// sameManufacturer tells whether parsed manufacturer data still matches an
+// advertisement's, without encoding it again.
+func sameManufacturer(parsed []ManufacturerData, data map[uint16][]byte) bool {
+	if len(parsed) != len(data) {
+		return false
+	}
+	for _, m := range parsed {
+		payload, ok := data[m.CompanyID]
+		if !ok || len(m.Data) != 2 * len(payload) {
+			return false
+		}
+		for i, b := range payload {
+			if m.Data[2 * i] != hexDigits[b >> 4] || m.Data[2 * i + 1] != hexDigits[b & 0xf] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ReportDevice raises a DEVICE event for a device that showed up or
+// changed, along with the services it advertises, which BlueZ collects from
+// its advertisements on Linux.
+func ReportDevice(addr string) {
+	services, data, err := advertisedServices(addr)
+	if err == nil {
+		Devices.SetServices(addr, services, data)
+	}
+	LogDeviceInfo(Devices.Device(addr).DeviceInfo()...)
+}
+
+// ReportQueue holds the devices waiting to be reported, each address once
+// however often it changed meanwhile, so a burst of advertisements is
+// reported by one worker instead of a goroutine each.
+type ReportQueue struct {
+	mu      sync.Mutex
+	pending map[string]bool
+	order   []string
+	wake    chan struct{}
+}
+
+var DeviceReports = ReportQueue{pending: map[string]bool{}, wake: make(chan struct{}, 1)}
+
+// Add queues a device to be reported, unless it already is.
+func (rq *ReportQueue) Add(addr string) {
+	rq.mu.Lock()
+	if !rq.pending[addr] {
+		rq.pending[addr] = true
+		rq.order = append(rq.order, addr)
+	}
+	rq.mu.Unlock()
+	select {
+	case rq.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next takes the device queued longest ago, if any.
+func (rq *ReportQueue) next() (string, bool) {
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+	if len(rq.order) == 0 {
+		return "", false
+	}
+	addr := rq.order[0]
+	rq.order = rq.order[1:]
+	delete(rq.pending, addr)
+	return addr, true
+}
+
+// Run reports the queued devices as they come.
+func (rq *ReportQueue) Run() {
+	for range rq.wake {
+		for addr, ok := rq.next(); ok; addr, ok = rq.next() {
+			ReportDevice(addr)
+		}
+	}
+}
+
+// formatManufacturer writes manufacturer data as company:payload pairs
+// separated by commas, eg. 004c:0215...
+func formatManufacturer(manufacturer []ManufacturerData) string {
+	parts := []string{}
+	for _, m := range manufacturer {
+		parts = append(parts, fmt.Sprintf("%04x:%s", m.CompanyID, m.Data))
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,38 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/hex"
+	"slices"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/muka/go-bluetooth/bluez/profile/device"
+)
+
+// advertisedServices returns the service UUIDs and service data BlueZ has
+// collected from a device's advertisements.
+func advertisedServices(address string) ([]string, []ServiceData, error) {
+	path, err := devicePath(address)
+	if err != nil {
+		return nil, nil, err
+	}
+	dev, err := device.NewDevice1(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	data := []ServiceData{}
+	for id, value := range dev.Properties.ServiceData {
+		if v, ok := value.(dbus.Variant); ok {
+			value = v.Value()
+		}
+		if b, ok := value.([]byte); ok {
+			data = append(data, ServiceData{id, hex.EncodeToString(b)})
+		}
+	}
+	slices.SortFunc(data, func (a, b ServiceData) int {
+		return strings.Compare(a.UUID, b.UUID)
+	})
+	return slices.Clone(dev.Properties.UUIDs), data, nil
+}
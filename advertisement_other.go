@@ -0,0 +1,7 @@
+//go:build !linux
+
+package main
+
+func advertisedServices(address string) ([]string, []ServiceData, error) {
+	return nil, nil, errUnsupported
+}
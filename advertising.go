@@ -0,0 +1,127 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"time"
+)
+
+const (
+	// advertisingGaps is how many of the latest gaps between advertisements
+	// are kept to infer a device's pattern from, looked at again every
+	// advertisingEvery gaps once there are advertisingMinGaps.
+	advertisingGaps    = 64
+	advertisingEvery   = 16
+	advertisingMinGaps = 16
+	// Gaps longer than advertisingSleep intervals are taken for sleeps
+	// rather than advertisements missed by the scan.
+	advertisingSleep = 4
+	// A device whose gaps vary by more than advertisingIrregular of their
+	// mean, or whose interval grew advertisingSlowing times its usual one,
+	// is flagged.
+	advertisingIrregular = 0.5
+	advertisingSlowing   = 2
+	advertisingBaselineAlpha = 0.05
+	// Gaps shorter than the shortest interval BLE allows are the same
+	// advertisement reported again.
+	advertisingMinInterval = 20 * time.Millisecond
+)
+
+// AdvertisingStats is what a device's advertising pattern looks like:
+// Interval between advertisements while awake, how much it varies (Jitter,
+// as a fraction of the mean), the fraction of the time it spends awake and
+// how long it sleeps for in between. Abnormal is irregular or slowing when
+// the pattern suggests a flat battery or a firmware bug.
+type AdvertisingStats struct {
+	Interval  string
+	Jitter    float64
+	DutyCycle float64
+	Sleep     string `json:",omitempty"`
+	Abnormal  string `json:",omitempty"`
+	// Baseline is the interval the device usually advertises at, which
+	// adapts slowly so only sudden slowdowns are flagged.
+	Baseline  string
+	interval  time.Duration
+	baseline  time.Duration
+}
+
+// advertising keeps the latest gaps of a device.
+type advertising struct {
+	gaps  []time.Duration
+	next  int
+	added int
+	stats *AdvertisingStats
+}
+
+// add records a gap, returning whether the pattern was worked out again.
+func (a *advertising) add(gap time.Duration) bool {
+	if gap < advertisingMinInterval {
+		return false
+	}
+	if len(a.gaps) < advertisingGaps {
+		a.gaps = append(a.gaps, gap)
+	} else {
+		a.gaps[a.next] = gap
+		a.next = (a.next + 1) % advertisingGaps
+	}
+	a.added++
+	if len(a.gaps) < advertisingMinGaps || a.added % advertisingEvery != 0 {
+		return false
+	}
+	stats := inferAdvertising(a.gaps)
+	stats.baseline = stats.interval
+	if previous := a.stats; previous != nil {
+		stats.baseline = previous.baseline + time.Duration(advertisingBaselineAlpha * float64(stats.interval - previous.baseline))
+		if stats.Abnormal == "" && stats.interval > advertisingSlowing * previous.baseline {
+			stats.Abnormal = "slowing"
+		}
+	}
+	stats.Baseline = stats.baseline.Round(time.Millisecond).String()
+	a.stats = &stats
+	return true
+}
+
+// inferAdvertising tells sleeps from gaps while awake by how they compare
+// with the shortest gaps but an outlier or two, a scan missing
+// advertisements only making gaps longer.
+func inferAdvertising(gaps []time.Duration) AdvertisingStats {
+	sorted := slices.Clone(gaps)
+	slices.Sort(sorted)
+	interval := sorted[len(sorted) / 10]
+	var awake, total time.Duration
+	awakeGaps := []float64{}
+	sleeps := []time.Duration{}
+	for _, gap := range sorted {
+		total += gap
+		if gap > advertisingSleep * interval {
+			sleeps = append(sleeps, gap)
+			continue
+		}
+		awake += gap
+		// Gaps spanning advertisements the scan missed count as several.
+		missed := max(math.Round(float64(gap) / float64(interval)), 1)
+		awakeGaps = append(awakeGaps, float64(gap) / missed)
+	}
+	mean, variance := 0.0, 0.0
+	for _, gap := range awakeGaps {
+		mean += gap / float64(len(awakeGaps))
+	}
+	for _, gap := range awakeGaps {
+		variance += (gap - mean) * (gap - mean) / float64(len(awakeGaps))
+	}
+	stats := AdvertisingStats{
+		Interval: time.Duration(mean).Round(time.Millisecond).String(),
+		DutyCycle: math.Round(100 * float64(awake) / float64(total)) / 100,
+		interval: time.Duration(mean),
+	}
+	if mean > 0 {
+		stats.Jitter = math.Round(100 * math.Sqrt(variance) / mean) / 100
+	}
+	if len(sleeps) > 0 {
+		stats.Sleep = sleeps[len(sleeps) / 2].Round(time.Millisecond).String()
+	}
+	if stats.Jitter > advertisingIrregular {
+		stats.Abnormal = "irregular"
+	}
+	return stats
+}
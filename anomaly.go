@@ -0,0 +1,92 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"sync"
+)
+
+const (
+	anomalyAlpha  = 0.1
+	anomalyWarmup = 10
+	anomalyStuck  = 30
+)
+
+// anomalyBand tracks an exponentially weighted mean and variance of one
+// metric of one device.
+type anomalyBand struct {
+	mean     float64
+	variance float64
+	samples  int
+	last     float64
+	repeats  int
+	outliers int
+	flagged  bool
+	stuck    bool
+}
+
+// SafeAnomalies flags samples further than Threshold standard deviations
+// from their EWMA band, and sensors reporting the same value for too long.
+// A zero Threshold disables detection.
+type SafeAnomalies struct {
+	mu        sync.Mutex
+	Threshold float64
+	bands     map[string]*anomalyBand
+}
+
+var Anomalies = SafeAnomalies{Threshold: 4, bands: map[string]*anomalyBand{}}
+
+// Observe feeds a sample and returns a reason when it is anomalous. Each
+// excursion is only reported once, until the metric is back in its band.
+func (sa *SafeAnomalies) Observe(addr string, metric string, value float64) string {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	if sa.Threshold <= 0 {
+		return ""
+	}
+	key := addr + ";" + metric
+	b, ok := sa.bands[key]
+	if !ok {
+		sa.bands[key] = &anomalyBand{mean: value, last: value, samples: 1}
+		return ""
+	}
+	reason := ""
+	if value == b.last {
+		b.repeats++
+		if b.repeats >= anomalyStuck && !b.stuck {
+			b.stuck = true
+			reason = "stuck"
+		}
+	} else {
+		b.repeats = 0
+		b.stuck = false
+	}
+	b.last = value
+	stddev := math.Sqrt(b.variance)
+	deviation := math.Abs(value - b.mean)
+	outside := b.samples >= anomalyWarmup && deviation > sa.Threshold * max(stddev, 1)
+	if outside && !b.flagged && reason == "" {
+		reason = "deviation"
+	}
+	b.flagged = outside
+	// Outliers are kept out of the band so a single spike doesn't widen it,
+	// but a lasting shift is relearned.
+	if outside {
+		b.outliers++
+	} else {
+		b.outliers = 0
+		diff := value - b.mean
+		b.mean += anomalyAlpha * diff
+		b.variance = (1 - anomalyAlpha) * (b.variance + anomalyAlpha * diff * diff)
+	}
+	b.samples++
+	if b.outliers >= anomalyWarmup {
+		*b = anomalyBand{mean: value, last: value, samples: 1, repeats: b.repeats, stuck: b.stuck}
+	}
+	if reason == "" {
+		return ""
+	}
+	return strings.Join([]string{
+		addr, metric, reason, formatFloat(value), formatFloat(b.mean), formatFloat(stddev),
+	}, ";")
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AuditEntry is one line of the audit log. Hash chains every entry to the
+// previous one, and Signature is an HMAC of Hash with a key that never leaves
+// the data directory, so entries can't be edited, dropped or reordered
+// without verification failing.
+type AuditEntry struct {
+	Seq       int64
+	Time      time.Time
+	Actor     string
+	Action    string
+	Detail    string
+	Prev      string
+	Hash      string
+	Signature string
+}
+
+type AuditVerification struct {
+	Valid    bool
+	Entries  int64
+	BrokenAt int64  `json:",omitempty"`
+	Error    string `json:",omitempty"`
+}
+
+type AuditLog struct {
+	mu   sync.Mutex
+	f    *os.File
+	key  []byte
+	seq  int64
+	head string
+}
+
+const (
+	auditFile    = "audit.log"
+	auditKeyFile = "audit.key"
+)
+
+var Audit = AuditLog{}
+
+func (e *AuditEntry) digest() string {
+	payload, _ := json.Marshal([]any{e.Seq, e.Time, e.Actor, e.Action, e.Detail, e.Prev})
+	sum := sha256.Sum256(payload)
+	return hex.EncodeToString(sum[:])
+}
+
+func (al *AuditLog) sign(hash string) string {
+	mac := hmac.New(sha256.New, al.key)
+	mac.Write([]byte(hash))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func loadAuditKey() ([]byte, error) {
+	path := filepath.Join(DataDir, auditKeyFile)
+	key, err := os.ReadFile(path)
+	if err == nil {
+		return key, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(DataDir, 0o755); err != nil {
+		return nil, err
+	}
+	return key, os.WriteFile(path, key, 0o600)
+}
+
+// Open loads the signing key and picks the chain up where the existing log
+// left off.
+func (al *AuditLog) Open() error {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	key, err := loadAuditKey()
+	if err != nil {
+		return err
+	}
+	al.key = key
+	path := filepath.Join(DataDir, auditFile)
+	if f, err := os.Open(path); err == nil {
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			e := AuditEntry{}
+			if json.Unmarshal(s.Bytes(), &e) == nil {
+				al.seq, al.head = e.Seq, e.Hash
+			}
+		}
+		f.Close()
+	}
+	al.f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	return err
+}
+
+func (al *AuditLog) Record(actor string, action string, detail string) {
+	Quiesce.RLock()
+	defer Quiesce.RUnlock()
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if al.f == nil {
+		return
+	}
+	e := AuditEntry{
+		Seq: al.seq + 1,
+		Time: time.Now().UTC(),
+		Actor: actor,
+		Action: action,
+		Detail: detail,
+		Prev: al.head,
+	}
+	e.Hash = e.digest()
+	e.Signature = al.sign(e.Hash)
+	line, _ := json.Marshal(e)
+	_, err := al.f.Write(append(line, '\n'))
+	if err != nil {
+		log.Printf("[ERROR] Could not write audit entry - %v", err)
+		return
+	}
+	err = al.f.Sync()
+	if err != nil {
+		log.Printf("[ERROR] Could not sync audit log - %v", err)
+	}
+	al.seq, al.head = e.Seq, e.Hash
+}
+
+func (al *AuditLog) Verify() AuditVerification {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	v := AuditVerification{Valid: true}
+	f, err := os.Open(filepath.Join(DataDir, auditFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return v
+	}
+	if err != nil {
+		return AuditVerification{Error: err.Error()}
+	}
+	defer f.Close()
+	prev := ""
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		v.Entries++
+		e := AuditEntry{}
+		err := json.Unmarshal(s.Bytes(), &e)
+		switch {
+		case err != nil:
+			v.Error = "entry is not valid JSON"
+		case e.Seq != v.Entries:
+			v.Error = "entry is out of sequence"
+		case e.Prev != prev:
+			v.Error = "entry does not chain to the previous one"
+		case e.digest() != e.Hash:
+			v.Error = "entry hash does not match its contents"
+		case !hmac.Equal([]byte(al.sign(e.Hash)), []byte(e.Signature)):
+			v.Error = "entry signature is invalid"
+		}
+		if v.Error != "" {
+			v.Valid = false
+			v.BrokenAt = v.Entries
+			return v
+		}
+		prev = e.Hash
+	}
+	return v
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+// Audited records every request to h in the audit log, along with the
+// route variables and the resulting status.
+func Audited(action string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+		sr := &statusRecorder{ResponseWriter: w, status: 200}
+		h.ServeHTTP(sr, r)
+		u := *r.URL
+		q := u.Query()
+		q.Del("token")
+		u.RawQuery = q.Encode()
+		detail := r.Method + " " + u.RequestURI() + " -> " + strconv.Itoa(sr.status)
+		Audit.Record(r.RemoteAddr, action, detail)
+	})
+}
+
+func ExportAuditHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		Audit.mu.Lock()
+		defer Audit.mu.Unlock()
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		http.ServeFile(w, r, filepath.Join(DataDir, auditFile))
+	}
+}
+
+func VerifyAuditHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		v := Audit.Verify()
+		w.Header().Set("Content-Type", "application/json")
+		if !v.Valid {
+			w.WriteHeader(http.StatusConflict)
+		}
+		json.NewEncoder(w).Encode(v)
+	}
+}
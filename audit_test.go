@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditVerify(t *testing.T) {
+	dataDir := DataDir
+	t.Cleanup(func () { DataDir = dataDir })
+	tests := []struct {
+		name     string
+		tamper   func (al *AuditLog, entries []AuditEntry) []AuditEntry
+		brokenAt int64
+		err      string
+	}{
+		{"untouched", func (al *AuditLog, entries []AuditEntry) []AuditEntry { return entries }, 0, ""},
+		{"edited", func (al *AuditLog, entries []AuditEntry) []AuditEntry {
+			entries[1].Detail = "something else"
+			return entries
+		}, 2, "entry hash does not match its contents"},
+		{"edited and hashed again", func (al *AuditLog, entries []AuditEntry) []AuditEntry {
+			entries[1].Detail = "something else"
+			entries[1].Hash = entries[1].digest()
+			return entries
+		}, 2, "entry signature is invalid"},
+		{"dropped", func (al *AuditLog, entries []AuditEntry) []AuditEntry {
+			return append(entries[:1], entries[2:]...)
+		}, 2, "entry is out of sequence"},
+		{"dropped and renumbered", func (al *AuditLog, entries []AuditEntry) []AuditEntry {
+			entries = append(entries[:1], entries[2:]...)
+			entries[1].Seq = 2
+			entries[1].Hash = entries[1].digest()
+			entries[1].Signature = al.sign(entries[1].Hash)
+			return entries
+		}, 2, "entry does not chain to the previous one"},
+		{"reordered", func (al *AuditLog, entries []AuditEntry) []AuditEntry {
+			entries[1], entries[2] = entries[2], entries[1]
+			return entries
+		}, 2, "entry is out of sequence"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func (t *testing.T) {
+			DataDir = t.TempDir()
+			al := &AuditLog{}
+			if err := al.Open(); err != nil {
+				t.Fatal(err)
+			}
+			defer al.f.Close()
+			for _, action := range []string{"scan", "connect", "disconnect"} {
+				al.Record("admin", action, "AA:BB:CC:DD:EE:FF")
+			}
+			path := filepath.Join(DataDir, auditFile)
+			b, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries := []AuditEntry{}
+			for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+				e := AuditEntry{}
+				if err := json.Unmarshal([]byte(line), &e); err != nil {
+					t.Fatal(err)
+				}
+				entries = append(entries, e)
+			}
+			lines := []string{}
+			for _, e := range test.tamper(al, entries) {
+				line, _ := json.Marshal(e)
+				lines = append(lines, string(line))
+			}
+			if err := os.WriteFile(path, []byte(strings.Join(lines, "\n") + "\n"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			v := al.Verify()
+			if v.Valid != (test.err == "") || v.BrokenAt != test.brokenAt || v.Error != test.err {
+				t.Errorf("got %+v, want broken at %d with %q", v, test.brokenAt, test.err)
+			}
+		})
+	}
+}
+
+func TestAuditVerifyInvalidJSON(t *testing.T) {
+	dataDir := DataDir
+	t.Cleanup(func () { DataDir = dataDir })
+	DataDir = t.TempDir()
+	al := &AuditLog{}
+	if err := al.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer al.f.Close()
+	al.Record("admin", "scan", "")
+	al.f.Write([]byte("{\"Seq\": 2,\n"))
+	v := al.Verify()
+	if v.Valid || v.BrokenAt != 2 || v.Error != "entry is not valid JSON" {
+		t.Errorf("got %+v, want broken at 2 with invalid JSON", v)
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+type Role int
+
+const (
+	RoleNone Role = iota
+	RoleRead
+	RoleOperator
+	RoleAdmin
+)
+
+var roleNames = map[string]Role{"read": RoleRead, "operator": RoleOperator, "admin": RoleAdmin}
+
+func (r Role) String() string {
+	for name, role := range roleNames {
+		if role == r {
+			return name
+		}
+	}
+	return "none"
+}
+
+// routeRoles overrides the default policy (GET needs read access, anything
+// else admin) for specific route templates.
+var routeRoles = map[string]Role{
+	"/scan": RoleOperator,
+	"/stop": RoleOperator,
+	"/scan/mode": RoleOperator,
+	"/connect/{addr}": RoleOperator,
+	"/connect/{addr}/cancel": RoleOperator,
+	"/disconnect": RoleOperator,
+	"/disconnect/{addr}": RoleOperator,
+	"/wedge/stop": RoleAdmin,
+	"/serial/stop": RoleAdmin,
+	"/audit": RoleAdmin,
+	"/audit/verify": RoleAdmin,
+	"/admin/guests": RoleAdmin,
+	"/devices/{addr}/console": RoleAdmin,
+	"/captures/{id}": RoleAdmin,
+	"/devices/{addr}/mtu": RoleOperator,
+	"/devices/{addr}/subscribe/{uuid}": RoleOperator,
+	"/devices/{addr}/unsubscribe/{uuid}": RoleOperator,
+	"/devices/{addr}/machine/{event}": RoleOperator,
+	"/webpush/subscriptions": RoleOperator,
+	// Each command in a batch is checked on its own.
+	"/commands": RoleRead,
+}
+
+const (
+	tokenCookie  = "bluboi_token"
+	guestKeyFile = "guest.key"
+	guestsFile   = "guests.json"
+)
+
+// Guest is an expiring grant handed out as a signed link. The token carries
+// everything needed to check it; the list is only kept for revocation and so
+// admins can see what's outstanding.
+type Guest struct {
+	ID      string
+	Role    string
+	Expires time.Time
+	Revoked bool
+}
+
+type SafeGuests struct {
+	mu     sync.Mutex
+	key    []byte
+	Guests map[string]*Guest
+}
+
+var (
+	AdminToken = ""
+	Guests = SafeGuests{Guests: map[string]*Guest{}}
+	errInvalidToken = errors.New("invalid token")
+)
+
+func (sg *SafeGuests) Load() error {
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+	path := filepath.Join(DataDir, guestKeyFile)
+	key, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(DataDir, 0o755); err != nil {
+			return err
+		}
+		err = os.WriteFile(path, key, 0o600)
+	}
+	if err != nil {
+		return err
+	}
+	sg.key = key
+	return LoadJSON(guestsFile, &sg.Guests)
+}
+
+func (sg *SafeGuests) sign(payload string) string {
+	mac := hmac.New(sha256.New, sg.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (sg *SafeGuests) Issue(role Role, d time.Duration) (*Guest, string, error) {
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+	g := &Guest{ID: uuid.NewString(), Role: role.String(), Expires: time.Now().Add(d).UTC().Truncate(time.Second)}
+	b, _ := json.Marshal(g)
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	sg.Guests[g.ID] = g
+	for id, other := range sg.Guests {
+		if time.Now().After(other.Expires) {
+			delete(sg.Guests, id)
+		}
+	}
+	return g, payload + "." + sg.sign(payload), SaveJSON(guestsFile, sg.Guests)
+}
+
+func (sg *SafeGuests) Revoke(id string) bool {
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+	g, ok := sg.Guests[id]
+	if !ok {
+		return false
+	}
+	g.Revoked = true
+	SaveJSON(guestsFile, sg.Guests)
+	return true
+}
+
+func (sg *SafeGuests) List() []Guest {
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+	guests := []Guest{}
+	for _, g := range sg.Guests {
+		guests = append(guests, *g)
+	}
+	return guests
+}
+
+// Check returns the role a guest token grants.
+func (sg *SafeGuests) Check(token string) (Role, error) {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return RoleNone, errInvalidToken
+	}
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+	if !hmac.Equal([]byte(sg.sign(payload)), []byte(sig)) {
+		return RoleNone, errInvalidToken
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return RoleNone, errInvalidToken
+	}
+	claim := Guest{}
+	if json.Unmarshal(b, &claim) != nil {
+		return RoleNone, errInvalidToken
+	}
+	if time.Now().After(claim.Expires) {
+		return RoleNone, errors.New("token expired")
+	}
+	if g, ok := sg.Guests[claim.ID]; !ok || g.Revoked {
+		return RoleNone, errors.New("token revoked")
+	}
+	return roleNames[claim.Role], nil
+}
+
+func requestToken(r *http.Request) string {
+	if t := r.URL.Query().Get("token"); t != "" {
+		return t
+	}
+	if t, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return t
+	}
+	if c, err := r.Cookie(tokenCookie); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+// authEnabled reports whether an admin token was given, or generated during
+// setup. -admin-token takes precedence over the generated one.
+func authEnabled() bool {
+	return AdminToken != "" || Setup.HasToken()
+}
+
+func isAdminToken(token string) bool {
+	if AdminToken != "" {
+		return subtle.ConstantTimeCompare([]byte(token), []byte(AdminToken)) == 1
+	}
+	return Setup.CheckToken(token)
+}
+
+func RequestRole(r *http.Request) (Role, error) {
+	if !authEnabled() {
+		return RoleAdmin, nil
+	}
+	token := requestToken(r)
+	if token == "" {
+		return RoleNone, errors.New("missing token")
+	}
+	if isAdminToken(token) {
+		return RoleAdmin, nil
+	}
+	return Guests.Check(token)
+}
+
+func requiredRole(r *http.Request) Role {
+	if route := mux.CurrentRoute(r); route != nil {
+		if tpl, err := route.GetPathTemplate(); err == nil {
+			// The /device/ aliases share the policy of the /devices/ routes.
+			if rest, ok := strings.CutPrefix(tpl, "/device/"); ok {
+				tpl = "/devices/" + rest
+			}
+			if role, ok := routeRoles[tpl]; ok {
+				return role
+			}
+			if strings.HasPrefix(tpl, "/admin/") {
+				return RoleAdmin
+			}
+		}
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return RoleRead
+	}
+	return RoleAdmin
+}
+
+// AuthMiddleware enforces the route policy when an admin token is set. A
+// token passed in the query string is kept in a cookie so the UI keeps
+// working after opening a link.
+func AuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+		role, err := RequestRole(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if role < requiredRole(r) {
+			http.Error(w, "forbidden for role " + role.String(), http.StatusForbidden)
+			return
+		}
+		if t := r.URL.Query().Get("token"); t != "" && authEnabled() {
+			http.SetCookie(w, &http.Cookie{Name: tokenCookie, Value: t, Path: "/", HttpOnly: true, SameSite: http.SameSiteStrictMode})
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type GuestRequest struct {
+	Role    string
+	Minutes int
+}
+
+type GuestResponse struct {
+	Guest
+	URL string
+}
+
+func IssueGuestHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		req := GuestRequest{Role: "read", Minutes: 60}
+		if r.ContentLength != 0 {
+			err := json.NewDecoder(r.Body).Decode(&req)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		role := roleNames[req.Role]
+		if role != RoleRead && role != RoleOperator {
+			http.Error(w, "role must be read or operator", http.StatusBadRequest)
+			return
+		}
+		if req.Minutes < 1 {
+			http.Error(w, "minutes must be positive", http.StatusBadRequest)
+			return
+		}
+		g, token, err := Guests.Issue(role, time.Duration(req.Minutes) * time.Minute)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(201)
+		json.NewEncoder(w).Encode(GuestResponse{*g, "http://" + r.Host + "/?token=" + token})
+	}
+}
+
+func ListGuestsHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Guests.List())
+	}
+}
+
+func RevokeGuestHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		if !Guests.Revoke(mux.Vars(r)["id"]) {
+			http.Error(w, "no such guest", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(200)
+	}
+}
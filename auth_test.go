@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRequiredRole(t *testing.T) {
+	tests := []struct {
+		template string
+		method   string
+		path     string
+		role     Role
+	}{
+		{"/devices/{addr}/subscribe/{uuid}", "POST", "/devices/AA/subscribe/2a37", RoleOperator},
+		{"/device/{addr}/subscribe/{uuid}", "POST", "/device/AA/subscribe/2a37", RoleOperator},
+		{"/device/{addr}/char/{uuid}", "GET", "/device/AA/char/2a37", RoleRead},
+		{"/device/{addr}/char/{uuid}", "POST", "/device/AA/char/2a37", RoleAdmin},
+		{"/connect/{addr}", "POST", "/connect/AA", RoleOperator},
+		{"/admin/guests", "GET", "/admin/guests", RoleAdmin},
+		{"/admin/{anything}", "GET", "/admin/x", RoleAdmin},
+		{"/devices", "GET", "/devices", RoleRead},
+		{"/devices/meta", "PATCH", "/devices/meta", RoleAdmin},
+	}
+	for _, test := range tests {
+		got := RoleNone
+		r := mux.NewRouter()
+		r.HandleFunc(test.template, func (w http.ResponseWriter, r *http.Request) { got = requiredRole(r) }).Methods(test.method)
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(test.method, test.path, nil))
+		if got != test.role {
+			t.Errorf("%v %v: got %v, want %v", test.method, test.template, got, test.role)
+		}
+	}
+}
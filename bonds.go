@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// Bond is a device paired with the adapter, scanned for or not.
+type Bond struct {
+	Address   string
+	Name      string `json:",omitempty"`
+	Alias     string `json:",omitempty"`
+	Trusted   bool
+	Connected bool
+}
+
+// knownAddress finds a device to connect to among those scanned, or those
+// bonded with the adapter, which BlueZ connects to without scanning first.
+func knownAddress(addr string) (bluetooth.Address, bool) {
+	if Devices.Exists(addr) {
+		return *Devices.Device(addr).Address, true
+	}
+	return bondedAddress(addr)
+}
+
+// BondsHandler lists the devices paired with the adapter.
+func BondsHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		bonds, err := listBonds()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(bonds)
+	}
+}
@@ -0,0 +1,52 @@
+//go:build linux
+
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/muka/go-bluetooth/api"
+	"tinygo.org/x/bluetooth"
+)
+
+func listBonds() ([]Bond, error) {
+	a, err := api.GetDefaultAdapter()
+	if err != nil {
+		return nil, err
+	}
+	devices, err := a.GetDevices()
+	if err != nil {
+		return nil, err
+	}
+	bonds := []Bond{}
+	for _, dev := range devices {
+		p := dev.Properties
+		if !p.Paired {
+			continue
+		}
+		bonds = append(bonds, Bond{
+			Address: strings.ToUpper(p.Address),
+			Name: p.Name,
+			Alias: Metadata.Get(strings.ToUpper(p.Address)).Alias,
+			Trusted: p.Trusted,
+			Connected: Adapter.IsConnected(p.Address),
+		})
+	}
+	sort.Slice(bonds, func (i, j int) bool {
+		return bonds[i].Address < bonds[j].Address
+	})
+	return bonds, nil
+}
+
+func bondedAddress(addr string) (bluetooth.Address, bool) {
+	security, err := linkSecurity(strings.ToUpper(addr))
+	if err != nil || !security.Paired {
+		return bluetooth.Address{}, false
+	}
+	mac, err := bluetooth.ParseMAC(addr)
+	if err != nil {
+		return bluetooth.Address{}, false
+	}
+	return bluetooth.Address{MACAddress: bluetooth.MACAddress{MAC: mac}}, true
+}
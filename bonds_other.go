@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import "tinygo.org/x/bluetooth"
+
+func listBonds() ([]Bond, error) {
+	return nil, errUnsupported
+}
+
+func bondedAddress(addr string) (bluetooth.Address, bool) {
+	return bluetooth.Address{}, false
+}
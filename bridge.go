@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// Nordic UART Service characteristics. RX is written to by the central, TX
+// notifies data coming from the peripheral.
+const (
+	NUSService = "6e400001-b5a3-f393-e0a9-e50e24dcca9e"
+	NUSRX      = "6e400002-b5a3-f393-e0a9-e50e24dcca9e"
+	NUSTX      = "6e400003-b5a3-f393-e0a9-e50e24dcca9e"
+)
+
+// Bridge pipes bytes between a local stream and a pair of characteristics of
+// the connected device: anything pumped into it is written to the write
+// characteristic, and notifications on the notify characteristic are copied
+// to out.
+type Bridge struct {
+	write  *bluetooth.DeviceCharacteristic
+	notify *bluetooth.DeviceCharacteristic
+	chunk  int
+}
+
+func NewBridge(address string, writeUUID string, notifyUUID string, out io.Writer) (*Bridge, error) {
+	err := CheckWriteSecurity(address, writeUUID)
+	if err != nil {
+		return nil, err
+	}
+	write, err := Adapter.Characteristic(address, writeUUID)
+	if err != nil {
+		return nil, err
+	}
+	notify, err := Adapter.Characteristic(address, notifyUUID)
+	if err != nil {
+		return nil, err
+	}
+	// Writes have to fit in a single ATT packet, which is the MTU minus the
+	// 3 byte ATT header.
+	chunk := 20
+	if mtu, err := write.GetMTU(); err == nil && mtu > 23 {
+		chunk = int(mtu) - 3
+	}
+	err = notify.EnableNotifications(func (buf []byte) {
+		out.Write(buf)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Bridge{write: write, notify: notify, chunk: chunk}, nil
+}
+
+// Pump forwards everything read from r to the device until r returns an
+// error.
+func (b *Bridge) Pump(r io.Reader) error {
+	buf := make([]byte, b.chunk)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, err := b.write.WriteWithoutResponse(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Send writes p to the device, split into packets that fit the MTU.
+func (b *Bridge) Send(p []byte) error {
+	for len(p) > 0 {
+		n := min(len(p), b.chunk)
+		if _, err := b.write.WriteWithoutResponse(p[:n]); err != nil {
+			return err
+		}
+		p = p[n:]
+	}
+	return nil
+}
+
+func (b *Bridge) Close() error {
+	return b.notify.EnableNotifications(nil)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const calibrationsFile = "calibrations.json"
+
+// Calibration maps a raw reading to raw * Scale + Offset. Calibrations are
+// never edited, a new version is added instead so exported data can name
+// the one in force.
+type Calibration struct {
+	Address string
+	Metric  string
+	Version int
+	Offset  float64
+	Scale   float64
+	Note    string `json:",omitempty"`
+	Since   time.Time
+}
+
+type SafeCalibrations struct {
+	mu      sync.Mutex
+	History []Calibration
+}
+
+var Calibrations = SafeCalibrations{History: []Calibration{}}
+
+func (sc *SafeCalibrations) Load() error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return LoadJSON(calibrationsFile, &sc.History)
+}
+
+// current expects sc.mu to be held.
+func (sc *SafeCalibrations) current(addr string, metric string) (Calibration, bool) {
+	for i := len(sc.History) - 1; i >= 0; i-- {
+		c := sc.History[i]
+		if c.Address == addr && c.Metric == metric {
+			return c, true
+		}
+	}
+	return Calibration{}, false
+}
+
+// Apply calibrates a raw reading, returning the calibration version used, 0
+// for an uncalibrated metric.
+func (sc *SafeCalibrations) Apply(addr string, metric string, raw float64) (float64, int) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	c, ok := sc.current(addr, metric)
+	if !ok {
+		return raw, 0
+	}
+	return raw * c.Scale + c.Offset, c.Version
+}
+
+func (sc *SafeCalibrations) Add(c Calibration) (Calibration, error) {
+	if c.Metric == "" {
+		return c, errors.New("missing metric")
+	}
+	if c.Scale == 0 {
+		return c, errors.New("scale can't be 0")
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	prev, _ := sc.current(c.Address, c.Metric)
+	c.Version = prev.Version + 1
+	c.Since = time.Now().UTC()
+	history := append(sc.History, c)
+	err := SaveJSON(calibrationsFile, history)
+	if err != nil {
+		return c, err
+	}
+	sc.History = history
+	return c, nil
+}
+
+func (sc *SafeCalibrations) List(addr string) []Calibration {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	list := []Calibration{}
+	for _, c := range sc.History {
+		if c.Address == addr {
+			list = append(list, c)
+		}
+	}
+	return list
+}
+
+func ListCalibrationsHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Calibrations.List(strings.ToUpper(mux.Vars(r)["addr"])))
+	}
+}
+
+func AddCalibrationHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		c := Calibration{Scale: 1}
+		err := json.NewDecoder(r.Body).Decode(&c)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c.Address = strings.ToUpper(mux.Vars(r)["addr"])
+		c, err = Calibrations.Add(c)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(201)
+		json.NewEncoder(w).Encode(c)
+	}
+}
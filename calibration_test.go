@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestCalibrationAddressCase(t *testing.T) {
+	useDataDir(t)
+	t.Cleanup(func () { Calibrations = SafeCalibrations{History: []Calibration{}} })
+	Calibrations = SafeCalibrations{History: []Calibration{}}
+	r := mux.NewRouter()
+	r.Handle("/devices/{addr}/calibrations", ListCalibrationsHandler()).Methods("GET")
+	r.Handle("/devices/{addr}/calibrations", AddCalibrationHandler()).Methods("POST")
+	for i, addr := range []string{"aa:bb:cc:dd:ee:ff", "AA:BB:CC:DD:EE:FF"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("POST", "/devices/" + addr + "/calibrations", strings.NewReader(`{"Metric": "temperature", "Offset": 1}`)))
+		c := Calibration{}
+		json.NewDecoder(w.Body).Decode(&c)
+		if w.Code != 201 || c.Address != "AA:BB:CC:DD:EE:FF" || c.Version != i + 1 {
+			t.Errorf("%v: got %d with %+v", addr, w.Code, c)
+		}
+	}
+	if got, version := Calibrations.Apply("AA:BB:CC:DD:EE:FF", "temperature", 20); got != 21 || version != 2 {
+		t.Errorf("got %v with version %d, want 21 with 2", got, version)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/devices/aa:bb:cc:dd:ee:ff/calibrations", nil))
+	list := []Calibration{}
+	json.NewDecoder(w.Body).Decode(&list)
+	if len(list) != 2 {
+		t.Errorf("listing with lower case got %v, want both", list)
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const (
+	capturesFile = "captures.json"
+	capturesDir  = "captures"
+)
+
+// Sniffers are the built in -sniffer commands. {addr} is replaced with the
+// device to follow and {file} with the pcap to write.
+var Sniffers = map[string]string{
+	"ubertooth": "ubertooth-btle -f -t {addr} -c {file}",
+}
+
+// Capture is a pcap recorded by the external sniffer while following one
+// device.
+type Capture struct {
+	ID      string
+	Address string
+	Started time.Time
+	Ended   time.Time `json:",omitempty"`
+	Running bool
+	Error   string    `json:",omitempty"`
+	Size    int64
+}
+
+type CaptureRequest struct {
+	Address string
+	Seconds int `json:",omitempty"`
+}
+
+type SafeCaptures struct {
+	mu       sync.Mutex
+	Command  string
+	Captures []Capture
+	cmd      *exec.Cmd
+}
+
+var (
+	Captures = SafeCaptures{Captures: []Capture{}}
+	errNoSniffer = errors.New("no sniffer configured, start bluboi with -sniffer")
+	errCaptureRunning = errors.New("a capture is already running")
+	errUnknownCapture = errors.New("no such capture")
+)
+
+// SetSniffer selects a built in sniffer or a command holding {addr} and
+// {file}.
+func (sc *SafeCaptures) SetSniffer(sniffer string) error {
+	if command, ok := Sniffers[sniffer]; ok {
+		sniffer = command
+	}
+	if sniffer != "" && (!strings.Contains(sniffer, "{addr}") || !strings.Contains(sniffer, "{file}")) {
+		return errors.New("sniffer commands need {addr} and {file} arguments")
+	}
+	sc.Command = sniffer
+	return nil
+}
+
+// Load reads the capture index. Captures that were running when bluboi
+// stopped are marked as interrupted.
+func (sc *SafeCaptures) Load() error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	err := LoadJSON(capturesFile, &sc.Captures)
+	if err != nil {
+		return err
+	}
+	for i := range sc.Captures {
+		if sc.Captures[i].Running {
+			sc.Captures[i].Running = false
+			sc.Captures[i].Error = "interrupted"
+		}
+	}
+	return nil
+}
+
+func capturePath(id string) string {
+	return filepath.Join(DataDir, capturesDir, id + ".pcap")
+}
+
+// find expects sc.mu to be held.
+func (sc *SafeCaptures) find(id string) int {
+	for i, c := range sc.Captures {
+		if c.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Start hands the address to the sniffer, stopping it after seconds unless
+// 0.
+func (sc *SafeCaptures) Start(address string, seconds int) (Capture, error) {
+	if _, err := net.ParseMAC(address); err != nil {
+		return Capture{}, errors.New(address + " is not a device address")
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.Command == "" {
+		return Capture{}, errNoSniffer
+	}
+	if sc.cmd != nil {
+		return Capture{}, errCaptureRunning
+	}
+	err := os.MkdirAll(filepath.Join(DataDir, capturesDir), 0o755)
+	if err != nil {
+		return Capture{}, err
+	}
+	c := Capture{ID: uuid.NewString(), Address: address, Started: time.Now().UTC(), Running: true}
+	args := strings.Fields(sc.Command)
+	for i, arg := range args {
+		args[i] = strings.NewReplacer("{addr}", address, "{file}", capturePath(c.ID)).Replace(arg)
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	err = cmd.Start()
+	if err != nil {
+		return Capture{}, err
+	}
+	sc.cmd = cmd
+	sc.Captures = append(sc.Captures, c)
+	SaveJSON(capturesFile, sc.Captures)
+	go sc.wait(c.ID, cmd)
+	if seconds > 0 {
+		time.AfterFunc(time.Duration(seconds) * time.Second, func () {
+			sc.stop(cmd)
+		})
+	}
+	LogInfo("Capturing", address, "as", c.ID)
+	return c, nil
+}
+
+func (sc *SafeCaptures) wait(id string, cmd *exec.Cmd) {
+	err := cmd.Wait()
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.cmd = nil
+	i := sc.find(id)
+	if i < 0 {
+		return
+	}
+	c := &sc.Captures[i]
+	c.Running = false
+	c.Ended = time.Now().UTC()
+	// Sniffers exit with an error when interrupted, only a missing pcap is
+	// worth reporting.
+	if info, statErr := os.Stat(capturePath(id)); statErr == nil {
+		c.Size = info.Size()
+	} else if err != nil {
+		c.Error = err.Error()
+	} else {
+		c.Error = "the sniffer didn't write a capture"
+	}
+	SaveJSON(capturesFile, sc.Captures)
+	LogInfo("Capture", id, "ended.")
+}
+
+// stop interrupts the sniffer so it can finish its pcap, killing it if it's
+// still running after 5 seconds.
+func (sc *SafeCaptures) stop(cmd *exec.Cmd) {
+	if cmd.Process.Signal(os.Interrupt) != nil {
+		cmd.Process.Kill()
+		return
+	}
+	time.AfterFunc(5 * time.Second, func () {
+		sc.mu.Lock()
+		defer sc.mu.Unlock()
+		if sc.cmd == cmd {
+			cmd.Process.Kill()
+		}
+	})
+}
+
+func (sc *SafeCaptures) Stop(id string) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	i := sc.find(id)
+	if i < 0 {
+		return errUnknownCapture
+	}
+	if !sc.Captures[i].Running || sc.cmd == nil {
+		return errors.New("capture isn't running")
+	}
+	sc.stop(sc.cmd)
+	return nil
+}
+
+func (sc *SafeCaptures) Delete(id string) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	i := sc.find(id)
+	if i < 0 {
+		return errUnknownCapture
+	}
+	if sc.Captures[i].Running {
+		return errCaptureRunning
+	}
+	err := os.Remove(capturePath(id))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	sc.Captures = append(sc.Captures[:i], sc.Captures[i+1:]...)
+	return SaveJSON(capturesFile, sc.Captures)
+}
+
+func (sc *SafeCaptures) List() []Capture {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return append([]Capture{}, sc.Captures...)
+}
+
+func (sc *SafeCaptures) Get(id string) (Capture, bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	i := sc.find(id)
+	if i < 0 {
+		return Capture{}, false
+	}
+	return sc.Captures[i], true
+}
+
+func ListCapturesHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Captures.List())
+	}
+}
+
+func StartCaptureHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		req := CaptureRequest{}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c, err := Captures.Start(req.Address, req.Seconds)
+		if errors.Is(err, errNoSniffer) || errors.Is(err, errCaptureRunning) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(201)
+		json.NewEncoder(w).Encode(c)
+	}
+}
+
+// DownloadCaptureHandler serves a finished capture's pcap.
+func DownloadCaptureHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		c, ok := Captures.Get(mux.Vars(r)["id"])
+		if !ok {
+			http.Error(w, errUnknownCapture.Error(), http.StatusNotFound)
+			return
+		}
+		if c.Running {
+			http.Error(w, "capture is still running", http.StatusConflict)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"" + c.ID + ".pcap\"")
+		http.ServeFile(w, r, capturePath(c.ID))
+	}
+}
+
+func StopCaptureHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		err := Captures.Stop(mux.Vars(r)["id"])
+		if errors.Is(err, errUnknownCapture) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(200)
+	}
+}
+
+func DeleteCaptureHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		err := Captures.Delete(mux.Vars(r)["id"])
+		if errors.Is(err, errUnknownCapture) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, errCaptureRunning) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(200)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Exit codes of the subcommands, so scripts can tell failures apart.
+const (
+	exitOK = 0
+	// Checks failed, or problems were found.
+	exitFailed = 1
+	exitUsage  = 2
+	// What was to be checked couldn't be read, or the database opened.
+	exitUnavailable = 3
+)
+
+// CommandError is what a subcommand run with -json prints when it couldn't
+// do its job.
+type CommandError struct {
+	Error string
+}
+
+func printJSON(v any) {
+	e := json.NewEncoder(os.Stdout)
+	e.SetIndent("", "  ")
+	e.Encode(v)
+}
+
+// commandFailed reports what a subcommand couldn't do, as JSON if asked
+// to, and returns the exit code.
+func commandFailed(asJSON bool, what string, err error) int {
+	if asJSON {
+		printJSON(CommandError{what + " - " + err.Error()})
+	} else {
+		fmt.Println(what, "-", err)
+	}
+	return exitUnavailable
+}
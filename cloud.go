@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	cloudFile       = "cloud.json"
+	azureAPIVersion = "2021-04-12"
+	sasLifetime     = time.Hour
+)
+
+// CloudConfig connects the gateway to Azure IoT Hub or AWS IoT Core as
+// DeviceID, which has to be registered there beforehand: bluboi doesn't
+// register itself through the Device Provisioning Service or AWS fleet
+// provisioning. Azure authenticates with the device's SharedKey or an X.509
+// certificate, AWS with the thing's certificate.
+type CloudConfig struct {
+	Provider  string
+	Host      string
+	DeviceID  string
+	SharedKey string   `json:",omitempty"`
+	CertFile  string   `json:",omitempty"`
+	KeyFile   string   `json:",omitempty"`
+	CAFile    string   `json:",omitempty"`
+	Events    []string `json:",omitempty"`
+}
+
+// CloudCommand is what cloud-to-device messages carry. Only the operator
+// commands are accepted.
+type CloudCommand struct {
+	Type string
+	Data string
+}
+
+var (
+	DefaultCloudEvents = []string{"AGG", "DEVICE", "ANOMALY", "SENSOR_DEAD", "SENSOR_ALIVE", "CONNECTED", "DISCONNECTED"}
+	cloudCommands      = []string{"SCAN", "STOP_SCAN", "CONNECT", "DISCONNECT"}
+)
+
+func (cc CloudConfig) Validate() error {
+	switch cc.Provider {
+	case "":
+		return nil
+	case "azure":
+		if cc.SharedKey == "" && cc.CertFile == "" {
+			return errors.New("azure needs a SharedKey or a CertFile")
+		}
+		if cc.SharedKey != "" {
+			if _, err := base64.StdEncoding.DecodeString(cc.SharedKey); err != nil {
+				return errors.New("SharedKey is not base64")
+			}
+		}
+	case "aws":
+		if cc.CertFile == "" {
+			return errors.New("aws needs a CertFile and KeyFile")
+		}
+	default:
+		return errors.New("provider must be azure or aws")
+	}
+	if cc.Host == "" || cc.DeviceID == "" {
+		return errors.New("Host and DeviceID are required")
+	}
+	_, err := cc.tlsConfig()
+	return err
+}
+
+func (cc CloudConfig) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{}
+	if cc.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cc.CertFile, cc.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if cc.CAFile != "" {
+		pem, err := os.ReadFile(cc.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates in " + cc.CAFile)
+		}
+	}
+	return config, nil
+}
+
+// SASToken signs an IoT Hub shared access signature for the device.
+func SASToken(host string, deviceID string, key string, expiry time.Time) (string, error) {
+	secret, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return "", err
+	}
+	resource := url.QueryEscape(host + "/devices/" + deviceID)
+	se := strconv.FormatInt(expiry.Unix(), 10)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(resource + "\n" + se))
+	sig := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return "SharedAccessSignature sr=" + resource + "&sig=" + url.QueryEscape(sig) + "&se=" + se, nil
+}
+
+// options builds fresh connection options, so a reconnection after the
+// SAS token expired signs a new one.
+func (cc CloudConfig) options(onMessage func (string, []byte)) (MQTTOptions, error) {
+	tlsConfig, err := cc.tlsConfig()
+	if err != nil {
+		return MQTTOptions{}, err
+	}
+	opts := MQTTOptions{
+		Broker: "mqtts://" + cc.Host,
+		ClientID: cc.DeviceID,
+		TLS: tlsConfig,
+		OnMessage: onMessage,
+	}
+	if cc.Provider == "azure" {
+		opts.Username = cc.Host + "/" + cc.DeviceID + "/?api-version=" + azureAPIVersion
+		if cc.SharedKey != "" {
+			opts.Password, err = SASToken(cc.Host, cc.DeviceID, cc.SharedKey, time.Now().Add(sasLifetime))
+		}
+	}
+	return opts, err
+}
+
+func (cc CloudConfig) telemetryTopic(level string) string {
+	if cc.Provider == "azure" {
+		return "devices/" + cc.DeviceID + "/messages/events/level=" + url.QueryEscape(level)
+	}
+	return "bluboi/" + cc.DeviceID + "/events/" + level
+}
+
+func (cc CloudConfig) commandTopic() string {
+	if cc.Provider == "azure" {
+		return "devices/" + cc.DeviceID + "/messages/devicebound/#"
+	}
+	return "bluboi/" + cc.DeviceID + "/commands"
+}
+
+type SafeCloud struct {
+	mu     sync.Mutex
+	Config CloudConfig
+	client *MQTTClient
+	stop   chan struct{}
+}
+
+var Cloud = SafeCloud{}
+
+func (sc *SafeCloud) Load() error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	err := LoadJSON(cloudFile, &sc.Config)
+	if err != nil {
+		return err
+	}
+	return sc.Config.Validate()
+}
+
+// HandleCommand routes a cloud-to-device message into the event queue.
+func (sc *SafeCloud) HandleCommand(provider string, payload []byte) {
+	cmd := CloudCommand{}
+	err := json.Unmarshal(payload, &cmd)
+	if err != nil || !slices.Contains(cloudCommands, cmd.Type) {
+		LogError("Ignored cloud command", strconv.Quote(string(payload)))
+		return
+	}
+	Audit.Record(provider, "cloud_command", cmd.Type + " " + cmd.Data)
+	EventQueue <- Event{cmd.Type, cmd.Data}
+}
+
+// start expects sc.mu to be held.
+func (sc *SafeCloud) start() {
+	config := sc.Config
+	if config.Provider == "" {
+		return
+	}
+	if len(config.Events) == 0 {
+		config.Events = DefaultCloudEvents
+	}
+	stop := make(chan struct{})
+	sc.stop = stop
+	go RunMQTT(func () (MQTTOptions, error) {
+		return config.options(func (topic string, payload []byte) {
+			sc.HandleCommand(config.Provider, payload)
+		})
+	}, func (c *MQTTClient) {
+		c.Subscribe(config.commandTopic(), 1)
+		sc.mu.Lock()
+		defer sc.mu.Unlock()
+		// Set may have replaced the session while it was connecting.
+		select {
+		case <-stop:
+		default:
+			sc.client = c
+		}
+	}, stop)
+}
+
+// Run forwards the events the cloud sink lets through.
+func (sc *SafeCloud) Run() {
+	_, logs := Sinks.Subscribe("cloud", 1000)
+	sc.mu.Lock()
+	sc.start()
+	sc.mu.Unlock()
+	for l := range logs {
+		sc.mu.Lock()
+		client := sc.client
+		config := sc.Config
+		sc.mu.Unlock()
+		events := config.Events
+		if len(events) == 0 {
+			events = DefaultCloudEvents
+		}
+		if client == nil || !slices.Contains(events, l.Level) {
+			continue
+		}
+		payload, _ := json.Marshal(NewMQTTEvent(l))
+		err := client.Publish(MQTTMessage{config.telemetryTopic(l.Level), payload, 1, false})
+		if err != nil {
+			log.Printf("[ERROR] Could not forward %v to %v - %v", l.Level, config.Provider, err)
+		}
+	}
+}
+
+// Set validates and saves a new config, then reconnects with it. An empty
+// SharedKey keeps the current one.
+func (sc *SafeCloud) Set(config CloudConfig) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if config.SharedKey == "" && config.CertFile == "" {
+		config.SharedKey = sc.Config.SharedKey
+	}
+	err := config.Validate()
+	if err != nil {
+		return err
+	}
+	err = SaveJSON(cloudFile, config)
+	if err != nil {
+		return err
+	}
+	if sc.stop != nil {
+		close(sc.stop)
+		sc.stop = nil
+	}
+	sc.client = nil
+	sc.Config = config
+	sc.start()
+	return nil
+}
+
+func GetCloudHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		Cloud.mu.Lock()
+		config := Cloud.Config
+		Cloud.mu.Unlock()
+		config.SharedKey = ""
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(config)
+	}
+}
+
+func SetCloudHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		config := CloudConfig{}
+		err := json.NewDecoder(r.Body).Decode(&config)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = Cloud.Set(config)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(200)
+	}
+}
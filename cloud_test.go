@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSharedKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+
+func TestSASToken(t *testing.T) {
+	expiry := time.Date(2026, 10, 14, 8, 0, 0, 0, time.UTC)
+	got, err := SASToken("myhub.azure-devices.net", "gateway-1", testSharedKey, expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "SharedAccessSignature sr=myhub.azure-devices.net%2Fdevices%2Fgateway-1&sig=AMSrR7Cu9ZoHKzsng%2FoEQ22VaTmo%2BAQnWwGayjTrU2g%3D&se=1791964800"
+	if got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if other, _ := SASToken("myhub.azure-devices.net", "gateway-2", testSharedKey, expiry); other == got {
+		t.Errorf("another device got the same signature")
+	}
+	if _, err := SASToken("myhub.azure-devices.net", "gateway-1", "not base64!", expiry); err == nil {
+		t.Errorf("signed with a key that isn't base64")
+	}
+}
+
+func TestCloudOptions(t *testing.T) {
+	azure := CloudConfig{Provider: "azure", Host: "myhub.azure-devices.net", DeviceID: "gateway-1", SharedKey: testSharedKey}
+	opts, err := azure.options(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Broker != "mqtts://myhub.azure-devices.net" || opts.ClientID != "gateway-1" || opts.Username != "myhub.azure-devices.net/gateway-1/?api-version=" + azureAPIVersion {
+		t.Errorf("got %+v", opts)
+	}
+	if !strings.HasPrefix(opts.Password, "SharedAccessSignature sr=myhub.azure-devices.net%2Fdevices%2Fgateway-1&") {
+		t.Errorf("got password %v, want a SAS token for the device", opts.Password)
+	}
+	aws := CloudConfig{Provider: "aws", Host: "xxxx-ats.iot.eu-west-1.amazonaws.com", DeviceID: "gateway-1"}
+	if opts, err := aws.options(nil); err != nil || opts.Username != "" || opts.Password != "" {
+		t.Errorf("aws got %+v, %v, want no credentials besides the certificate", opts, err)
+	}
+	tests := []struct {
+		config    CloudConfig
+		telemetry string
+		commands  string
+	}{
+		{azure, "devices/gateway-1/messages/events/level=SENSOR_DEAD", "devices/gateway-1/messages/devicebound/#"},
+		{aws, "bluboi/gateway-1/events/SENSOR_DEAD", "bluboi/gateway-1/commands"},
+	}
+	for _, test := range tests {
+		if got := test.config.telemetryTopic("SENSOR_DEAD"); got != test.telemetry {
+			t.Errorf("%v: telemetry to %v, want %v", test.config.Provider, got, test.telemetry)
+		}
+		if got := test.config.commandTopic(); got != test.commands {
+			t.Errorf("%v: commands from %v, want %v", test.config.Provider, got, test.commands)
+		}
+	}
+}
+
+func TestCloudConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config CloudConfig
+		ok     bool
+	}{
+		{"disabled", CloudConfig{}, true},
+		{"azure with a key", CloudConfig{Provider: "azure", Host: "h", DeviceID: "d", SharedKey: testSharedKey}, true},
+		{"azure without credentials", CloudConfig{Provider: "azure", Host: "h", DeviceID: "d"}, false},
+		{"key not base64", CloudConfig{Provider: "azure", Host: "h", DeviceID: "d", SharedKey: "!"}, false},
+		{"aws without a certificate", CloudConfig{Provider: "aws", Host: "h", DeviceID: "d"}, false},
+		{"missing certificate file", CloudConfig{Provider: "aws", Host: "h", DeviceID: "d", CertFile: "/nonexistent.pem", KeyFile: "/nonexistent.pem"}, false},
+		{"no host", CloudConfig{Provider: "azure", DeviceID: "d", SharedKey: testSharedKey}, false},
+		{"unknown provider", CloudConfig{Provider: "gcp", Host: "h", DeviceID: "d"}, false},
+	}
+	for _, test := range tests {
+		if err := test.config.Validate(); (err == nil) != test.ok {
+			t.Errorf("%v: got %v", test.name, err)
+		}
+	}
+}
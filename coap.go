@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A minimal CoAP (RFC 7252) server with Observe (RFC 7641) support. It only
+// implements what bluboi needs: GET on a handful of JSON resources, and
+// notifications to observers.
+
+const (
+	coapCON = 0
+	coapNON = 1
+	coapACK = 2
+	coapRST = 3
+
+	coapGET              = 0x01
+	coapContent          = 0x45
+	coapNotFound         = 0x84
+	coapMethodNotAllowed = 0x85
+
+	coapOptionObserve       = 6
+	coapOptionURIPath       = 11
+	coapOptionContentFormat = 12
+
+	coapFormatJSON = 50
+)
+
+var errCoAPMessage = errors.New("malformed CoAP message")
+
+type CoAPOption struct {
+	Number uint16
+	Value  []byte
+}
+
+type CoAPMessage struct {
+	Type      uint8
+	Code      uint8
+	MessageID uint16
+	Token     []byte
+	Options   []CoAPOption
+	Payload   []byte
+}
+
+func (m *CoAPMessage) Option(number uint16) ([]byte, bool) {
+	for _, o := range m.Options {
+		if o.Number == number {
+			return o.Value, true
+		}
+	}
+	return nil, false
+}
+
+func (m *CoAPMessage) Path() string {
+	parts := []string{}
+	for _, o := range m.Options {
+		if o.Number == coapOptionURIPath {
+			parts = append(parts, string(o.Value))
+		}
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+func coapUint(v []byte) uint32 {
+	n := uint32(0)
+	for _, b := range v {
+		n = n << 8 | uint32(b)
+	}
+	return n
+}
+
+func coapUintBytes(n uint32) []byte {
+	b := binary.BigEndian.AppendUint32(nil, n)
+	for len(b) > 0 && b[0] == 0 {
+		b = b[1:]
+	}
+	return b
+}
+
+// coapExtended reads an option delta or length nibble together with its
+// extended bytes.
+func coapExtended(nibble uint8, data []byte) (uint16, []byte, error) {
+	switch nibble {
+	case 13:
+		if len(data) < 1 {
+			return 0, nil, errCoAPMessage
+		}
+		return uint16(data[0]) + 13, data[1:], nil
+	case 14:
+		if len(data) < 2 {
+			return 0, nil, errCoAPMessage
+		}
+		return binary.BigEndian.Uint16(data) + 269, data[2:], nil
+	case 15:
+		return 0, nil, errCoAPMessage
+	}
+	return uint16(nibble), data, nil
+}
+
+func ParseCoAP(data []byte) (*CoAPMessage, error) {
+	if len(data) < 4 || data[0] >> 6 != 1 {
+		return nil, errCoAPMessage
+	}
+	m := &CoAPMessage{
+		Type: data[0] >> 4 & 0x3,
+		Code: data[1],
+		MessageID: binary.BigEndian.Uint16(data[2:4]),
+	}
+	tkl := int(data[0] & 0xf)
+	data = data[4:]
+	if tkl > 8 || len(data) < tkl {
+		return nil, errCoAPMessage
+	}
+	m.Token = append([]byte{}, data[:tkl]...)
+	data = data[tkl:]
+	number := uint16(0)
+	for len(data) > 0 {
+		if data[0] == 0xff {
+			m.Payload = data[1:]
+			break
+		}
+		head := data[0]
+		delta, rest, err := coapExtended(head >> 4, data[1:])
+		if err != nil {
+			return nil, err
+		}
+		length, rest, err := coapExtended(head & 0xf, rest)
+		if err != nil {
+			return nil, err
+		}
+		if len(rest) < int(length) {
+			return nil, errCoAPMessage
+		}
+		number += delta
+		m.Options = append(m.Options, CoAPOption{number, rest[:length]})
+		data = rest[length:]
+	}
+	return m, nil
+}
+
+func coapNibble(v int) (uint8, []byte) {
+	switch {
+	case v < 13:
+		return uint8(v), nil
+	case v < 269:
+		return 13, []byte{byte(v - 13)}
+	}
+	return 14, binary.BigEndian.AppendUint16(nil, uint16(v - 269))
+}
+
+func (m *CoAPMessage) Bytes() []byte {
+	out := []byte{1 << 6 | m.Type << 4 | uint8(len(m.Token)), m.Code}
+	out = binary.BigEndian.AppendUint16(out, m.MessageID)
+	out = append(out, m.Token...)
+	options := append([]CoAPOption{}, m.Options...)
+	sort.SliceStable(options, func (i, j int) bool {
+		return options[i].Number < options[j].Number
+	})
+	prev := uint16(0)
+	for _, o := range options {
+		dn, dext := coapNibble(int(o.Number - prev))
+		ln, lext := coapNibble(len(o.Value))
+		out = append(out, dn << 4 | ln)
+		out = append(out, dext...)
+		out = append(out, lext...)
+		out = append(out, o.Value...)
+		prev = o.Number
+	}
+	if len(m.Payload) > 0 {
+		out = append(out, 0xff)
+		out = append(out, m.Payload...)
+	}
+	return out
+}
+
+type coapObserver struct {
+	addr      *net.UDPAddr
+	token     []byte
+	messageID uint16
+}
+
+type CoAPServer struct {
+	mu        sync.Mutex
+	conn      *net.UDPConn
+	messageID uint16
+	sequence  uint32
+	observers map[string][]coapObserver
+}
+
+var CoAP = CoAPServer{observers: map[string][]coapObserver{}}
+
+// coapResource renders the JSON representation of a resource.
+func coapResource(path string) ([]byte, bool) {
+	switch path {
+	case "/devices":
+		b, _ := json.Marshal(Presence.Listing())
+		return b, true
+	case "/logs":
+		return []byte("[]"), true
+	}
+	return nil, false
+}
+
+func (cs *CoAPServer) nextMessageID() uint16 {
+	cs.messageID++
+	return cs.messageID
+}
+
+func (cs *CoAPServer) Listen(addr string) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return err
+	}
+	cs.mu.Lock()
+	cs.conn = conn
+	cs.mu.Unlock()
+	return nil
+}
+
+func (cs *CoAPServer) Serve() error {
+	cs.mu.Lock()
+	conn := cs.conn
+	cs.mu.Unlock()
+	log.Printf("[INFO] Starting CoAP server on %v", conn.LocalAddr())
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+		req, err := ParseCoAP(buf[:n])
+		if err != nil {
+			continue
+		}
+		cs.handle(from, req)
+	}
+}
+
+func (cs *CoAPServer) handle(from *net.UDPAddr, req *CoAPMessage) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if req.Type == coapRST {
+		cs.forget(func (o coapObserver) bool {
+			return o.addr.String() == from.String() && o.messageID == req.MessageID
+		})
+		return
+	}
+	if req.Type == coapACK || req.Code == 0 {
+		return
+	}
+	res := &CoAPMessage{Type: coapNON, Code: coapContent, Token: req.Token}
+	if req.Type == coapCON {
+		res.Type = coapACK
+		res.MessageID = req.MessageID
+	} else {
+		res.MessageID = cs.nextMessageID()
+	}
+	path := req.Path()
+	payload, ok := coapResource(path)
+	switch {
+	case req.Code != coapGET:
+		res.Code = coapMethodNotAllowed
+	case !ok:
+		res.Code = coapNotFound
+	default:
+		res.Payload = payload
+		res.Options = append(res.Options, CoAPOption{coapOptionContentFormat, coapUintBytes(coapFormatJSON)})
+		if observe, ok := req.Option(coapOptionObserve); ok {
+			cs.forget(func (o coapObserver) bool {
+				return o.addr.String() == from.String() && string(o.token) == string(req.Token)
+			})
+			if coapUint(observe) == 0 {
+				cs.observers[path] = append(cs.observers[path], coapObserver{addr: from, token: req.Token})
+				res.Options = append(res.Options, CoAPOption{coapOptionObserve, coapUintBytes(cs.sequence)})
+			}
+		}
+	}
+	cs.conn.WriteToUDP(res.Bytes(), from)
+}
+
+// forget drops all observers matching the predicate, expecting cs.mu to be
+// held.
+func (cs *CoAPServer) forget(match func (coapObserver) bool) {
+	for path, observers := range cs.observers {
+		kept := observers[:0]
+		for _, o := range observers {
+			if !match(o) {
+				kept = append(kept, o)
+			}
+		}
+		cs.observers[path] = kept
+	}
+}
+
+// Notify pushes payload to everyone observing path.
+func (cs *CoAPServer) Notify(path string, payload []byte) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.conn == nil || len(cs.observers[path]) == 0 {
+		return
+	}
+	cs.sequence = (cs.sequence + 1) & 0xffffff
+	for i, o := range cs.observers[path] {
+		msg := &CoAPMessage{
+			Type: coapNON,
+			Code: coapContent,
+			MessageID: cs.nextMessageID(),
+			Token: o.token,
+			Options: []CoAPOption{
+				{coapOptionObserve, coapUintBytes(cs.sequence)},
+				{coapOptionContentFormat, coapUintBytes(coapFormatJSON)},
+			},
+			Payload: payload,
+		}
+		cs.observers[path][i].messageID = msg.MessageID
+		cs.conn.WriteToUDP(msg.Bytes(), o.addr)
+	}
+}
+
+func (cs *CoAPServer) observed(path string) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.conn != nil && len(cs.observers[path]) > 0
+}
+
+// NotifyLog forwards a log entry to observers of /logs, and a fresh device
+// list to observers of /devices whenever a device shows up. Nothing is
+// rendered without observers, as the device list grows with every device.
+func (cs *CoAPServer) NotifyLog(l *Log) {
+	if cs.observed("/logs") {
+		b, _ := json.Marshal(l)
+		cs.Notify("/logs", b)
+	}
+	if l.Level == "DEVICE" && cs.observed("/devices") {
+		devices, _ := coapResource("/devices")
+		cs.Notify("/devices", devices)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+)
+
+// maxQueuedCommands bounds the commands sent in one batch.
+const maxQueuedCommands = 100
+
+// QueuedCommandMaxAge is how long a command may have been queued for and
+// still be carried out; connecting to a device an hour after asking to is
+// more surprising than not doing it.
+var QueuedCommandMaxAge = 10 * time.Minute
+
+// QueuedCommand is a request the UI couldn't send while offline. ID is its
+// Idempotency-Key, so a batch sent again after dropping mid-way doesn't
+// carry out anything twice. Age is how many seconds it has been queued for,
+// measured by the client so its clock needn't agree with the gateway's.
+type QueuedCommand struct {
+	ID     string
+	Method string
+	Path   string
+	Body   json.RawMessage `json:",omitempty"`
+	Age    float64
+}
+
+type CommandResult struct {
+	ID     string
+	Status int
+	Body   string `json:",omitempty"`
+}
+
+func (qc QueuedCommand) check() error {
+	if qc.ID == "" {
+		return errors.New("commands need an ID")
+	}
+	if !strings.HasPrefix(qc.Path, "/") || strings.HasPrefix(qc.Path, "/commands") {
+		return errors.New("command " + qc.ID + " has an invalid path")
+	}
+	switch qc.Method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+	default:
+		return errors.New("command " + qc.ID + " has to be a POST, PUT, PATCH or DELETE")
+	}
+	return nil
+}
+
+// CommandsHandler carries out a batch of queued commands in order through
+// h, with the token of the batch, each needing the role it would on its own.
+// It answers with the status and body each got; commands queued for longer
+// than QueuedCommandMaxAge get 410 without being carried out.
+func CommandsHandler(h http.Handler) http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		commands := []QueuedCommand{}
+		err := json.NewDecoder(r.Body).Decode(&commands)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(commands) > maxQueuedCommands {
+			http.Error(w, "too many commands in one batch", http.StatusRequestEntityTooLarge)
+			return
+		}
+		for _, qc := range commands {
+			if err := qc.check(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		results := []CommandResult{}
+		for _, qc := range commands {
+			if time.Duration(qc.Age * float64(time.Second)) > QueuedCommandMaxAge {
+				results = append(results, CommandResult{ID: qc.ID, Status: http.StatusGone, Body: "queued for too long"})
+				continue
+			}
+			req, err := http.NewRequestWithContext(r.Context(), qc.Method, qc.Path, strings.NewReader(string(qc.Body)))
+			if err != nil {
+				results = append(results, CommandResult{ID: qc.ID, Status: http.StatusBadRequest, Body: err.Error()})
+				continue
+			}
+			req.RemoteAddr = r.RemoteAddr
+			if token := requestToken(r); token != "" {
+				req.Header.Set("Authorization", "Bearer " + token)
+			}
+			if len(qc.Body) > 0 {
+				req.Header.Set("Content-Type", "application/json")
+			}
+			req.Header.Set(IdempotencyHeader, qc.ID)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			results = append(results, CommandResult{ID: qc.ID, Status: rec.Code, Body: strings.TrimSpace(rec.Body.String())})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	}
+}
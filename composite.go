@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	compositesFile  = "composites.json"
+	compositeMaxAge = 10 * time.Minute
+)
+
+// CompositeDevice combines metrics of several devices into one, recorded
+// under ID like a device of its own. Function is avg (the default), min, max
+// or sum, over the members heard from in the last compositeMaxAge.
+type CompositeDevice struct {
+	ID       string
+	Name     string
+	Members  []string
+	Metrics  []string
+	Function string `json:",omitempty"`
+}
+
+type CompositeSample struct {
+	Address string
+	Metric  string
+	Value   float64
+}
+
+type memberValue struct {
+	value float64
+	at    time.Time
+}
+
+type SafeComposites struct {
+	mu         sync.Mutex
+	Composites []CompositeDevice
+	latest     map[string]map[string]memberValue
+}
+
+var Composites = SafeComposites{Composites: []CompositeDevice{}, latest: map[string]map[string]memberValue{}}
+
+func ValidateComposites(composites []CompositeDevice) error {
+	ids := map[string]bool{}
+	for _, c := range composites {
+		if c.ID == "" || ids[c.ID] || strings.IndexFunc(c.ID, func (r rune) bool { return !isIdent(r) && r != '-' }) >= 0 {
+			return errors.New("composites need distinct IDs made of letters, digits, - and _")
+		}
+		ids[c.ID] = true
+		if len(c.Members) == 0 || len(c.Metrics) == 0 {
+			return errors.New(c.ID + ": needs Members and Metrics")
+		}
+		for _, member := range c.Members {
+			if _, err := net.ParseMAC(member); err != nil {
+				return errors.New(c.ID + ": " + member + " is not a device address")
+			}
+		}
+		if !slices.Contains([]string{"", "avg", "min", "max", "sum"}, c.Function) {
+			return errors.New(c.ID + ": function must be avg, min, max or sum")
+		}
+	}
+	return nil
+}
+
+func (sc *SafeComposites) Load() error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	err := LoadJSON(compositesFile, &sc.Composites)
+	if err != nil {
+		return err
+	}
+	return ValidateComposites(sc.Composites)
+}
+
+func combine(function string, values []float64) float64 {
+	switch function {
+	case "min":
+		return fold(math.Min, values)
+	case "max":
+		return fold(math.Max, values)
+	}
+	sum := fold(func (a float64, b float64) float64 { return a + b }, values)
+	if function == "sum" {
+		return sum
+	}
+	return sum / float64(len(values))
+}
+
+// Observe remembers a member's value and returns the updated values of the
+// composites it is part of.
+func (sc *SafeComposites) Observe(addr string, metric string, value float64) []CompositeSample {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	samples := []CompositeSample{}
+	for _, c := range sc.Composites {
+		if !slices.ContainsFunc(c.Members, func (m string) bool { return strings.EqualFold(m, addr) }) || !slices.Contains(c.Metrics, metric) {
+			continue
+		}
+		key := c.ID + ";" + metric
+		latest, ok := sc.latest[key]
+		if !ok {
+			latest = map[string]memberValue{}
+			sc.latest[key] = latest
+		}
+		latest[strings.ToUpper(addr)] = memberValue{value, time.Now()}
+		values := []float64{}
+		for member, v := range latest {
+			if time.Since(v.at) > compositeMaxAge {
+				delete(latest, member)
+				continue
+			}
+			values = append(values, v.value)
+		}
+		samples = append(samples, CompositeSample{c.ID, metric, combine(c.Function, values)})
+	}
+	return samples
+}
+
+// compositeListing lists a composite as healthy as its healthiest member.
+func compositeListing(c CompositeDevice, devices []DeviceListing) DeviceListing {
+	meta := Metadata.Get(c.ID)
+	listing := DeviceListing{Address: c.ID, Name: c.Name, Alias: meta.Alias, Tags: meta.Tags, Members: c.Members, Health: "dead"}
+	rank := map[string]int{"dead": 0, "learning": 1, "late": 2, "ok": 3}
+	for _, d := range devices {
+		if !slices.ContainsFunc(c.Members, func (m string) bool { return strings.EqualFold(m, d.Address) }) {
+			continue
+		}
+		if rank[d.Health] > rank[listing.Health] {
+			listing.Health = d.Health
+		}
+		listing.InRange = listing.InRange || d.InRange
+		listing.LastSeen = maxTime(listing.LastSeen, d.LastSeen)
+	}
+	return listing
+}
+
+func (sc *SafeComposites) List() []CompositeDevice {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.Composites
+}
+
+func (sc *SafeComposites) Set(composites []CompositeDevice) error {
+	err := ValidateComposites(composites)
+	if err != nil {
+		return err
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	err = SaveJSON(compositesFile, composites)
+	if err != nil {
+		return err
+	}
+	sc.Composites = composites
+	sc.latest = map[string]map[string]memberValue{}
+	return nil
+}
+
+func GetCompositesHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Composites.List())
+	}
+}
+
+func SetCompositesHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		composites := []CompositeDevice{}
+		err := json.NewDecoder(r.Body).Decode(&composites)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = Composites.Set(composites)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(200)
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ConfigProblem is one mistake found in a config, with what to do about it.
+type ConfigProblem struct {
+	Section string
+	Problem string
+	Fix     string `json:",omitempty"`
+}
+
+type ConfigReport struct {
+	Valid    bool
+	Problems []ConfigProblem
+}
+
+// ConfigBundle holds config documents by section, each in the format it is
+// stored in under the data directory.
+type ConfigBundle map[string]json.RawMessage
+
+var (
+	configSections = map[string]string{
+		"sinks": sinksFile,
+		"mqtt": mqttFile,
+		"cloud": cloudFile,
+		"retention": retentionFile,
+		"bridges": bridgesFile,
+		"virtual": virtualFile,
+		"composites": compositesFile,
+		"thresholds": thresholdsFile,
+		"deadbands": deadbandsFile,
+		"devicelists": deviceListsFile,
+		"people": peopleFile,
+		"modes": modesFile,
+		"polls": pollsFile,
+		"machines": machinesFile,
+		"webpush": webPushFile,
+	}
+	SinkNames   = []string{"sse", "coap", "digest", "tts", "replica", "mqtt", "cloud", "owntracks", "webpush"}
+	EventLevels = []string{
+		"INFO", "DEVICE", "ERROR", "CONNECTED", "DISCONNECTED",
+		"ADAPTER_ADDED", "ADAPTER_REMOVED", "ADAPTER_RECOVERED", "ADAPTER_FAILED", "ADAPTER_SELECTED",
+		"ADAPTER_POWERED_OFF", "ADAPTER_POWERED_ON",
+		"AGG", "ANOMALY", "SENSOR_DEAD", "SENSOR_ALIVE", "NOTIFY",
+		"THRESHOLD_BREACH", "MTU", "STATE", "DEVICE_GONE", "CONNECT_FAILED",
+		"CONNECT_ATTEMPT", "CONNECT_RETRY", "RECONNECTING", "RECONNECTED",
+		"CONNECTION_LOST", "PAIRED", "PAIRING_FAILED", "PAIRING_CODE", "UNPAIRED",
+		"PAIRING_REQUEST", "DEVICE_PENDING", "DEVICE_APPROVED", "DEVICE_REJECTED",
+		"ADVERTISING_ABNORMAL", "PERSON", "MODE",
+	}
+)
+
+func sectionNames() string {
+	names := []string{}
+	for name := range configSections {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return strings.Join(names, ", ")
+}
+
+// decodeStrict rejects fields the document type doesn't have, which is
+// where most typos end up.
+func decodeStrict(raw json.RawMessage, v any) error {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+type configChecker struct {
+	problems []ConfigProblem
+}
+
+func (cc *configChecker) add(section string, problem string, fix string) {
+	cc.problems = append(cc.problems, ConfigProblem{section, problem, fix})
+}
+
+func (cc *configChecker) decode(bundle ConfigBundle, section string, v any) bool {
+	raw, ok := bundle[section]
+	if !ok || string(raw) == "null" {
+		return false
+	}
+	err := decodeStrict(raw, v)
+	if err != nil {
+		cc.add(section, err.Error(), "Field names are case sensitive, see the README for the fields " + section + " takes.")
+		return false
+	}
+	return true
+}
+
+func (cc *configChecker) levels(section string, levels []string) {
+	for _, level := range levels {
+		if !slices.Contains(EventLevels, level) {
+			cc.add(section, "unknown event type " + strconv.Quote(level), "Event types are " + strings.Join(EventLevels, ", ") + ".")
+		}
+	}
+}
+
+// CheckConfig validates every section of a bundle and the references
+// between them. Sections left out are not checked.
+func CheckConfig(bundle ConfigBundle) []ConfigProblem {
+	cc := &configChecker{problems: []ConfigProblem{}}
+	for section := range bundle {
+		if _, ok := configSections[section]; !ok {
+			cc.add(section, "unknown section", "Sections are " + sectionNames() + ".")
+		}
+	}
+
+	profiles := map[string]ThrottleProfile{}
+	if cc.decode(bundle, "sinks", &profiles) {
+		for name, profile := range profiles {
+			section := "sinks." + name
+			if !slices.Contains(SinkNames, name) {
+				cc.add(section, "no sink is called " + strconv.Quote(name), "Sinks are " + strings.Join(SinkNames, ", ") + ".")
+			}
+			if err := profile.Validate(); err != nil {
+				cc.add(section, err.Error(), "")
+			}
+			cc.levels(section + ".Levels", profile.Levels)
+		}
+	}
+	// passes reports whether a sink's profile lets an event type through.
+	passes := func (sink string, level string) bool {
+		levels := profiles[sink].Levels
+		return len(levels) == 0 || slices.Contains(levels, level)
+	}
+
+	mqtt := MQTTConfig{}
+	if cc.decode(bundle, "mqtt", &mqtt) {
+		if _, err := mqtt.Compile(); err != nil {
+			cc.add("mqtt", err.Error(), "")
+		}
+		if mqtt.Broker == "" && (len(mqtt.Routes) > 0 || mqtt.Mode != "") {
+			cc.add("mqtt", "routes are configured but there is no Broker, nothing will be published", "Set Broker, eg. mqtt://localhost:1883.")
+		}
+		if u, err := url.Parse(mqtt.Broker); mqtt.Broker != "" && (err != nil || !slices.Contains([]string{"tcp", "mqtt", "ssl", "tls", "mqtts"}, u.Scheme)) {
+			cc.add("mqtt.Broker", strconv.Quote(mqtt.Broker) + " is not a broker URL", "Use mqtt://host:port, or mqtts:// for TLS.")
+		}
+		if mqtt.Username != "" && mqtt.Password == "" {
+			cc.add("mqtt.Password", "Username is set without a Password", "Most brokers reject this, set Password or remove Username.")
+		}
+		for level := range mqtt.Routes {
+			if level == "" || level == "*" {
+				continue
+			}
+			cc.levels("mqtt.Routes", []string{level})
+			if !passes("mqtt", level) {
+				cc.add("mqtt.Routes." + level, "never used, the mqtt sink profile drops " + level + " events", "Add " + level + " to sinks.mqtt.Levels or remove the route.")
+			}
+		}
+	}
+
+	cloud := CloudConfig{}
+	if cc.decode(bundle, "cloud", &cloud) {
+		if err := cloud.Validate(); err != nil {
+			cc.add("cloud", err.Error(), "Check the credentials exist and are readable by the bluboi user.")
+		}
+		cc.levels("cloud.Events", cloud.Events)
+		events := cloud.Events
+		if len(events) == 0 {
+			events = DefaultCloudEvents
+		}
+		forwarded := slices.ContainsFunc(events, func (level string) bool {
+			return passes("cloud", level)
+		})
+		if cloud.Provider != "" && !forwarded {
+			cc.add("cloud.Events", "nothing will be forwarded, the cloud sink profile drops every event in Events", "Make sinks.cloud.Levels and cloud.Events overlap.")
+		}
+	}
+
+	tiers := []RetentionTier{}
+	if cc.decode(bundle, "retention", &tiers) {
+		if err := ValidateRetention(tiers); err != nil {
+			cc.add("retention", err.Error(), "")
+		}
+	}
+
+	virtual := []VirtualMetric{}
+	if cc.decode(bundle, "virtual", &virtual) {
+		if _, err := CompileVirtual(virtual); err != nil {
+			cc.add("virtual", err.Error(), "Expressions take numbers, metric names, + - * / ^, parentheses and " + exprFuncNames() + ".")
+		}
+	}
+
+	composites := []CompositeDevice{}
+	if cc.decode(bundle, "composites", &composites) {
+		if err := ValidateComposites(composites); err != nil {
+			cc.add("composites", err.Error(), "")
+		}
+	}
+
+	thresholds := map[string][]Threshold{}
+	if cc.decode(bundle, "thresholds", &thresholds) {
+		for addr, t := range thresholds {
+			if err := ValidateThresholds(t); err != nil {
+				cc.add("thresholds." + addr, err.Error(), "")
+			}
+		}
+	}
+
+	deadbands := map[string][]Deadband{}
+	if cc.decode(bundle, "deadbands", &deadbands) {
+		for addr, d := range deadbands {
+			if err := ValidateDeadbands(d); err != nil {
+				cc.add("deadbands." + addr, err.Error(), "")
+			}
+		}
+	}
+
+	lists := DeviceLists{}
+	if cc.decode(bundle, "devicelists", &lists) {
+		if err := ValidateDeviceLists(lists); err != nil {
+			cc.add("devicelists", err.Error(), "")
+		}
+	}
+
+	people := []Person{}
+	if cc.decode(bundle, "people", &people) {
+		if err := ValidatePeople(people); err != nil {
+			cc.add("people", err.Error(), "")
+		}
+	}
+
+	modes := ModeConfig{}
+	if cc.decode(bundle, "modes", &modes) {
+		if err := ValidateModeConfig(modes); err != nil {
+			cc.add("modes", err.Error(), "")
+		}
+	}
+
+	polls := map[string][]Poll{}
+	if cc.decode(bundle, "polls", &polls) {
+		for addr, p := range polls {
+			if err := ValidatePolls(p); err != nil {
+				cc.add("polls." + addr, err.Error(), "")
+			}
+		}
+	}
+
+	machines := map[string]StateMachine{}
+	if cc.decode(bundle, "machines", &machines) {
+		for addr, m := range machines {
+			if err := ValidateMachine(m); err != nil {
+				cc.add("machines." + addr, err.Error(), "")
+			}
+		}
+	}
+
+	webpush := WebPushConfig{}
+	if cc.decode(bundle, "webpush", &webpush) {
+		if err := webpush.Validate(); err != nil {
+			cc.add("webpush", err.Error(), "")
+		}
+		cc.levels("webpush.Events", webpush.Events)
+		if webpush.Subject == "" {
+			cc.add("webpush.Subject", "there is no Subject, nothing will be pushed", "Set Subject to a contact for push services, eg. mailto:admin@example.com.")
+		}
+	}
+
+	bridges := []BridgeConfig{}
+	if cc.decode(bundle, "bridges", &bridges) {
+		_, httpPort, _ := net.SplitHostPort(HTTPAddr)
+		ports := map[int]bool{}
+		for _, bridge := range bridges {
+			section := "bridges." + strconv.Itoa(bridge.Port)
+			if err := bridge.Validate(); err != nil {
+				cc.add(section, err.Error(), "")
+			}
+			if ports[bridge.Port] {
+				cc.add(section, "more than one bridge uses this port", "Give each bridge its own Port.")
+			}
+			ports[bridge.Port] = true
+			if strconv.Itoa(bridge.Port) == httpPort {
+				cc.add(section, "the HTTP server already listens on this port", "Pick another Port.")
+			}
+			if _, err := net.ParseMAC(bridge.Address); bridge.Address != "" && err != nil {
+				cc.add(section + ".Address", strconv.Quote(bridge.Address) + " is not a device address", "Use the address listed by GET /devices, eg. AA:BB:CC:DD:EE:FF.")
+			}
+		}
+	}
+	slices.SortStableFunc(cc.problems, func (a, b ConfigProblem) int {
+		return strings.Compare(a.Section, b.Section)
+	})
+	return cc.problems
+}
+
+// StoredConfig reads every config document from the store into a bundle.
+func StoredConfig() (ConfigBundle, error) {
+	bundle := ConfigBundle{}
+	for section, file := range configSections {
+		var raw json.RawMessage
+		err := LoadJSON(file, &raw)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", file, err)
+		}
+		if raw != nil {
+			bundle[section] = raw
+		}
+	}
+	return bundle, nil
+}
+
+// ConfigCommand implements `bluboi config check`, checking a bundle file or,
+// without one, the stored config, and returns the process exit code.
+func ConfigCommand(args []string) int {
+	flags := flag.NewFlagSet("config", flag.ExitOnError)
+	flags.StringVar(&DataDir, "data", DataDir, "directory bluboi persists its state in")
+	db := flags.String("db", "sqlite", "where state and history are stored: \"sqlite\" for bluboi.db in the data directory, \"file\" for JSON files in it, or a postgres:// URL")
+	asJSON := flags.Bool("json", false, "print a JSON report instead")
+	if len(args) == 0 || args[0] != "check" {
+		fmt.Println("Usage: bluboi config check [-data dir] [-db url] [-json] [bundle.json]")
+		return exitUsage
+	}
+	flags.Parse(args[1:])
+	bundle := ConfigBundle{}
+	if path := flags.Arg(0); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return commandFailed(*asJSON, "Could not read the config", err)
+		}
+		err = json.Unmarshal(data, &bundle)
+		if err != nil {
+			return commandFailed(*asJSON, "Could not parse the config", err)
+		}
+	} else {
+		err := OpenStore(*db)
+		if err != nil {
+			return commandFailed(*asJSON, "Could not open the database", err)
+		}
+		defer Store.Close()
+		bundle, err = StoredConfig()
+		if err != nil {
+			return commandFailed(*asJSON, "Could not read the config", err)
+		}
+	}
+	problems := CheckConfig(bundle)
+	code := exitOK
+	if len(problems) > 0 {
+		code = exitFailed
+	}
+	if *asJSON {
+		printJSON(ConfigReport{len(problems) == 0, problems})
+		return code
+	}
+	for _, p := range problems {
+		fmt.Printf("[FAIL] %v - %v\n", p.Section, p.Problem)
+		if p.Fix != "" {
+			fmt.Printf("       %v\n", p.Fix)
+		}
+	}
+	if len(problems) > 0 {
+		fmt.Printf("\n%v found.\n", plural(len(problems), "problem"))
+		return code
+	}
+	fmt.Printf("Checked %v, no problems found.\n", plural(len(bundle), "section"))
+	return code
+}
+
+// ValidateConfigHandler checks a posted bundle without applying it.
+func ValidateConfigHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		bundle := ConfigBundle{}
+		err := json.NewDecoder(r.Body).Decode(&bundle)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		problems := CheckConfig(bundle)
+		w.Header().Set("Content-Type", "application/json")
+		if len(problems) > 0 {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+		}
+		json.NewEncoder(w).Encode(ConfigReport{len(problems) == 0, problems})
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// maxConnectBackoff caps the wait between connection attempts however many
+// there are.
+const maxConnectBackoff = 30 * time.Second
+
+// ConnectRetry is how often and how patiently to try connecting: up to
+// Attempts times, waiting Backoff after the first failure and twice as long
+// after every next one, give or take Jitter as a fraction of the wait so
+// gateways retrying together spread out.
+type ConnectRetry struct {
+	Attempts int
+	Backoff  time.Duration
+	Jitter   float64
+}
+
+var (
+	// ConnectTimeout bounds each connection attempt, 0 leaving them to
+	// BlueZ.
+	ConnectTimeout = 30 * time.Second
+	ConnectPolicy = ConnectRetry{Attempts: 1, Backoff: time.Second, Jitter: 0.2}
+	// Passive has the gateway only listen to advertisements, never
+	// connecting to or pairing with a device (-scan-type passive).
+	Passive = false
+	errPassive = errors.New("connecting is off, bluboi only listens to advertisements (-scan-type passive)")
+	errNotConnecting = errors.New("not connecting to that device")
+	errConnectCancelled = errors.New("cancelled")
+)
+
+// ConnectAllowed tells whether the gateway may connect to or pair with
+// devices.
+func ConnectAllowed() error {
+	if Passive {
+		return errPassive
+	}
+	return nil
+}
+
+// delay is how long to wait after the attempt-th failed attempt.
+func (cr ConnectRetry) delay(attempt int) time.Duration {
+	delay := cr.Backoff
+	for i := 1; i < attempt && delay < maxConnectBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, maxConnectBackoff)
+	if cr.Jitter > 0 {
+		delay += time.Duration((rand.Float64() * 2 - 1) * cr.Jitter * float64(delay))
+	}
+	return max(delay, 0)
+}
+
+// Connect connects to a scanned or bonded device, making up to ConnectPolicy.Attempts
+// attempts. Each raises CONNECT_ATTEMPT (address;attempt;attempts), and
+// failures followed by another attempt CONNECT_RETRY
+// (address;attempt;reason;delay). It gives up with CONNECT_FAILED
+// (address;reason) once out of attempts or cancelled. The adapter isn't
+// locked while waiting, so a hanging attempt doesn't hold up anything else.
+func (sa *SafeAdapter) Connect(address string) {
+	key := strings.ToUpper(address)
+	if sa.IsConnected(key) {
+		LogError("You're already connected to", address)
+		return
+	}
+	device, ok := knownAddress(address)
+	if !ok {
+		LogError("Could not find the device.")
+		return
+	}
+	cancel, ok := sa.startAttempt(key)
+	if !ok {
+		LogError("Already connecting to", address)
+		return
+	}
+	defer sa.endAttempt(key, cancel)
+	err := sa.connect(key, device, cancel)
+	if err != nil {
+		LogEvent("CONNECT_FAILED", key + ";" + err.Error())
+	}
+}
+
+// connect makes the attempts of a connection registered with startAttempt.
+func (sa *SafeAdapter) connect(key string, address bluetooth.Address, cancel <-chan struct{}) error {
+	if err := ConnectAllowed(); err != nil {
+		return err
+	}
+	if !DeviceAccess.MayConnect(key, advertisedName(key)) {
+		return errNotAllowed
+	}
+	policy := ConnectPolicy
+	attempts := max(policy.Attempts, 1)
+	for attempt := 1; ; attempt++ {
+		LogEvent("CONNECT_ATTEMPT", key + ";" + strconv.Itoa(attempt) + ";" + strconv.Itoa(attempts))
+		dvc, err := sa.dial(key, address, cancel)
+		if err == nil {
+			sa.mu.Lock()
+			defer sa.mu.Unlock()
+			sa.connections[key] = dvc
+			sa.order = append(sa.order, key)
+			LogEvent("CONNECTED", "Connected to", DisplayName(key), "(" + key + ")")
+			go ReadBattery(key)
+			go ReportMTU(key)
+			go Machines.Start(key)
+			return nil
+		}
+		if attempt >= attempts || errors.Is(err, errConnectCancelled) {
+			return err
+		}
+		delay := policy.delay(attempt)
+		LogEvent("CONNECT_RETRY", key + ";" + strconv.Itoa(attempt) + ";" + err.Error() + ";" + delay.Round(time.Millisecond).String())
+		select {
+		case <-time.After(delay):
+		case <-cancel:
+			return errConnectCancelled
+		}
+	}
+}
+
+// dial makes one connection attempt, giving up after ConnectTimeout or once
+// cancel is closed.
+func (sa *SafeAdapter) dial(key string, address bluetooth.Address, cancel <-chan struct{}) (*bluetooth.Device, error) {
+	type attempt struct {
+		dvc *bluetooth.Device
+		err error
+	}
+	done := make(chan attempt, 1)
+	start := time.Now()
+	go func () {
+		dvc, err := sa.Adapter.Connect(address, bluetooth.ConnectionParams{})
+		done <- attempt{dvc, err}
+	} ()
+	var timeout <-chan time.Time
+	if ConnectTimeout > 0 {
+		timeout = time.After(ConnectTimeout)
+	}
+	var err error
+	select {
+	case a := <-done:
+		Latencies.Observe("connect", time.Since(start), a.err)
+		return a.dvc, a.err
+	case <-timeout:
+		err = errors.New("timed out after " + ConnectTimeout.String())
+	case <-cancel:
+		err = errConnectCancelled
+	}
+	Latencies.Observe("connect", time.Since(start), err)
+	abortConnect(key)
+	go func () {
+		// The attempt may still succeed after being given up on.
+		if a := <-done; a.err == nil {
+			a.dvc.Disconnect()
+		}
+	} ()
+	return nil, err
+}
+
+// startAttempt registers a connection attempt, returning the channel
+// closed to cancel it, unless one is already under way.
+func (sa *SafeAdapter) startAttempt(key string) (<-chan struct{}, bool) {
+	sa.attemptsMu.Lock()
+	defer sa.attemptsMu.Unlock()
+	if _, ok := sa.attempts[key]; ok {
+		return nil, false
+	}
+	cancel := make(chan struct{})
+	sa.attempts[key] = cancel
+	return cancel, true
+}
+
+// Attempts counts the devices being connected to.
+func (sa *SafeAdapter) Attempts() int {
+	sa.attemptsMu.Lock()
+	defer sa.attemptsMu.Unlock()
+	return len(sa.attempts)
+}
+
+// endAttempt unregisters the attempt started with cancel, leaving alone an
+// attempt started once it was cancelled.
+func (sa *SafeAdapter) endAttempt(key string, cancel <-chan struct{}) {
+	sa.attemptsMu.Lock()
+	defer sa.attemptsMu.Unlock()
+	if current, ok := sa.attempts[key]; ok && current == cancel {
+		delete(sa.attempts, key)
+	}
+}
+
+// CancelConnect gives up on a connection attempt in progress, or on waiting
+// to retry one.
+func (sa *SafeAdapter) CancelConnect(address string) error {
+	key := strings.ToUpper(address)
+	sa.attemptsMu.Lock()
+	defer sa.attemptsMu.Unlock()
+	cancel, ok := sa.attempts[key]
+	if !ok {
+		return errNotConnecting
+	}
+	close(cancel)
+	delete(sa.attempts, key)
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"tinygo.org/x/bluetooth"
+)
+
+func TestConnectRetryDelay(t *testing.T) {
+	tests := []struct {
+		backoff time.Duration
+		attempt int
+		want    time.Duration
+	}{
+		{time.Second, 1, time.Second},
+		{time.Second, 2, 2 * time.Second},
+		{time.Second, 3, 4 * time.Second},
+		{time.Second, 5, 16 * time.Second},
+		{time.Second, 6, maxConnectBackoff},
+		{time.Second, 1000, maxConnectBackoff},
+		{500 * time.Millisecond, 3, 2 * time.Second},
+		{time.Minute, 1, maxConnectBackoff},
+		{0, 4, 0},
+	}
+	for _, test := range tests {
+		cr := ConnectRetry{Attempts: 10, Backoff: test.backoff}
+		if got := cr.delay(test.attempt); got != test.want {
+			t.Errorf("delay(%d) with %v backoff = %v, want %v", test.attempt, test.backoff, got, test.want)
+		}
+	}
+}
+
+func TestConnectRetryJitter(t *testing.T) {
+	tests := []struct {
+		jitter  float64
+		attempt int
+		low     time.Duration
+		high    time.Duration
+	}{
+		{0.2, 1, 800 * time.Millisecond, 1200 * time.Millisecond},
+		{0.2, 3, 3200 * time.Millisecond, 4800 * time.Millisecond},
+		{0.5, 10, 15 * time.Second, 45 * time.Second},
+		{1, 2, 0, 4 * time.Second},
+	}
+	for _, test := range tests {
+		cr := ConnectRetry{Attempts: 10, Backoff: time.Second, Jitter: test.jitter}
+		for i := 0; i < 1000; i++ {
+			if got := cr.delay(test.attempt); got < test.low || got > test.high {
+				t.Fatalf("delay(%d) with %v jitter = %v, want between %v and %v", test.attempt, test.jitter, got, test.low, test.high)
+			}
+		}
+	}
+}
+
+func TestPassiveRefusesConnecting(t *testing.T) {
+	t.Cleanup(func () { Passive = false })
+	Passive = true
+	sa := &SafeAdapter{}
+	if err := sa.connect("AA:BB:CC:DD:EE:FF", bluetooth.Address{}, nil); !errors.Is(err, errPassive) {
+		t.Errorf("connecting got %v, want %v", err, errPassive)
+	}
+	if _, err := Pair("aa:bb:cc:dd:ee:ff", PairRequest{}); !errors.Is(err, errPassive) {
+		t.Errorf("pairing got %v, want %v", err, errPassive)
+	}
+	if _, ok := Pairings.Request("AA:BB:CC:DD:EE:FF"); ok {
+		t.Errorf("a refused pairing was left in progress")
+	}
+}
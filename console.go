@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"tinygo.org/x/bluetooth"
+)
+
+const consoleHelp = "commands: services, read <uuid>, write <uuid> <hex>, notify <uuid>, unnotify <uuid>, help"
+
+var consoleUpgrader = websocket.Upgrader{}
+
+// Console runs text commands against the connected device for one
+// WebSocket. Every command gets one reply message; notifications arrive as
+// "notify <uuid> <hex>" messages in between.
+type Console struct {
+	mu       sync.Mutex
+	conn     *websocket.Conn
+	actor    string
+	address  string
+	notified map[string]*bluetooth.DeviceCharacteristic
+}
+
+func (c *Console) send(text string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.WriteMessage(websocket.TextMessage, []byte(text))
+}
+
+func (c *Console) services() string {
+	services, err := Adapter.Services(c.address)
+	if err != nil {
+		return "error " + err.Error()
+	}
+	lines := []string{}
+	for _, s := range services {
+		lines = append(lines, "service " + s.UUID)
+		for _, char := range s.Characteristics {
+			lines = append(lines, "  " + strings.TrimSpace(char.UUID + " " + strings.Join(char.Properties, ",")))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Run executes one command line and returns its reply.
+func (c *Console) Run(line string) string {
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return consoleHelp
+	}
+	switch {
+	case args[0] == "services" && len(args) == 1:
+		return c.services()
+	case args[0] == "read" && len(args) == 2:
+		value, err := Adapter.ReadCharacteristic(c.address, args[1])
+		if err != nil {
+			return "error " + err.Error()
+		}
+		return "value " + args[1] + " " + hex.EncodeToString(value)
+	case args[0] == "write" && len(args) == 3:
+		value, err := hex.DecodeString(args[2])
+		if err != nil {
+			return "error value must be hex, eg. 0a1b"
+		}
+		Audit.Record(c.actor, "console_write", c.address + " " + args[1] + " " + args[2])
+		err = Adapter.WriteCharacteristic(c.address, args[1], value)
+		if err != nil {
+			return "error " + err.Error()
+		}
+		return "ok"
+	case args[0] == "notify" && len(args) == 2:
+		char, err := Adapter.Characteristic(c.address, args[1])
+		if err != nil {
+			return "error " + err.Error()
+		}
+		uuid := args[1]
+		err = char.EnableNotifications(func (buf []byte) {
+			c.send("notify " + uuid + " " + hex.EncodeToString(buf))
+		})
+		if err != nil {
+			return "error " + err.Error()
+		}
+		c.notified[uuid] = char
+		return "ok"
+	case args[0] == "unnotify" && len(args) == 2:
+		char, ok := c.notified[args[1]]
+		if !ok {
+			return "error not subscribed to " + args[1]
+		}
+		delete(c.notified, args[1])
+		char.EnableNotifications(nil)
+		return "ok"
+	}
+	return "error unknown command, " + consoleHelp
+}
+
+func (c *Console) Close() {
+	for _, char := range c.notified {
+		char.EnableNotifications(nil)
+	}
+	c.conn.Close()
+}
+
+// ConsoleHandler opens a console for the connected device over a WebSocket.
+func ConsoleHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		address := mux.Vars(r)["addr"]
+		if !Adapter.IsConnected(address) {
+			http.Error(w, errNotConnectedTo.Error(), http.StatusConflict)
+			return
+		}
+		conn, err := consoleUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		c := &Console{conn: conn, actor: r.RemoteAddr, address: address, notified: map[string]*bluetooth.DeviceCharacteristic{}}
+		defer c.Close()
+		Audit.Record(c.actor, "open_console", address)
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			err = c.send(c.Run(string(msg)))
+			if err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const deadbandsFile = "deadbands.json"
+
+// Streams a metric goes out on that deadbands compress: the AGG events sent
+// to MQTT and the other sinks, and the raw samples stored in history.
+const (
+	streamAggregates = "agg"
+	streamHistory    = "history"
+)
+
+// Deadband only lets a metric of a device through once it moved by at least
+// Delta since it last went out, or MaxInterval after that at the latest, so
+// chatty sensors don't flood brokers and databases. AGG events are compared
+// by their average. Anomalies and thresholds still see every value.
+type Deadband struct {
+	Metric      string
+	Delta       float64
+	MaxInterval string `json:",omitempty"`
+}
+
+type deadbandState struct {
+	value float64
+	sent  time.Time
+}
+
+type SafeDeadbands struct {
+	mu        sync.Mutex
+	Deadbands map[string][]Deadband
+	states    map[string]*deadbandState
+}
+
+var Deadbands = SafeDeadbands{Deadbands: map[string][]Deadband{}, states: map[string]*deadbandState{}}
+
+func ValidateDeadbands(deadbands []Deadband) error {
+	metrics := map[string]bool{}
+	for _, d := range deadbands {
+		if d.Metric == "" || metrics[d.Metric] {
+			return errors.New("deadbands need distinct metrics")
+		}
+		metrics[d.Metric] = true
+		if d.Delta < 0 {
+			return errors.New(d.Metric + ": delta can't be negative")
+		}
+		if d.MaxInterval != "" {
+			if i, err := time.ParseDuration(d.MaxInterval); err != nil || i <= 0 {
+				return errors.New(d.Metric + ": max interval must be a duration, eg. 5m")
+			}
+		}
+	}
+	return nil
+}
+
+func (sd *SafeDeadbands) Load() error {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	err := LoadJSON(deadbandsFile, &sd.Deadbands)
+	if err != nil {
+		return err
+	}
+	for addr, deadbands := range sd.Deadbands {
+		if err := ValidateDeadbands(deadbands); err != nil {
+			return errors.New(addr + " " + err.Error())
+		}
+	}
+	return nil
+}
+
+// Pass tells whether a value of a device's metric should go out on a
+// stream, always when the metric has no deadband.
+func (sd *SafeDeadbands) Pass(stream string, addr string, metric string, value float64) bool {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	var d *Deadband
+	for i := range sd.Deadbands[addr] {
+		if sd.Deadbands[addr][i].Metric == metric {
+			d = &sd.Deadbands[addr][i]
+		}
+	}
+	if d == nil {
+		return true
+	}
+	key := addr + ";" + metric + ";" + stream
+	state, ok := sd.states[key]
+	now := time.Now()
+	if ok && math.Abs(value - state.value) < d.Delta {
+		interval, _ := time.ParseDuration(d.MaxInterval)
+		if interval == 0 || now.Sub(state.sent) < interval {
+			return false
+		}
+	}
+	sd.states[key] = &deadbandState{value, now}
+	return true
+}
+
+func (sd *SafeDeadbands) List(addr string) []Deadband {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	if deadbands, ok := sd.Deadbands[strings.ToUpper(addr)]; ok {
+		return deadbands
+	}
+	return []Deadband{}
+}
+
+// Set replaces the deadbands of a device, an empty list removes them.
+func (sd *SafeDeadbands) Set(addr string, deadbands []Deadband) error {
+	err := ValidateDeadbands(deadbands)
+	if err != nil {
+		return err
+	}
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	addr = strings.ToUpper(addr)
+	all := map[string][]Deadband{}
+	for a, d := range sd.Deadbands {
+		all[a] = d
+	}
+	if len(deadbands) == 0 {
+		delete(all, addr)
+	} else {
+		all[addr] = deadbands
+	}
+	err = SaveJSON(deadbandsFile, all)
+	if err != nil {
+		return err
+	}
+	sd.Deadbands = all
+	for key := range sd.states {
+		if strings.HasPrefix(key, addr + ";") {
+			delete(sd.states, key)
+		}
+	}
+	return nil
+}
+
+func GetDeadbandsHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Deadbands.List(mux.Vars(r)["addr"]))
+	}
+}
+
+func SetDeadbandsHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		deadbands := []Deadband{}
+		err := json.NewDecoder(r.Body).Decode(&deadbands)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = Deadbands.Set(mux.Vars(r)["addr"], deadbands)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(200)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestDeadbandsAddressCase(t *testing.T) {
+	useDataDir(t)
+	t.Cleanup(func () { Deadbands = SafeDeadbands{Deadbands: map[string][]Deadband{}, states: map[string]*deadbandState{}} })
+	Deadbands = SafeDeadbands{Deadbands: map[string][]Deadband{}, states: map[string]*deadbandState{}}
+	if err := Deadbands.Set("aa:bb:cc:dd:ee:ff", []Deadband{{Metric: "temperature", Delta: 0.5}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []string{"aa:bb:cc:dd:ee:ff", "AA:BB:CC:DD:EE:FF"} {
+		if got := Deadbands.List(addr); len(got) != 1 {
+			t.Errorf("%v: got %v, want the deadband", addr, got)
+		}
+	}
+	tests := []struct {
+		value float64
+		pass  bool
+	}{
+		{20, true},
+		{20.4, false},
+		{20.5, true},
+	}
+	for _, test := range tests {
+		if got := Deadbands.Pass(streamAggregates, "AA:BB:CC:DD:EE:FF", "temperature", test.value); got != test.pass {
+			t.Errorf("%v: got %v, want %v", test.value, got, test.pass)
+		}
+	}
+	if err := Deadbands.Set("AA:BB:CC:DD:EE:FF", nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(Deadbands.Deadbands) != 0 || len(Deadbands.states) != 0 {
+		t.Errorf("removing with another case left %v, %v", Deadbands.Deadbands, Deadbands.states)
+	}
+}
@@ -0,0 +1,117 @@
+//go:build linux
+
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/muka/go-bluetooth/bluez"
+	"github.com/muka/go-bluetooth/bluez/profile/gatt"
+)
+
+// descriptorObject is a descriptor of a connected device as BlueZ exposes
+// it, with the UUID of its characteristic.
+type descriptorObject struct {
+	path  dbus.ObjectPath
+	char  string
+	uuid  string
+	flags []string
+}
+
+func descriptorObjects(address string) ([]descriptorObject, error) {
+	path, err := devicePath(address)
+	if err != nil {
+		return nil, err
+	}
+	om, err := bluez.GetObjectManager()
+	if err != nil {
+		return nil, err
+	}
+	objects, err := om.GetManagedObjects()
+	if err != nil {
+		return nil, err
+	}
+	descriptors := []descriptorObject{}
+	for objectPath, ifaces := range objects {
+		if !strings.HasPrefix(string(objectPath), string(path) + "/") {
+			continue
+		}
+		props, ok := ifaces["org.bluez.GattDescriptor1"]
+		if !ok {
+			continue
+		}
+		d := descriptorObject{path: objectPath}
+		d.uuid, _ = props["UUID"].Value().(string)
+		d.flags, _ = props["Flags"].Value().([]string)
+		charPath, _ := props["Characteristic"].Value().(dbus.ObjectPath)
+		d.char, _ = objects[charPath]["org.bluez.GattCharacteristic1"]["UUID"].Value().(string)
+		descriptors = append(descriptors, d)
+	}
+	sort.Slice(descriptors, func (i int, j int) bool {
+		return descriptors[i].path < descriptors[j].path
+	})
+	return descriptors, nil
+}
+
+// deviceDescriptors returns the descriptors of every characteristic of a
+// connected device by UUID, reading the values of the ones describing it.
+func deviceDescriptors(address string) (map[string][]GATTDescriptor, error) {
+	objects, err := descriptorObjects(address)
+	if err != nil {
+		return nil, err
+	}
+	descriptors := map[string][]GATTDescriptor{}
+	for _, d := range objects {
+		descriptor := GATTDescriptor{UUID: d.uuid, Flags: d.flags}
+		if d.uuid == userDescriptionUUID || d.uuid == presentationFormatUUID {
+			descriptor.value, _ = readDescriptorObject(d.path)
+		}
+		descriptors[d.char] = append(descriptors[d.char], descriptor)
+	}
+	return descriptors, nil
+}
+
+func findDescriptor(address string, char string, uuid string) (dbus.ObjectPath, error) {
+	objects, err := descriptorObjects(address)
+	if err != nil {
+		return "", err
+	}
+	for _, d := range objects {
+		if d.char == char && d.uuid == uuid {
+			return d.path, nil
+		}
+	}
+	return "", errDescriptorNotFound
+}
+
+func readDescriptorObject(path dbus.ObjectPath) ([]byte, error) {
+	d, err := gatt.NewGattDescriptor1(path)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	return d.ReadValue(map[string]interface{}{})
+}
+
+func readDescriptor(address string, char string, uuid string) ([]byte, error) {
+	path, err := findDescriptor(address, char, uuid)
+	if err != nil {
+		return nil, err
+	}
+	return readDescriptorObject(path)
+}
+
+func writeDescriptor(address string, char string, uuid string, value []byte) error {
+	path, err := findDescriptor(address, char, uuid)
+	if err != nil {
+		return err
+	}
+	d, err := gatt.NewGattDescriptor1(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.WriteValue(value, map[string]interface{}{})
+}
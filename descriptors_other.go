@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+func deviceDescriptors(address string) (map[string][]GATTDescriptor, error) {
+	return nil, errUnsupported
+}
+
+func readDescriptor(address string, char string, uuid string) ([]byte, error) {
+	return nil, errUnsupported
+}
+
+func writeDescriptor(address string, char string, uuid string, value []byte) error {
+	return errUnsupported
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// DesiredState is what a device should look like, for configuration
+// management: fields left out are left alone. Subscriptions are the
+// characteristics notifications are logged for, every other one being
+// unsubscribed from, and need the device connected.
+type DesiredState struct {
+	Alias         *string
+	Tags          *[]string
+	Reconnect     *bool
+	Trusted       *bool
+	Connected     *bool
+	Subscriptions *[]string
+}
+
+// DesiredStateReport lists what converging took, Changed being false when
+// the device already was in the desired state.
+type DesiredStateReport struct {
+	Changed bool
+	Changes []string
+	Error   string `json:",omitempty"`
+}
+
+var errNotConnectedForSubscriptions = errors.New("subscriptions need the device connected, set Connected")
+
+// subscriptionKey normalizes a UUID so short and long forms compare equal.
+func subscriptionKey(uuid string) string {
+	id, err := ParseUUID(uuid)
+	if err != nil {
+		return strings.ToLower(uuid)
+	}
+	return id.String()
+}
+
+// Converge brings a device to the desired state, in order: metadata,
+// trust, connection, then subscriptions. With check it only reports what it
+// would change. It stops at the first step that fails, reporting what it
+// changed up to there.
+func Converge(address string, desired DesiredState, check bool) (DesiredStateReport, error) {
+	addr := strings.ToUpper(address)
+	report := DesiredStateReport{Changes: []string{}}
+	change := func (what string) {
+		report.Changed = true
+		report.Changes = append(report.Changes, what)
+	}
+
+	meta := Metadata.Get(addr)
+	patch := MetaPatch{Alias: desired.Alias, Tags: desired.Tags, Reconnect: desired.Reconnect}
+	patched := patch.Apply(meta)
+	if desired.Alias != nil && patched.Alias != meta.Alias {
+		change("alias")
+	}
+	if desired.Tags != nil && !slices.Equal(patched.Tags, meta.Tags) {
+		change("tags")
+	}
+	if desired.Reconnect != nil && (meta.Reconnect == nil || *meta.Reconnect != *desired.Reconnect) {
+		change("reconnect")
+	}
+	if report.Changed && !check {
+		_, err := Metadata.Update(addr, "", patch.Apply)
+		if err != nil {
+			return report, err
+		}
+		if patched.Alias != meta.Alias {
+			reportAlias(addr)
+		}
+	}
+
+	if desired.Trusted != nil {
+		security, err := linkSecurity(addr)
+		if err != nil {
+			return report, err
+		}
+		if security.Trusted != *desired.Trusted {
+			change("trusted")
+			if !check {
+				err = trustDevice(addr, *desired.Trusted)
+				if err != nil {
+					return report, err
+				}
+			}
+		}
+	}
+
+	connected := Adapter.IsConnected(addr)
+	if desired.Connected != nil && *desired.Connected != connected {
+		if *desired.Connected {
+			change("connect")
+		} else {
+			change("disconnect")
+		}
+		if !check {
+			if *desired.Connected {
+				if Adapter.detached.Load() {
+					return report, errors.New("adapter is not available")
+				}
+				Adapter.Connect(addr)
+				if !Adapter.IsConnected(addr) {
+					return report, errors.New("could not connect, see CONNECT_FAILED")
+				}
+			} else {
+				Adapter.Disconnect(addr)
+			}
+		}
+		connected = *desired.Connected
+	}
+
+	if desired.Subscriptions != nil {
+		if !connected {
+			return report, errNotConnectedForSubscriptions
+		}
+		current := map[string]string{}
+		for _, uuid := range Subscriptions.List(addr) {
+			current[subscriptionKey(uuid)] = uuid
+		}
+		wanted := map[string]bool{}
+		for _, uuid := range *desired.Subscriptions {
+			key := subscriptionKey(uuid)
+			wanted[key] = true
+			if _, ok := current[key]; ok {
+				continue
+			}
+			change("subscribe " + key)
+			if !check {
+				err := Subscriptions.Subscribe(addr, uuid)
+				if err != nil {
+					return report, err
+				}
+			}
+		}
+		keys := []string{}
+		for key := range current {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		for _, key := range keys {
+			if wanted[key] {
+				continue
+			}
+			change("unsubscribe " + key)
+			if !check {
+				err := Subscriptions.Unsubscribe(addr, current[key])
+				if err != nil {
+					return report, err
+				}
+			}
+		}
+	}
+	return report, nil
+}
+
+// DesiredStateHandler converges a device to the DesiredState body and
+// reports what changed, only what would with the check query parameter.
+// Sending the same body again changes nothing.
+func DesiredStateHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		desired := DesiredState{}
+		err := json.NewDecoder(r.Body).Decode(&desired)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		check := r.URL.Query().Get("check") == "true"
+		report, err := Converge(mux.Vars(r)["addr"], desired, check)
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			report.Error = err.Error()
+			status := http.StatusBadGateway
+			if errors.Is(err, errNotConnectedForSubscriptions) || errors.Is(err, errNotConnectedTo) {
+				status = http.StatusConflict
+			}
+			if errors.Is(err, errCharacteristicNotFound) {
+				status = http.StatusNotFound
+			}
+			w.WriteHeader(status)
+		}
+		json.NewEncoder(w).Encode(report)
+	}
+}
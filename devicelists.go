@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const deviceListsFile = "devicelists.json"
+
+var errNotAllowed = errors.New("not allowed by the device lists")
+
+// DevicePattern matches devices by address and advertised name, both glob
+// patterns (eg. "AA:BB:CC:*" or "Ruuvi*") ignoring case. Empty fields match
+// any device.
+type DevicePattern struct {
+	Address string `json:",omitempty"`
+	Name    string `json:",omitempty"`
+}
+
+// DeviceLists keep devices out, for kiosks and shared deployments: Block
+// drops devices at scan time, so they're never listed or sent, and with
+// AllowOnly only devices matching Allow are connected to.
+type DeviceLists struct {
+	Block     []DevicePattern `json:",omitempty"`
+	Allow     []DevicePattern `json:",omitempty"`
+	AllowOnly bool            `json:",omitempty"`
+}
+
+type SafeDeviceLists struct {
+	mu    sync.Mutex
+	Lists DeviceLists
+}
+
+var DeviceAccess = SafeDeviceLists{}
+
+func (dp DevicePattern) Matches(addr string, name string) bool {
+	address, _ := path.Match(strings.ToUpper(dp.Address), strings.ToUpper(addr))
+	named, _ := path.Match(strings.ToLower(dp.Name), strings.ToLower(name))
+	return (dp.Address == "" || address) && (dp.Name == "" || named)
+}
+
+func matchesAny(patterns []DevicePattern, addr string, name string) bool {
+	for _, dp := range patterns {
+		if dp.Matches(addr, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func ValidateDeviceLists(lists DeviceLists) error {
+	for _, dp := range append(slices.Clone(lists.Block), lists.Allow...) {
+		if dp.Address == "" && dp.Name == "" {
+			return errors.New("patterns need an Address, a Name or both")
+		}
+		if _, err := path.Match(dp.Address, ""); err != nil {
+			return errors.New(dp.Address + ": " + err.Error())
+		}
+		if _, err := path.Match(dp.Name, ""); err != nil {
+			return errors.New(dp.Name + ": " + err.Error())
+		}
+	}
+	if lists.AllowOnly && len(lists.Allow) == 0 {
+		return errors.New("AllowOnly needs devices to Allow")
+	}
+	return nil
+}
+
+func (sl *SafeDeviceLists) Load() error {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	err := LoadJSON(deviceListsFile, &sl.Lists)
+	if err != nil {
+		return err
+	}
+	return ValidateDeviceLists(sl.Lists)
+}
+
+func (sl *SafeDeviceLists) Get() DeviceLists {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	return sl.Lists
+}
+
+// Blocked tells whether a device is to be dropped.
+func (sl *SafeDeviceLists) Blocked(addr string, name string) bool {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	return matchesAny(sl.Lists.Block, addr, name)
+}
+
+// MayConnect tells whether a device may be connected to.
+func (sl *SafeDeviceLists) MayConnect(addr string, name string) bool {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	if matchesAny(sl.Lists.Block, addr, name) {
+		return false
+	}
+	return !sl.Lists.AllowOnly || matchesAny(sl.Lists.Allow, addr, name)
+}
+
+// Set replaces the lists, forgetting the listed devices they block with
+// DEVICE_GONE (address;name;blocked) and disconnecting from those they no
+// longer allow.
+func (sl *SafeDeviceLists) Set(lists DeviceLists) error {
+	err := ValidateDeviceLists(lists)
+	if err != nil {
+		return err
+	}
+	sl.mu.Lock()
+	err = SaveJSON(deviceListsFile, lists)
+	if err == nil {
+		sl.Lists = lists
+	}
+	sl.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	Devices.ForEach(func (addr string, device Device) {
+		if sl.Blocked(addr, device.Name) {
+			if forgotten, ok := Devices.Forget(addr); ok {
+				Devices.gone(forgotten, "blocked")
+			}
+		}
+	})
+	for _, addr := range Adapter.Addresses() {
+		if !sl.MayConnect(addr, advertisedName(addr)) {
+			Adapter.Disconnect(addr)
+		}
+	}
+	return nil
+}
+
+// advertisedName is the name a device advertises, or advertised when it was
+// last seen.
+func advertisedName(addr string) string {
+	if name := Devices.Device(addr).Name; name != "" {
+		return name
+	}
+	known, _ := Known.Get(addr)
+	return known.Name
+}
+
+func GetDeviceListsHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(DeviceAccess.Get())
+	}
+}
+
+func SetDeviceListsHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		lists := DeviceLists{}
+		err := json.NewDecoder(r.Body).Decode(&lists)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = DeviceAccess.Set(lists)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(200)
+	}
+}
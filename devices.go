@@ -0,0 +1,274 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tinygo.org/x/bluetooth"
+)
+
+const (
+	// deviceShards splits the device registry so advertisements for
+	// different devices don't wait on each other, or on clients listing
+	// them.
+	deviceShards      = 16
+	deviceExpiryCheck = 10 * time.Second
+)
+
+type deviceShard struct {
+	mu      sync.RWMutex
+	devices map[string]Device
+}
+
+// SafeDevices holds the scanned devices by upper case address, at most
+// Limit of them unless 0.
+type SafeDevices struct {
+	shards   [deviceShards]deviceShard
+	Limit    int
+	count    atomic.Int64
+	evicting atomic.Bool
+}
+
+func NewSafeDevices() *SafeDevices {
+	sd := &SafeDevices{}
+	for i := range sd.shards {
+		sd.shards[i].devices = map[string]Device{}
+	}
+	return sd
+}
+
+// shard picks the shard of an address with FNV-1a, which doesn't allocate.
+func (sd *SafeDevices) shard(addr string) *deviceShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(addr); i++ {
+		h ^= uint32(addr[i])
+		h *= 16777619
+	}
+	return &sd.shards[h % deviceShards]
+}
+
+// ForEach calls callback for every device. It works on a copy of each shard,
+// so callbacks may be slow or look devices up themselves without holding up
+// scanning.
+func (sd *SafeDevices) ForEach(callback func (key string, value Device)) {
+	for i := range sd.shards {
+		shard := &sd.shards[i]
+		shard.mu.RLock()
+		addrs := make([]string, 0, len(shard.devices))
+		devices := make([]Device, 0, len(shard.devices))
+		for addr, device := range shard.devices {
+			addrs = append(addrs, addr)
+			devices = append(devices, device)
+		}
+		shard.mu.RUnlock()
+		for j := range addrs {
+			callback(addrs[j], devices[j])
+		}
+	}
+}
+
+func (sd *SafeDevices) Device(addr string) Device {
+	shard := sd.shard(addr)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	return shard.devices[addr]
+}
+
+func (sd *SafeDevices) Exists(addr string) bool {
+	shard := sd.shard(addr)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	_, ok := shard.devices[addr]
+	return ok
+}
+
+func (sd *SafeDevices) Length() int {
+	n := 0
+	for i := range sd.shards {
+		sd.shards[i].mu.RLock()
+		n += len(sd.shards[i].devices)
+		sd.shards[i].mu.RUnlock()
+	}
+	return n
+}
+
+func (sd *SafeDevices) Add(device Device) {
+	addr := device.Address.String()
+	shard := sd.shard(addr)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if _, ok := shard.devices[addr]; !ok {
+		sd.count.Add(1)
+	}
+	shard.devices[addr] = device
+}
+
+// Observe records an advertisement, returning whether the device should be
+// reported: it's new, its name showed up, or its RSSI moved far enough.
+func (sd *SafeDevices) Observe(addr string, result bluetooth.ScanResult) bool {
+	shard := sd.shard(addr)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	name, manufacturer := result.LocalName(), result.ManufacturerData()
+	now := time.Now()
+	device, ok := shard.devices[addr]
+	if !ok {
+		address := result.Address
+		shard.devices[addr] = Device {
+			Name: name,
+			Address: &address,
+			RSSI: result.RSSI,
+			reportedRSSI: result.RSSI,
+			Manufacturer: parseManufacturer(manufacturer),
+			FirstSeen: now,
+			LastSeen: now,
+		}
+		sd.count.Add(1)
+		return true
+	}
+	device.LastSeen = now
+	report := false
+	if device.Name == "" && name != "" {
+		device.Name = name
+		report = true
+	}
+	device.RSSI = result.RSSI
+	if len(manufacturer) > 0 && !sameManufacturer(device.Manufacturer, manufacturer) {
+		device.Manufacturer = parseManufacturer(manufacturer)
+	}
+	moved := int(result.RSSI) - int(device.reportedRSSI)
+	if report || moved >= rssiReportStep || moved <= -rssiReportStep {
+		device.reportedRSSI = result.RSSI
+		report = true
+	}
+	shard.devices[addr] = device
+	return report
+}
+
+func (sd *SafeDevices) SetServices(addr string, services []string, data []ServiceData) {
+	shard := sd.shard(addr)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	device, ok := shard.devices[addr]
+	if !ok {
+		return
+	}
+	device.Services, device.ServiceData = services, data
+	shard.devices[addr] = device
+}
+
+// Forget drops a device, returning it if it was listed.
+func (sd *SafeDevices) Forget(addr string) (Device, bool) {
+	shard := sd.shard(addr)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	device, ok := shard.devices[addr]
+	if ok {
+		delete(shard.devices, addr)
+		sd.count.Add(-1)
+	}
+	return device, ok
+}
+
+// Expire forgets the devices last seen before a time, returning them.
+func (sd *SafeDevices) Expire(before time.Time) []Device {
+	gone := []Device{}
+	for i := range sd.shards {
+		shard := &sd.shards[i]
+		shard.mu.Lock()
+		for addr, device := range shard.devices {
+			if device.LastSeen.Before(before) {
+				delete(shard.devices, addr)
+				gone = append(gone, device)
+			}
+		}
+		shard.mu.Unlock()
+	}
+	sd.count.Add(int64(-len(gone)))
+	return gone
+}
+
+// Full tells whether there are more than Limit devices.
+func (sd *SafeDevices) Full() bool {
+	return sd.Limit > 0 && sd.count.Load() > int64(sd.Limit)
+}
+
+// Evict makes room once there are more than Limit devices, forgetting the
+// ones seen longest ago with DEVICE_GONE events. It frees a sixteenth of
+// the limit at once, so a stream of new devices doesn't sort the registry
+// for every one of them.
+func (sd *SafeDevices) Evict() {
+	if !sd.Full() || !sd.evicting.CompareAndSwap(false, true) {
+		return
+	}
+	sd.evict()
+}
+
+// StartEvict evicts in the background, unless an eviction is already
+// running, so the scan callback never starts more than one.
+func (sd *SafeDevices) StartEvict() {
+	if sd.Full() && sd.evicting.CompareAndSwap(false, true) {
+		go sd.evict()
+	}
+}
+
+// evict is Evict once sd.evicting was set.
+func (sd *SafeDevices) evict() {
+	defer sd.evicting.Store(false)
+	type seen struct {
+		addr string
+		at   time.Time
+	}
+	all := []seen{}
+	for i := range sd.shards {
+		shard := &sd.shards[i]
+		shard.mu.RLock()
+		for addr, device := range shard.devices {
+			all = append(all, seen{addr, device.LastSeen})
+		}
+		shard.mu.RUnlock()
+	}
+	excess := len(all) - sd.Limit + max(sd.Limit / 16, 1)
+	if excess <= 0 {
+		return
+	}
+	sort.Slice(all, func (i, j int) bool { return all[i].at.Before(all[j].at) })
+	gone := []Device{}
+	for _, s := range all[:min(excess, len(all))] {
+		shard := sd.shard(s.addr)
+		shard.mu.Lock()
+		// Devices heard from again since are kept.
+		if device, ok := shard.devices[s.addr]; ok && device.LastSeen.Equal(s.at) {
+			delete(shard.devices, s.addr)
+			gone = append(gone, device)
+		}
+		shard.mu.Unlock()
+	}
+	sd.count.Add(int64(-len(gone)))
+	for _, device := range gone {
+		sd.gone(device, "evicted")
+	}
+}
+
+// gone drops what else is known about a device that was forgotten, and
+// tells clients.
+func (sd *SafeDevices) gone(device Device, reason string) {
+	addr := device.Address.String()
+	Known.Record(device)
+	Presence.Forget(addr)
+	LogEvent("DEVICE_GONE", addr + ";" + device.Name + ";" + reason)
+}
+
+// RunExpiry forgets devices that went unseen for longer than after, raising
+// a DEVICE_GONE event (address;name;expired) for each so clients can drop
+// them too.
+func (sd *SafeDevices) RunExpiry(after time.Duration) {
+	for {
+		time.Sleep(min(deviceExpiryCheck, after))
+		for _, device := range sd.Expire(time.Now().Add(-after)) {
+			sd.gone(device, "expired")
+		}
+	}
+}
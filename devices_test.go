@@ -0,0 +1,80 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"tinygo.org/x/bluetooth"
+)
+
+func TestSafeDevicesEvict(t *testing.T) {
+	tests := []struct {
+		name     string
+		limit    int
+		devices  int
+		evicting bool
+		gone     int
+	}{
+		{"no limit", 0, 50, false, 0},
+		{"under the limit", 8, 7, false, 0},
+		{"at the limit", 8, 8, false, 0},
+		{"one over", 8, 9, false, 2},
+		{"far over", 8, 20, false, 13},
+		{"a sixteenth of the limit", 32, 33, false, 3},
+		{"already evicting", 8, 20, true, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func (t *testing.T) {
+			events := make(chan []string)
+			go func () {
+				gone := []string{}
+				for {
+					select {
+					case l := <-Logs:
+						if l.Level == "DEVICE_GONE" {
+							gone = append(gone, l.Msg)
+						}
+					case <-time.After(50 * time.Millisecond):
+						events <- gone
+						return
+					}
+				}
+			} ()
+			sd := NewSafeDevices()
+			sd.Limit = test.limit
+			now := time.Now()
+			// Device i was last seen i minutes ago.
+			for i := 0; i < test.devices; i++ {
+				address := bluetooth.Address{}
+				address.MAC = bluetooth.MAC{byte(i), 0x00, 0x00, 0xee, 0xee, 0xee}
+				sd.Add(Device{Address: &address, Name: "evict", LastSeen: now.Add(-time.Duration(i) * time.Minute)})
+			}
+			sd.evicting.Store(test.evicting)
+			sd.Evict()
+			gone := <-events
+			if sd.Length() != test.devices - test.gone || int(sd.count.Load()) != sd.Length() {
+				t.Fatalf("%d devices left, counted %d, want %d", sd.Length(), sd.count.Load(), test.devices - test.gone)
+			}
+			if len(gone) != test.gone {
+				t.Fatalf("%d DEVICE_GONE events, want %d", len(gone), test.gone)
+			}
+			// The oldest ones go.
+			for i := test.devices - test.gone; i < test.devices; i++ {
+				address := bluetooth.Address{}
+				address.MAC = bluetooth.MAC{byte(i), 0x00, 0x00, 0xee, 0xee, 0xee}
+				addr := address.String()
+				if sd.Exists(addr) {
+					t.Errorf("%v was kept", addr)
+				}
+				if !slices.Contains(gone, addr + ";evict;evicted") {
+					t.Errorf("no DEVICE_GONE for %v in %v", addr, strings.Join(gone, ", "))
+				}
+			}
+			if sd.evicting.Load() != test.evicting {
+				t.Errorf("evicting left at %v", sd.evicting.Load())
+			}
+		})
+	}
+}
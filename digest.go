@@ -0,0 +1,170 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	digestMinInterval     = 5 * time.Second
+	digestDefaultInterval = 30 * time.Second
+	digestListed          = 3
+)
+
+// Digest accumulates significant changes between two summaries. Devices
+// are remembered across summaries so replayed DEVICE events are only
+// announced once.
+type Digest struct {
+	include  map[string]bool
+	seen     map[string]bool
+	devices  []string
+	people   []string
+	activity []string
+	adapter  []string
+	errors   []string
+}
+
+func NewDigest(include []string) *Digest {
+	d := &Digest{include: map[string]bool{}, seen: map[string]bool{}}
+	for _, category := range include {
+		d.include[strings.TrimSpace(category)] = true
+	}
+	return d
+}
+
+func (d *Digest) wants(category string) bool {
+	return len(d.include) == 0 || d.include[category]
+}
+
+func appendDistinct(list []string, s string) []string {
+	for _, v := range list {
+		if v == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
+func (d *Digest) Add(l Log) {
+	switch {
+	case l.Level == "DEVICE" && d.wants("devices"):
+		addr, name, _ := strings.Cut(l.Msg, ";")
+		name, _, _ = strings.Cut(name, ";")
+		// Devices without a name are only worth a mention once they have one.
+		if d.seen[addr] || name == "" {
+			return
+		}
+		d.seen[addr] = true
+		d.devices = append(d.devices, name)
+	case l.Level == "PERSON" && d.wants("people"):
+		fields := strings.Split(l.Msg, ";")
+		if len(fields) < 2 {
+			return
+		}
+		if fields[1] == "home" {
+			d.people = append(d.people, fields[0] + " came home")
+		} else {
+			d.people = append(d.people, fields[0] + " left")
+		}
+	case l.Level == "ERROR" && d.wants("errors"):
+		d.errors = append(d.errors, l.Msg)
+	case strings.HasPrefix(l.Level, "ADAPTER_") && d.wants("adapter"):
+		d.adapter = appendDistinct(d.adapter, l.Msg)
+	case (l.Level == "INFO" || l.Level == "CONNECTED" || l.Level == "DISCONNECTED") && d.wants("activity"):
+		d.activity = appendDistinct(d.activity, strings.TrimSuffix(l.Msg, "."))
+	}
+}
+
+func listed(items []string) string {
+	if len(items) <= digestListed {
+		return strings.Join(items, ", ")
+	}
+	return strings.Join(items[:digestListed], ", ") + " and " + strconv.Itoa(len(items) - digestListed) + " more"
+}
+
+func plural(n int, word string) string {
+	if n == 1 {
+		return "1 " + word
+	}
+	return strconv.Itoa(n) + " " + word + "s"
+}
+
+// Summary returns one readable sentence per category that changed and resets
+// the digest, or an empty string when nothing happened.
+func (d *Digest) Summary() string {
+	parts := []string{}
+	if len(d.devices) > 0 {
+		parts = append(parts, plural(len(d.devices), "new device") + ": " + listed(d.devices) + ".")
+	}
+	if len(d.people) > 0 {
+		parts = append(parts, listed(d.people) + ".")
+	}
+	for _, msg := range d.adapter {
+		parts = append(parts, msg)
+	}
+	if len(d.activity) > 0 {
+		parts = append(parts, listed(d.activity) + ".")
+	}
+	if len(d.errors) > 0 {
+		parts = append(parts, plural(len(d.errors), "error") + ", latest: " + d.errors[len(d.errors) - 1])
+	}
+	d.devices, d.people, d.activity, d.adapter, d.errors = nil, nil, nil, nil, nil
+	return strings.Join(parts, " ")
+}
+
+// DigestHandler streams at most one DIGEST event per interval (in seconds)
+// summarizing what changed. include limits it to some of devices, people,
+// activity, adapter and errors.
+func DigestHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		interval := digestDefaultInterval
+		if s := r.URL.Query().Get("interval"); s != "" {
+			seconds, err := strconv.Atoi(s)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			interval = max(time.Duration(seconds) * time.Second, digestMinInterval)
+		}
+		include := []string{}
+		if s := r.URL.Query().Get("include"); s != "" {
+			include = strings.Split(s, ",")
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		digest := NewDigest(include)
+		Devices.ForEach(func (addr string, _ Device) {
+			digest.seen[addr] = true
+		})
+		id, logs := Sinks.Subscribe("digest", 100)
+		defer Sinks.Unregister(id)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		for {
+			select {
+			case l := <-logs:
+				digest.Add(l)
+			case <-ticker.C:
+				summary := digest.Summary()
+				if summary == "" {
+					continue
+				}
+				_, err := w.Write(LogToSSE(&Log{Level: "DIGEST", Msg: summary}))
+				if err != nil {
+					return
+				}
+				if f, ok := w.(http.Flusher); ok {
+					f.Flush()
+				}
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
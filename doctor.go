@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+)
+
+// Check is a single doctor check. Fix is only printed when the check fails.
+type Check struct {
+	Name string
+	Run  func () error
+	Fix  string
+}
+
+type CheckResult struct {
+	Name  string
+	OK    bool
+	Error string `json:",omitempty"`
+	Fix   string `json:",omitempty"`
+}
+
+// DoctorReport is what bluboi doctor -json prints.
+type DoctorReport struct {
+	Passed       bool
+	Checks       []CheckResult
+	Requirements []Requirement
+}
+
+// Doctor runs every check, printing what failed and how to fix it, or a
+// DoctorReport with -json, and returns the process exit code.
+func Doctor(args []string) int {
+	flags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print a JSON report instead")
+	flags.Parse(args)
+	checks := append(platformChecks(), Check{
+		Name: "HTTP port " + HTTPAddr + " is free",
+		Run: func () error {
+			l, err := net.Listen("tcp", HTTPAddr)
+			if err != nil {
+				return err
+			}
+			return l.Close()
+		},
+		Fix: "Stop whatever is listening on " + HTTPAddr + " (`ss -ltnp`), or another bluboi instance.",
+	})
+	report := DoctorReport{Passed: true, Checks: []CheckResult{}, Requirements: Requirements}
+	for _, c := range checks {
+		result := CheckResult{Name: c.Name, OK: true}
+		if err := c.Run(); err != nil {
+			result = CheckResult{Name: c.Name, Error: err.Error(), Fix: c.Fix}
+			report.Passed = false
+		}
+		report.Checks = append(report.Checks, result)
+	}
+	code := exitOK
+	if !report.Passed {
+		code = exitFailed
+	}
+	if *asJSON {
+		printJSON(report)
+		return code
+	}
+	failed := 0
+	for _, c := range report.Checks {
+		if c.OK {
+			fmt.Printf("[OK]   %v\n", c.Name)
+			continue
+		}
+		failed++
+		fmt.Printf("[FAIL] %v - %v\n", c.Name, c.Error)
+		fmt.Printf("       %v\n", c.Fix)
+	}
+	fmt.Printf("\nWhat each backend needs:\n")
+	for _, r := range Requirements {
+		fmt.Printf("  %-34v %v\n", r.Backend, r.Needs)
+	}
+	if failed > 0 {
+		fmt.Printf("\n%d of %d checks failed.\n", failed, len(checks))
+		return code
+	}
+	fmt.Printf("\nAll %d checks passed.\n", len(checks))
+	return code
+}
@@ -0,0 +1,137 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/muka/go-bluetooth/bluez/profile/adapter"
+)
+
+const capNetAdmin = 12
+
+func platformChecks() []Check {
+	return []Check{
+		{
+			Name: "Allowed to control Bluetooth",
+			Run: checkPermissions,
+			Fix: "Run as a member of the bluetooth group (`sudo usermod -aG bluetooth $USER`) or grant the binary CAP_NET_ADMIN (`sudo setcap cap_net_admin+ep ./bluboi`).",
+		},
+		{
+			Name: "D-Bus system bus is reachable",
+			Run: func () error {
+				_, err := dbus.SystemBus()
+				return err
+			},
+			Fix: "Make sure dbus is running (`systemctl status dbus`) and DBUS_SYSTEM_BUS_ADDRESS isn't pointing somewhere else.",
+		},
+		{
+			Name: "BlueZ is running",
+			Run: checkBlueZ,
+			Fix: "Install and start BlueZ (`sudo systemctl enable --now bluetooth`).",
+		},
+		{
+			Name: "Bluetooth radio is not blocked",
+			Run: checkRfkill,
+			Fix: "Unblock it with `sudo rfkill unblock bluetooth`. A hard block is a physical switch or BIOS setting.",
+		},
+		{
+			Name: "Adapter " + adapter.GetDefaultAdapterID() + " is present",
+			Run: func () error {
+				exists, err := adapter.AdapterExists(adapter.GetDefaultAdapterID())
+				if err != nil {
+					return err
+				}
+				if !exists {
+					return errors.New("not found")
+				}
+				return nil
+			},
+			Fix: "Plug in a Bluetooth adapter and check `hciconfig -a` / `bluetoothctl list`.",
+		},
+	}
+}
+
+func checkPermissions() error {
+	if os.Geteuid() == 0 {
+		return nil
+	}
+	if hasCapability(capNetAdmin) {
+		return nil
+	}
+	u, err := user.Current()
+	if err != nil {
+		return err
+	}
+	groups, err := u.GroupIds()
+	if err != nil {
+		return err
+	}
+	g, err := user.LookupGroup("bluetooth")
+	if err != nil {
+		return errors.New("no bluetooth group and no CAP_NET_ADMIN")
+	}
+	for _, id := range groups {
+		if id == g.Gid {
+			return nil
+		}
+	}
+	return errors.New("not in the bluetooth group and no CAP_NET_ADMIN")
+}
+
+// hasCapability checks the effective capability set of the current process.
+func hasCapability(capability uint) bool {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if value, ok := strings.CutPrefix(s.Text(), "CapEff:"); ok {
+			caps, err := strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+			return err == nil && caps & (1 << capability) != 0
+		}
+	}
+	return false
+}
+
+func checkBlueZ() error {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return err
+	}
+	owned := false
+	err = conn.BusObject().Call("org.freedesktop.DBus.NameHasOwner", 0, "org.bluez").Store(&owned)
+	if err != nil {
+		return err
+	}
+	if !owned {
+		return errors.New("org.bluez is not on the system bus")
+	}
+	return nil
+}
+
+func checkRfkill() error {
+	devices, _ := filepath.Glob("/sys/class/rfkill/rfkill*")
+	for _, dev := range devices {
+		typ, err := os.ReadFile(filepath.Join(dev, "type"))
+		if err != nil || strings.TrimSpace(string(typ)) != "bluetooth" {
+			continue
+		}
+		for _, block := range []string{"hard", "soft"} {
+			state, err := os.ReadFile(filepath.Join(dev, block))
+			if err == nil && strings.TrimSpace(string(state)) == "1" {
+				return errors.New(filepath.Base(dev) + " is " + block + " blocked")
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package main
+
+func platformChecks() []Check {
+	return []Check{}
+}
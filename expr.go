@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Expr is a compiled arithmetic expression over named variables.
+type Expr func (vars map[string]float64) float64
+
+type exprFunc struct {
+	arity int
+	call  func (args []float64) float64
+}
+
+// exprFuncs are the functions expressions can call. An arity of -1 takes one
+// or more arguments.
+var exprFuncs = map[string]exprFunc{
+	"abs": {1, func (a []float64) float64 { return math.Abs(a[0]) }},
+	"sqrt": {1, func (a []float64) float64 { return math.Sqrt(a[0]) }},
+	"exp": {1, func (a []float64) float64 { return math.Exp(a[0]) }},
+	"ln": {1, func (a []float64) float64 { return math.Log(a[0]) }},
+	"log10": {1, func (a []float64) float64 { return math.Log10(a[0]) }},
+	"round": {1, func (a []float64) float64 { return math.Round(a[0]) }},
+	"pow": {2, func (a []float64) float64 { return math.Pow(a[0], a[1]) }},
+	"clamp": {3, func (a []float64) float64 { return math.Min(math.Max(a[0], a[1]), a[2]) }},
+	"min": {-1, func (a []float64) float64 { return fold(math.Min, a) }},
+	"max": {-1, func (a []float64) float64 { return fold(math.Max, a) }},
+}
+
+func exprFuncNames() string {
+	names := []string{}
+	for name := range exprFuncs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func fold(f func (float64, float64) float64, a []float64) float64 {
+	v := a[0]
+	for _, x := range a[1:] {
+		v = f(v, x)
+	}
+	return v
+}
+
+type exprParser struct {
+	src  string
+	pos  int
+	vars map[string]bool
+}
+
+// ParseExpr compiles an expression made of numbers, variables, + - * / ^,
+// parentheses and calls to exprFuncs, returning the variables it uses.
+func ParseExpr(src string) (Expr, []string, error) {
+	p := &exprParser{src: src, vars: map[string]bool{}}
+	e, err := p.sum()
+	if err != nil {
+		return nil, nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.src) {
+		return nil, nil, p.errorf("unexpected " + strconv.Quote(p.src[p.pos:p.pos + 1]))
+	}
+	vars := []string{}
+	for v := range p.vars {
+		vars = append(vars, v)
+	}
+	return e, vars, nil
+}
+
+func (p *exprParser) errorf(msg string) error {
+	return errors.New("at column " + strconv.Itoa(p.pos + 1) + ": " + msg)
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.src) && p.src[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+// accept consumes c if it comes next.
+func (p *exprParser) accept(c byte) bool {
+	p.skipSpace()
+	if p.pos < len(p.src) && p.src[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// op consumes one of ops if it comes next, returning 0 otherwise.
+func (p *exprParser) op(ops string) byte {
+	p.skipSpace()
+	if p.pos < len(p.src) && strings.IndexByte(ops, p.src[p.pos]) >= 0 {
+		p.pos++
+		return p.src[p.pos - 1]
+	}
+	return 0
+}
+
+func binaryExpr(op byte, l Expr, r Expr) Expr {
+	switch op {
+	case '+':
+		return func (v map[string]float64) float64 { return l(v) + r(v) }
+	case '-':
+		return func (v map[string]float64) float64 { return l(v) - r(v) }
+	case '*':
+		return func (v map[string]float64) float64 { return l(v) * r(v) }
+	}
+	return func (v map[string]float64) float64 { return l(v) / r(v) }
+}
+
+func (p *exprParser) sum() (Expr, error) {
+	left, err := p.product()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.op("+-"); op != 0; op = p.op("+-") {
+		right, err := p.product()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr(op, left, right)
+	}
+	return left, nil
+}
+
+func (p *exprParser) product() (Expr, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.op("*/"); op != 0; op = p.op("*/") {
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr(op, left, right)
+	}
+	return left, nil
+}
+
+func (p *exprParser) unary() (Expr, error) {
+	if p.accept('-') {
+		e, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func (v map[string]float64) float64 { return -e(v) }, nil
+	}
+	base, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	// ^ binds tighter than unary minus on its left and is right associative.
+	if p.accept('^') {
+		exponent, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func (v map[string]float64) float64 { return math.Pow(base(v), exponent(v)) }, nil
+	}
+	return base, nil
+}
+
+func (p *exprParser) primary() (Expr, error) {
+	p.skipSpace()
+	if p.accept('(') {
+		e, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(')') {
+			return nil, p.errorf("expected )")
+		}
+		return e, nil
+	}
+	start := p.pos
+	if p.pos < len(p.src) && (isDigit(p.src[p.pos]) || p.src[p.pos] == '.') {
+		for p.pos < len(p.src) && (isDigit(p.src[p.pos]) || p.src[p.pos] == '.') {
+			p.pos++
+		}
+		// An exponent, as in 1e-3.
+		if p.pos + 1 < len(p.src) && (p.src[p.pos] == 'e' || p.src[p.pos] == 'E') {
+			p.pos++
+			if p.src[p.pos] == '+' || p.src[p.pos] == '-' {
+				p.pos++
+			}
+			for p.pos < len(p.src) && isDigit(p.src[p.pos]) {
+				p.pos++
+			}
+		}
+		text := p.src[start:p.pos]
+		n, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			p.pos = start
+			return nil, p.errorf("invalid number " + text)
+		}
+		return func (map[string]float64) float64 { return n }, nil
+	}
+	for p.pos < len(p.src) && isIdent(rune(p.src[p.pos])) {
+		p.pos++
+	}
+	name := p.src[start:p.pos]
+	if name == "" || isDigit(name[0]) {
+		if p.pos >= len(p.src) {
+			return nil, p.errorf("unexpected end of expression")
+		}
+		return nil, p.errorf("unexpected " + strconv.Quote(p.src[p.pos:p.pos + 1]))
+	}
+	if !p.accept('(') {
+		p.vars[name] = true
+		return func (v map[string]float64) float64 { return v[name] }, nil
+	}
+	f, ok := exprFuncs[name]
+	if !ok {
+		return nil, p.errorf("unknown function " + name)
+	}
+	args := []Expr{}
+	for !p.accept(')') {
+		if len(args) > 0 && !p.accept(',') {
+			return nil, p.errorf("expected , or )")
+		}
+		arg, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	if f.arity == -1 && len(args) == 0 {
+		return nil, p.errorf(name + " needs at least one argument")
+	}
+	if f.arity != -1 && len(args) != f.arity {
+		return nil, p.errorf(name + " takes " + plural(f.arity, "argument"))
+	}
+	return func (v map[string]float64) float64 {
+		values := make([]float64, len(args))
+		for i, arg := range args {
+			values[i] = arg(v)
+		}
+		return f.call(values)
+	}, nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdent(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
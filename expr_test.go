@@ -0,0 +1,72 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseExpr(t *testing.T) {
+	vars := map[string]float64{"temperature": 20, "a": 1, "b": 5, "x": 150}
+	tests := []struct {
+		src  string
+		want float64
+		vars []string
+	}{
+		{"1 + 2 * 3", 7, nil},
+		{"(1 + 2) * 3", 9, nil},
+		{"10 - 4 - 3", 3, nil},
+		{"8 / 4 / 2", 1, nil},
+		{"-2^2", -4, nil},
+		{"2^3^2", 512, nil},
+		{"1e-3 * 1000", 1, nil},
+		{"temperature * 1.8 + 32", 68, []string{"temperature"}},
+		{"max(a, b, 3)", 5, []string{"a", "b"}},
+		{"min(b)", 5, []string{"b"}},
+		{"clamp(x, 0, 100)", 100, []string{"x"}},
+		{"round(sqrt(b * b))", 5, []string{"b"}},
+		{"missing + 1", 1, []string{"missing"}},
+	}
+	for _, test := range tests {
+		e, used, err := ParseExpr(test.src)
+		if err != nil {
+			t.Errorf("%q: %v", test.src, err)
+			continue
+		}
+		if got := e(vars); got != test.want {
+			t.Errorf("%q = %v, want %v", test.src, got, test.want)
+		}
+		slices.Sort(used)
+		if !slices.Equal(used, test.vars) {
+			t.Errorf("%q uses %v, want %v", test.src, used, test.vars)
+		}
+	}
+}
+
+func TestParseExprErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"", "at column 1: unexpected end of expression"},
+		{"1 +", "at column 4: unexpected end of expression"},
+		{"1 2", "at column 3: unexpected \"2\""},
+		{"(1 + 2", "expected )"},
+		{"foo(1)", "unknown function foo"},
+		{"pow(1)", "pow takes 2 arguments"},
+		{"max()", "max needs at least one argument"},
+		{"max(1 2)", "expected , or )"},
+		{"1..2", "invalid number 1..2"},
+		{"a * $", "unexpected \"$\""},
+	}
+	for _, test := range tests {
+		_, _, err := ParseExpr(test.src)
+		if err == nil {
+			t.Errorf("%q: want an error", test.src)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%q: got %q, want %q", test.src, err, test.want)
+		}
+	}
+}
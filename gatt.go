@@ -0,0 +1,451 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"tinygo.org/x/bluetooth"
+)
+
+// GATTDescriptor is a descriptor of a characteristic. Flags are the BlueZ
+// ones, like the characteristic's properties.
+type GATTDescriptor struct {
+	UUID  string
+	Flags []string `json:",omitempty"`
+	value []byte
+}
+
+// PresentationFormat is a characteristic presentation format descriptor:
+// values are Format (eg. uint16 or utf8s) times 10^Exponent, in the unit
+// with the 16-bit UUID Unit.
+type PresentationFormat struct {
+	Format   string
+	Exponent int
+	Unit     string
+}
+
+// GATTCharacteristic is a discovered characteristic. Description and Format
+// come from its user description and presentation format descriptors.
+type GATTCharacteristic struct {
+	UUID        string
+	Properties  []string            `json:",omitempty"`
+	Description string              `json:",omitempty"`
+	Format      *PresentationFormat `json:",omitempty"`
+	Descriptors []GATTDescriptor    `json:",omitempty"`
+}
+
+type GATTService struct {
+	UUID            string
+	Characteristics []GATTCharacteristic
+}
+
+// CharacteristicValue is a characteristic's value in one of the encodings
+// hex, base64 or utf8. Writes with Verify read the value back, comparing
+// only the bits set in the hex Mask when there is one.
+type CharacteristicValue struct {
+	UUID     string
+	Encoding string
+	Value    string
+	Verify   bool   `json:",omitempty"`
+	Mask     string `json:",omitempty"`
+}
+
+const maxAttributeLength = 512
+
+var (
+	errNotConnectedTo = errors.New("not connected to that device")
+	errUnknownEncoding = errors.New("encoding must be hex, base64 or utf8")
+	errDescriptorNotFound = errors.New("could not find descriptor")
+	errNotVerified = errors.New("the value read back doesn't match the one written")
+	cccdUUID = bluetooth.New16BitUUID(0x2902).String()
+	userDescriptionUUID = bluetooth.New16BitUUID(0x2901).String()
+	presentationFormatUUID = bluetooth.New16BitUUID(0x2904).String()
+	// presentationFormats names the format codes of the Bluetooth assigned
+	// numbers, starting at 1.
+	presentationFormats = []string{
+		"boolean", "2bit", "nibble", "uint8", "uint12", "uint16", "uint24", "uint32", "uint48", "uint64", "uint128",
+		"sint8", "sint12", "sint16", "sint24", "sint32", "sint48", "sint64", "sint128",
+		"float32", "float64", "SFLOAT", "FLOAT", "duint16", "utf8s", "utf16s", "struct",
+	}
+)
+
+func ParsePresentationFormat(value []byte) *PresentationFormat {
+	if len(value) < 4 {
+		return nil
+	}
+	format := "0x" + hex.EncodeToString(value[:1])
+	if value[0] >= 1 && int(value[0]) <= len(presentationFormats) {
+		format = presentationFormats[value[0] - 1]
+	}
+	return &PresentationFormat{format, int(int8(value[1])), hex.EncodeToString([]byte{value[3], value[2]})}
+}
+
+// describe fills in what a characteristic's descriptors say about it.
+func (c *GATTCharacteristic) describe() {
+	for _, d := range c.Descriptors {
+		switch d.UUID {
+		case userDescriptionUUID:
+			c.Description = string(d.value)
+		case presentationFormatUUID:
+			c.Format = ParsePresentationFormat(d.value)
+		}
+	}
+}
+
+// DecodeValue is the inverse of EncodeValue.
+func DecodeValue(encoding string, value string) ([]byte, error) {
+	switch encoding {
+	case "", "hex":
+		return hex.DecodeString(value)
+	case "base64":
+		return base64.StdEncoding.DecodeString(value)
+	case "utf8":
+		return []byte(value), nil
+	}
+	return nil, errUnknownEncoding
+}
+
+func EncodeValue(encoding string, value []byte) (string, error) {
+	switch encoding {
+	case "", "hex":
+		return hex.EncodeToString(value), nil
+	case "base64":
+		return base64.StdEncoding.EncodeToString(value), nil
+	case "utf8":
+		if !utf8.Valid(value) {
+			return "", errors.New("value is not valid UTF-8, read it as hex or base64")
+		}
+		return string(value), nil
+	}
+	return "", errUnknownEncoding
+}
+
+// Services discovers every service, characteristic and descriptor of a
+// connected device. Properties and descriptors come from BlueZ, and are left
+// out where they aren't available.
+func (sa *SafeAdapter) Services(address string) ([]GATTService, error) {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	device, err := sa.connection(address)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	services, err := device.DiscoverServices(nil)
+	if err != nil {
+		Latencies.Observe("discover", time.Since(start), err)
+		return nil, err
+	}
+	address = strings.ToUpper(address)
+	flags, _ := deviceCharacteristicFlags(address)
+	descriptors, _ := deviceDescriptors(address)
+	result := []GATTService{}
+	defer func () {
+		Latencies.Observe("discover", time.Since(start), err)
+	} ()
+	for i := range services {
+		var chars []bluetooth.DeviceCharacteristic
+		chars, err = services[i].DiscoverCharacteristics(nil)
+		if err != nil {
+			return nil, err
+		}
+		service := GATTService{UUID: services[i].UUID().String(), Characteristics: []GATTCharacteristic{}}
+		for j := range chars {
+			uuid := chars[j].UUID().String()
+			char := GATTCharacteristic{UUID: uuid, Properties: flags[uuid], Descriptors: descriptors[uuid]}
+			char.describe()
+			service.Characteristics = append(service.Characteristics, char)
+		}
+		result = append(result, service)
+	}
+	return result, nil
+}
+
+// ReadCharacteristic reads a characteristic of a connected device.
+func (sa *SafeAdapter) ReadCharacteristic(address string, uuid string) ([]byte, error) {
+	char, err := sa.Characteristic(address, uuid)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxAttributeLength)
+	start := time.Now()
+	n, err := char.Read(buf)
+	Latencies.Observe("read", time.Since(start), err)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// WriteCharacteristic writes to a characteristic of a connected device,
+// unless the link isn't secure enough for it.
+func (sa *SafeAdapter) WriteCharacteristic(address string, uuid string, value []byte) error {
+	char, err := sa.Characteristic(address, uuid)
+	if err != nil {
+		return err
+	}
+	err = CheckWriteSecurity(address, uuid)
+	if err != nil {
+		return err
+	}
+	if len(value) > maxAttributeLength {
+		return errors.New("values are at most " + strconv.Itoa(maxAttributeLength) + " bytes")
+	}
+	start := time.Now()
+	_, err = char.WriteWithoutResponse(value)
+	Latencies.Observe("write", time.Since(start), err)
+	return err
+}
+
+// VerifyCharacteristic reads a characteristic back after a write and checks
+// it holds value, in the bits set in mask unless it's nil.
+func (sa *SafeAdapter) VerifyCharacteristic(address string, uuid string, value []byte, mask []byte) error {
+	readBack, err := sa.ReadCharacteristic(address, uuid)
+	if err != nil {
+		return err
+	}
+	if len(readBack) != len(value) {
+		return fmt.Errorf("%w, read back %s", errNotVerified, hex.EncodeToString(readBack))
+	}
+	for i := range value {
+		m := byte(0xff)
+		if mask != nil {
+			m = mask[i]
+		}
+		if readBack[i] & m != value[i] & m {
+			return fmt.Errorf("%w, read back %s", errNotVerified, hex.EncodeToString(readBack))
+		}
+	}
+	return nil
+}
+
+// ReadDescriptor reads a descriptor of a characteristic of a connected
+// device.
+func (sa *SafeAdapter) ReadDescriptor(address string, char string, uuid string) ([]byte, error) {
+	if !sa.IsConnected(address) {
+		return nil, errNotConnectedTo
+	}
+	charID, err := ParseUUID(char)
+	if err != nil {
+		return nil, err
+	}
+	id, err := ParseUUID(uuid)
+	if err != nil {
+		return nil, err
+	}
+	return readDescriptor(strings.ToUpper(address), charID.String(), id.String())
+}
+
+// WriteDescriptor writes a descriptor of a characteristic of a connected
+// device. BlueZ doesn't let the CCCD be written, so notifications and
+// indications are subscribed to instead, as with the subscribe endpoint.
+func (sa *SafeAdapter) WriteDescriptor(address string, char string, uuid string, value []byte) error {
+	if !sa.IsConnected(address) {
+		return errNotConnectedTo
+	}
+	charID, err := ParseUUID(char)
+	if err != nil {
+		return err
+	}
+	id, err := ParseUUID(uuid)
+	if err != nil {
+		return err
+	}
+	if len(value) > maxAttributeLength {
+		return errors.New("values are at most " + strconv.Itoa(maxAttributeLength) + " bytes")
+	}
+	if id.String() == cccdUUID {
+		if len(value) != 2 {
+			return errors.New("CCCD values are 2 bytes, eg. 0100 for notifications")
+		}
+		if value[0] & 3 != 0 {
+			return Subscriptions.Subscribe(address, char)
+		}
+		err = Subscriptions.Unsubscribe(address, char)
+		if errors.Is(err, errNotSubscribed) {
+			return nil
+		}
+		return err
+	}
+	return writeDescriptor(strings.ToUpper(address), charID.String(), id.String(), value)
+}
+
+func ListServicesHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		services, err := Adapter.Services(mux.Vars(r)["addr"])
+		if errors.Is(err, errNotConnectedTo) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(services)
+	}
+}
+
+// ReadCharacteristicHandler reads a characteristic, encoded as hex unless
+// encoding asks for base64 or utf8.
+func ReadCharacteristicHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		encoding := r.URL.Query().Get("encoding")
+		if _, err := EncodeValue(encoding, nil); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		value, err := Adapter.ReadCharacteristic(vars["addr"], vars["uuid"])
+		if errors.Is(err, errNotConnectedTo) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if errors.Is(err, errCharacteristicNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		encoded, err := EncodeValue(encoding, value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if encoding == "" {
+			encoding = "hex"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(CharacteristicValue{UUID: vars["uuid"], Encoding: encoding, Value: encoded})
+	}
+}
+
+// decodeWrite returns the value to write and the mask to verify it with.
+func (cv CharacteristicValue) decodeWrite() ([]byte, []byte, error) {
+	value, err := DecodeValue(cv.Encoding, cv.Value)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cv.Mask == "" {
+		return value, nil, nil
+	}
+	mask, err := hex.DecodeString(cv.Mask)
+	if err != nil || len(mask) != len(value) {
+		return nil, nil, errors.New("mask must be hex, as long as the value")
+	}
+	return value, mask, nil
+}
+
+// WriteCharacteristicHandler writes a CharacteristicValue, hex unless its
+// Encoding says base64 or utf8, and verifies it when asked to.
+func WriteCharacteristicHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		req := CharacteristicValue{}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		value, mask, err := req.decodeWrite()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = Adapter.WriteCharacteristic(vars["addr"], vars["uuid"], value)
+		if err == nil && req.Verify {
+			err = Adapter.VerifyCharacteristic(vars["addr"], vars["uuid"], value, mask)
+		}
+		if errors.Is(err, errNotConnectedTo) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if errors.Is(err, errCharacteristicNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(200)
+	}
+}
+
+// ReadDescriptorHandler reads a descriptor, encoded like characteristic
+// values.
+func ReadDescriptorHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		encoding := r.URL.Query().Get("encoding")
+		if _, err := EncodeValue(encoding, nil); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		value, err := Adapter.ReadDescriptor(vars["addr"], vars["uuid"], vars["desc"])
+		if errors.Is(err, errNotConnectedTo) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if errors.Is(err, errDescriptorNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		encoded, err := EncodeValue(encoding, value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if encoding == "" {
+			encoding = "hex"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(CharacteristicValue{UUID: vars["desc"], Encoding: encoding, Value: encoded})
+	}
+}
+
+func WriteDescriptorHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		req := CharacteristicValue{}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		value, err := DecodeValue(req.Encoding, req.Value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = Adapter.WriteDescriptor(vars["addr"], vars["uuid"], vars["desc"], value)
+		if errors.Is(err, errNotConnectedTo) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if errors.Is(err, errDescriptorNotFound) || errors.Is(err, errCharacteristicNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(200)
+	}
+}
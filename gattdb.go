@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const gattSnapshotsFile = "gatt_snapshots.json"
+
+// GATTSnapshot is the GATT database of a device as discovered at one point,
+// labelled with its firmware revision unless told otherwise.
+type GATTSnapshot struct {
+	Version  int
+	Label    string `json:",omitempty"`
+	Taken    time.Time
+	Services []GATTService
+}
+
+// GATTChange is one service, characteristic or descriptor in a diff, with
+// the properties it gained or lost when it is in both snapshots.
+type GATTChange struct {
+	Service        string
+	Characteristic string   `json:",omitempty"`
+	Descriptor     string   `json:",omitempty"`
+	Gained         []string `json:",omitempty"`
+	Lost           []string `json:",omitempty"`
+}
+
+type GATTDiff struct {
+	From    int
+	To      int
+	Added   []GATTChange
+	Removed []GATTChange
+	Changed []GATTChange
+}
+
+type SafeGATTSnapshots struct {
+	mu        sync.Mutex
+	Snapshots map[string][]GATTSnapshot
+}
+
+var GATTSnapshots = SafeGATTSnapshots{Snapshots: map[string][]GATTSnapshot{}}
+
+const firmwareRevisionUUID = "2a26"
+
+func (sg *SafeGATTSnapshots) Load() error {
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+	return LoadJSON(gattSnapshotsFile, &sg.Snapshots)
+}
+
+// Take discovers the connected device's GATT database and stores it. The
+// label defaults to the device information firmware revision.
+func (sg *SafeGATTSnapshots) Take(address string, label string) (GATTSnapshot, error) {
+	services, err := Adapter.Services(address)
+	if err != nil {
+		return GATTSnapshot{}, err
+	}
+	if label == "" {
+		if revision, err := Adapter.ReadCharacteristic(address, firmwareRevisionUUID); err == nil {
+			label = strings.TrimRight(string(revision), "\x00")
+		}
+	}
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+	address = strings.ToUpper(address)
+	snapshots := sg.Snapshots[address]
+	s := GATTSnapshot{Version: 1, Label: label, Taken: time.Now().UTC(), Services: services}
+	if len(snapshots) > 0 {
+		s.Version = snapshots[len(snapshots) - 1].Version + 1
+	}
+	all := map[string][]GATTSnapshot{}
+	for a, list := range sg.Snapshots {
+		all[a] = list
+	}
+	all[address] = append(slices.Clip(snapshots), s)
+	err = SaveJSON(gattSnapshotsFile, all)
+	if err != nil {
+		return GATTSnapshot{}, err
+	}
+	sg.Snapshots = all
+	return s, nil
+}
+
+func (sg *SafeGATTSnapshots) List(address string) []GATTSnapshot {
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+	return append([]GATTSnapshot{}, sg.Snapshots[strings.ToUpper(address)]...)
+}
+
+// Get returns a snapshot by version, counting back from the latest when
+// version isn't positive.
+func (sg *SafeGATTSnapshots) Get(address string, version int) (GATTSnapshot, bool) {
+	snapshots := sg.List(address)
+	if version <= 0 {
+		i := len(snapshots) - 1 + version
+		if i < 0 {
+			return GATTSnapshot{}, false
+		}
+		return snapshots[i], true
+	}
+	for _, s := range snapshots {
+		if s.Version == version {
+			return s, true
+		}
+	}
+	return GATTSnapshot{}, false
+}
+
+// gattEntries flattens a database into its services, characteristics and
+// descriptors keyed by path, with their properties.
+func gattEntries(services []GATTService) (map[string]GATTChange, []string, map[string][]string) {
+	entries := map[string]GATTChange{}
+	order := []string{}
+	properties := map[string][]string{}
+	add := func (key string, c GATTChange, props []string) {
+		if _, ok := entries[key]; !ok {
+			order = append(order, key)
+		}
+		entries[key] = c
+		properties[key] = props
+	}
+	for _, s := range services {
+		add(s.UUID, GATTChange{Service: s.UUID}, nil)
+		for _, c := range s.Characteristics {
+			add(s.UUID + "/" + c.UUID, GATTChange{Service: s.UUID, Characteristic: c.UUID}, c.Properties)
+			for _, d := range c.Descriptors {
+				add(s.UUID + "/" + c.UUID + "/" + d.UUID, GATTChange{Service: s.UUID, Characteristic: c.UUID, Descriptor: d.UUID}, d.Flags)
+			}
+		}
+	}
+	return entries, order, properties
+}
+
+func missing(from []string, in []string) []string {
+	result := []string{}
+	for _, p := range from {
+		if !slices.Contains(in, p) {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// DiffGATT compares two snapshots of a device.
+func DiffGATT(from GATTSnapshot, to GATTSnapshot) GATTDiff {
+	diff := GATTDiff{From: from.Version, To: to.Version, Added: []GATTChange{}, Removed: []GATTChange{}, Changed: []GATTChange{}}
+	before, beforeOrder, beforeProps := gattEntries(from.Services)
+	after, afterOrder, afterProps := gattEntries(to.Services)
+	for _, key := range beforeOrder {
+		if _, ok := after[key]; !ok {
+			diff.Removed = append(diff.Removed, before[key])
+		}
+	}
+	for _, key := range afterOrder {
+		if _, ok := before[key]; !ok {
+			diff.Added = append(diff.Added, after[key])
+			continue
+		}
+		change := after[key]
+		change.Gained = missing(afterProps[key], beforeProps[key])
+		change.Lost = missing(beforeProps[key], afterProps[key])
+		if len(change.Gained) > 0 || len(change.Lost) > 0 {
+			diff.Changed = append(diff.Changed, change)
+		}
+	}
+	return diff
+}
+
+func ListGATTSnapshotsHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(GATTSnapshots.List(mux.Vars(r)["addr"]))
+	}
+}
+
+func TakeGATTSnapshotHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		req := struct{ Label string }{}
+		if r.ContentLength != 0 {
+			err := json.NewDecoder(r.Body).Decode(&req)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		s, err := GATTSnapshots.Take(mux.Vars(r)["addr"], req.Label)
+		if errors.Is(err, errNotConnectedTo) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(201)
+		json.NewEncoder(w).Encode(s)
+	}
+}
+
+// DiffGATTSnapshotsHandler compares the snapshot versions from and to,
+// defaulting to the last two.
+func DiffGATTSnapshotsHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		address := mux.Vars(r)["addr"]
+		versions := []int{-1, 0}
+		for i, param := range []string{"from", "to"} {
+			if v := r.URL.Query().Get(param); v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil || n < 1 {
+					http.Error(w, param + " must be a snapshot version", http.StatusBadRequest)
+					return
+				}
+				versions[i] = n
+			}
+		}
+		from, fromOK := GATTSnapshots.Get(address, versions[0])
+		to, toOK := GATTSnapshots.Get(address, versions[1])
+		if !fromOK || !toOK {
+			http.Error(w, "no such snapshots, take at least two to compare", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(DiffGATT(from, to))
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HealthSchemaVersion is bumped whenever fields of Health are renamed or
+// removed. Adding fields doesn't change it.
+const HealthSchemaVersion = "1.0"
+
+type HealthStatus struct {
+	State  string
+	Health string
+}
+
+type AdapterHealth struct {
+	Address   string
+	Status    HealthStatus
+	Connected bool
+	Resets    int64
+}
+
+type KernelEvent struct {
+	Message string
+}
+
+type Health struct {
+	SchemaVersion string
+	Id            string
+	Status        HealthStatus
+	StartedAt     time.Time
+	UptimeSeconds int64
+	Adapter       AdapterHealth
+	USBErrors     []KernelEvent
+	Devices       int
+	Clients       int
+}
+
+// AdapterResets counts how many times the adapter had to be reset since start.
+var AdapterResets atomic.Int64
+
+var usbErrorPatterns = [][]string{
+	{"usb", "error"},
+	{"usb", "reset"},
+	{"usb", "disconnect"},
+	{"bluetooth: hci", "timeout"},
+	{"bluetooth: hci", "failed"},
+	{"bluetooth: hci", "error"},
+}
+
+type kernelLog struct {
+	mu      sync.Mutex
+	checked time.Time
+	events  []KernelEvent
+}
+
+var dmesg = kernelLog{}
+
+// USBErrors scans the kernel log for lines that usually show up when a USB
+// dongle misbehaves. dmesg is slow and usually static, so results are cached
+// for a short while. When the kernel log can't be read nothing is reported.
+func (kl *kernelLog) USBErrors() []KernelEvent {
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+	if time.Since(kl.checked) < 30 * time.Second {
+		return kl.events
+	}
+	kl.checked = time.Now()
+	kl.events = []KernelEvent{}
+	out, err := exec.Command("dmesg").Output()
+	if err != nil {
+		return kl.events
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		lower := strings.ToLower(line)
+		for _, pattern := range usbErrorPatterns {
+			if strings.Contains(lower, pattern[0]) && strings.Contains(lower, pattern[1]) {
+				kl.events = append(kl.events, KernelEvent{strings.TrimSpace(line)})
+				break
+			}
+		}
+	}
+	return kl.events
+}
+
+func GatewayHealth() Health {
+	h := Health{
+		SchemaVersion: HealthSchemaVersion,
+		Id: "bluboi",
+		Status: HealthStatus{"Enabled", "OK"},
+		StartedAt: StartedAt,
+		UptimeSeconds: int64(time.Since(StartedAt).Seconds()),
+		Adapter: AdapterHealth{
+			Status: HealthStatus{"Enabled", "OK"},
+			Connected: Adapter.DeviceAddress() != "",
+			Resets: AdapterResets.Load(),
+		},
+		USBErrors: dmesg.USBErrors(),
+		Devices: Devices.Length(),
+		Clients: Clients.Length(),
+	}
+	addr, err := adapterAddress()
+	if err != nil {
+		h.Adapter.Status = HealthStatus{"Absent", "Critical"}
+		h.Status.Health = "Critical"
+	} else if Adapter.poweredOff.Load() {
+		h.Adapter.Address = addr
+		h.Adapter.Status = HealthStatus{"Disabled", "Warning"}
+		h.Status.Health = "Warning"
+	} else {
+		h.Adapter.Address = addr
+	}
+	if h.Status.Health == "OK" && len(h.USBErrors) > 0 {
+		h.Adapter.Status.Health = "Warning"
+		h.Status.Health = "Warning"
+	}
+	return h
+}
+
+func HealthHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(GatewayHealth())
+	}
+}
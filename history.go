@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	retentionFile = "retention.json"
+	compactEvery  = 10 * time.Minute
+	// Raw samples are stored in batches of up to historyBatch, at least
+	// every historyFlushEvery.
+	historyBatch      = 256
+	historyFlushEvery = time.Second
+)
+
+// RetentionTier keeps points at ResolutionSeconds for KeepHours, forever
+// when KeepHours is 0. The first tier holds raw samples, every later one is
+// rolled up from the tier before it.
+type RetentionTier struct {
+	Name              string
+	ResolutionSeconds int
+	KeepHours         int
+}
+
+var DefaultRetention = []RetentionTier{
+	{"raw", 0, 24},
+	{"minute", 60, 30 * 24},
+	{"hourly", 3600, 0},
+}
+
+// SafeHistory manages the telemetry time series kept by the Store, as
+// Aggregate points per tier. mu only guards the fields, the Store is never
+// read or written with it held so samples can keep coming in meanwhile.
+type SafeHistory struct {
+	mu         sync.Mutex
+	compacting sync.Mutex
+	Tiers      []RetentionTier
+	compacted  map[string]time.Time
+	pending    []Aggregate
+}
+
+var History = SafeHistory{compacted: map[string]time.Time{}}
+
+var errUnknownTier = errors.New("unknown retention tier")
+
+func ValidateRetention(tiers []RetentionTier) error {
+	if len(tiers) == 0 || tiers[0].ResolutionSeconds != 0 {
+		return errors.New("the first tier must hold raw samples")
+	}
+	names := map[string]bool{}
+	for i, tier := range tiers {
+		if tier.Name == "" || names[tier.Name] || filepath.Base(tier.Name) != tier.Name {
+			return errors.New("tiers need distinct file-safe names")
+		}
+		names[tier.Name] = true
+		if tier.KeepHours < 0 {
+			return errors.New(tier.Name + ": KeepHours can't be negative")
+		}
+		if i == 0 {
+			continue
+		}
+		prev := tiers[i - 1]
+		if tier.ResolutionSeconds <= prev.ResolutionSeconds {
+			return errors.New(tier.Name + ": resolution must be coarser than " + prev.Name)
+		}
+		// Points have to outlive the next compaction to be rolled up.
+		keep := time.Duration(prev.KeepHours) * time.Hour
+		if prev.KeepHours != 0 && keep < compactEvery + 2 * time.Duration(tier.ResolutionSeconds) * time.Second {
+			return errors.New(prev.Name + ": kept too short to be rolled up into " + tier.Name)
+		}
+	}
+	return nil
+}
+
+func (sh *SafeHistory) Open() error {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.Tiers = DefaultRetention
+	err := LoadJSON(retentionFile, &sh.Tiers)
+	if err != nil {
+		return err
+	}
+	err = ValidateRetention(sh.Tiers)
+	if err != nil {
+		return err
+	}
+	for _, tier := range sh.Tiers[1:] {
+		resolution := time.Duration(tier.ResolutionSeconds) * time.Second
+		err := Store.Scan(tier.Name, time.Time{}, func (p Aggregate) {
+			sh.compacted[tier.Name] = maxTime(sh.compacted[tier.Name], p.Start.Add(resolution))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Append queues a raw sample to be stored with the next batch.
+func (sh *SafeHistory) Append(addr string, metric string, value float64, calibration int) {
+	p := Aggregate{
+		Address: addr,
+		Metric: metric,
+		Start: time.Now().UTC(),
+		Window: "0s",
+		Min: value,
+		Max: value,
+		Avg: value,
+		Count: 1,
+		Calibration: calibration,
+	}
+	sh.mu.Lock()
+	if len(sh.Tiers) == 0 {
+		sh.mu.Unlock()
+		return
+	}
+	sh.pending = append(sh.pending, p)
+	full := len(sh.pending) >= historyBatch
+	sh.mu.Unlock()
+	if full {
+		sh.Flush()
+	}
+}
+
+// Flush stores the queued raw samples.
+func (sh *SafeHistory) Flush() {
+	sh.mu.Lock()
+	if len(sh.pending) == 0 || len(sh.Tiers) == 0 {
+		sh.mu.Unlock()
+		return
+	}
+	points, raw := sh.pending, sh.Tiers[0].Name
+	sh.pending = make([]Aggregate, 0, historyBatch)
+	sh.mu.Unlock()
+	Quiesce.RLock()
+	defer Quiesce.RUnlock()
+	err := Store.Append(raw, points)
+	if err != nil {
+		log.Printf("[ERROR] Could not store %v telemetry samples - %v", len(points), err)
+	}
+}
+
+func (sh *SafeHistory) RunFlushes() {
+	for {
+		time.Sleep(historyFlushEvery)
+		sh.Flush()
+	}
+}
+
+func merge(into *Aggregate, p Aggregate) {
+	into.Avg = (into.Avg * float64(into.Count) + p.Avg * float64(p.Count)) / float64(into.Count + p.Count)
+	into.Min = min(into.Min, p.Min)
+	into.Max = max(into.Max, p.Max)
+	into.Count += p.Count
+}
+
+// rollup summarizes every complete bucket of from not yet in to.
+// Calibrations are never mixed in one point.
+func (sh *SafeHistory) rollup(from RetentionTier, to RetentionTier) error {
+	resolution := time.Duration(to.ResolutionSeconds) * time.Second
+	now := time.Now()
+	sh.mu.Lock()
+	since := sh.compacted[to.Name]
+	sh.mu.Unlock()
+	buckets := map[string]*Aggregate{}
+	order := []string{}
+	err := Store.Scan(from.Name, since, func (p Aggregate) {
+		start := p.Start.Truncate(resolution)
+		if start.Before(since) || start.Add(resolution).After(now) {
+			return
+		}
+		key := start.String() + ";" + p.Address + ";" + p.Metric + ";" + strconv.Itoa(p.Calibration)
+		if b, ok := buckets[key]; ok {
+			merge(b, p)
+			return
+		}
+		p.Start = start
+		p.Window = resolution.String()
+		buckets[key] = &p
+		order = append(order, key)
+	})
+	if err != nil || len(order) == 0 {
+		return err
+	}
+	points := []Aggregate{}
+	for _, key := range order {
+		points = append(points, *buckets[key])
+	}
+	Quiesce.RLock()
+	err = Store.Append(to.Name, points)
+	Quiesce.RUnlock()
+	if err != nil {
+		return err
+	}
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	for _, p := range points {
+		sh.compacted[to.Name] = maxTime(sh.compacted[to.Name], p.Start.Add(resolution))
+	}
+	return nil
+}
+
+func maxTime(a time.Time, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// prune drops points older than the tier keeps them.
+func (sh *SafeHistory) prune(tier RetentionTier) error {
+	if tier.KeepHours == 0 {
+		return nil
+	}
+	Quiesce.RLock()
+	defer Quiesce.RUnlock()
+	return Store.Prune(tier.Name, time.Now().Add(-time.Duration(tier.KeepHours) * time.Hour))
+}
+
+// tiers returns the tiers, and the raw one's name.
+func (sh *SafeHistory) tiers() ([]RetentionTier, string) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if len(sh.Tiers) == 0 {
+		return nil, ""
+	}
+	return sh.Tiers, sh.Tiers[0].Name
+}
+
+// Compact rolls every tier up into the next and applies retention, one
+// compaction at a time.
+func (sh *SafeHistory) Compact() error {
+	sh.Flush()
+	sh.compacting.Lock()
+	defer sh.compacting.Unlock()
+	tiers, _ := sh.tiers()
+	for i := 1; i < len(tiers); i++ {
+		err := sh.rollup(tiers[i - 1], tiers[i])
+		if err != nil {
+			return err
+		}
+	}
+	for _, tier := range tiers {
+		err := sh.prune(tier)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sh *SafeHistory) RunCompaction() {
+	for {
+		time.Sleep(compactEvery)
+		err := History.Compact()
+		if err != nil {
+			log.Printf("[ERROR] Could not compact telemetry history - %v", err)
+		}
+	}
+}
+
+// Samples returns the raw samples of a device taken from from to to, now
+// when zero, oldest first.
+func (sh *SafeHistory) Samples(addr string, from time.Time, to time.Time) ([]Aggregate, error) {
+	sh.Flush()
+	samples := []Aggregate{}
+	_, raw := sh.tiers()
+	if raw == "" {
+		return samples, nil
+	}
+	err := Store.Scan(raw, from, func (p Aggregate) {
+		if p.Address == addr && (to.IsZero() || !p.Start.After(to)) {
+			samples = append(samples, p)
+		}
+	})
+	sort.SliceStable(samples, func (i, j int) bool {
+		return samples[i].Start.Before(samples[j].Start)
+	})
+	return samples, err
+}
+
+// Points returns the stored points of a tier, optionally limited to one
+// device or metric.
+func (sh *SafeHistory) Points(tier string, addr string, metric string) ([]Aggregate, error) {
+	sh.Flush()
+	tiers, _ := sh.tiers()
+	known := false
+	for _, t := range tiers {
+		known = known || t.Name == tier
+	}
+	if !known {
+		return nil, errUnknownTier
+	}
+	points := []Aggregate{}
+	err := Store.Scan(tier, time.Time{}, func (p Aggregate) {
+		if (addr == "" || p.Address == addr) && (metric == "" || p.Metric == metric) {
+			points = append(points, p)
+		}
+	})
+	return points, err
+}
+
+func (sh *SafeHistory) SetTiers(tiers []RetentionTier) error {
+	err := ValidateRetention(tiers)
+	if err != nil {
+		return err
+	}
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	err = SaveJSON(retentionFile, tiers)
+	if err != nil {
+		return err
+	}
+	sh.Tiers = tiers
+	return nil
+}
+
+func GetRetentionHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		History.mu.Lock()
+		tiers := History.Tiers
+		History.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tiers)
+	}
+}
+
+func SetRetentionHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		tiers := []RetentionTier{}
+		err := json.NewDecoder(r.Body).Decode(&tiers)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = History.SetTiers(tiers)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(200)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistoryCompact(t *testing.T) {
+	useDataDir(t)
+	sh := &SafeHistory{Tiers: DefaultRetention, compacted: map[string]time.Time{}}
+	start := time.Now().UTC().Truncate(time.Minute).Add(-3 * time.Minute)
+	raw := []Aggregate{}
+	for i, value := range []float64{1, 3, 5, 7} {
+		raw = append(raw, Aggregate{Address: "AA", Metric: "rssi", Start: start.Add(time.Duration(i) * 20 * time.Second), Window: "0s", Min: value, Max: value, Avg: value, Count: 1})
+	}
+	// A calibration change starts a point of its own.
+	raw = append(raw, Aggregate{Address: "AA", Metric: "rssi", Start: start.Add(30 * time.Second), Window: "0s", Min: 9, Max: 9, Avg: 9, Count: 1, Calibration: 1})
+	// Its minute isn't over, so it's left for a later compaction.
+	raw = append(raw, Aggregate{Address: "AA", Metric: "rssi", Start: time.Now().UTC().Add(time.Minute), Window: "0s", Avg: 2, Count: 1})
+	if err := Store.Append("raw", raw); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := sh.Compact(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	points, err := sh.Points("minute", "AA", "rssi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Aggregate{
+		{Start: start, Min: 1, Max: 5, Avg: 3, Count: 3},
+		{Start: start.Add(time.Minute), Min: 7, Max: 7, Avg: 7, Count: 1},
+		{Start: start, Min: 9, Max: 9, Avg: 9, Count: 1, Calibration: 1},
+	}
+	if len(points) != len(want) {
+		t.Fatalf("got %+v, want %d points", points, len(want))
+	}
+	for i, p := range points {
+		w := want[i]
+		if !p.Start.Equal(w.Start) || p.Window != "1m0s" || p.Min != w.Min || p.Max != w.Max || p.Avg != w.Avg || p.Count != w.Count || p.Calibration != w.Calibration {
+			t.Errorf("point %d is %+v, want %+v", i, p, w)
+		}
+	}
+	if got := sh.compacted["minute"]; !got.Equal(start.Add(2 * time.Minute)) {
+		t.Errorf("compacted up to %v, want %v", got, start.Add(2 * time.Minute))
+	}
+}
+
+// TestHistoryAppendDuringScan checks samples are queued while the Store is
+// being read, rather than waiting for it.
+func TestHistoryAppendDuringScan(t *testing.T) {
+	useDataDir(t)
+	sh := &SafeHistory{Tiers: DefaultRetention, compacted: map[string]time.Time{}}
+	Store.Append("raw", []Aggregate{{Address: "AA", Metric: "rssi", Start: time.Now().UTC(), Window: "0s", Count: 1}})
+	scanning, release := make(chan bool), make(chan bool)
+	store := Store
+	Store = blockingBackend{store, scanning, release}
+	scanned := make(chan bool)
+	t.Cleanup(func () {
+		close(release)
+		<-scanned
+	})
+	go func () {
+		sh.Points("raw", "", "")
+		scanned <- true
+	} ()
+	<-scanning
+	done := make(chan bool)
+	go func () {
+		sh.Append("AA", "rssi", 1, 0)
+		done <- true
+	} ()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Append waited for the scan")
+	}
+}
+
+type blockingBackend struct {
+	Backend
+	scanning chan bool
+	release  chan bool
+}
+
+func (bb blockingBackend) Scan(tier string, since time.Time, callback func (Aggregate)) error {
+	bb.scanning <- true
+	<-bb.release
+	return bb.Backend.Scan(tier, since, callback)
+}
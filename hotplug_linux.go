@@ -0,0 +1,78 @@
+//go:build linux
+
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/muka/go-bluetooth/bluez/profile/adapter"
+	"golang.org/x/sys/unix"
+)
+
+// WatchHotplug listens for kernel uevents about the selected Bluetooth
+// controller so a USB dongle being unplugged and re-enumerating doesn't
+// leave bluboi bound to an adapter that no longer exists.
+func WatchHotplug() {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_DGRAM, unix.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		log.Printf("[ERROR] Could not watch for adapter hotplug - %v", err)
+		return
+	}
+	defer unix.Close(fd)
+	err = unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: 1})
+	if err != nil {
+		log.Printf("[ERROR] Could not watch for adapter hotplug - %v", err)
+		return
+	}
+	buf := make([]byte, 8192)
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			log.Printf("[ERROR] Stopped watching for adapter hotplug - %v", err)
+			return
+		}
+		event := parseUevent(buf[:n])
+		if event["SUBSYSTEM"] != "bluetooth" || event["DEVTYPE"] != "host" {
+			continue
+		}
+		id := event["DEVPATH"][strings.LastIndex(event["DEVPATH"], "/") + 1:]
+		// Other controllers coming and going are none of our business, only
+		// the one selected is followed.
+		if id != adapterID() {
+			continue
+		}
+		switch event["ACTION"] {
+		case "remove":
+			Adapter.Detach(id)
+		case "add":
+			go attachAdapter(id)
+		}
+	}
+}
+
+// parseUevent splits the NUL separated KEY=value pairs following the
+// "action@devpath" header of a uevent.
+func parseUevent(msg []byte) map[string]string {
+	event := map[string]string{}
+	for _, field := range strings.Split(string(msg), "\x00") {
+		if k, v, ok := strings.Cut(field, "="); ok {
+			event[k] = v
+		}
+	}
+	return event
+}
+
+func attachAdapter(id string) {
+	// The kernel announces the controller before BlueZ has registered it on
+	// D-Bus, so wait for it to show up.
+	for i := 0; i < 20; i++ {
+		if _, err := adapter.GetAdapter(id); err == nil {
+			Adapter.Attach(id)
+			return
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	LogEvent("ADAPTER_FAILED", "Adapter", id, "appeared but never registered with BlueZ.")
+}
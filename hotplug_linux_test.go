@@ -0,0 +1,44 @@
+//go:build linux
+
+package main
+
+import (
+	"maps"
+	"strings"
+	"testing"
+)
+
+func TestParseUevent(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields []string
+		want   map[string]string
+	}{
+		{"controller added", []string{
+			"add@/devices/pci0000:00/0000:00:14.0/usb1/1-2/1-2:1.0/bluetooth/hci1",
+			"ACTION=add",
+			"DEVPATH=/devices/pci0000:00/0000:00:14.0/usb1/1-2/1-2:1.0/bluetooth/hci1",
+			"SUBSYSTEM=bluetooth",
+			"DEVTYPE=host",
+			"SEQNUM=4711",
+		}, map[string]string{
+			"ACTION": "add",
+			"DEVPATH": "/devices/pci0000:00/0000:00:14.0/usb1/1-2/1-2:1.0/bluetooth/hci1",
+			"SUBSYSTEM": "bluetooth",
+			"DEVTYPE": "host",
+			"SEQNUM": "4711",
+		}},
+		{"header only", []string{"remove@/devices/virtual/bluetooth/hci0"}, map[string]string{}},
+		{"empty", nil, map[string]string{}},
+		{"value with =", []string{"change@/x", "MODALIAS=usb:v0A12p0001=x"}, map[string]string{"MODALIAS": "usb:v0A12p0001=x"}},
+		{"empty value", []string{"change@/x", "DEVTYPE="}, map[string]string{"DEVTYPE": ""}},
+		{"trailing NULs", []string{"add@/x", "ACTION=add", "", ""}, map[string]string{"ACTION": "add"}},
+		{"later wins", []string{"add@/x", "ACTION=add", "ACTION=remove"}, map[string]string{"ACTION": "remove"}},
+	}
+	for _, test := range tests {
+		got := parseUevent([]byte(strings.Join(test.fields, "\x00")))
+		if !maps.Equal(got, test.want) {
+			t.Errorf("%v: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
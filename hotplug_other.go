@@ -0,0 +1,7 @@
+//go:build !linux
+
+package main
+
+// WatchHotplug is a no-op outside of Linux, where adapters are managed by the
+// OS.
+func WatchHotplug() {}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// idempotencyTTL is how long a response is kept for its key to be
+	// replayed, long enough for a phone to get back on Wi-Fi.
+	idempotencyTTL = 24 * time.Hour
+	// idempotencyKept bounds the responses kept, the oldest going first.
+	idempotencyKept = 1000
+	IdempotencyHeader = "Idempotency-Key"
+)
+
+type idempotentResponse struct {
+	done        bool
+	status      int
+	contentType string
+	body        []byte
+	at          time.Time
+}
+
+// SafeIdempotency remembers the responses to requests sent with an
+// Idempotency-Key, so one sent again after the connection dropped mid-way
+// gets the same answer instead of doing it twice.
+type SafeIdempotency struct {
+	mu        sync.Mutex
+	responses map[string]*idempotentResponse
+	order     []string
+}
+
+var Idempotency = SafeIdempotency{responses: map[string]*idempotentResponse{}}
+
+// start claims key, returning what it was answered with before if anything.
+// ok is false while a request with the same key is still being handled.
+func (si *SafeIdempotency) start(key string) (previous *idempotentResponse, ok bool) {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	si.expire()
+	if res, found := si.responses[key]; found {
+		return res, res.done
+	}
+	si.responses[key] = &idempotentResponse{at: time.Now()}
+	si.order = append(si.order, key)
+	for len(si.order) > idempotencyKept {
+		delete(si.responses, si.order[0])
+		si.order = si.order[1:]
+	}
+	return nil, true
+}
+
+// finish stores the response to key, or forgets key when the request
+// failed on the server's side so it may be tried again.
+func (si *SafeIdempotency) finish(key string, res *idempotentResponse) {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	claimed, found := si.responses[key]
+	if !found {
+		return
+	}
+	if res.status >= 500 {
+		delete(si.responses, key)
+		return
+	}
+	res.done, res.at = true, claimed.at
+	si.responses[key] = res
+}
+
+// expire expects si.mu to be held.
+func (si *SafeIdempotency) expire() {
+	for len(si.order) > 0 {
+		res, found := si.responses[si.order[0]]
+		if found && time.Since(res.at) < idempotencyTTL {
+			return
+		}
+		delete(si.responses, si.order[0])
+		si.order = si.order[1:]
+	}
+}
+
+type bodyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (br *bodyRecorder) WriteHeader(status int) {
+	br.status = status
+	br.ResponseWriter.WriteHeader(status)
+}
+
+func (br *bodyRecorder) Write(b []byte) (int, error) {
+	br.body.Write(b)
+	return br.ResponseWriter.Write(b)
+}
+
+// IdempotencyMiddleware answers requests other than GET and HEAD sent again
+// with the same Idempotency-Key with the response to the first, marked with
+// Idempotent-Replayed, without handling them again. Keys are per token,
+// method and path, so one client can't be answered with another's response.
+func IdempotencyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(IdempotencyHeader)
+		if id == "" || r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := hashToken(requestToken(r)) + " " + r.Method + " " + r.URL.Path + " " + id
+		previous, ok := Idempotency.start(key)
+		if !ok {
+			http.Error(w, "a request with that Idempotency-Key is still being handled", http.StatusConflict)
+			return
+		}
+		if previous != nil {
+			if previous.contentType != "" {
+				w.Header().Set("Content-Type", previous.contentType)
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(previous.status)
+			w.Write(previous.body)
+			return
+		}
+		// Until the response is stored, a panic in next releases the key as
+		// a server error would, so it isn't stuck in 409 for a day.
+		res := &idempotentResponse{status: http.StatusInternalServerError}
+		defer func () { Idempotency.finish(key, res) } ()
+		br := &bodyRecorder{ResponseWriter: w, status: 200}
+		next.ServeHTTP(br, r)
+		res = &idempotentResponse{
+			status: br.status,
+			contentType: w.Header().Get("Content-Type"),
+			body: br.body.Bytes(),
+		}
+	})
+}
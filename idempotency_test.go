@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// useIdempotency starts the test with no responses kept.
+func useIdempotency(t *testing.T) {
+	t.Cleanup(func () { Idempotency = SafeIdempotency{responses: map[string]*idempotentResponse{}} })
+	Idempotency = SafeIdempotency{responses: map[string]*idempotentResponse{}}
+}
+
+func idempotentRequest(h http.Handler, method string, path string, token string, key string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer " + token)
+	}
+	if key != "" {
+		r.Header.Set(IdempotencyHeader, key)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestIdempotencyReplay(t *testing.T) {
+	useIdempotency(t)
+	calls := 0
+	status := http.StatusCreated
+	h := IdempotencyMiddleware(http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(strconv.Itoa(calls)))
+	}))
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		token    string
+		key      string
+		status   int
+		body     string
+		replayed bool
+	}{
+		{"first", "POST", "/scan", "a", "k1", 201, "1", false},
+		{"again", "POST", "/scan", "a", "k1", 201, "1", true},
+		{"another key", "POST", "/scan", "a", "k2", 201, "2", false},
+		{"another token", "POST", "/scan", "b", "k1", 201, "3", false},
+		{"another path", "POST", "/stop", "a", "k1", 201, "4", false},
+		{"another method", "DELETE", "/scan", "a", "k1", 201, "5", false},
+		{"no key", "POST", "/scan", "a", "", 201, "6", false},
+		{"no key again", "POST", "/scan", "a", "", 201, "7", false},
+		{"GET", "GET", "/scan", "a", "k3", 201, "8", false},
+		{"GET again", "GET", "/scan", "a", "k3", 201, "9", false},
+		{"first still", "POST", "/scan", "a", "k1", 201, "1", true},
+	}
+	for _, test := range tests {
+		w := idempotentRequest(h, test.method, test.path, test.token, test.key)
+		replayed := w.Header().Get("Idempotent-Replayed") == "true"
+		if w.Code != test.status || w.Body.String() != test.body || replayed != test.replayed {
+			t.Errorf("%v: got %d %q replayed %v, want %d %q replayed %v", test.name, w.Code, w.Body.String(), replayed, test.status, test.body, test.replayed)
+		}
+		if replayed && w.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%v: replayed as %v", test.name, w.Header().Get("Content-Type"))
+		}
+	}
+
+	// Server errors aren't kept, so the request can be tried again.
+	status = http.StatusBadGateway
+	idempotentRequest(h, "POST", "/scan", "a", "k4")
+	status = http.StatusOK
+	if w := idempotentRequest(h, "POST", "/scan", "a", "k4"); w.Code != 200 || w.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("after a server error got %d, replayed %v", w.Code, w.Header().Get("Idempotent-Replayed"))
+	}
+	// Nor are expired responses.
+	for _, res := range Idempotency.responses {
+		res.at = time.Now().Add(-idempotencyTTL)
+	}
+	before := calls
+	if idempotentRequest(h, "POST", "/scan", "a", "k1"); calls != before + 1 {
+		t.Errorf("an expired response was replayed")
+	}
+}
+
+func TestIdempotencyInFlight(t *testing.T) {
+	useIdempotency(t)
+	entered, release := make(chan struct{}), make(chan struct{})
+	h := IdempotencyMiddleware(http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/panic" {
+			panic("handler failed")
+		}
+		close(entered)
+		<-release
+		w.WriteHeader(200)
+	}))
+	done := make(chan int)
+	go func () {
+		done <- idempotentRequest(h, "POST", "/scan", "a", "k1").Code
+	} ()
+	<-entered
+	if w := idempotentRequest(h, "POST", "/scan", "a", "k1"); w.Code != http.StatusConflict {
+		t.Errorf("while the first is handled got %d, want 409", w.Code)
+	}
+	close(release)
+	if code := <-done; code != 200 {
+		t.Errorf("the first got %d", code)
+	}
+	if w := idempotentRequest(h, "POST", "/scan", "a", "k1"); w.Code != 200 || w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("once handled got %d, replayed %v", w.Code, w.Header().Get("Idempotent-Replayed"))
+	}
+
+	// A panic releases the key.
+	for i := 0; i < 2; i++ {
+		func () {
+			defer func () {
+				if recover() == nil {
+					t.Errorf("attempt %d didn't reach the handler", i + 1)
+				}
+			} ()
+			idempotentRequest(h, "POST", "/panic", "a", "k2")
+		} ()
+	}
+}
+
+func TestIdempotencyKept(t *testing.T) {
+	useIdempotency(t)
+	h := IdempotencyMiddleware(http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {}))
+	for i := 0; i <= idempotencyKept; i++ {
+		idempotentRequest(h, "POST", "/scan", "a", strconv.Itoa(i))
+	}
+	if len(Idempotency.responses) != idempotencyKept || len(Idempotency.order) != idempotencyKept {
+		t.Errorf("kept %d responses in order %d, want %d", len(Idempotency.responses), len(Idempotency.order), idempotencyKept)
+	}
+	if w := idempotentRequest(h, "POST", "/scan", "a", "0"); w.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("the oldest response was kept")
+	}
+	if w := idempotentRequest(h, "POST", "/scan", "a", strconv.Itoa(idempotencyKept)); w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("the newest response wasn't kept")
+	}
+}
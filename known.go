@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	knownFile       = "known.json"
+	knownFlushEvery = time.Minute
+)
+
+// KnownDevice is what's remembered of a device ever listed, with its
+// metadata as of when it was last seen.
+type KnownDevice struct {
+	Address   string
+	Name      string   `json:",omitempty"`
+	Alias     string   `json:",omitempty"`
+	Tags      []string `json:",omitempty"`
+	Services  []string `json:",omitempty"`
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// SafeKnown is the history of every device listed by upper case address,
+// kept in known.json so it outlives restarts, expiry and eviction.
+type SafeKnown struct {
+	mu      sync.Mutex
+	devices map[string]KnownDevice
+	dirty   bool
+}
+
+var Known = SafeKnown{devices: map[string]KnownDevice{}}
+
+func (sk *SafeKnown) Load() error {
+	sk.mu.Lock()
+	defer sk.mu.Unlock()
+	devices := []KnownDevice{}
+	err := LoadJSON(knownFile, &devices)
+	for _, known := range devices {
+		sk.devices[known.Address] = known
+	}
+	return err
+}
+
+// Record remembers what's listed about a device.
+func (sk *SafeKnown) Record(device Device) {
+	addr := device.Address.String()
+	meta := Metadata.Get(addr)
+	sk.mu.Lock()
+	defer sk.mu.Unlock()
+	known, ok := sk.devices[addr]
+	if !ok {
+		known = KnownDevice{Address: addr, FirstSeen: device.FirstSeen}
+	}
+	if !device.LastSeen.After(known.LastSeen) && known.Alias == meta.Alias && slices.Equal(known.Tags, meta.Tags) {
+		return
+	}
+	if device.Name != "" {
+		known.Name = device.Name
+	}
+	if len(device.Services) > 0 {
+		known.Services = device.Services
+	}
+	if known.FirstSeen.IsZero() || device.FirstSeen.Before(known.FirstSeen) {
+		known.FirstSeen = device.FirstSeen
+	}
+	known.LastSeen = maxTime(known.LastSeen, device.LastSeen)
+	known.Alias, known.Tags = meta.Alias, meta.Tags
+	sk.devices[addr] = known
+	sk.dirty = true
+}
+
+func (sk *SafeKnown) Get(addr string) (KnownDevice, bool) {
+	sk.mu.Lock()
+	defer sk.mu.Unlock()
+	known, ok := sk.devices[addr]
+	return known, ok
+}
+
+// Forget drops a device from the history, returning whether it was in it.
+// It's remembered again if it's still listed or shows up again.
+func (sk *SafeKnown) Forget(addr string) bool {
+	sk.mu.Lock()
+	defer sk.mu.Unlock()
+	_, ok := sk.devices[addr]
+	delete(sk.devices, addr)
+	sk.dirty = sk.dirty || ok
+	return ok
+}
+
+// Flush records the listed devices, saving the history if anything changed.
+func (sk *SafeKnown) Flush() {
+	Devices.ForEach(func (addr string, device Device) {
+		sk.Record(device)
+	})
+	sk.mu.Lock()
+	if !sk.dirty {
+		sk.mu.Unlock()
+		return
+	}
+	devices := sk.sorted()
+	sk.dirty = false
+	sk.mu.Unlock()
+	err := SaveJSON(knownFile, devices)
+	if err != nil {
+		log.Printf("[ERROR] Could not save the known devices - %v", err)
+		sk.mu.Lock()
+		sk.dirty = true
+		sk.mu.Unlock()
+	}
+}
+
+func (sk *SafeKnown) RunFlushes() {
+	for {
+		time.Sleep(knownFlushEvery)
+		sk.Flush()
+	}
+}
+
+// sorted lists the devices seen most recently first, expecting sk.mu to be
+// held.
+func (sk *SafeKnown) sorted() []KnownDevice {
+	devices := make([]KnownDevice, 0, len(sk.devices))
+	for _, known := range sk.devices {
+		devices = append(devices, known)
+	}
+	sort.Slice(devices, func (i, j int) bool {
+		return devices[i].LastSeen.After(devices[j].LastSeen)
+	})
+	return devices
+}
+
+// List is the history, with the latest of the devices listed right now.
+func (sk *SafeKnown) List() []KnownDevice {
+	Devices.ForEach(func (addr string, device Device) {
+		sk.Record(device)
+	})
+	sk.mu.Lock()
+	defer sk.mu.Unlock()
+	return sk.sorted()
+}
+
+// knownListing tells whether a known device is in /devices right now.
+type knownListing struct {
+	KnownDevice
+	Listed bool
+}
+
+// ListKnownHandler lists every device ever listed, seen most recently
+// first, those seen since the optional RFC 3339 since query parameter only.
+func ListKnownHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		since := time.Time{}
+		if s := r.URL.Query().Get("since"); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			since = t
+		}
+		listings := []knownListing{}
+		for _, known := range Known.List() {
+			if known.LastSeen.Before(since) {
+				break
+			}
+			listings = append(listings, knownListing{known, Devices.Exists(known.Address)})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(listings)
+	}
+}
+
+func ForgetKnownHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		if !Known.Forget(strings.ToUpper(mux.Vars(r)["addr"])) {
+			http.Error(w, "device was never seen", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(200)
+	}
+}
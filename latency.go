@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the latency
+// histograms, from notifications handled in a millisecond to connections
+// taking as long as BlueZ allows.
+var latencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+type latencyHistogram struct {
+	counts []uint64
+	count  uint64
+	errors uint64
+	sum    float64
+}
+
+// LatencySummary is how an operation performed since start. Quantiles are
+// the upper bounds of the buckets they fall in, "+Inf" past the last one.
+type LatencySummary struct {
+	Count  uint64
+	Errors uint64
+	Mean   string
+	P50    string
+	P90    string
+	P99    string
+}
+
+// SafeLatencies keeps a latency histogram per GATT operation: connect,
+// discover, read, write and notify (handling a notification once
+// received).
+type SafeLatencies struct {
+	mu  sync.Mutex
+	ops map[string]*latencyHistogram
+}
+
+var Latencies = SafeLatencies{ops: map[string]*latencyHistogram{}}
+
+// Observe records how long an operation took, and whether it failed.
+func (sl *SafeLatencies) Observe(op string, took time.Duration, err error) {
+	seconds := took.Seconds()
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	h, ok := sl.ops[op]
+	if !ok {
+		h = &latencyHistogram{counts: make([]uint64, len(latencyBuckets))}
+		sl.ops[op] = h
+	}
+	h.count++
+	h.sum += seconds
+	if err != nil {
+		h.errors++
+	}
+	if i, _ := slices.BinarySearch(latencyBuckets, seconds); i < len(latencyBuckets) {
+		h.counts[i]++
+	}
+}
+
+// quantile expects sl.mu to be held.
+func (h *latencyHistogram) quantile(q float64) string {
+	rank := uint64(q * float64(h.count))
+	seen := uint64(0)
+	for i, n := range h.counts {
+		seen += n
+		if seen > rank {
+			return (time.Duration(latencyBuckets[i] * float64(time.Second))).String()
+		}
+	}
+	return "+Inf"
+}
+
+func (sl *SafeLatencies) Summaries() map[string]LatencySummary {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	summaries := map[string]LatencySummary{}
+	for op, h := range sl.ops {
+		mean := time.Duration(h.sum / float64(h.count) * float64(time.Second))
+		summaries[op] = LatencySummary{
+			Count: h.count,
+			Errors: h.errors,
+			Mean: mean.Round(time.Microsecond).String(),
+			P50: h.quantile(0.5),
+			P90: h.quantile(0.9),
+			P99: h.quantile(0.99),
+		}
+	}
+	return summaries
+}
+
+// writePrometheus renders the histograms in the Prometheus text format.
+func (sl *SafeLatencies) writePrometheus(b *strings.Builder) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	ops := []string{}
+	for op := range sl.ops {
+		ops = append(ops, op)
+	}
+	slices.Sort(ops)
+	b.WriteString("# HELP bluboi_operation_duration_seconds How long GATT operations took.\n")
+	b.WriteString("# TYPE bluboi_operation_duration_seconds histogram\n")
+	for _, op := range ops {
+		h := sl.ops[op]
+		cumulative := uint64(0)
+		for i, le := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(b, "bluboi_operation_duration_seconds_bucket{op=%q,le=\"%s\"} %d\n", op, strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(b, "bluboi_operation_duration_seconds_bucket{op=%q,le=\"+Inf\"} %d\n", op, h.count)
+		fmt.Fprintf(b, "bluboi_operation_duration_seconds_sum{op=%q} %s\n", op, formatFloat(h.sum))
+		fmt.Fprintf(b, "bluboi_operation_duration_seconds_count{op=%q} %d\n", op, h.count)
+	}
+	b.WriteString("# HELP bluboi_operation_errors_total GATT operations that failed.\n")
+	b.WriteString("# TYPE bluboi_operation_errors_total counter\n")
+	for _, op := range ops {
+		fmt.Fprintf(b, "bluboi_operation_errors_total{op=%q} %d\n", op, sl.ops[op].errors)
+	}
+}
+
+func writeGauge(b *strings.Builder, name string, help string, value int) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, value)
+}
+
+// MetricsHandler serves the connection pool and operation latencies to
+// Prometheus.
+func MetricsHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		b := strings.Builder{}
+		writeGauge(&b, "bluboi_connections", "Devices connected.", len(Adapter.Addresses()))
+		writeGauge(&b, "bluboi_connection_attempts", "Connection attempts in progress, including waits to retry.", Adapter.Attempts())
+		writeGauge(&b, "bluboi_devices", "Devices scanned.", Devices.Length())
+		writeGauge(&b, "bluboi_event_clients", "Clients following /events.", Clients.Length())
+		Latencies.writePrometheus(&b)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write([]byte(b.String()))
+	}
+}
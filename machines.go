@@ -0,0 +1,436 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const machinesFile = "machines.json"
+
+// StateMachine models the protocol of a peripheral, eg. a lock that has to
+// be woken, authenticated and then told to open, so it can be driven
+// reliably instead of by scripts. A device's machine starts in Initial
+// whenever it is connected, and every change of state raises a STATE event
+// (address;from;to;cause).
+type StateMachine struct {
+	Initial string
+	States  map[string]MachineState
+}
+
+// MachineState makes the Enter writes when it is entered, going to OnError
+// if one fails, then waits for one of its transitions or, when After is
+// set, goes to Then once After has passed.
+type MachineState struct {
+	Enter   []MachineWrite      `json:",omitempty"`
+	OnError string              `json:",omitempty"`
+	On      []MachineTransition `json:",omitempty"`
+	After   string              `json:",omitempty"`
+	Then    string              `json:",omitempty"`
+}
+
+// MachineWrite writes a hex value to a characteristic.
+type MachineWrite struct {
+	Char  string
+	Value string
+}
+
+// MachineTransition goes to To on the named Event, or on a notification (or
+// polled value) of Char starting with the hex Value, any value if empty.
+type MachineTransition struct {
+	Event string `json:",omitempty"`
+	Char  string `json:",omitempty"`
+	Value string `json:",omitempty"`
+	To    string
+}
+
+type MachineStatus struct {
+	Machine StateMachine
+	State   string    `json:",omitempty"`
+	Since   time.Time
+}
+
+// machineRun is a machine running on a connected device. generation changes
+// with every transition so timers and failed writes from earlier states are
+// ignored.
+type machineRun struct {
+	machine    StateMachine
+	state      string
+	since      time.Time
+	generation uint64
+	timer      *time.Timer
+	writes     chan machineWrites
+}
+
+type machineWrites struct {
+	generation uint64
+	onError    string
+	writes     []MachineWrite
+}
+
+type SafeMachines struct {
+	mu       sync.Mutex
+	Machines map[string]StateMachine
+	builtin  map[string]StateMachine
+	runs     map[string]*machineRun
+}
+
+var Machines = SafeMachines{Machines: map[string]StateMachine{}, builtin: map[string]StateMachine{}, runs: map[string]*machineRun{}}
+
+var (
+	errNoMachine      = errors.New("the device has no state machine")
+	errMachineStopped = errors.New("the device's state machine isn't running, connect to it first")
+)
+
+func ValidateMachine(m StateMachine) error {
+	if _, ok := m.States[m.Initial]; !ok {
+		return errors.New("Initial must be one of the states")
+	}
+	known := func (state string) bool {
+		_, ok := m.States[state]
+		return ok
+	}
+	for name, s := range m.States {
+		for _, w := range s.Enter {
+			if _, err := ParseUUID(w.Char); err != nil {
+				return errors.New(name + ": " + w.Char + " is not a UUID")
+			}
+			if _, err := hex.DecodeString(w.Value); err != nil || w.Value == "" {
+				return errors.New(name + ": values to write must be hex")
+			}
+		}
+		if s.OnError != "" && !known(s.OnError) {
+			return errors.New(name + ": no state called " + s.OnError)
+		}
+		for _, t := range s.On {
+			if (t.Event == "") == (t.Char == "") {
+				return errors.New(name + ": transitions need either an Event or a Char")
+			}
+			if t.Char != "" {
+				if _, err := ParseUUID(t.Char); err != nil {
+					return errors.New(name + ": " + t.Char + " is not a UUID")
+				}
+			}
+			if _, err := hex.DecodeString(t.Value); err != nil {
+				return errors.New(name + ": values to match must be hex")
+			}
+			if !known(t.To) {
+				return errors.New(name + ": no state called " + t.To)
+			}
+		}
+		if (s.After == "") != (s.Then == "") {
+			return errors.New(name + ": After and Then go together")
+		}
+		if s.After != "" {
+			if d, err := time.ParseDuration(s.After); err != nil || d <= 0 {
+				return errors.New(name + ": After must be a duration, eg. 5s")
+			}
+			if !known(s.Then) {
+				return errors.New(name + ": no state called " + s.Then)
+			}
+		}
+	}
+	return nil
+}
+
+func (sm *SafeMachines) Load() error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	err := LoadJSON(machinesFile, &sm.Machines)
+	if err != nil {
+		return err
+	}
+	for addr, m := range sm.Machines {
+		if err := ValidateMachine(m); err != nil {
+			return errors.New(addr + " " + err.Error())
+		}
+	}
+	return nil
+}
+
+// RegisterMachine defines a device's machine in Go, for devices bluboi is
+// built to drive. Machines in machines.json take precedence.
+func RegisterMachine(addr string, m StateMachine) {
+	if err := ValidateMachine(m); err != nil {
+		panic("state machine for " + addr + ": " + err.Error())
+	}
+	Machines.mu.Lock()
+	defer Machines.mu.Unlock()
+	Machines.builtin[strings.ToUpper(addr)] = m
+}
+
+// machine returns the machine of a device, expecting sm.mu to be held.
+func (sm *SafeMachines) machine(addr string) (StateMachine, bool) {
+	if m, ok := sm.Machines[addr]; ok {
+		return m, true
+	}
+	m, ok := sm.builtin[addr]
+	return m, ok
+}
+
+func (sm *SafeMachines) Status(addr string) (MachineStatus, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	addr = strings.ToUpper(addr)
+	m, ok := sm.machine(addr)
+	if !ok {
+		return MachineStatus{}, errNoMachine
+	}
+	status := MachineStatus{Machine: m}
+	if run, ok := sm.runs[addr]; ok {
+		status.State, status.Since = run.state, run.since
+	}
+	return status, nil
+}
+
+// Set replaces the machine of a device, restarting it if it's running.
+func (sm *SafeMachines) Set(addr string, m StateMachine) error {
+	err := ValidateMachine(m)
+	if err != nil {
+		return err
+	}
+	return sm.save(strings.ToUpper(addr), &m)
+}
+
+// Delete removes the machine of a device, stopping it.
+func (sm *SafeMachines) Delete(addr string) error {
+	return sm.save(strings.ToUpper(addr), nil)
+}
+
+func (sm *SafeMachines) save(addr string, m *StateMachine) error {
+	sm.mu.Lock()
+	all := map[string]StateMachine{}
+	for a, machine := range sm.Machines {
+		all[a] = machine
+	}
+	if m == nil {
+		delete(all, addr)
+	} else {
+		all[addr] = *m
+	}
+	err := SaveJSON(machinesFile, all)
+	if err != nil {
+		sm.mu.Unlock()
+		return err
+	}
+	sm.Machines = all
+	_, running := sm.runs[addr]
+	sm.mu.Unlock()
+	if running {
+		sm.Stop(addr)
+		go sm.Start(addr)
+	}
+	return nil
+}
+
+// Start runs the machine of a newly connected device, subscribing to the
+// characteristics its transitions wait on.
+func (sm *SafeMachines) Start(addr string) {
+	sm.mu.Lock()
+	addr = strings.ToUpper(addr)
+	m, ok := sm.machine(addr)
+	if !ok || sm.runs[addr] != nil {
+		sm.mu.Unlock()
+		return
+	}
+	run := &machineRun{machine: m, writes: make(chan machineWrites, 16)}
+	sm.runs[addr] = run
+	sm.mu.Unlock()
+	subscribed := map[string]bool{}
+	for _, s := range m.States {
+		for _, t := range s.On {
+			if t.Char == "" || subscribed[strings.ToLower(t.Char)] {
+				continue
+			}
+			subscribed[strings.ToLower(t.Char)] = true
+			if err := Subscriptions.Subscribe(addr, t.Char); err != nil {
+				LogError("State machine of", addr, "could not subscribe to", t.Char, "-", err.Error())
+			}
+		}
+	}
+	go sm.write(addr, run)
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if sm.runs[addr] == run {
+		sm.enter(addr, run, m.Initial, "start")
+	}
+}
+
+// Stop stops the machine of a disconnected device, or every machine when
+// addr is empty.
+func (sm *SafeMachines) Stop(addr string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	for a, run := range sm.runs {
+		if addr != "" && a != strings.ToUpper(addr) {
+			continue
+		}
+		if run.timer != nil {
+			run.timer.Stop()
+		}
+		close(run.writes)
+		delete(sm.runs, a)
+	}
+}
+
+// enter moves a running machine to another state, expecting sm.mu to be
+// held. The state's writes are queued to keep them in order without doing
+// I/O under the lock.
+func (sm *SafeMachines) enter(addr string, run *machineRun, state string, cause string) {
+	from := run.state
+	run.state, run.since = state, time.Now().UTC()
+	run.generation++
+	if run.timer != nil {
+		run.timer.Stop()
+		run.timer = nil
+	}
+	LogEvent("STATE", strings.Join([]string{addr, from, state, cause}, ";"))
+	s := run.machine.States[state]
+	if len(s.Enter) > 0 {
+		select {
+		case run.writes <- machineWrites{run.generation, s.OnError, s.Enter}:
+		default:
+			LogError("State machine of", addr, "is too far behind, skipped the writes of", state)
+		}
+	}
+	if s.After != "" {
+		after, _ := time.ParseDuration(s.After)
+		generation := run.generation
+		run.timer = time.AfterFunc(after, func () {
+			sm.transition(addr, generation, s.Then, "timeout")
+		})
+	}
+}
+
+// transition enters a state unless the machine has moved on since
+// generation.
+func (sm *SafeMachines) transition(addr string, generation uint64, state string, cause string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	run, ok := sm.runs[addr]
+	if !ok || run.generation != generation {
+		return
+	}
+	sm.enter(addr, run, state, cause)
+}
+
+func (sm *SafeMachines) write(addr string, run *machineRun) {
+	for w := range run.writes {
+		for _, mw := range w.writes {
+			value, _ := hex.DecodeString(mw.Value)
+			err := Adapter.WriteCharacteristic(addr, mw.Char, value)
+			if err != nil {
+				LogError("State machine of", addr, "could not write", mw.Char, "-", err.Error())
+				if w.onError != "" {
+					sm.transition(addr, w.generation, w.onError, "error")
+				}
+				break
+			}
+		}
+	}
+}
+
+// Notify takes the transition waiting on a value of a characteristic, if
+// the device's machine is in a state with one.
+func (sm *SafeMachines) Notify(addr string, uuid string, value []byte) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	addr = strings.ToUpper(addr)
+	run, ok := sm.runs[addr]
+	if !ok {
+		return
+	}
+	encoded := hex.EncodeToString(value)
+	for _, t := range run.machine.States[run.state].On {
+		if t.Char != "" && sameUUID(t.Char, uuid) && strings.HasPrefix(encoded, strings.ToLower(t.Value)) {
+			sm.enter(addr, run, t.To, strings.ToLower(uuid))
+			return
+		}
+	}
+}
+
+// Fire takes the transition on a named event from the current state.
+func (sm *SafeMachines) Fire(addr string, event string) (string, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	addr = strings.ToUpper(addr)
+	if _, ok := sm.machine(addr); !ok {
+		return "", errNoMachine
+	}
+	run, ok := sm.runs[addr]
+	if !ok {
+		return "", errMachineStopped
+	}
+	for _, t := range run.machine.States[run.state].On {
+		if t.Event == event {
+			sm.enter(addr, run, t.To, event)
+			return t.To, nil
+		}
+	}
+	return "", errors.New("no transition on " + event + " from " + run.state)
+}
+
+func GetMachineHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		status, err := Machines.Status(mux.Vars(r)["addr"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	}
+}
+
+func SetMachineHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		m := StateMachine{}
+		err := json.NewDecoder(r.Body).Decode(&m)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = Machines.Set(mux.Vars(r)["addr"], m)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(200)
+	}
+}
+
+func DeleteMachineHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		err := Machines.Delete(mux.Vars(r)["addr"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(200)
+	}
+}
+
+// FireMachineEventHandler sends a named event to a device's machine and
+// tells the state it moved to.
+func FireMachineEventHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		state, err := Machines.Fire(vars["addr"], vars["event"])
+		if errors.Is(err, errNoMachine) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct{ State string }{state})
+	}
+}
@@ -1,13 +1,24 @@
 package main
 
 import (
-	"context"
 	"embed"
+	"encoding/json"
+	"errors"
+	"flag"
 	"io/fs"
 	"log"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/google/uuid"
@@ -23,6 +34,7 @@ type Event struct {
 type Log struct {
 	Level string
 	Msg string
+	Version uint64 `json:",omitempty"`
 }
 
 type Connection struct {
@@ -34,8 +46,15 @@ type Client struct {
 	id uint32
 	w http.ResponseWriter
 	r *http.Request
+	// Whether events were written since the last flush.
+	dirty bool
 }
 
+// sseFlushEvery is how often events written to event streams are flushed,
+// so busy scans cost one write per client per interval rather than one per
+// event.
+const sseFlushEvery = 50 * time.Millisecond
+
 type SafeClients struct {
 	mu sync.Mutex
 	Clients []Client
@@ -89,59 +108,87 @@ func (sc *SafeClients) BroadcastLog(l []byte) {
 			break
 		}
 		default: {
-			if f, ok := w.(http.Flusher); ok {
-				f.Flush()
-			}
+			sc.Clients[i].dirty = true
 		}
 		}
 	}
 }
 
-type Device struct {
-	Name string
-	Address *bluetooth.Address
-}
-
-type SafeDevices struct {
-	mu sync.Mutex
-	Devices map[string] Device
+// FlushPending flushes the clients events were written to since the last
+// flush.
+func (sc *SafeClients) FlushPending() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for i := range sc.Clients {
+		if !sc.Clients[i].dirty {
+			continue
+		}
+		sc.Clients[i].dirty = false
+		if f, ok := sc.Clients[i].w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
 }
 
-func (sd *SafeDevices) ForEach(callback func (key string, value Device)) {
-	sd.mu.Lock()
-	defer sd.mu.Unlock()
-	for addr, device := range sd.Devices {
-		callback(addr, device)
+func (sc *SafeClients) RunFlushes() {
+	for {
+		time.Sleep(sseFlushEvery)
+		sc.FlushPending()
 	}
 }
 
-func (sd *SafeDevices) Device(addr string) Device {
-	sd.mu.Lock()
-	defer sd.mu.Unlock()
-	return sd.Devices[addr]
+type Device struct {
+	Name string
+	Address *bluetooth.Address
+	// RSSI of the latest advertisement, and the one last sent in a DEVICE
+	// event.
+	RSSI int16
+	reportedRSSI int16
+	// Manufacturer data of the latest advertisement, and the services
+	// advertised so far.
+	Manufacturer []ManufacturerData
+	Services []string
+	ServiceData []ServiceData
+	FirstSeen time.Time
+	LastSeen time.Time
 }
 
-func (sd *SafeDevices) Exists(addr string) bool {
-	sd.mu.Lock()
-	defer sd.mu.Unlock()
-	if _, ok := sd.Devices[addr]; ok {
-		return true
-	}
-	return false
-}
+// rssiReportStep is how far a device's RSSI has to move before it is sent
+// again, so the UI can keep sorting by proximity without an event per
+// advertisement.
+const rssiReportStep = 5
 
-func (sd *SafeDevices) Add(device Device) {
-	sd.mu.Lock()
-	defer sd.mu.Unlock()
-	sd.Devices[device.Address.String()] = device
+// DeviceInfo is what a DEVICE event says about a device:
+// address;name;rssi;manufacturer;services;alias.
+func (d Device) DeviceInfo() []string {
+	addr := d.Address.String()
+	return []string{addr, d.Name, strconv.Itoa(int(d.RSSI)), formatManufacturer(d.Manufacturer), strings.Join(d.Services, ","), Metadata.Get(addr).Alias}
 }
 
 
 type SafeAdapter struct {
 	mu sync.Mutex
 	Adapter *bluetooth.Adapter
-	BTDevice *bluetooth.Device
-	Connected bool
+	// Connected devices by upper case address, and their addresses from the
+	// first connected to the last.
+	connections map[string]*bluetooth.Device
+	order []string
+	// Connection attempts in progress, by upper case address, closed to
+	// cancel them.
+	attemptsMu sync.Mutex
+	attempts map[string]chan struct{}
+	scanning atomic.Bool
+	continuous atomic.Bool
+	filter atomic.Pointer[ScanFilter]
+	lastResult atomic.Int64
+	detached atomic.Bool
+	// poweredOff is set while the adapter is powered off with PowerOff,
+	// which also detaches it.
+	powerMu sync.Mutex
+	poweredOff atomic.Bool
+	// What to restore once a removed adapter comes back.
+	resumeScan bool
+	resumeAddresses []string
 }
 
 func (sa *SafeAdapter) Enable() error {
@@ -151,68 +198,127 @@ func (sa *SafeAdapter) Enable() error {
 	return err
 }
 
-func (sa *SafeAdapter) Connect(address string) {
-	sa.mu.Lock()
-	defer sa.mu.Unlock()
-	if sa.Connected || sa.BTDevice != nil {
-		LogError("You're already connected.")
-		return
-	}
-	if !Devices.Exists(address) {
-		LogError("Could not find the device.")
-		return
-	}
-	device := Devices.Device(address)
-	dvc, err := sa.Adapter.Connect(*device.Address, bluetooth.ConnectionParams{})
-	if err != nil {
-		LogError("Could not connect to ", device.Name, err.Error())
-		return
-	}
-	sa.BTDevice = dvc
-	sa.Connected = true
-	LogInfo("Connected to", device.Name)
+// forget drops a connection, expecting sa.mu to be held.
+func (sa *SafeAdapter) forget(key string) {
+	delete(sa.connections, key)
+	sa.order = slices.DeleteFunc(sa.order, func (a string) bool { return a == key })
+	Subscriptions.Clear(key)
+	Machines.Stop(key)
 }
 
-func (sa *SafeAdapter) Scan(seconds time.Duration) {
+// forgetAll drops every connection, expecting sa.mu to be held.
+func (sa *SafeAdapter) forgetAll() {
+	sa.connections = map[string]*bluetooth.Device{}
+	sa.order = nil
+	Subscriptions.Clear("")
+	Machines.Stop("")
+}
+
+// Scan scans for the given number of seconds, or until stopped when 0,
+// only taking in the devices matching filter unless it is nil.
+func (sa *SafeAdapter) Scan(seconds time.Duration, filter *ScanFilter) {
 	// sa.mu.Lock()
 	// defer sa.mu.Unlock()
-	ctx, cancel := context.WithTimeout(context.TODO(), seconds * time.Second)
-	defer cancel()
-	LogInfo("Scanning...")
+	var timeout <-chan time.Time
+	if seconds > 0 {
+		timeout = time.After(seconds * time.Second)
+		LogInfo("Scanning for", strconv.Itoa(int(seconds)), "seconds...")
+	} else {
+		LogInfo("Scanning until stopped...")
+	}
+	sa.filter.Store(filter)
+	if filter != nil {
+		LogInfo("Only taking in devices", filter.String() + ".")
+	}
+	sa.lastResult.Store(time.Now().UnixNano())
+	sa.scanning.Store(true)
+	done := make(chan struct{})
 	go func () {
+		defer close(done)
+		defer sa.scanning.Store(false)
 		err := sa.Adapter.Scan(func (b *bluetooth.Adapter, result bluetooth.ScanResult) {
-			if result.LocalName() == "" {
-				return
-			}
-			if Devices.Exists(result.Address.String()) {
-				return
-			}
-			Devices.Add(Device {
-				Name: result.LocalName(),
-				Address: &result.Address,
-			})
-			LogDeviceInfo(result.Address.String(), result.LocalName())
+			sa.handleScanResult(result)
 		})
 		if err != nil {
 			LogError(err.Error())
 		}
 	} ()
+	select {
+	case <-done:
+		// Stopped, or it couldn't start.
+		return
+	case <-timeout:
+	}
+	err := sa.Adapter.StopScan()
+	if err != nil {
+		log.Printf("[ERROR] Could not stop scanning after timeout - %v", err)
+		return
+	}
+	LogInfo("Stopped Scanning.")
+}
+
+// handleScanResult records an advertisement. Devices are listed once they
+// have a name, or manufacturer data for beacons and sensors without one,
+// unless blocked, and in lockdown once they're approved.
+func (sa *SafeAdapter) handleScanResult(result bluetooth.ScanResult) {
+	sa.lastResult.Store(time.Now().UnixNano())
+	if result.LocalName() == "" && len(result.ManufacturerData()) == 0 {
+		return
+	}
+	if !sa.filter.Load().Matches(result) {
+		return
+	}
+	addr := scanAddresses.String(result.Address)
+	if DeviceAccess.Blocked(addr, result.LocalName()) {
+		return
+	}
+	if !Onboarding.Admit(addr, result) {
+		return
+	}
+	Presence.Seen(addr)
+	Telemetry.Record(addr, "rssi", float64(result.RSSI))
+	DeviceStreams.PublishRSSI(addr, result.RSSI)
+	if Devices.Observe(addr, result) {
+		DeviceReports.Add(addr)
+		Devices.StartEvict()
+	}
+}
+
+// ScanContinuously keeps a scan running while in continuous mode, starting a
+// new one whenever the last one ended, unless the adapter is gone.
+func (sa *SafeAdapter) ScanContinuously() {
 	for {
-		select {
-			case <-ctx.Done(): {
-				err := sa.Adapter.StopScan()
-				if err != nil {
-					log.Printf("[ERROR] Could not stop scanning after timeout - %v", err)
-					return
-				}
-				LogInfo("Stopped Scanning.")
-				return
-			}
-			default: 
+		if sa.continuous.Load() && !sa.scanning.Load() && !sa.detached.Load() {
+			sa.Scan(continuousScanSeconds, nil)
 		}
+		time.Sleep(5 * time.Second)
 	}
 }
 
+func (sa *SafeAdapter) ScanMode() string {
+	if sa.continuous.Load() {
+		return "continuous"
+	}
+	return "on-demand"
+}
+
+// SetScanMode switches between scanning when asked to and scanning in the
+// background. Leaving continuous mode stops the scan in progress.
+func (sa *SafeAdapter) SetScanMode(mode string) error {
+	if mode != "on-demand" && mode != "continuous" {
+		return errors.New("mode must be on-demand or continuous")
+	}
+	continuous := mode == "continuous"
+	if sa.continuous.Swap(continuous) == continuous {
+		return nil
+	}
+	LogInfo("Scanning mode set to", mode + ".")
+	if !continuous && sa.scanning.Load() {
+		sa.StopScan()
+	}
+	return nil
+}
+
 func (sa *SafeAdapter) StopScan() {
 	// sa.mu.Lock()
 	// defer sa.mu.Unlock()
@@ -224,31 +330,314 @@ func (sa *SafeAdapter) StopScan() {
 	LogInfo("Stopped Scanning.")
 }
 
-func (sa *SafeAdapter) Disconnect() {
+// Disconnect disconnects from one device, or from every one when address is
+// empty.
+func (sa *SafeAdapter) Disconnect(address string) {
 	sa.mu.Lock()
 	defer sa.mu.Unlock()
-	if !sa.Connected || sa.BTDevice == nil {
+	targets := slices.Clone(sa.order)
+	if address != "" {
+		targets = []string{strings.ToUpper(address)}
+		if _, ok := sa.connections[targets[0]]; !ok {
+			LogError("Currently not connected to", address)
+			return
+		}
+	}
+	if len(targets) == 0 {
 		LogError("Currently not connected to any device.")
 		return;
 	}
-	err := sa.BTDevice.Disconnect()
+	for _, key := range targets {
+		err := sa.connections[key].Disconnect()
+		if err != nil {
+			LogError("Could not disconnect device -", err.Error())
+			continue
+		}
+		sa.forget(key)
+		LogEvent("DISCONNECTED", "Disconnected from", key)
+	}
+}
+
+// DeviceAddress returns the device connected last, which features working
+// with a single device use, or "" when none is.
+func (sa *SafeAdapter) DeviceAddress() string {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	if len(sa.order) == 0 {
+		return ""
+	}
+	return sa.order[len(sa.order) - 1]
+}
+
+// Addresses returns the connected devices, from the first connected to the
+// last.
+func (sa *SafeAdapter) Addresses() []string {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	return slices.Clone(sa.order)
+}
+
+func (sa *SafeAdapter) IsConnected(address string) bool {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	_, ok := sa.connections[strings.ToUpper(address)]
+	return ok
+}
+
+// connection returns a connected device, expecting sa.mu to be held.
+func (sa *SafeAdapter) connection(address string) (*bluetooth.Device, error) {
+	device, ok := sa.connections[strings.ToUpper(address)]
+	if !ok {
+		return nil, errNotConnectedTo
+	}
+	return device, nil
+}
+
+// Reset power cycles the adapter and enables it again. Any connection is
+// gone afterwards.
+func (sa *SafeAdapter) Reset() error {
+	sa.Adapter.StopScan()
+	err := resetAdapter()
 	if err != nil {
-		LogError("Could not disconnect device -", err.Error())
-		return;
+		return err
+	}
+	sa.mu.Lock()
+	sa.forgetAll()
+	sa.mu.Unlock()
+	return sa.Enable()
+}
+
+// pause stops everything that needs the adapter, remembering what was going
+// on so resume can pick it back up. It returns false when already paused.
+func (sa *SafeAdapter) pause() bool {
+	if sa.detached.Swap(true) {
+		return false
+	}
+	sa.mu.Lock()
+	sa.resumeScan = sa.scanning.Load()
+	sa.resumeAddresses = slices.Clone(sa.order)
+	sa.forgetAll()
+	sa.mu.Unlock()
+	sa.Adapter.StopScan()
+	return true
+}
+
+// rebind enables a fresh adapter in place of the paused one.
+func (sa *SafeAdapter) rebind() error {
+	adapter := &bluetooth.Adapter{}
+	adapter.SetConnectHandler(sa.handleConnect)
+	err := adapter.Enable()
+	if err != nil {
+		return err
+	}
+	sa.mu.Lock()
+	sa.Adapter = adapter
+	sa.mu.Unlock()
+	return nil
+}
+
+// resume picks back up the scan and the connections that were active when
+// the adapter was paused.
+func (sa *SafeAdapter) resume() {
+	sa.mu.Lock()
+	resumeScan, resumeAddresses := sa.resumeScan, sa.resumeAddresses
+	sa.resumeScan, sa.resumeAddresses = false, nil
+	sa.mu.Unlock()
+	sa.detached.Store(false)
+	if resumeScan {
+		EventQueue <- Event{Type: "SCAN"}
+	}
+	for _, address := range resumeAddresses {
+		EventQueue <- Event{Type: "CONNECT", Data: address}
+	}
+}
+
+// Detach pauses everything that needs the adapter after it went away.
+func (sa *SafeAdapter) Detach(id string) {
+	if sa.pause() {
+		LogEvent("ADAPTER_REMOVED", "Adapter", id, "was removed.")
+	}
+}
+
+// Attach binds to a freshly (re)appeared adapter and resumes scanning and
+// the connection that were active when it was removed. One powered off with
+// PowerOff is kept off, resuming once PowerOn powers it back up.
+func (sa *SafeAdapter) Attach(id string) {
+	err := sa.rebind()
+	if err != nil {
+		LogEvent("ADAPTER_FAILED", "Could not enable adapter", id, "-", err.Error())
+		return
+	}
+	if sa.poweredOff.Load() {
+		if err := setAdapterPower(false); err != nil {
+			LogError("Could not keep adapter", id, "powered off -", err.Error())
+		}
+		return
+	}
+	LogEvent("ADAPTER_ADDED", "Adapter", id, "is available.")
+	sa.resume()
+}
+
+// PowerOff powers the adapter down, pausing everything that needs it until
+// PowerOn, and raises ADAPTER_POWERED_OFF.
+func (sa *SafeAdapter) PowerOff() error {
+	sa.powerMu.Lock()
+	defer sa.powerMu.Unlock()
+	if sa.poweredOff.Load() {
+		return nil
+	}
+	if !sa.pause() {
+		return errAdapterUnavailable
+	}
+	err := setAdapterPower(false)
+	if err != nil {
+		sa.resume()
+		return err
+	}
+	sa.poweredOff.Store(true)
+	LogEvent("ADAPTER_POWERED_OFF", "Adapter powered off.")
+	return nil
+}
+
+// PowerOn powers the adapter back up and enables it again, resuming what
+// PowerOff paused and raising ADAPTER_POWERED_ON. It also brings back an
+// adapter powered off behind the gateway's back.
+func (sa *SafeAdapter) PowerOn() error {
+	sa.powerMu.Lock()
+	defer sa.powerMu.Unlock()
+	if sa.detached.Load() && !sa.poweredOff.Load() {
+		return errAdapterUnavailable
+	}
+	err := setAdapterPower(true)
+	if err != nil {
+		return err
+	}
+	if !sa.poweredOff.Load() {
+		return sa.Enable()
+	}
+	err = sa.rebind()
+	if err != nil {
+		return err
+	}
+	sa.poweredOff.Store(false)
+	LogEvent("ADAPTER_POWERED_ON", "Adapter powered on.")
+	sa.resume()
+	return nil
+}
+
+// Switch moves to another adapter, disconnecting from the devices on the
+// current one and picking the scan and connections back up on the new one.
+func (sa *SafeAdapter) Switch(id string) error {
+	sa.powerMu.Lock()
+	defer sa.powerMu.Unlock()
+	if sa.detached.Load() {
+		return errAdapterUnavailable
+	}
+	if id == adapterID() {
+		return nil
+	}
+	previous := adapterID()
+	err := useAdapter(id)
+	if err != nil {
+		return err
+	}
+	adapter := &bluetooth.Adapter{}
+	adapter.SetConnectHandler(sa.handleConnect)
+	sa.Adapter.StopScan()
+	sa.mu.Lock()
+	resumeScan, resumeAddresses := sa.scanning.Load(), slices.Clone(sa.order)
+	for _, key := range sa.order {
+		sa.connections[key].Disconnect()
+		LogEvent("DISCONNECTED", "Disconnected from", key)
+	}
+	sa.forgetAll()
+	err = adapter.Enable()
+	if err != nil {
+		sa.mu.Unlock()
+		useAdapter(previous)
+		return err
+	}
+	sa.Adapter = adapter
+	sa.mu.Unlock()
+	LogEvent("ADAPTER_SELECTED", "Switched to adapter", id + ".")
+	if resumeScan {
+		EventQueue <- Event{Type: "SCAN"}
+	}
+	for _, address := range resumeAddresses {
+		EventQueue <- Event{Type: "CONNECT", Data: address}
+	}
+	return nil
+}
+
+// Characteristic looks up a characteristic by UUID across all services of a
+// connected device.
+func (sa *SafeAdapter) Characteristic(address string, uuid string) (*bluetooth.DeviceCharacteristic, error) {
+	id, err := ParseUUID(uuid)
+	if err != nil {
+		return nil, err
+	}
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	device, err := sa.connection(address)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	defer func () {
+		Latencies.Observe("discover", time.Since(start), err)
+	} ()
+	services, err := device.DiscoverServices(nil)
+	if err != nil {
+		return nil, err
+	}
+	for i := range services {
+		var chars []bluetooth.DeviceCharacteristic
+		chars, err = services[i].DiscoverCharacteristics(nil)
+		if err != nil {
+			return nil, err
+		}
+		for j := range chars {
+			if chars[j].UUID() == id {
+				return &chars[j], nil
+			}
+		}
+	}
+	return nil, errCharacteristicNotFound
+}
+
+// ParseUUID accepts both the full 128-bit form and the 16-bit short form
+// (eg. "180d") of a UUID.
+func ParseUUID(s string) (bluetooth.UUID, error) {
+	if len(s) == 4 {
+		short, err := strconv.ParseUint(s, 16, 16)
+		if err != nil {
+			return bluetooth.UUID{}, err
+		}
+		return bluetooth.New16BitUUID(uint16(short)), nil
 	}
-	sa.Connected = false
-	sa.BTDevice = nil
-	LogInfo("Disconnected.")
+	return bluetooth.ParseUUID(s)
+}
+
+// sameUUID tells whether two UUIDs are the same, short or not.
+func sameUUID(a string, b string) bool {
+	ua, errA := ParseUUID(a)
+	ub, errB := ParseUUID(b)
+	return errA == nil && errB == nil && ua == ub
 }
 
 var (
-	Adapter = SafeAdapter{Adapter: bluetooth.DefaultAdapter, BTDevice: nil}
+	Adapter = SafeAdapter{Adapter: bluetooth.DefaultAdapter, connections: map[string]*bluetooth.Device{}, attempts: map[string]chan struct{}{}}
 	Logs = make(chan Log, 10)
 	EventQueue = make(chan Event, 10)
 	ConnectedDevice = Connection{}
-	IsConnecting = false
-	Devices = SafeDevices{Devices: map[string]Device{}}
+	Devices = NewSafeDevices()
 	Clients = SafeClients{Clients: []Client{}}
+	StartedAt = time.Now()
+	HTTPAddr = ":6969"
+	continuousScanSeconds time.Duration = 60
+	defaultScanSeconds time.Duration = 5
+	errCharacteristicNotFound = errors.New("could not find characteristic")
+	errAdapterUnavailable = errors.New("adapter is not available")
 )
 
 func LogInfo(info ...string) {
@@ -265,6 +654,13 @@ func LogDeviceInfo(info ...string) {
 	}
 }
  
+func LogEvent(level string, info ...string) {
+	Logs <- Log {
+		Level: level,
+		Msg: strings.Join(info, " "),
+	}
+}
+
 func LogError(err ...string) {
 	Logs <- Log {
 		Level: "ERROR",
@@ -273,7 +669,23 @@ func LogError(err ...string) {
 }
 
 func LogToSSE(l *Log) []byte {
-	return []byte("event: " + l.Level + "\ndata: \"" + l.Msg + "\"\n\n")
+	id := ""
+	if l.Version != 0 {
+		id = "id: " + strconv.FormatUint(l.Version, 10) + "\n"
+	}
+	return []byte(id + "event: " + l.Level + "\ndata: \"" + l.Msg + "\"\n\n")
+}
+
+// FlushOnSignal saves the known devices and the raw history batched in
+// memory before exiting on SIGINT or SIGTERM, so restarts don't lose them.
+func FlushOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	log.Printf("[INFO] Received %v, saving state before exiting.", sig)
+	Known.Flush()
+	History.Flush()
+	os.Exit(0)
 }
 
 func ProcessEventQueue() {
@@ -281,9 +693,18 @@ func ProcessEventQueue() {
 	for {
 		e := <-EventQueue
 		log.Printf("[INFO] Received Event: %v", e.Type)
+		if Adapter.detached.Load() {
+			LogError("Adapter is not available.")
+			continue
+		}
 		switch e.Type {
 		case "SCAN" : {
-			go Adapter.Scan(5)
+			seconds, filter, err := parseScan(e.Data)
+			if err != nil {
+				LogError(err.Error())
+				break
+			}
+			go Adapter.Scan(seconds, filter)
 			break
 		}
 		case "STOP_SCAN" : {
@@ -295,25 +716,109 @@ func ProcessEventQueue() {
 			break
 		}
 		case "DISCONNECT" : {
-			go Adapter.Disconnect()
+			go Adapter.Disconnect(e.Data)
+			break
+		}
+		case "WEDGE" : {
+			go Wedge.Start()
+			break
+		}
+		case "STOP_WEDGE" : {
+			go Wedge.Stop()
+			break
+		}
+		case "SERIAL" : {
+			go Serial.Start()
+			break
+		}
+		case "STOP_SERIAL" : {
+			go Serial.Stop()
 			break
 		}
 		}
 	}
 }
 
+// uiPolicy only lets the UI load its own scripts, styles, images, manifest
+// and service worker, and talk back to this server.
+const uiPolicy = "default-src 'none'; script-src 'self'; style-src 'self'; img-src 'self'; connect-src 'self'; manifest-src 'self'; worker-src 'self'; base-uri 'none'; form-action 'none'; frame-ancestors 'none'"
+
 func ServeUI() http.Handler {
 	fsys, err := fs.Sub(public, "public")
-    if err != nil {
-        log.Fatalf("Could not read filesystem - %v", err)
-    }
-    return http.FileServer(http.FS(fsys))
+	if err != nil {
+		log.Fatalf("Could not read filesystem - %v", err)
+	}
+	mime.AddExtensionType(".webmanifest", "application/manifest+json")
+	files := http.FileServer(http.FS(fsys))
+	return http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy", uiPolicy)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		files.ServeHTTP(w, r)
+	})
+}
+
+// scanSeconds parses how long a SCAN event asks to scan for, 0 meaning
+// until stopped and nothing the default.
+func scanSeconds(data string) (time.Duration, error) {
+	if data == "" {
+		return defaultScanSeconds, nil
+	}
+	seconds, err := strconv.Atoi(data)
+	if err != nil || seconds < 0 {
+		return 0, errors.New("seconds must be a number of seconds to scan for, or 0 to scan until stopped")
+	}
+	return time.Duration(seconds), nil
 }
 
+// ScanHandler starts a scan for the seconds query parameter, 0 scanning
+// until stopped, filtered by name, rssi and uuid.
 func ScanHandler() http.HandlerFunc {
 	return func (w http.ResponseWriter, r *http.Request) {
+		query := url.Values{}
+		for _, key := range []string{"seconds", "name", "rssi", "uuid"} {
+			if value := r.URL.Query().Get(key); value != "" {
+				query.Set(key, value)
+			}
+		}
+		if _, _, err := parseScan(query.Encode()); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		EventQueue <- Event {
 			Type: "SCAN",
+			Data: query.Encode(),
+		}
+		w.WriteHeader(200)
+	}
+}
+
+type ScanModeStatus struct {
+	Mode string
+}
+
+func GetScanModeHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ScanModeStatus{Adapter.ScanMode()})
+	}
+}
+
+// SetScanModeHandler switches scanning mode at runtime, like -scan does on
+// start.
+func SetScanModeHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		req := ScanModeStatus{}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = Adapter.SetScanMode(req.Mode)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
 		w.WriteHeader(200)
 	}
@@ -332,10 +837,10 @@ func GetEventsHandler() http.HandlerFunc {
 		}
 		id := uuid.New().ID()
 		index := Clients.Length()
-		Clients.AddClient(Client{id, w, r})
+		Clients.AddClient(Client{id: id, w: w, r: r})
 		Clients.Flush(index)
 		Devices.ForEach(func (_ string, device Device) {
-			LogDeviceInfo(device.Address.String(), device.Name)
+			LogDeviceInfo(device.DeviceInfo()...)
 		})
 		select {
 			case <-r.Context().Done():  {
@@ -359,6 +864,10 @@ func StopScanHandler() http.HandlerFunc {
 func ConnectHandler() http.HandlerFunc {
 	return func (w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
+		if !DeviceAccess.MayConnect(strings.ToUpper(vars["addr"]), advertisedName(strings.ToUpper(vars["addr"]))) {
+			http.Error(w, errNotAllowed.Error(), http.StatusForbidden)
+			return
+		}
 		EventQueue <- Event {
 			Type: "CONNECT",
 			Data: vars["addr"],
@@ -367,48 +876,503 @@ func ConnectHandler() http.HandlerFunc {
 	}
 }
 
+// CancelConnectHandler gives up on connecting to addr right away, rather
+// than through the event queue, which a hanging attempt could be holding up.
+func CancelConnectHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		err := Adapter.CancelConnect(mux.Vars(r)["addr"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(200)
+	}
+}
+
+// DisconnectHandler disconnects from the device addr, or from every device
+// without it.
 func DisconnectHandler() http.HandlerFunc {
 	return func (w http.ResponseWriter, r *http.Request) {
 		EventQueue <- Event {
 			Type: "DISCONNECT",
+			Data: mux.Vars(r)["addr"],
 		}
 		w.WriteHeader(200)
 	}
 }
 
 func BroadcastLogs() {
+	// Event streams are written in order so clients can check versions.
+	_, sse := Sinks.Subscribe("sse", 1000)
+	go func () {
+		for l := range sse {
+			Clients.BroadcastLog(LogToSSE(&l))
+			DeviceStreams.Route(l)
+		}
+	} ()
+	Sinks.Register("coap", func (l Log) {
+		go CoAP.NotifyLog(&l)
+	})
+	go Sinks.RunFlusher()
+	go Clients.RunFlushes()
 	for {
 		l := <-Logs
-		go Clients.BroadcastLog(LogToSSE(&l))
+		l.Version = StateVersion.Add(1)
+		Changes.Record(l)
+		Sinks.Dispatch(l)
 	}
 }
 
+//go:generate go run gen_sri.go
 //go:embed public/*
 var public embed.FS
 
 func main() {
-	err := Adapter.Enable() 
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		os.Exit(Doctor(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(MigrateCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(ConfigCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		os.Exit(RestoreCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "soak" {
+		os.Exit(SoakCommand(os.Args[2:]))
+	}
+
+	flag.StringVar(&DataDir, "data", DataDir, "directory bluboi persists its state in")
+	db := flag.String("db", "sqlite", "where state and history are stored: \"sqlite\" for bluboi.db in the data directory, \"file\" for JSON files in it, or a postgres:// URL")
+	coapAddr := flag.String("coap", "", "address to serve CoAP on (eg. :5683), disabled when empty")
+	snmpAddr := flag.String("snmp", "", "address to serve SNMP on (eg. :1161), disabled when empty")
+	snmpCommunity := flag.String("snmp-community", "public", "SNMP read community")
+	allowRoot := flag.Bool("allow-root", false, "keep running as root instead of refusing to")
+	runAs := flag.String("user", "", "user to switch to once all listeners are bound, when started as root")
+	flag.DurationVar(&ConnectTimeout, "connect-timeout", ConnectTimeout, "how long to wait for a connection before giving up, 0 waits as long as BlueZ does")
+	flag.IntVar(&ConnectPolicy.Attempts, "connect-attempts", ConnectPolicy.Attempts, "how many times to try connecting to a device")
+	flag.DurationVar(&ConnectPolicy.Backoff, "connect-backoff", ConnectPolicy.Backoff, "how long to wait before trying to connect again, doubled after every failed attempt")
+	flag.Float64Var(&ConnectPolicy.Jitter, "connect-jitter", ConnectPolicy.Jitter, "fraction of the wait between connection attempts to randomize")
+	flag.DurationVar(&QueuedCommandMaxAge, "queued-command-max-age", QueuedCommandMaxAge, "how long the UI may have queued a command for while offline and still have it carried out")
+	flag.BoolVar(&Reconnect, "reconnect", Reconnect, "reconnect to devices that drop, unless their metadata says otherwise")
+	flag.BoolVar(&Lockdown, "lockdown", Lockdown, "hold devices seen for the first time back until approved with POST /devices/pending/{addr}/approve")
+	flag.BoolVar(&RequireEncryption, "require-encryption", RequireEncryption, "refuse writes to characteristics requiring encryption over unencrypted links")
+	tts := TTSConfig{}
+	flag.StringVar(&tts.Command, "tts-command", "", "command announcing events, the text replaces {} or goes to stdin (eg. \"espeak --stdin\")")
+	flag.StringVar(&tts.URL, "tts-url", "", "HTTP TTS service events are posted to instead of running a command")
+	ttsEvents := flag.String("tts-events", "DEVICE,DISCONNECTED,ADAPTER_FAILED", "comma separated event types to announce")
+	adapterFlag := flag.String("adapter", "", "adapter to use, eg. hci1, defaults to the one chosen during setup or with POST /adapters/{id}/select")
+	listen := flag.String("listen", "", "address the HTTP server listens on, defaults to the one chosen during setup or " + HTTPAddr)
+	flag.StringVar(&AdminToken, "admin-token", os.Getenv("BLUBOI_ADMIN_TOKEN"), "token required for admin access, overriding the one generated during setup; authentication is disabled when neither is set")
+	windows := flag.String("aggregate", DefaultWindows, "comma separated metric=window pairs aggregated into AGG events")
+	flag.Float64Var(&Anomalies.Threshold, "anomaly-z", Anomalies.Threshold, "standard deviations from its EWMA band a sample has to be to raise an ANOMALY, 0 disables")
+	flag.IntVar(&Presence.DeadAfter, "dead-after", Presence.DeadAfter, "advertising intervals a device may miss before SENSOR_DEAD is raised, 0 disables")
+	expireAfter := flag.Duration("expire-after", 0, "how long a device may go unseen before it is forgotten with DEVICE_GONE, 0 keeps devices forever")
+	memoryBudget := flag.Int("memory-budget", 0, "MiB of memory to stay within, evicting devices and refusing recordings beyond it, 0 for no budget")
+	replica := ReplicaConfig{}
+	flag.StringVar(&replica.URL, "replica", "", "URL the device store is mirrored to with PUT, eg. another bluboi's /replicas/<name>")
+	flag.StringVar(&replica.Token, "replica-token", os.Getenv("BLUBOI_REPLICA_TOKEN"), "bearer token sent to the replica")
+	owntracks := OwnTracksConfig{}
+	flag.StringVar(&owntracks.Region, "owntracks", "", "region (room) to publish presence in as OwnTracks transitions, over MQTT and -owntracks-url")
+	flag.StringVar(&owntracks.User, "owntracks-user", "bluboi", "OwnTracks user the devices belong to")
+	flag.StringVar(&owntracks.URL, "owntracks-url", "", "HTTP endpoint OwnTracks messages are posted to, eg. OwnTracks Recorder's /pub")
+	owntracksLocation := flag.String("owntracks-location", "", "lat,lon of the region")
+	preset := flag.String("preset", "", "tunes the defaults for a use: " + presetNames())
+	scan := flag.String("scan", "on-demand", "\"on-demand\" to scan when asked to, or \"continuous\" to keep scanning")
+	scanType := flag.String("scan-type", "active", "\"active\" to also connect to and pair with devices, or \"passive\" to only listen to advertisements")
+	sniffer := flag.String("sniffer", "", "sniffer captures are recorded with: ubertooth, or a command following {addr} into the pcap {file}; disabled when empty")
+	flag.Parse()
+	err := UsePreset(*preset)
+	if err != nil {
+		log.Fatalf("[ERROR] Invalid -preset - %v", err)
+	}
+	if *scan != "on-demand" && *scan != "continuous" {
+		log.Fatalf("[ERROR] -scan must be on-demand or continuous")
+	}
+	if *scanType != "active" && *scanType != "passive" {
+		log.Fatalf("[ERROR] -scan-type must be active or passive")
+	}
+	Passive = *scanType == "passive"
+	if ConnectPolicy.Attempts < 1 || ConnectPolicy.Backoff < 0 || ConnectPolicy.Jitter < 0 || ConnectPolicy.Jitter > 1 {
+		log.Fatalf("[ERROR] -connect-attempts must be at least 1, -connect-backoff positive and -connect-jitter between 0 and 1")
+	}
+	if *owntracksLocation != "" {
+		owntracks.Lat, owntracks.Lon, err = ParseLocation(*owntracksLocation)
+		if err != nil {
+			log.Fatalf("[ERROR] Invalid -owntracks-location - %v", err)
+		}
+	}
+	tts.Events = strings.Split(*ttsEvents, ",")
+	err = Captures.SetSniffer(*sniffer)
+	if err != nil {
+		log.Fatalf("[ERROR] Invalid -sniffer - %v", err)
+	}
+
+	if os.Geteuid() == 0 && *runAs == "" && !*allowRoot {
+		log.Fatalf("[ERROR] Refusing to run as root - pass -user to drop privileges after start, or -allow-root")
+	}
+
+	aggWindows, err := ParseWindows(*windows)
+	if err != nil {
+		log.Fatalf("[ERROR] Invalid -aggregate - %v", err)
+	}
+	Telemetry.Windows = aggWindows
+	ApplyMemoryBudget(*memoryBudget)
+
+	err = OpenStore(*db)
+	if err != nil {
+		log.Fatalf("[ERROR] Could not open the database - %v", err)
+	}
+	err = CheckSchema()
+	if err != nil {
+		log.Fatalf("[ERROR] Could not migrate the database - %v", err)
+	}
+
+	err = Setup.Load()
+	if err != nil {
+		log.Fatalf("[ERROR] Could not load the setup - %v", err)
+	}
+	if *listen != "" {
+		HTTPAddr = *listen
+	} else if Setup.Config.Listen != "" {
+		HTTPAddr = Setup.Config.Listen
+	}
+	if !Setup.Complete() {
+		log.Println("[INFO] Setup has not been completed, see GET /setup")
+	}
+
+	err = Audit.Open()
+	if err != nil {
+		log.Fatalf("[ERROR] Could not open the audit log - %v", err)
+	}
+	Audit.Record("system", "start", "pid " + strconv.Itoa(os.Getpid()) + " uid " + strconv.Itoa(os.Geteuid()))
+	err = Guests.Load()
+	if err != nil {
+		log.Fatalf("[ERROR] Could not load guest links - %v", err)
+	}
+	err = SigningKeys.Load()
+	if err != nil {
+		log.Fatalf("[ERROR] Could not load signing keys - %v", err)
+	}
+	err = Sinks.Load()
+	if err != nil {
+		log.Fatalf("[ERROR] Could not load sink profiles - %v", err)
+	}
+	err = Calibrations.Load()
+	if err != nil {
+		log.Fatalf("[ERROR] Could not load calibrations - %v", err)
+	}
+	err = VirtualMetrics.Load()
+	if err != nil {
+		log.Fatalf("[ERROR] Invalid virtual metrics - %v", err)
+	}
+	err = GATTSnapshots.Load()
+	if err != nil {
+		log.Fatalf("[ERROR] Could not load GATT snapshots - %v", err)
+	}
+	err = Captures.Load()
+	if err != nil {
+		log.Fatalf("[ERROR] Could not load captures - %v", err)
+	}
+	err = Recordings.Load()
+	if err != nil {
+		log.Fatalf("[ERROR] Could not load recordings - %v", err)
+	}
+	err = Polls.Load()
+	if err != nil {
+		log.Fatalf("[ERROR] Invalid polls - %v", err)
+	}
+	err = Thresholds.Load()
+	if err != nil {
+		log.Fatalf("[ERROR] Invalid thresholds - %v", err)
+	}
+	err = Deadbands.Load()
+	if err != nil {
+		log.Fatalf("[ERROR] Invalid deadbands - %v", err)
+	}
+	err = Machines.Load()
+	if err != nil {
+		log.Fatalf("[ERROR] Invalid state machines - %v", err)
+	}
+	err = Composites.Load()
+	if err != nil {
+		log.Fatalf("[ERROR] Invalid composite devices - %v", err)
+	}
+	err = Metadata.Load()
+	if err != nil {
+		log.Fatalf("[ERROR] Could not load device metadata - %v", err)
+	}
+	err = Known.Load()
+	if err != nil {
+		log.Fatalf("[ERROR] Could not load the known devices - %v", err)
+	}
+	err = People.Load()
+	if err != nil {
+		log.Fatalf("[ERROR] Invalid people - %v", err)
+	}
+	err = Modes.Load()
+	if err != nil {
+		log.Fatalf("[ERROR] Invalid modes - %v", err)
+	}
+	err = DeviceAccess.Load()
+	if err != nil {
+		log.Fatalf("[ERROR] Invalid device lists - %v", err)
+	}
+	err = Onboarding.Load()
+	if err != nil {
+		log.Fatalf("[ERROR] Could not load device approvals - %v", err)
+	}
+	err = MQTT.Load()
+	if err != nil {
+		log.Fatalf("[ERROR] Invalid MQTT config - %v", err)
+	}
+	err = Cloud.Load()
+	if err != nil {
+		log.Fatalf("[ERROR] Invalid cloud config - %v", err)
+	}
+	err = WebPush.Load()
+	if err != nil {
+		log.Fatalf("[ERROR] Invalid webpush config - %v", err)
+	}
+	err = History.Open()
+	if err != nil {
+		log.Fatalf("[ERROR] Could not open the telemetry history - %v", err)
+	}
+
+	if *adapterFlag != "" {
+		err = useAdapter(*adapterFlag)
+		if err != nil {
+			log.Fatalf("[ERROR] Could not use adapter %v - %v", *adapterFlag, err)
+		}
+	} else if Setup.Config.Adapter != "" {
+		err = useAdapter(Setup.Config.Adapter)
+		if err != nil {
+			log.Printf("[ERROR] Could not use adapter %v - %v", Setup.Config.Adapter, err)
+		}
+	}
+	Adapter.Adapter.SetConnectHandler(Adapter.handleConnect)
+	err = Adapter.Enable() 
 	if err != nil {
 		log.Fatalf("[ERROR] Could not enable bluetooth - %v", err)
 	}	
 	go ProcessEventQueue()
 	go BroadcastLogs()
+	go WatchAdapter()
+	Adapter.continuous.Store(*scan == "continuous")
+	go Adapter.ScanContinuously()
+	go WatchHotplug()
+	go RunTTS(tts)
+	go Telemetry.RunAggregation()
+	go Polls.Run()
+	go Presence.WatchPresence()
+	go History.RunCompaction()
+	go History.RunFlushes()
+	go Known.RunFlushes()
+	go FlushOnSignal()
+	go DeviceReports.Run()
+	go People.Run()
+	go Modes.Run()
+	if *expireAfter > 0 {
+		go Devices.RunExpiry(*expireAfter)
+	}
+	go MQTT.Run()
+	go Cloud.Run()
+	go WebPush.Run()
+	if replica.URL != "" {
+		go RunReplication(replica)
+	}
+	if owntracks.Region != "" {
+		go RunOwnTracks(owntracks)
+	}
+	err = Bridges.Load()
+	if err != nil {
+		log.Printf("[ERROR] Could not load bridges - %v", err)
+	}
+
+	// Everything that may need a privileged port is bound before privileges
+	// are dropped.
+	if *coapAddr != "" {
+		err := CoAP.Listen(*coapAddr)
+		if err != nil {
+			log.Printf("[ERROR] Could not start the CoAP server - %v", err)
+		} else {
+			go CoAP.Serve()
+		}
+	}
+
+	if *snmpAddr != "" {
+		agent := SNMPAgent{Community: *snmpCommunity}
+		err := agent.Listen(*snmpAddr)
+		if err != nil {
+			log.Printf("[ERROR] Could not start the SNMP agent - %v", err)
+		} else {
+			go agent.Serve()
+		}
+	}
+
+	listener, err := net.Listen("tcp", HTTPAddr)
+	if err != nil {
+		log.Fatalf("[ERROR] Could not start the server - %v", err)
+	}
+
+	if *runAs != "" && os.Geteuid() == 0 {
+		err := DropPrivileges(*runAs)
+		if err != nil {
+			log.Fatalf("[ERROR] Could not drop privileges - %v", err)
+		}
+		log.Printf("[INFO] Dropped privileges to %v", *runAs)
+		Audit.Record("system", "drop_privileges", *runAs)
+	}
 
 	log.Println("[INFO] Starting HTTP server")
 	r := mux.NewRouter()
 	r.Handle("/events", GetEventsHandler())
-	r.Handle("/scan", ScanHandler())
-	r.Handle("/stop", StopScanHandler())
-	r.Handle("/connect/{addr}", ConnectHandler())
-	r.Handle("/disconnect", DisconnectHandler())
+	r.Handle("/events/digest", DigestHandler())
+	r.Handle("/events/{addr}", DeviceEventsHandler()).Methods("GET")
+	r.Handle("/scan", Audited("scan", ScanHandler()))
+	r.Handle("/scan/mode", GetScanModeHandler()).Methods("GET")
+	r.Handle("/scan/mode", Audited("set_scan_mode", SetScanModeHandler())).Methods("PUT")
+	r.Handle("/stop", Audited("stop_scan", StopScanHandler()))
+	r.Handle("/connect/{addr}", Audited("connect", ConnectHandler()))
+	r.Handle("/connect/{addr}/cancel", Audited("cancel_connect", CancelConnectHandler())).Methods("POST")
+	r.Handle("/disconnect", Audited("disconnect", DisconnectHandler()))
+	r.Handle("/disconnect/{addr}", Audited("disconnect", DisconnectHandler()))
+	r.Handle("/wedge", Audited("wedge", WedgeHandler())).Methods("POST")
+	r.Handle("/wedge/stop", Audited("stop_wedge", StopWedgeHandler()))
+	r.Handle("/serial", Audited("serial", SerialHandler())).Methods("POST")
+	r.Handle("/serial/stop", Audited("stop_serial", StopSerialHandler()))
+	r.Handle("/state", StateHandler()).Methods("GET")
+	r.Handle("/state/changes", StateChangesHandler()).Methods("GET")
+	r.Handle("/commands", CommandsHandler(r)).Methods("POST")
+	r.Handle("/health", HealthHandler())
+	r.Handle("/status", StatusHandler()).Methods("GET")
+	r.Handle("/adapter", AdapterHandler()).Methods("GET")
+	r.Handle("/adapter/power/on", Audited("power_on_adapter", AdapterPowerHandler(true))).Methods("POST")
+	r.Handle("/adapter/power/off", Audited("power_off_adapter", AdapterPowerHandler(false))).Methods("POST")
+	r.Handle("/adapters", ListAdaptersHandler()).Methods("GET")
+	r.Handle("/adapters/{id}/select", Audited("select_adapter", SelectAdapterHandler())).Methods("POST")
+	r.Handle("/people", ListPeopleHandler()).Methods("GET")
+	r.Handle("/people/config", GetPeopleHandler()).Methods("GET")
+	r.Handle("/people/config", Audited("set_people", SetPeopleHandler())).Methods("PUT")
+	r.Handle("/mode", GetModeHandler()).Methods("GET")
+	r.Handle("/mode", Audited("set_mode", SetModeHandler())).Methods("PUT")
+	r.Handle("/metrics", MetricsHandler()).Methods("GET")
+	r.Handle("/setup", GetSetupHandler()).Methods("GET")
+	r.Handle("/setup", Audited("setup", FinishSetupHandler())).Methods("POST")
+	r.Handle("/pair/{addr}", Audited("pair", PairHandler())).Methods("POST")
+	r.Handle("/pair/{addr}", Audited("unpair", UnpairHandler())).Methods("DELETE")
+	r.Handle("/bonds", BondsHandler()).Methods("GET")
+	r.Handle("/bond/{addr}", Audited("unpair", UnpairHandler())).Methods("DELETE")
+	r.Handle("/pair/{addr}/respond", Audited("respond_pairing", RespondPairingHandler())).Methods("POST")
+	r.Handle("/connection", ConnectionHandler()).Methods("GET")
+	r.Handle("/connections", ListConnectionsHandler()).Methods("GET")
+	r.Handle("/devices", ListDevicesHandler()).Methods("GET")
+	r.Handle("/devices/lists", GetDeviceListsHandler()).Methods("GET")
+	r.Handle("/devices/lists", Audited("set_device_lists", SetDeviceListsHandler())).Methods("PUT")
+	r.Handle("/devices/known", ListKnownHandler()).Methods("GET")
+	r.Handle("/devices/known/{addr}", Audited("forget_device", ForgetKnownHandler())).Methods("DELETE")
+	r.Handle("/devices/pending", ListPendingHandler()).Methods("GET")
+	r.Handle("/devices/pending/{addr}/approve", Audited("approve_device", ApprovePendingHandler())).Methods("POST")
+	r.Handle("/devices/pending/{addr}/reject", Audited("reject_device", RejectPendingHandler())).Methods("POST")
+	r.Handle("/devices/{addr}", DeviceHandler()).Methods("GET")
+	r.Handle("/devices/meta", Audited("bulk_update_metadata", BulkMetaHandler())).Methods("PATCH")
+	r.Handle("/devices/{addr}/meta", GetMetaHandler()).Methods("GET")
+	r.Handle("/devices/{addr}/meta", Audited("update_metadata", UpdateMetaHandler())).Methods("PUT", "PATCH")
+	r.Handle("/devices/{addr}/alias", Audited("set_alias", SetAliasHandler())).Methods("PUT")
+	r.Handle("/device/{addr}/alias", Audited("set_alias", SetAliasHandler())).Methods("PUT")
+	r.Handle("/devices/{addr}/favorite", Audited("favorite", FavoriteHandler())).Methods("POST", "DELETE")
+	r.Handle("/device/{addr}/favorite", Audited("favorite", FavoriteHandler())).Methods("POST", "DELETE")
+	r.Handle("/devices/{addr}/desired-state", Audited("converge", DesiredStateHandler())).Methods("PUT")
+	r.Handle("/device/{addr}/desired-state", Audited("converge", DesiredStateHandler())).Methods("PUT")
+	r.Handle("/devices/{addr}/services", ListServicesHandler()).Methods("GET")
+	r.Handle("/device/{addr}/services", ListServicesHandler()).Methods("GET")
+	r.Handle("/devices/{addr}/gatt-snapshots", ListGATTSnapshotsHandler()).Methods("GET")
+	r.Handle("/devices/{addr}/gatt-snapshots", Audited("take_gatt_snapshot", TakeGATTSnapshotHandler())).Methods("POST")
+	r.Handle("/devices/{addr}/gatt-snapshots/diff", DiffGATTSnapshotsHandler()).Methods("GET")
+	r.Handle("/devices/{addr}/mtu", GetMTUHandler()).Methods("GET")
+	r.Handle("/devices/{addr}/mtu", Audited("request_mtu", RequestMTUHandler())).Methods("POST")
+	r.Handle("/devices/{addr}/console", ConsoleHandler()).Methods("GET")
+	r.Handle("/devices/{addr}/char/{uuid}", ReadCharacteristicHandler()).Methods("GET")
+	r.Handle("/device/{addr}/char/{uuid}", ReadCharacteristicHandler()).Methods("GET")
+	r.Handle("/devices/{addr}/char/{uuid}", Audited("write_characteristic", WriteCharacteristicHandler())).Methods("POST")
+	r.Handle("/device/{addr}/char/{uuid}", Audited("write_characteristic", WriteCharacteristicHandler())).Methods("POST")
+	r.Handle("/devices/{addr}/writes", Audited("write_characteristics", WriteSequenceHandler())).Methods("POST")
+	r.Handle("/devices/{addr}/char/{uuid}/desc/{desc}", ReadDescriptorHandler()).Methods("GET")
+	r.Handle("/devices/{addr}/char/{uuid}/desc/{desc}", Audited("write_descriptor", WriteDescriptorHandler())).Methods("POST")
+	r.Handle("/devices/{addr}/subscribe/{uuid}", Audited("subscribe", SubscribeHandler())).Methods("POST")
+	r.Handle("/device/{addr}/subscribe/{uuid}", Audited("subscribe", SubscribeHandler())).Methods("POST")
+	r.Handle("/devices/{addr}/unsubscribe/{uuid}", Audited("unsubscribe", UnsubscribeHandler())).Methods("POST")
+	r.Handle("/devices/{addr}/polls", GetPollsHandler()).Methods("GET")
+	r.Handle("/devices/{addr}/polls", Audited("set_polls", SetPollsHandler())).Methods("PUT")
+	r.Handle("/devices/{addr}/thresholds", GetThresholdsHandler()).Methods("GET")
+	r.Handle("/devices/{addr}/thresholds", Audited("set_thresholds", SetThresholdsHandler())).Methods("PUT")
+	r.Handle("/devices/{addr}/thresholds/replay", ReplayThresholdsHandler()).Methods("POST")
+	r.Handle("/devices/{addr}/deadbands", GetDeadbandsHandler()).Methods("GET")
+	r.Handle("/devices/{addr}/deadbands", Audited("set_deadbands", SetDeadbandsHandler())).Methods("PUT")
+	r.Handle("/devices/{addr}/machine", GetMachineHandler()).Methods("GET")
+	r.Handle("/devices/{addr}/machine", Audited("set_machine", SetMachineHandler())).Methods("PUT")
+	r.Handle("/devices/{addr}/machine", Audited("delete_machine", DeleteMachineHandler())).Methods("DELETE")
+	r.Handle("/devices/{addr}/machine/{event}", Audited("machine_event", FireMachineEventHandler())).Methods("POST")
+	r.Handle("/devices/{addr}/calibration", ListCalibrationsHandler()).Methods("GET")
+	r.Handle("/devices/{addr}/calibration", Audited("calibrate", AddCalibrationHandler())).Methods("POST")
+	r.Handle("/captures", ListCapturesHandler()).Methods("GET")
+	r.Handle("/captures", Audited("start_capture", StartCaptureHandler())).Methods("POST")
+	r.Handle("/captures/{id}", DownloadCaptureHandler()).Methods("GET")
+	r.Handle("/captures/{id}", Audited("delete_capture", DeleteCaptureHandler())).Methods("DELETE")
+	r.Handle("/captures/{id}/stop", Audited("stop_capture", StopCaptureHandler())).Methods("POST")
+	r.Handle("/recordings", ListRecordingsHandler()).Methods("GET")
+	r.Handle("/recordings", Audited("start_recording", StartRecordingHandler())).Methods("POST")
+	r.Handle("/recordings/{id}", DownloadRecordingHandler()).Methods("GET")
+	r.Handle("/recordings/{id}", Audited("delete_recording", DeleteRecordingHandler())).Methods("DELETE")
+	r.Handle("/recordings/{id}/stop", Audited("stop_recording", StopRecordingHandler())).Methods("POST")
+	r.Handle("/replicas", ListReplicasHandler()).Methods("GET")
+	r.Handle("/replicas/{gateway}", GetReplicaHandler()).Methods("GET")
+	r.Handle("/replicas/{gateway}", PutReplicaHandler()).Methods("PUT")
+	r.Handle("/telemetry/aggregates", ExportAggregatesHandler()).Methods("GET")
+	r.Handle("/bridges", ListBridgesHandler()).Methods("GET")
+	r.Handle("/bridges", Audited("add_bridge", AddBridgeHandler())).Methods("POST")
+	r.Handle("/bridges/{port}", Audited("remove_bridge", RemoveBridgeHandler())).Methods("DELETE")
+	r.Handle("/audit", ExportAuditHandler()).Methods("GET")
+	r.Handle("/audit/verify", VerifyAuditHandler()).Methods("GET")
+	r.Handle("/admin/guests", ListGuestsHandler()).Methods("GET")
+	r.Handle("/admin/guests", Audited("issue_guest", IssueGuestHandler())).Methods("POST")
+	r.Handle("/admin/guests/{id}", Audited("revoke_guest", RevokeGuestHandler())).Methods("DELETE")
+	r.Handle("/admin/snapshot", Audited("snapshot", SnapshotHandler())).Methods("POST")
+	r.Handle("/admin/config/validate", ValidateConfigHandler()).Methods("POST")
+	r.Handle("/admin/plan", PlanHandler()).Methods("POST")
+	r.Handle("/admin/apply", Audited("apply_config", ApplyHandler())).Methods("POST")
+	r.Handle("/admin/retention", GetRetentionHandler()).Methods("GET")
+	r.Handle("/admin/retention", Audited("set_retention", SetRetentionHandler())).Methods("PUT")
+	r.Handle("/admin/cloud", GetCloudHandler()).Methods("GET")
+	r.Handle("/admin/cloud", Audited("set_cloud", SetCloudHandler())).Methods("PUT")
+	r.Handle("/admin/mqtt", GetMQTTHandler()).Methods("GET")
+	r.Handle("/admin/mqtt", Audited("set_mqtt", SetMQTTHandler())).Methods("PUT")
+	r.Handle("/admin/webpush", GetWebPushHandler()).Methods("GET")
+	r.Handle("/admin/webpush", Audited("set_webpush", SetWebPushHandler())).Methods("PUT")
+	r.Handle("/admin/webpush/rotate", Audited("rotate_webpush_keys", RotateWebPushKeysHandler())).Methods("POST")
+	r.Handle("/webpush/key", WebPushKeyHandler()).Methods("GET")
+	r.Handle("/webpush/subscriptions", Audited("subscribe_webpush", SubscribePushHandler())).Methods("POST")
+	r.Handle("/webpush/subscriptions", Audited("unsubscribe_webpush", UnsubscribePushHandler())).Methods("DELETE")
+	r.Handle("/admin/virtual-metrics", GetVirtualMetricsHandler()).Methods("GET")
+	r.Handle("/admin/virtual-metrics", Audited("set_virtual_metrics", SetVirtualMetricsHandler())).Methods("PUT")
+	r.Handle("/admin/composites", GetCompositesHandler()).Methods("GET")
+	r.Handle("/admin/composites", Audited("set_composites", SetCompositesHandler())).Methods("PUT")
+	r.Handle("/admin/sinks", GetSinksHandler()).Methods("GET")
+	r.Handle("/admin/sinks", Audited("set_sink_profiles", SetSinksHandler())).Methods("PUT")
+	r.Handle("/admin/signing-keys", ListSigningKeysHandler()).Methods("GET")
+	r.Handle("/admin/signing-keys/rotate", Audited("rotate_signing_key", RotateSigningKeyHandler())).Methods("POST")
 	r.PathPrefix("/").Handler(ServeUI())
+	r.Use(AuthMiddleware)
+	r.Use(PresetMiddleware)
+	r.Use(IdempotencyMiddleware)
 	server := http.Server {
-		Addr: ":6969",
 		Handler: r,
 		ReadHeaderTimeout: 3 * time.Second,
 		ReadTimeout: 10 * time.Second,
 	}
-	err = server.ListenAndServe()
+	err = server.Serve(listener)
 	if err != nil {
 		log.Printf("[ERROR] Could not start the server - %v", err)
 	}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"testing"
+
+	"tinygo.org/x/bluetooth"
+)
+
+var pipeline sync.Once
+
+// startPipeline sets up a data directory and the workers the scan callback
+// hands off to, once for every benchmark.
+func startPipeline(b *testing.B) {
+	pipeline.Do(func () {
+		DataDir = b.TempDir()
+		log.SetOutput(io.Discard)
+		if err := OpenStore("file"); err != nil {
+			b.Fatal(err)
+		}
+		windows, _ := ParseWindows(DefaultWindows)
+		Telemetry.Windows = windows
+		go BroadcastLogs()
+		go DeviceReports.Run()
+		go History.RunFlushes()
+	})
+}
+
+// BenchmarkHandleScanResult measures an advertisement from a device already
+// listed going through the scan callback.
+func BenchmarkHandleScanResult(b *testing.B) {
+	startPipeline(b)
+	results := make([]bluetooth.ScanResult, 100)
+	for i := range results {
+		results[i].Address.MAC = bluetooth.MAC{byte(i), 0x00, 0x00, 0x50, 0xa4, 0x5e}
+		results[i].RSSI = -60
+		results[i].AdvertisementPayload = syntheticAdvertisement{
+			name: fmt.Sprintf("bench-%d", i),
+			manufacturer: map[uint16][]byte{0xffff: {byte(i), 0x64}},
+		}
+		Adapter.handleScanResult(results[i])
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Adapter.handleScanResult(results[i % len(results)])
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"log"
+	"runtime/debug"
+)
+
+// Rough costs of what a memory budget bounds: a device across the registry,
+// presence, telemetry and anomaly tracking, and a recording's full queue.
+const (
+	deviceFootprint    = 2 << 10
+	recordingFootprint = recordingQueue * 128
+	// Shares of the budget, as fractions, left for devices and for
+	// recordings. The rest covers everything of fixed size.
+	budgetDeviceShare    = 8
+	budgetRecordingShare = 8
+)
+
+// ApplyMemoryBudget keeps bluboi within mib MiB, for small boards: the Go
+// runtime collects garbage harder as it gets close, the devices seen
+// longest ago are evicted once the registry holds its share, and
+// recordings are refused beyond theirs. Raw history batches and telemetry
+// history are fixed size already.
+func ApplyMemoryBudget(mib int) {
+	if mib <= 0 {
+		return
+	}
+	budget := int64(mib) << 20
+	debug.SetMemoryLimit(budget)
+	Devices.Limit = max(int(budget / budgetDeviceShare / deviceFootprint), 1)
+	Recordings.Limit = max(int(budget / budgetRecordingShare / recordingFootprint), 1)
+	log.Printf("[INFO] Memory budget of %v MiB, keeping up to %v devices and %v recordings", mib, Devices.Limit, Recordings.Limit)
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+const metadataFile = "metadata.json"
+
+// DeviceMeta is what users attach to a device. Version goes up with every
+// change and is served as the ETag, so concurrent editors can't overwrite
+// each other's changes unknowingly.
+type DeviceMeta struct {
+	Alias     string   `json:",omitempty"`
+	Tags      []string `json:",omitempty"`
+	// Reconnect overrides -reconnect for the device when set.
+	Reconnect *bool    `json:",omitempty"`
+	// Favorite devices are listed even when they're out of range.
+	Favorite  bool     `json:",omitempty"`
+	Version   int
+}
+
+// MetaPatch changes only the fields it sets. AddTags and RemoveTags edit the
+// tags rather than replacing them.
+type MetaPatch struct {
+	Alias      *string
+	Tags       *[]string
+	AddTags    []string
+	RemoveTags []string
+	Reconnect  *bool
+	Favorite   *bool
+}
+
+type SafeMetadata struct {
+	mu      sync.Mutex
+	Devices map[string]DeviceMeta
+}
+
+var Metadata = SafeMetadata{Devices: map[string]DeviceMeta{}}
+
+var errMetaConflict = errors.New("metadata changed since it was read")
+
+func (m DeviceMeta) ETag() string {
+	return "\"" + strconv.Itoa(m.Version) + "\""
+}
+
+func (p MetaPatch) Apply(m DeviceMeta) DeviceMeta {
+	if p.Alias != nil {
+		m.Alias = strings.TrimSpace(*p.Alias)
+	}
+	if p.Reconnect != nil {
+		m.Reconnect = p.Reconnect
+	}
+	if p.Favorite != nil {
+		m.Favorite = *p.Favorite
+	}
+	tags := slices.Clone(m.Tags)
+	if p.Tags != nil {
+		tags = slices.Clone(*p.Tags)
+	}
+	for _, tag := range p.AddTags {
+		if !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	tags = slices.DeleteFunc(tags, func (tag string) bool {
+		return tag == "" || slices.Contains(p.RemoveTags, tag)
+	})
+	slices.Sort(tags)
+	m.Tags = slices.Compact(tags)
+	return m
+}
+
+// Load also folds entries stored under lower case addresses into the upper
+// case ones, keeping the most edited of the two.
+func (sm *SafeMetadata) Load() error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	devices := map[string]DeviceMeta{}
+	err := LoadJSON(metadataFile, &devices)
+	if err != nil {
+		return err
+	}
+	sm.Devices = map[string]DeviceMeta{}
+	for addr, m := range devices {
+		addr = strings.ToUpper(addr)
+		if current, ok := sm.Devices[addr]; !ok || m.Version > current.Version {
+			sm.Devices[addr] = m
+		}
+	}
+	return nil
+}
+
+// DisplayName is what to call a device in events: its alias, or the name it
+// advertises.
+func DisplayName(addr string) string {
+	if alias := Metadata.Get(addr).Alias; alias != "" {
+		return alias
+	}
+	return Devices.Device(addr).Name
+}
+
+// Favorites lists the addresses of the favorite devices.
+func (sm *SafeMetadata) Favorites() []string {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	addrs := []string{}
+	for addr, m := range sm.Devices {
+		if m.Favorite {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+func (sm *SafeMetadata) Get(addr string) DeviceMeta {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.Devices[strings.ToUpper(addr)]
+}
+
+// Update applies change to a device's metadata if it is still at the
+// version the caller read, any version when ifMatch is empty.
+func (sm *SafeMetadata) Update(addr string, ifMatch string, change func (DeviceMeta) DeviceMeta) (DeviceMeta, error) {
+	addr = strings.ToUpper(addr)
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	current := sm.Devices[addr]
+	if ifMatch != "" && ifMatch != "*" && ifMatch != current.ETag() {
+		return current, errMetaConflict
+	}
+	updated := change(current)
+	updated.Version = current.Version + 1
+	devices := map[string]DeviceMeta{}
+	for a, m := range sm.Devices {
+		devices[a] = m
+	}
+	devices[addr] = updated
+	err := SaveJSON(metadataFile, devices)
+	if err != nil {
+		return current, err
+	}
+	sm.Devices = devices
+	return updated, nil
+}
+
+func writeMeta(w http.ResponseWriter, m DeviceMeta) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", m.ETag())
+	json.NewEncoder(w).Encode(m)
+}
+
+func GetMetaHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		m := Metadata.Get(mux.Vars(r)["addr"])
+		if r.Header.Get("If-None-Match") == m.ETag() {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		writeMeta(w, m)
+	}
+}
+
+// UpdateMetaHandler replaces the metadata on PUT and patches it on PATCH.
+// Send the ETag read before as If-Match to get a 412 instead of overwriting
+// someone else's change.
+func UpdateMetaHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		patch := MetaPatch{}
+		var change func (DeviceMeta) DeviceMeta
+		if r.Method == http.MethodPut {
+			meta := DeviceMeta{}
+			err := json.NewDecoder(r.Body).Decode(&meta)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			patch.Alias = &meta.Alias
+			patch.Tags = &meta.Tags
+			change = func (m DeviceMeta) DeviceMeta {
+				m = patch.Apply(m)
+				m.Reconnect = meta.Reconnect
+				m.Favorite = meta.Favorite
+				return m
+			}
+		} else {
+			err := json.NewDecoder(r.Body).Decode(&patch)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			change = patch.Apply
+		}
+		addr := mux.Vars(r)["addr"]
+		alias := Metadata.Get(addr).Alias
+		m, err := Metadata.Update(addr, r.Header.Get("If-Match"), change)
+		if errors.Is(err, errMetaConflict) {
+			w.Header().Set("ETag", m.ETag())
+			http.Error(w, err.Error(), http.StatusPreconditionFailed)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if m.Alias != alias {
+			reportAlias(addr)
+		}
+		writeMeta(w, m)
+	}
+}
+
+// reportAlias sends a scanned device's DEVICE event again once its alias
+// changed, so clients show it right away.
+func reportAlias(addr string) {
+	addr = strings.ToUpper(addr)
+	if Devices.Exists(addr) {
+		LogDeviceInfo(Devices.Device(addr).DeviceInfo()...)
+	}
+}
+
+type AliasRequest struct {
+	Alias string
+}
+
+// SetAliasHandler gives a device the nickname it's shown by, an empty
+// Alias removing it. It takes If-Match like UpdateMetaHandler.
+func SetAliasHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		req := AliasRequest{}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		addr := strings.ToUpper(mux.Vars(r)["addr"])
+		m, err := Metadata.Update(addr, r.Header.Get("If-Match"), MetaPatch{Alias: &req.Alias}.Apply)
+		if errors.Is(err, errMetaConflict) {
+			w.Header().Set("ETag", m.ETag())
+			http.Error(w, err.Error(), http.StatusPreconditionFailed)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		reportAlias(addr)
+		writeMeta(w, m)
+	}
+}
+
+// FavoriteHandler pins a device to /devices on POST, so it's listed even
+// out of range, and unpins it on DELETE. It takes If-Match like
+// UpdateMetaHandler.
+func FavoriteHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		favorite := r.Method == http.MethodPost
+		addr := strings.ToUpper(mux.Vars(r)["addr"])
+		m, err := Metadata.Update(addr, r.Header.Get("If-Match"), MetaPatch{Favorite: &favorite}.Apply)
+		if errors.Is(err, errMetaConflict) {
+			w.Header().Set("ETag", m.ETag())
+			http.Error(w, err.Error(), http.StatusPreconditionFailed)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeMeta(w, m)
+	}
+}
+
+// MetaFilter selects devices by every field it sets.
+type MetaFilter struct {
+	NamePrefix string
+	Alias      string
+	Tag        string
+	Addresses  []string
+}
+
+type BulkMetaRequest struct {
+	Filter  MetaFilter
+	Changes MetaPatch
+	// IfMatch optionally maps addresses to the ETag last read for them.
+	IfMatch map[string]string
+}
+
+type BulkMetaResult struct {
+	Address string
+	Status  int
+	Meta    *DeviceMeta `json:",omitempty"`
+	Error   string      `json:",omitempty"`
+}
+
+func (f MetaFilter) Empty() bool {
+	return f.NamePrefix == "" && f.Alias == "" && f.Tag == "" && len(f.Addresses) == 0
+}
+
+func (f MetaFilter) Match(addr string, name string, meta DeviceMeta) bool {
+	return (f.NamePrefix == "" || strings.HasPrefix(name, f.NamePrefix)) &&
+		(f.Alias == "" || meta.Alias == f.Alias) &&
+		(f.Tag == "" || slices.Contains(meta.Tags, f.Tag)) &&
+		(len(f.Addresses) == 0 || slices.Contains(f.Addresses, addr))
+}
+
+// UpdateMatching patches every device matching the filter and saves once.
+// Devices whose ETag doesn't match are skipped and reported, the others are
+// still updated.
+func (sm *SafeMetadata) UpdateMatching(req BulkMetaRequest) ([]BulkMetaResult, error) {
+	names := map[string]string{}
+	Devices.ForEach(func (addr string, device Device) {
+		names[addr] = device.Name
+	})
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	for addr := range sm.Devices {
+		if _, ok := names[addr]; !ok {
+			names[addr] = ""
+		}
+	}
+	devices := map[string]DeviceMeta{}
+	for a, m := range sm.Devices {
+		devices[a] = m
+	}
+	results := []BulkMetaResult{}
+	updates := 0
+	for addr, name := range names {
+		current := devices[addr]
+		if !req.Filter.Match(addr, name, current) {
+			continue
+		}
+		if ifMatch := req.IfMatch[addr]; ifMatch != "" && ifMatch != current.ETag() {
+			results = append(results, BulkMetaResult{addr, http.StatusPreconditionFailed, &current, errMetaConflict.Error()})
+			continue
+		}
+		updated := req.Changes.Apply(current)
+		updated.Version = current.Version + 1
+		devices[addr] = updated
+		updates++
+		results = append(results, BulkMetaResult{Address: addr, Status: http.StatusOK, Meta: &updated})
+	}
+	slices.SortFunc(results, func (a, b BulkMetaResult) int {
+		return strings.Compare(a.Address, b.Address)
+	})
+	if updates == 0 {
+		return results, nil
+	}
+	err := SaveJSON(metadataFile, devices)
+	if err != nil {
+		return nil, err
+	}
+	sm.Devices = devices
+	return results, nil
+}
+
+func BulkMetaHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		req := BulkMetaRequest{}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Filter.Empty() {
+			http.Error(w, "a filter is required", http.StatusBadRequest)
+			return
+		}
+		results, err := Metadata.UpdateMatching(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	}
+}
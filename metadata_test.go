@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestMetadataETags(t *testing.T) {
+	useDataDir(t)
+	t.Cleanup(func () { Metadata = SafeMetadata{Devices: map[string]DeviceMeta{}} })
+	Metadata = SafeMetadata{Devices: map[string]DeviceMeta{}}
+	r := mux.NewRouter()
+	r.Handle("/devices/{addr}/meta", GetMetaHandler()).Methods("GET")
+	r.Handle("/devices/{addr}/meta", UpdateMetaHandler()).Methods("PUT", "PATCH")
+	r.Handle("/devices/{addr}/alias", SetAliasHandler()).Methods("PUT")
+	r.Handle("/devices/{addr}/favorite", FavoriteHandler()).Methods("POST", "DELETE")
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		header  string
+		value   string
+		body    string
+		status  int
+		etag    string
+	}{
+		{"nothing yet", "GET", "/devices/aa:bb:cc:dd:ee:ff/meta", "", "", "", 200, `"0"`},
+		{"patch", "PATCH", "/devices/aa:bb:cc:dd:ee:ff/meta", "If-Match", `"0"`, `{"AddTags": ["kitchen"]}`, 200, `"1"`},
+		{"same record upper case", "PATCH", "/devices/AA:BB:CC:DD:EE:FF/meta", "If-Match", `"0"`, `{"AddTags": ["hall"]}`, 412, `"1"`},
+		{"put", "PUT", "/devices/AA:BB:CC:DD:EE:FF/meta", "If-Match", `"1"`, `{"Alias": "fridge", "Tags": ["kitchen"]}`, 200, `"2"`},
+		{"stale alias", "PUT", "/devices/aa:bb:cc:dd:ee:ff/alias", "If-Match", `"1"`, `{"Alias": "freezer"}`, 412, `"2"`},
+		{"alias", "PUT", "/devices/aa:bb:cc:dd:ee:ff/alias", "If-Match", `"2"`, `{"Alias": "freezer"}`, 200, `"3"`},
+		{"favorite without If-Match", "POST", "/devices/aa:bb:cc:dd:ee:ff/favorite", "", "", "", 200, `"4"`},
+		{"stale favorite", "DELETE", "/devices/AA:BB:CC:DD:EE:FF/favorite", "If-Match", `"3"`, "", 412, `"4"`},
+		{"any version", "DELETE", "/devices/AA:BB:CC:DD:EE:FF/favorite", "If-Match", "*", "", 200, `"5"`},
+		{"not modified", "GET", "/devices/aa:bb:cc:dd:ee:ff/meta", "If-None-Match", `"5"`, "", 304, ""},
+		{"modified", "GET", "/devices/aa:bb:cc:dd:ee:ff/meta", "If-None-Match", `"4"`, "", 200, `"5"`},
+		{"bad body", "PATCH", "/devices/aa:bb:cc:dd:ee:ff/meta", "", "", "{", 400, ""},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		if test.header != "" {
+			req.Header.Set(test.header, test.value)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != test.status || w.Header().Get("ETag") != test.etag {
+			t.Errorf("%v: got %d with ETag %v, want %d with %v", test.name, w.Code, w.Header().Get("ETag"), test.status, test.etag)
+		}
+	}
+	m := Metadata.Get("aa:bb:cc:dd:ee:ff")
+	if len(Metadata.Devices) != 1 || m.Alias != "freezer" || m.Favorite || strings.Join(m.Tags, ",") != "kitchen" {
+		t.Errorf("got %+v in %v", m, Metadata.Devices)
+	}
+}
+
+func TestMetadataLoadFoldsCase(t *testing.T) {
+	useDataDir(t)
+	t.Cleanup(func () { Metadata = SafeMetadata{Devices: map[string]DeviceMeta{}} })
+	SaveJSON(metadataFile, map[string]DeviceMeta{
+		"aa:bb:cc:dd:ee:ff": {Alias: "newer", Version: 3},
+		"AA:BB:CC:DD:EE:FF": {Alias: "older", Version: 1},
+		"11:22:33:44:55:66": {Alias: "only", Version: 1},
+	})
+	if err := Metadata.Load(); err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]string{"AA:BB:CC:DD:EE:FF": "newer", "11:22:33:44:55:66": "only"}
+	for addr, alias := range tests {
+		if got := Metadata.Get(addr).Alias; got != alias {
+			t.Errorf("%v: got %q, want %q", addr, got, alias)
+		}
+	}
+	if len(Metadata.Devices) != 2 {
+		t.Errorf("got %v, want 2 devices", Metadata.Devices)
+	}
+}
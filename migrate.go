@@ -0,0 +1,178 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+// Migration moves a backend's schema from Version - 1 to Version, and Down
+// back again.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// LoadMigrations reads the NNNN_name.up.sql and NNNN_name.down.sql pairs
+// embedded for a backend, ordered by version.
+func LoadMigrations(backend string) ([]Migration, error) {
+	return loadMigrations(migrationFiles, path.Join("migrations", backend))
+}
+
+func loadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		base, direction, ok := strings.Cut(strings.TrimSuffix(entry.Name(), ".sql"), ".")
+		number, name, _ := strings.Cut(base, "_")
+		version, err := strconv.Atoi(number)
+		if !ok || err != nil || version < 1 {
+			return nil, errors.New("badly named migration " + entry.Name())
+		}
+		script, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		switch direction {
+		case "up":
+			m.Up = string(script)
+		case "down":
+			m.Down = string(script)
+		default:
+			return nil, errors.New("badly named migration " + entry.Name())
+		}
+	}
+	migrations := []Migration{}
+	for _, m := range byVersion {
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func (i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	for i, m := range migrations {
+		if m.Version != i + 1 || m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d is missing or incomplete", i + 1)
+		}
+	}
+	return migrations, nil
+}
+
+// LatestSchema is the schema version this binary expects.
+func LatestSchema() int {
+	return len(Store.Migrations())
+}
+
+// Migrate moves the store's schema to target, one migration at a time.
+func Migrate(target int) error {
+	migrations := Store.Migrations()
+	if target < 0 || target > len(migrations) {
+		return fmt.Errorf("no schema version %d, latest is %d", target, len(migrations))
+	}
+	current, err := Store.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if current > len(migrations) {
+		return fmt.Errorf("schema version %d is newer than this binary knows (%d)", current, len(migrations))
+	}
+	for ; current < target; current++ {
+		m := migrations[current]
+		log.Printf("[INFO] Migrating to schema %d (%v)", m.Version, m.Name)
+		if err := Store.ApplyMigration(m, true); err != nil {
+			return fmt.Errorf("migration %d failed - %w", m.Version, err)
+		}
+	}
+	for ; current > target; current-- {
+		m := migrations[current - 1]
+		log.Printf("[INFO] Reverting schema %d (%v)", m.Version, m.Name)
+		if err := Store.ApplyMigration(m, false); err != nil {
+			return fmt.Errorf("reverting migration %d failed - %w", m.Version, err)
+		}
+	}
+	return nil
+}
+
+// CheckSchema brings an older store up to date on start, and refuses to
+// touch one written by a newer binary.
+func CheckSchema() error {
+	current, err := Store.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if current > LatestSchema() {
+		return fmt.Errorf("schema version %d is newer than this binary knows (%d), upgrade bluboi or run an older binary's migrate down", current, LatestSchema())
+	}
+	return Migrate(LatestSchema())
+}
+
+// MigrateCommand implements `bluboi migrate [status|up|down|to N]`.
+func MigrateCommand(args []string) int {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	flags.StringVar(&DataDir, "data", DataDir, "directory bluboi persists its state in")
+	db := flags.String("db", "sqlite", "where state and history are stored: \"sqlite\" for bluboi.db in the data directory, \"file\" for JSON files in it, or a postgres:// URL")
+	flags.Parse(args)
+	err := OpenStore(*db)
+	if err != nil {
+		fmt.Println("Could not open the database -", err)
+		return 1
+	}
+	defer Store.Close()
+	current, err := Store.SchemaVersion()
+	if err != nil {
+		fmt.Println("Could not read the schema version -", err)
+		return 1
+	}
+	target := current
+	switch command := flags.Arg(0); command {
+	case "", "status":
+		fmt.Printf("Schema version %d, latest %d\n", current, LatestSchema())
+		for _, m := range Store.Migrations() {
+			state := "pending"
+			if m.Version <= current {
+				state = "applied"
+			}
+			fmt.Printf("  %04d %-20s %v\n", m.Version, m.Name, state)
+		}
+		return 0
+	case "up":
+		target = LatestSchema()
+	case "down":
+		target = current - 1
+	case "to":
+		target, err = strconv.Atoi(flags.Arg(1))
+		if err != nil {
+			fmt.Println("Usage: bluboi migrate to <version>")
+			return 2
+		}
+	default:
+		fmt.Println("Usage: bluboi migrate [-db url] [status|up|down|to <version>]")
+		return 2
+	}
+	err = Migrate(target)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	fmt.Printf("Schema version %d\n", target)
+	return 0
+}
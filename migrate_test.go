@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		want  string
+		err   string
+	}{
+		{"ordered by version", []string{"0010_ten", "0002_two", "0001_one", "0003_three", "0004_four", "0005_five", "0006_six", "0007_seven", "0008_eight", "0009_nine"}, "one two three four five six seven eight nine ten", ""},
+		{"none", nil, "", ""},
+		{"gap", []string{"0001_one", "0003_three"}, "", "migration 2 is missing or incomplete"},
+		{"not from 1", []string{"0002_two"}, "", "migration 1 is missing or incomplete"},
+		{"bad number", []string{"one_one"}, "", "badly named migration one_one.down.sql"},
+		{"zero", []string{"0000_zero"}, "", "badly named migration 0000_zero.down.sql"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func (t *testing.T) {
+			fsys := fstest.MapFS{"m": {Mode: fs.ModeDir | 0o755}}
+			for _, name := range test.files {
+				fsys["m/" + name + ".up.sql"] = &fstest.MapFile{Data: []byte("up " + name)}
+				fsys["m/" + name + ".down.sql"] = &fstest.MapFile{Data: []byte("down " + name)}
+			}
+			migrations, err := loadMigrations(fsys, "m")
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			names := []string{}
+			for i, m := range migrations {
+				if m.Version != i + 1 || !strings.HasPrefix(m.Up, "up ") || !strings.HasPrefix(m.Down, "down ") {
+					t.Errorf("migration %d is %+v", i + 1, m)
+				}
+				names = append(names, m.Name)
+			}
+			if got := strings.Join(names, " "); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadMigrationsIncomplete(t *testing.T) {
+	fsys := fstest.MapFS{
+		"m/0001_one.up.sql": {Data: []byte("up")},
+		"m/0001_one.down.sql": {Data: []byte("down")},
+		"m/0002_two.up.sql": {Data: []byte("up")},
+	}
+	_, err := loadMigrations(fsys, "m")
+	if err == nil || err.Error() != "migration 2 is missing or incomplete" {
+		t.Errorf("got %v, want migration 2 incomplete", err)
+	}
+}
+
+// migrationBackend records the migrations applied to it, failing at
+// failAt when set.
+type migrationBackend struct {
+	Backend
+	migrations []Migration
+	version    int
+	failAt     int
+	applied    []string
+}
+
+func (mb *migrationBackend) Migrations() []Migration {
+	return mb.migrations
+}
+
+func (mb *migrationBackend) SchemaVersion() (int, error) {
+	return mb.version, nil
+}
+
+func (mb *migrationBackend) ApplyMigration(m Migration, up bool) error {
+	if m.Version == mb.failAt {
+		return errors.New("boom")
+	}
+	if up {
+		mb.applied = append(mb.applied, "+" + strconv.Itoa(m.Version))
+		mb.version = m.Version
+	} else {
+		mb.applied = append(mb.applied, "-" + strconv.Itoa(m.Version))
+		mb.version = m.Version - 1
+	}
+	return nil
+}
+
+func TestMigrate(t *testing.T) {
+	store := Store
+	log.SetOutput(io.Discard)
+	t.Cleanup(func () {
+		Store = store
+		log.SetOutput(os.Stderr)
+	})
+	tests := []struct {
+		name    string
+		current int
+		target  int
+		failAt  int
+		applied string
+		err     string
+	}{
+		{"up from scratch", 0, 4, 0, "+1 +2 +3 +4", ""},
+		{"up part way", 2, 4, 0, "+3 +4", ""},
+		{"down", 4, 1, 0, "-4 -3 -2", ""},
+		{"down to nothing", 2, 0, 0, "-2 -1", ""},
+		{"up to date", 3, 3, 0, "", ""},
+		{"stops at a failure", 0, 4, 3, "+1 +2", "migration 3 failed - boom"},
+		{"stops reverting at a failure", 4, 0, 2, "-4 -3", "reverting migration 2 failed - boom"},
+		{"unknown target", 0, 5, 0, "", "no schema version 5, latest is 4"},
+		{"negative target", 0, -1, 0, "", "no schema version -1, latest is 4"},
+		{"newer store", 6, 4, 0, "", "schema version 6 is newer than this binary knows (4)"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func (t *testing.T) {
+			mb := &migrationBackend{version: test.current, failAt: test.failAt}
+			for v := 1; v <= 4; v++ {
+				mb.migrations = append(mb.migrations, Migration{Version: v, Name: "m" + strconv.Itoa(v)})
+			}
+			Store = mb
+			err := Migrate(test.target)
+			if got := strings.Join(mb.applied, " "); got != test.applied {
+				t.Errorf("applied %q, want %q", got, test.applied)
+			}
+			if test.err == "" && err != nil || test.err != "" && (err == nil || err.Error() != test.err) {
+				t.Errorf("got %v, want %q", err, test.err)
+			}
+		})
+	}
+}
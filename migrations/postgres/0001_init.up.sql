@@ -0,0 +1,19 @@
+CREATE TABLE documents (
+	name text PRIMARY KEY,
+	data jsonb NOT NULL
+);
+
+CREATE TABLE points (
+	tier        text NOT NULL,
+	address     text NOT NULL,
+	metric      text NOT NULL,
+	start       timestamptz NOT NULL,
+	resolution  text NOT NULL,
+	min         double precision NOT NULL,
+	max         double precision NOT NULL,
+	avg         double precision NOT NULL,
+	count       integer NOT NULL,
+	calibration integer NOT NULL
+);
+
+CREATE INDEX points_tier_start ON points (tier, start);
@@ -0,0 +1,19 @@
+CREATE TABLE documents (
+	name text PRIMARY KEY,
+	data text NOT NULL
+);
+
+CREATE TABLE points (
+	tier        text NOT NULL,
+	address     text NOT NULL,
+	metric      text NOT NULL,
+	start       integer NOT NULL,
+	resolution  text NOT NULL,
+	min         real NOT NULL,
+	max         real NOT NULL,
+	avg         real NOT NULL,
+	count       integer NOT NULL,
+	calibration integer NOT NULL
+);
+
+CREATE INDEX points_tier_start ON points (tier, start);
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	modbusTimeout = 2 * time.Second
+	// Frames of unknown length are considered complete once the device has
+	// been quiet for this long, like the 3.5 character gap on a real bus.
+	modbusSilence = 100 * time.Millisecond
+	modbusGatewayTargetFailed = 0x0b
+)
+
+// RTUBuffer collects bytes notified by the device until they form a complete
+// Modbus RTU frame.
+type RTUBuffer struct {
+	mu     sync.Mutex
+	buf    []byte
+	signal chan struct{}
+}
+
+func NewRTUBuffer() *RTUBuffer {
+	return &RTUBuffer{signal: make(chan struct{}, 1)}
+}
+
+func (rb *RTUBuffer) Write(p []byte) (int, error) {
+	rb.mu.Lock()
+	rb.buf = append(rb.buf, p...)
+	rb.mu.Unlock()
+	select {
+	case rb.signal <- struct{}{}:
+	default:
+	}
+	return len(p), nil
+}
+
+func (rb *RTUBuffer) Reset() {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.buf = nil
+}
+
+func (rb *RTUBuffer) Bytes() []byte {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	return append([]byte(nil), rb.buf...)
+}
+
+// Wait blocks until a full frame has been received or the timeout expires.
+func (rb *RTUBuffer) Wait(timeout time.Duration) ([]byte, bool) {
+	deadline := time.After(timeout)
+	for {
+		frame := rb.Bytes()
+		if n := rtuFrameLength(frame); n > 0 && len(frame) >= n {
+			return frame[:n], true
+		}
+		quiet := time.NewTimer(modbusSilence)
+		select {
+		case <-rb.signal:
+			quiet.Stop()
+		case <-quiet.C:
+			if len(frame) >= 4 && rtuFrameLength(frame) == 0 {
+				return frame, true
+			}
+		case <-deadline:
+			quiet.Stop()
+			return nil, false
+		}
+	}
+}
+
+// rtuFrameLength returns the expected length of the RTU response starting in
+// frame, or 0 if it can't be told from the function code.
+func rtuFrameLength(frame []byte) int {
+	if len(frame) < 3 {
+		return 0
+	}
+	fc := frame[1]
+	switch {
+	case fc&0x80 != 0:
+		return 5
+	case fc >= 1 && fc <= 4, fc == 0x17:
+		return 5 + int(frame[2])
+	case fc == 5, fc == 6, fc == 15, fc == 16:
+		return 8
+	}
+	return 0
+}
+
+// ModbusCRC is the CRC-16/MODBUS checksum of data.
+func ModbusCRC(data []byte) uint16 {
+	crc := uint16(0xffff)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc >> 1 ^ 0xa001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+func rtuValid(frame []byte) bool {
+	if len(frame) < 4 {
+		return false
+	}
+	n := len(frame) - 2
+	return binary.LittleEndian.Uint16(frame[n:]) == ModbusCRC(frame[:n])
+}
+
+// ServeModbus speaks Modbus TCP on conn, forwarding each request as an RTU
+// frame over the bridge and answering with the device's RTU response.
+func ServeModbus(conn io.ReadWriter, bridge *Bridge, frames *RTUBuffer) error {
+	header := make([]byte, 7)
+	for {
+		_, err := io.ReadFull(conn, header)
+		if err != nil {
+			return err
+		}
+		length := int(binary.BigEndian.Uint16(header[4:6]))
+		if length < 2 {
+			return io.ErrUnexpectedEOF
+		}
+		pdu := make([]byte, length - 1)
+		_, err = io.ReadFull(conn, pdu)
+		if err != nil {
+			return err
+		}
+		unit := header[6]
+		request := append([]byte{unit}, pdu...)
+		request = binary.LittleEndian.AppendUint16(request, ModbusCRC(request))
+
+		frames.Reset()
+		err = bridge.Send(request)
+		if err != nil {
+			return err
+		}
+		response, ok := frames.Wait(modbusTimeout)
+		if !ok || !rtuValid(response) || response[0] != unit {
+			response = []byte{unit, pdu[0] | 0x80, modbusGatewayTargetFailed, 0, 0}
+		}
+		body := response[1:len(response) - 2]
+		reply := append([]byte{}, header[:4]...)
+		reply = binary.BigEndian.AppendUint16(reply, uint16(len(body) + 1))
+		reply = append(reply, response[0])
+		reply = append(reply, body...)
+		_, err = conn.Write(reply)
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	modesFile       = "modes.json"
+	modesCheckEvery = time.Minute
+)
+
+// The modes the gateway can be in. Quiet isn't set but scheduled, and is
+// active on top of the others.
+const (
+	modeHome     = "home"
+	modeAway     = "away"
+	modeVacation = "vacation"
+	modeQuiet    = "quiet"
+)
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// QuietHours is a daily window of quiet, From and To being local 15:04
+// times, To before From spanning midnight. Days limits it to days the
+// window starts on (mon, tue...), every day when empty.
+type QuietHours struct {
+	From string
+	To   string
+	Days []string `json:",omitempty"`
+}
+
+// ModeConfig is the mode the gateway is in, home by default, and when it's
+// quiet. With FollowPeople it switches between home and away as people
+// come and go, vacation staying until set otherwise. Thresholds and sink
+// profiles name the modes they're active or silent in, so presence based
+// automations can be silenced in one place.
+type ModeConfig struct {
+	Mode         string       `json:",omitempty"`
+	FollowPeople bool         `json:",omitempty"`
+	QuietHours   []QuietHours `json:",omitempty"`
+}
+
+type SafeModes struct {
+	mu     sync.Mutex
+	Config ModeConfig
+	active []string
+}
+
+var Modes = SafeModes{}
+
+func ValidateMode(mode string) error {
+	switch mode {
+	case modeHome, modeAway, modeVacation, modeQuiet:
+		return nil
+	}
+	return errors.New(mode + ": modes are home, away, vacation and quiet")
+}
+
+func ValidateModeConfig(config ModeConfig) error {
+	if config.Mode != "" && config.Mode != modeHome && config.Mode != modeAway && config.Mode != modeVacation {
+		return errors.New("mode must be home, away or vacation")
+	}
+	for _, q := range config.QuietHours {
+		if _, err := time.Parse("15:04", q.From); err != nil {
+			return errors.New("quiet hours need From as 15:04, eg. 22:30")
+		}
+		if _, err := time.Parse("15:04", q.To); err != nil {
+			return errors.New("quiet hours need To as 15:04, eg. 07:00")
+		}
+		for _, day := range q.Days {
+			if !slices.Contains(weekdays, strings.ToLower(day)) {
+				return errors.New(day + ": days are " + strings.Join(weekdays, ", "))
+			}
+		}
+	}
+	return nil
+}
+
+// quiet tells whether t falls within the window, in local time whatever
+// the location of t, eg. UTC for history samples.
+func (q QuietHours) quiet(t time.Time) bool {
+	t = t.Local()
+	from, _ := time.Parse("15:04", q.From)
+	to, _ := time.Parse("15:04", q.To)
+	minutes := func (t time.Time) int { return t.Hour() * 60 + t.Minute() }
+	now, start, end := minutes(t), minutes(from), minutes(to)
+	day := t
+	inside := start <= now && now < end
+	if end <= start {
+		inside = now >= start || now < end
+		if now < end {
+			// Past midnight, the window started the day before.
+			day = t.AddDate(0, 0, -1)
+		}
+	}
+	if !inside || len(q.Days) == 0 {
+		return inside
+	}
+	return slices.ContainsFunc(q.Days, func (d string) bool { return strings.ToLower(d) == weekdays[day.Weekday()] })
+}
+
+// modes lists the modes active at t, expecting sm.mu to be held.
+func (sm *SafeModes) modes(t time.Time) []string {
+	mode := sm.Config.Mode
+	if mode == "" {
+		mode = modeHome
+	}
+	active := []string{mode}
+	for _, q := range sm.Config.QuietHours {
+		if q.quiet(t) {
+			active = append(active, modeQuiet)
+			break
+		}
+	}
+	return active
+}
+
+func (sm *SafeModes) Load() error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	err := LoadJSON(modesFile, &sm.Config)
+	if err != nil {
+		return err
+	}
+	err = ValidateModeConfig(sm.Config)
+	sm.active = sm.modes(time.Now())
+	return err
+}
+
+func (sm *SafeModes) Get() ModeConfig {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.Config
+}
+
+// Active lists the modes the gateway is in right now.
+func (sm *SafeModes) Active() []string {
+	return sm.ActiveAt(time.Now())
+}
+
+// ActiveAt lists the modes the gateway would be in at t, were its mode the
+// same then.
+func (sm *SafeModes) ActiveAt(t time.Time) []string {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.modes(t)
+}
+
+// In tells whether any of modes is active.
+func (sm *SafeModes) In(modes []string) bool {
+	if len(modes) == 0 {
+		return false
+	}
+	for _, mode := range sm.Active() {
+		if slices.Contains(modes, mode) {
+			return true
+		}
+	}
+	return false
+}
+
+// Set replaces the config, raising MODE if that changed the active modes.
+func (sm *SafeModes) Set(config ModeConfig) error {
+	err := ValidateModeConfig(config)
+	if err != nil {
+		return err
+	}
+	sm.mu.Lock()
+	err = SaveJSON(modesFile, config)
+	if err == nil {
+		sm.Config = config
+	}
+	sm.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	sm.update()
+	return nil
+}
+
+// update raises MODE (the active modes, ;-separated) when they changed.
+func (sm *SafeModes) update() {
+	sm.mu.Lock()
+	active := sm.modes(time.Now())
+	changed := !slices.Equal(active, sm.active)
+	sm.active = active
+	sm.mu.Unlock()
+	if changed {
+		LogEvent("MODE", strings.Join(active, ";"))
+	}
+}
+
+// follow switches between home and away as people come and go, saving the
+// mode so it survives restarts.
+func (sm *SafeModes) follow() {
+	config := sm.Get()
+	if !config.FollowPeople || config.Mode == modeVacation || len(People.List()) == 0 {
+		return
+	}
+	mode := modeAway
+	if slices.ContainsFunc(People.States(), func (p PersonState) bool { return p.Home }) {
+		mode = modeHome
+	}
+	if mode == config.Mode || config.Mode == "" && mode == modeHome {
+		return
+	}
+	config.Mode = mode
+	if err := sm.Set(config); err != nil {
+		LogError("Could not switch to", mode, "mode -", err.Error())
+	}
+}
+
+// Run keeps the active modes up to date as quiet hours start and end and
+// people come and go.
+func (sm *SafeModes) Run() {
+	for {
+		time.Sleep(modesCheckEvery)
+		sm.follow()
+		sm.update()
+	}
+}
+
+// ModeStatus is the mode config along with the modes active right now.
+type ModeStatus struct {
+	ModeConfig
+	Active []string
+}
+
+func GetModeHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ModeStatus{Modes.Get(), Modes.Active()})
+	}
+}
+
+func SetModeHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		config := ModeConfig{}
+		err := json.NewDecoder(r.Body).Decode(&config)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = Modes.Set(config)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(200)
+	}
+}
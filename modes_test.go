@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuietHours(t *testing.T) {
+	// 2026-10-12 is a Monday.
+	at := func (day, hour, minute int) time.Time {
+		return time.Date(2026, 10, day, hour, minute, 0, 0, time.Local)
+	}
+	tests := []struct {
+		name  string
+		q     QuietHours
+		t     time.Time
+		quiet bool
+	}{
+		{"daytime window", QuietHours{From: "12:00", To: "14:00"}, at(12, 13, 0), true},
+		{"daytime window start", QuietHours{From: "12:00", To: "14:00"}, at(12, 12, 0), true},
+		{"daytime window end", QuietHours{From: "12:00", To: "14:00"}, at(12, 14, 0), false},
+		{"before midnight", QuietHours{From: "22:30", To: "07:00"}, at(12, 23, 59), true},
+		{"at midnight", QuietHours{From: "22:30", To: "07:00"}, at(13, 0, 0), true},
+		{"after midnight", QuietHours{From: "22:30", To: "07:00"}, at(13, 6, 59), true},
+		{"morning", QuietHours{From: "22:30", To: "07:00"}, at(13, 7, 0), false},
+		{"evening", QuietHours{From: "22:30", To: "07:00"}, at(12, 22, 29), false},
+		{"to midnight", QuietHours{From: "22:00", To: "00:00"}, at(12, 23, 30), true},
+		{"to midnight ends", QuietHours{From: "22:00", To: "00:00"}, at(13, 0, 0), false},
+		{"from midnight", QuietHours{From: "00:00", To: "06:00"}, at(13, 0, 0), true},
+		{"started on a listed day", QuietHours{From: "22:00", To: "07:00", Days: []string{"mon"}}, at(12, 23, 0), true},
+		{"past midnight of a listed day", QuietHours{From: "22:00", To: "07:00", Days: []string{"mon"}}, at(13, 3, 0), true},
+		{"evening after a listed day", QuietHours{From: "22:00", To: "07:00", Days: []string{"mon"}}, at(13, 23, 0), false},
+		{"past midnight of an unlisted day", QuietHours{From: "22:00", To: "07:00", Days: []string{"mon"}}, at(12, 3, 0), false},
+		{"weekend night", QuietHours{From: "23:00", To: "09:00", Days: []string{"Fri", "SAT"}}, at(18, 8, 0), true},
+		{"sunday night", QuietHours{From: "23:00", To: "09:00", Days: []string{"fri", "sat"}}, at(19, 8, 0), false},
+		{"UTC time", QuietHours{From: "22:30", To: "07:00"}, at(13, 1, 0).UTC(), true},
+	}
+	for _, test := range tests {
+		if got := test.q.quiet(test.t); got != test.quiet {
+			t.Errorf("%v: quiet(%v) = %v, want %v", test.name, test.t.Format("Mon 15:04"), got, test.quiet)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// A minimal MQTT 3.1.1 client. It only implements what bluboi needs:
+// publishing at QoS 0 or 1 without retries, subscribing, keepalive and a
+// last will. Messages published while disconnected are dropped.
+
+const (
+	mqttConnect    = 1
+	mqttConnAck    = 2
+	mqttPublish    = 3
+	mqttPubAck     = 4
+	mqttSubscribe  = 8
+	mqttSubAck     = 9
+	mqttPingReq    = 12
+	mqttPingResp   = 13
+	mqttDisconnect = 14
+)
+
+var errMQTTPacket = errors.New("malformed MQTT packet")
+
+type MQTTMessage struct {
+	Topic   string
+	Payload []byte
+	QoS     byte
+	Retain  bool
+}
+
+type MQTTOptions struct {
+	// Broker is a tcp://, mqtt://, ssl://, tls:// or mqtts:// URL.
+	Broker    string
+	ClientID  string
+	Username  string
+	Password  string
+	KeepAlive time.Duration
+	TLS       *tls.Config
+	Will      *MQTTMessage
+	OnMessage func (topic string, payload []byte)
+}
+
+type MQTTClient struct {
+	opts   MQTTOptions
+	mu     sync.Mutex
+	conn   net.Conn
+	nextID uint16
+	done   chan struct{}
+	once   sync.Once
+}
+
+func mqttString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func mqttPacket(header byte, body []byte) []byte {
+	out := []byte{header}
+	n := len(body)
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		out = append(out, digit)
+		if n == 0 {
+			break
+		}
+	}
+	return append(out, body...)
+}
+
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length := 0
+	for shift := 0; ; shift += 7 {
+		if shift > 21 {
+			return 0, nil, errMQTTPacket
+		}
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length |= int(digit & 0x7f) << shift
+		if digit & 0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	return header, body, err
+}
+
+func dialBroker(opts MQTTOptions) (net.Conn, error) {
+	u, err := url.Parse(opts.Broker)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "1883")
+		}
+		return dialer.Dial("tcp", host)
+	case "ssl", "tls", "mqtts":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "8883")
+		}
+		config := opts.TLS
+		if config == nil {
+			config = &tls.Config{}
+		}
+		if config.ServerName == "" {
+			config = config.Clone()
+			config.ServerName = u.Hostname()
+		}
+		return tls.DialWithDialer(dialer, "tcp", host, config)
+	}
+	return nil, errors.New("unsupported broker scheme " + u.Scheme)
+}
+
+// DialMQTT connects and waits for the broker to accept the session.
+func DialMQTT(opts MQTTOptions) (*MQTTClient, error) {
+	if opts.KeepAlive == 0 {
+		opts.KeepAlive = 30 * time.Second
+	}
+	conn, err := dialBroker(opts)
+	if err != nil {
+		return nil, err
+	}
+	flags := byte(0x02)
+	payload := mqttString(nil, opts.ClientID)
+	if opts.Will != nil {
+		flags |= 0x04 | opts.Will.QoS << 3
+		if opts.Will.Retain {
+			flags |= 0x20
+		}
+		payload = mqttString(payload, opts.Will.Topic)
+		payload = mqttString(payload, string(opts.Will.Payload))
+	}
+	if opts.Username != "" {
+		flags |= 0x80
+		payload = mqttString(payload, opts.Username)
+	}
+	if opts.Password != "" {
+		flags |= 0x40
+		payload = mqttString(payload, opts.Password)
+	}
+	body := mqttString(nil, "MQTT")
+	body = append(body, 4, flags)
+	body = binary.BigEndian.AppendUint16(body, uint16(opts.KeepAlive / time.Second))
+	body = append(body, payload...)
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	_, err = conn.Write(mqttPacket(mqttConnect << 4, body))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	header, ack, err := readMQTTPacket(r)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if header >> 4 != mqttConnAck || len(ack) != 2 {
+		conn.Close()
+		return nil, errMQTTPacket
+	}
+	if ack[1] != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("broker refused the connection (code %d)", ack[1])
+	}
+	conn.SetDeadline(time.Time{})
+	c := &MQTTClient{opts: opts, conn: conn, done: make(chan struct{})}
+	go c.readLoop(r)
+	go c.pingLoop()
+	return c, nil
+}
+
+// Done is closed once the connection is lost.
+func (c *MQTTClient) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *MQTTClient) fail(err error) {
+	c.once.Do(func () {
+		if err != nil {
+			log.Printf("[ERROR] MQTT connection to %v lost - %v", c.opts.Broker, err)
+		}
+		c.conn.Close()
+		close(c.done)
+	})
+}
+
+func (c *MQTTClient) write(packet []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := c.conn.Write(packet)
+	if err != nil {
+		go c.fail(err)
+	}
+	return err
+}
+
+// packetID expects c.mu to be held.
+func (c *MQTTClient) packetID() uint16 {
+	c.nextID++
+	if c.nextID == 0 {
+		c.nextID = 1
+	}
+	return c.nextID
+}
+
+func (c *MQTTClient) Publish(m MQTTMessage) error {
+	header := byte(mqttPublish << 4) | m.QoS << 1
+	if m.Retain {
+		header |= 1
+	}
+	body := mqttString(nil, m.Topic)
+	if m.QoS > 0 {
+		c.mu.Lock()
+		body = binary.BigEndian.AppendUint16(body, c.packetID())
+		c.mu.Unlock()
+	}
+	return c.write(mqttPacket(header, append(body, m.Payload...)))
+}
+
+func (c *MQTTClient) Subscribe(filter string, qos byte) error {
+	c.mu.Lock()
+	body := binary.BigEndian.AppendUint16(nil, c.packetID())
+	c.mu.Unlock()
+	body = mqttString(body, filter)
+	body = append(body, qos)
+	return c.write(mqttPacket(mqttSubscribe << 4 | 0x2, body))
+}
+
+func (c *MQTTClient) Close() error {
+	c.write(mqttPacket(mqttDisconnect << 4, nil))
+	c.fail(nil)
+	return nil
+}
+
+func (c *MQTTClient) readLoop(r *bufio.Reader) {
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(c.opts.KeepAlive * 3 / 2))
+		header, body, err := readMQTTPacket(r)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		if header >> 4 != mqttPublish {
+			continue
+		}
+		if len(body) < 2 {
+			c.fail(errMQTTPacket)
+			return
+		}
+		n := int(binary.BigEndian.Uint16(body))
+		if len(body) < 2 + n {
+			c.fail(errMQTTPacket)
+			return
+		}
+		topic := string(body[2:2 + n])
+		payload := body[2 + n:]
+		if qos := header >> 1 & 0x3; qos > 0 {
+			if len(payload) < 2 {
+				c.fail(errMQTTPacket)
+				return
+			}
+			c.write(mqttPacket(mqttPubAck << 4, payload[:2]))
+			payload = payload[2:]
+		}
+		if c.opts.OnMessage != nil {
+			c.opts.OnMessage(topic, payload)
+		}
+	}
+}
+
+func (c *MQTTClient) pingLoop() {
+	ticker := time.NewTicker(c.opts.KeepAlive / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.write(mqttPacket(mqttPingReq << 4, nil))
+		}
+	}
+}
+
+// RunMQTT keeps a session up, calling onConnect after every (re)connection
+// so subscriptions and birth messages can be sent again.
+func RunMQTT(opts func () (MQTTOptions, error), onConnect func (c *MQTTClient), stop <-chan struct{}) {
+	backoff := time.Second
+	for {
+		o, err := opts()
+		var c *MQTTClient
+		if err == nil {
+			c, err = DialMQTT(o)
+		}
+		if err != nil {
+			log.Printf("[ERROR] Could not connect to MQTT broker - %v", err)
+			select {
+			case <-stop:
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff * 2, time.Minute)
+			continue
+		}
+		backoff = time.Second
+		log.Printf("[INFO] Connected to MQTT broker %v", o.Broker)
+		onConnect(c)
+		select {
+		case <-stop:
+			c.Close()
+			return
+		case <-c.Done():
+		}
+	}
+}
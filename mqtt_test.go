@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMQTTPacketLength(t *testing.T) {
+	for _, n := range []int{0, 1, 127, 128, 16383, 16384, 2097151, 2097152} {
+		body := bytes.Repeat([]byte{0xab}, n)
+		packet := mqttPacket(mqttPublish << 4, body)
+		header, got, err := readMQTTPacket(bufio.NewReader(bytes.NewReader(packet)))
+		if err != nil || header != mqttPublish << 4 || !bytes.Equal(got, body) {
+			t.Errorf("%d bytes: got header %x, %d bytes, %v", n, header, len(got), err)
+		}
+	}
+	tests := []struct {
+		name   string
+		packet []byte
+		err    error
+	}{
+		{"length too long", []byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x01}, errMQTTPacket},
+		{"length cut off", []byte{0x30, 0x80}, io.EOF},
+		{"body cut off", []byte{0x30, 0x03, 0x00}, io.ErrUnexpectedEOF},
+	}
+	for _, test := range tests {
+		if _, _, err := readMQTTPacket(bufio.NewReader(bytes.NewReader(test.packet))); !errors.Is(err, test.err) {
+			t.Errorf("%v: got %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+// mqttBroker accepts a single connection, answering its CONNECT with code,
+// and hands it over with the body of the CONNECT.
+func mqttBroker(t *testing.T, code byte) (string, <-chan []byte, <-chan *bufio.ReadWriter) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func () { ln.Close() })
+	connects := make(chan []byte, 1)
+	conns := make(chan *bufio.ReadWriter, 1)
+	go func () {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		t.Cleanup(func () { conn.Close() })
+		rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+		header, body, err := readMQTTPacket(rw.Reader)
+		if err != nil || header != mqttConnect << 4 {
+			conn.Close()
+			return
+		}
+		connects <- body
+		rw.Write(mqttPacket(mqttConnAck << 4, []byte{0, code}))
+		rw.Flush()
+		conns <- rw
+	} ()
+	return "tcp://" + ln.Addr().String(), connects, conns
+}
+
+// readBrokerPacket reads what the client sent next, skipping pings.
+func readBrokerPacket(t *testing.T, rw *bufio.ReadWriter) (byte, []byte) {
+	for {
+		header, body, err := readMQTTPacket(rw.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header >> 4 != mqttPingReq {
+			return header, body
+		}
+	}
+}
+
+func TestMQTTClient(t *testing.T) {
+	broker, connects, conns := mqttBroker(t, 0)
+	messages := make(chan string, 1)
+	c, err := DialMQTT(MQTTOptions{
+		Broker: broker,
+		ClientID: "bluboi-test",
+		Username: "user",
+		Password: "secret",
+		KeepAlive: 10 * time.Second,
+		Will: &MQTTMessage{"bluboi/test/state", []byte("offline"), 1, true},
+		OnMessage: func (topic string, payload []byte) { messages <- topic + " " + string(payload) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	want := mqttString(nil, "MQTT")
+	want = append(want, 4, 0x02 | 0x04 | 1 << 3 | 0x20 | 0x80 | 0x40, 0, 10)
+	for _, s := range []string{"bluboi-test", "bluboi/test/state", "offline", "user", "secret"} {
+		want = mqttString(want, s)
+	}
+	if got := <-connects; !bytes.Equal(got, want) {
+		t.Errorf("CONNECT\n got %x\nwant %x", got, want)
+	}
+	rw := <-conns
+
+	if err := c.Publish(MQTTMessage{"bluboi/test/device", []byte("AA;Sensor"), 1, false}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Publish(MQTTMessage{"bluboi/test/agg", []byte("{}"), 0, true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Subscribe("bluboi/test/commands", 1); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		header byte
+		body   []byte
+	}{
+		{mqttPublish << 4 | 1 << 1, append(binary.BigEndian.AppendUint16(mqttString(nil, "bluboi/test/device"), 1), "AA;Sensor"...)},
+		{mqttPublish << 4 | 1, append(mqttString(nil, "bluboi/test/agg"), "{}"...)},
+		{mqttSubscribe << 4 | 0x2, append(mqttString([]byte{0, 2}, "bluboi/test/commands"), 1)},
+	}
+	for i, test := range tests {
+		header, body := readBrokerPacket(t, rw)
+		if header != test.header || !bytes.Equal(body, test.body) {
+			t.Errorf("packet %d: got %x %x, want %x %x", i, header, body, test.header, test.body)
+		}
+	}
+
+	// A QoS 1 message is acknowledged with its packet ID.
+	rw.Write(mqttPacket(mqttPublish << 4 | 1 << 1, append(binary.BigEndian.AppendUint16(mqttString(nil, "bluboi/test/commands"), 7), "SCAN"...)))
+	rw.Write(mqttPacket(mqttPublish << 4, append(mqttString(nil, "bluboi/test/commands"), "STOP"...)))
+	rw.Flush()
+	for _, want := range []string{"bluboi/test/commands SCAN", "bluboi/test/commands STOP"} {
+		select {
+		case got := <-messages:
+			if got != want {
+				t.Errorf("got message %q, want %q", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no %q", want)
+		}
+	}
+	if header, body := readBrokerPacket(t, rw); header != mqttPubAck << 4 || !bytes.Equal(body, []byte{0, 7}) {
+		t.Errorf("got %x %x, want a PUBACK of 7", header, body)
+	}
+
+	c.Close()
+	if header, _ := readBrokerPacket(t, rw); header != mqttDisconnect << 4 {
+		t.Errorf("got %x, want a DISCONNECT", header)
+	}
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Errorf("Done wasn't closed")
+	}
+}
+
+func TestMQTTClientLosesConnection(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	broker, _, conns := mqttBroker(t, 0)
+	c, err := DialMQTT(MQTTOptions{Broker: broker, ClientID: "bluboi-test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A PUBLISH too short to hold its topic.
+	rw := <-conns
+	rw.Write(mqttPacket(mqttPublish << 4, []byte{0, 9, 'a'}))
+	rw.Flush()
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Fatal("a malformed packet didn't end the connection")
+	}
+}
+
+func TestMQTTClientRefused(t *testing.T) {
+	broker, _, _ := mqttBroker(t, 5)
+	_, err := DialMQTT(MQTTOptions{Broker: broker, ClientID: "bluboi-test"})
+	if err == nil || !strings.Contains(err.Error(), "code 5") {
+		t.Errorf("got %v, want the refusal", err)
+	}
+	if _, err := DialMQTT(MQTTOptions{Broker: "ws://localhost"}); err == nil {
+		t.Errorf("dialed an unsupported scheme")
+	}
+}
+
+func TestMQTTCompile(t *testing.T) {
+	tests := []struct {
+		name   string
+		config MQTTConfig
+		ok     bool
+	}{
+		{"defaults", MQTTConfig{}, true},
+		{"route", MQTTConfig{Routes: map[string]MQTTRoute{"DEVICE": {Topic: "devices/{{field 0 .Fields}}", Payload: "{{field 1 .Fields}}", QoS: 1}}}, true},
+		{"dropped", MQTTConfig{Routes: map[string]MQTTRoute{"*": {Topic: "-"}}}, true},
+		{"QoS 2", MQTTConfig{Routes: map[string]MQTTRoute{"DEVICE": {Topic: "devices", QoS: 2}}}, false},
+		{"wildcard topic", MQTTConfig{Routes: map[string]MQTTRoute{"DEVICE": {Topic: "devices/+"}}}, false},
+		{"empty topic", MQTTConfig{Routes: map[string]MQTTRoute{"DEVICE": {Topic: "{{field 9 .Fields}}"}}}, false},
+		{"bad template", MQTTConfig{Routes: map[string]MQTTRoute{"DEVICE": {Topic: "{{.Gateway"}}}, false},
+		{"unknown field", MQTTConfig{Routes: map[string]MQTTRoute{"DEVICE": {Topic: "{{.Address}}"}}}, false},
+		{"unknown mode", MQTTConfig{Mode: "homie"}, false},
+		{"sparkplug without a group", MQTTConfig{Mode: "sparkplug"}, false},
+		{"sparkplug", MQTTConfig{Mode: "sparkplug", Sparkplug: SparkplugConfig{GroupID: "site"}}, true},
+	}
+	for _, test := range tests {
+		if _, err := test.config.Compile(); (err == nil) != test.ok {
+			t.Errorf("%v: got %v", test.name, err)
+		}
+	}
+}
+
+func TestMQTTRender(t *testing.T) {
+	routes, err := MQTTConfig{Routes: map[string]MQTTRoute{
+		"DEVICE": {Topic: "devices/{{replace (field 0 .Fields | lower) \":\" \"\"}}", Payload: "{{field 1 .Fields}}", QoS: 1, Retain: true},
+	}}.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := MQTTEvent{Gateway: "gw", Level: "DEVICE", Msg: "AA:BB;Sensor", Fields: []string{"AA:BB", "Sensor"}, Version: 3}
+	m, err := routes["DEVICE"].Render(e)
+	if err != nil || m.Topic != "devices/aabb" || string(m.Payload) != "Sensor" || m.QoS != 1 || !m.Retain {
+		t.Errorf("got %+v, %v", m, err)
+	}
+	e.Level = "AGG"
+	m, err = routes[""].Render(e)
+	if err != nil || m.Topic != "bluboi/gw/agg" || !strings.Contains(string(m.Payload), `"Msg":"AA:BB;Sensor"`) {
+		t.Errorf("default route got %v %s, %v", m.Topic, m.Payload, err)
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const mqttFile = "mqtt.json"
+
+// MQTTRoute shapes the messages for one event type. Topic and Payload are Go
+// templates executed against an MQTTEvent; a Topic of "-" drops the event.
+type MQTTRoute struct {
+	Topic   string
+	Payload string `json:",omitempty"`
+	QoS     byte   `json:",omitempty"`
+	Retain  bool   `json:",omitempty"`
+}
+
+// MQTTConfig publishes events to Broker. Routes are looked up by event type,
+// then "*", then DefaultMQTTRoute. With Mode "sparkplug" routes are ignored
+// and Sparkplug B messages are published instead.
+type MQTTConfig struct {
+	Broker    string
+	ClientID  string `json:",omitempty"`
+	Username  string `json:",omitempty"`
+	Password  string `json:",omitempty"`
+	Routes    map[string]MQTTRoute `json:",omitempty"`
+	Mode      string               `json:",omitempty"`
+	Sparkplug SparkplugConfig      `json:",omitempty"`
+}
+
+// MQTTEvent is what topic and payload templates see. Fields is Msg split on
+// ";", eg. address and name for DEVICE events.
+type MQTTEvent struct {
+	Gateway string
+	Level   string
+	Msg     string
+	Fields  []string
+	Version uint64
+	Time    time.Time
+}
+
+var DefaultMQTTRoute = MQTTRoute{
+	Topic: "bluboi/{{.Gateway}}/{{lower .Level}}",
+	Payload: "{{json .}}",
+}
+
+var mqttFuncs = template.FuncMap{
+	"json": func (v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"replace": strings.ReplaceAll,
+	"field": func (i int, fields []string) string {
+		if i < 0 || i >= len(fields) {
+			return ""
+		}
+		return fields[i]
+	},
+}
+
+type mqttTemplates struct {
+	topic   *template.Template
+	payload *template.Template
+	route   MQTTRoute
+}
+
+func NewMQTTEvent(l Log) MQTTEvent {
+	gateway, _ := os.Hostname()
+	return MQTTEvent{gateway, l.Level, l.Msg, strings.Split(l.Msg, ";"), l.Version, time.Now().UTC()}
+}
+
+func (t mqttTemplates) Render(e MQTTEvent) (MQTTMessage, error) {
+	topic := bytes.Buffer{}
+	err := t.topic.Execute(&topic, e)
+	if err != nil {
+		return MQTTMessage{}, err
+	}
+	payload := bytes.Buffer{}
+	err = t.payload.Execute(&payload, e)
+	if err != nil {
+		return MQTTMessage{}, err
+	}
+	return MQTTMessage{topic.String(), payload.Bytes(), t.route.QoS, t.route.Retain}, nil
+}
+
+// Compile parses every route and renders it once against a sample event,
+// so mistakes surface when the config is loaded rather than on the first
+// matching event.
+func (mc MQTTConfig) Compile() (map[string]mqttTemplates, error) {
+	switch mc.Mode {
+	case "":
+	case "sparkplug":
+		if mc.Sparkplug.GroupID == "" || strings.ContainsAny(mc.Sparkplug.GroupID + mc.Sparkplug.NodeID, "+#/") {
+			return nil, errors.New("sparkplug needs a GroupID, and IDs can't contain +, # or /")
+		}
+	default:
+		return nil, errors.New("mode must be empty or sparkplug")
+	}
+	routes := map[string]MQTTRoute{"": DefaultMQTTRoute}
+	for level, route := range mc.Routes {
+		routes[level] = route
+	}
+	compiled := map[string]mqttTemplates{}
+	sample := NewMQTTEvent(Log{Level: "DEVICE", Msg: "AA:BB:CC:DD:EE:FF;Sample", Version: 1})
+	for level, route := range routes {
+		if route.Topic == "-" {
+			compiled[level] = mqttTemplates{route: route}
+			continue
+		}
+		if route.Payload == "" {
+			route.Payload = DefaultMQTTRoute.Payload
+		}
+		if route.QoS > 1 {
+			return nil, errors.New(level + ": only QoS 0 and 1 are supported")
+		}
+		topic, err := template.New("topic").Funcs(mqttFuncs).Option("missingkey=error").Parse(route.Topic)
+		if err != nil {
+			return nil, errors.New(level + ": " + err.Error())
+		}
+		payload, err := template.New("payload").Funcs(mqttFuncs).Option("missingkey=error").Parse(route.Payload)
+		if err != nil {
+			return nil, errors.New(level + ": " + err.Error())
+		}
+		t := mqttTemplates{topic, payload, route}
+		m, err := t.Render(sample)
+		if err != nil {
+			return nil, errors.New(level + ": " + err.Error())
+		}
+		if m.Topic == "" || strings.ContainsAny(m.Topic, "+#") {
+			return nil, errors.New(level + ": topic renders to " + m.Topic + ", which can't be published to")
+		}
+		compiled[level] = t
+	}
+	return compiled, nil
+}
+
+type SafeMQTT struct {
+	mu     sync.Mutex
+	Config MQTTConfig
+	routes map[string]mqttTemplates
+	client *MQTTClient
+	node   *SparkplugNode
+	stop   chan struct{}
+}
+
+var MQTT = SafeMQTT{}
+
+func (sm *SafeMQTT) Load() error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	err := LoadJSON(mqttFile, &sm.Config)
+	if err != nil {
+		return err
+	}
+	sm.routes, err = sm.Config.Compile()
+	return err
+}
+
+// start expects sm.mu to be held.
+func (sm *SafeMQTT) start() {
+	if sm.Config.Broker == "" {
+		return
+	}
+	config := sm.Config
+	if config.ClientID == "" {
+		gateway, _ := os.Hostname()
+		config.ClientID = "bluboi-" + gateway
+	}
+	var node *SparkplugNode
+	if config.Mode == "sparkplug" {
+		if config.Sparkplug.NodeID == "" {
+			config.Sparkplug.NodeID, _ = os.Hostname()
+		}
+		node = NewSparkplugNode(config.Sparkplug)
+	}
+	sm.node = node
+	stop := make(chan struct{})
+	sm.stop = stop
+	var client *MQTTClient
+	go RunMQTT(func () (MQTTOptions, error) {
+		opts := MQTTOptions{
+			Broker: config.Broker,
+			ClientID: config.ClientID,
+			Username: config.Username,
+			Password: config.Password,
+		}
+		if node != nil {
+			opts.Will = node.Will()
+			ncmd := node.topic("NCMD", "")
+			opts.OnMessage = func (topic string, payload []byte) {
+				if topic == ncmd && node.Rebirth(payload) {
+					for _, m := range node.Births() {
+						client.Publish(m)
+					}
+				}
+			}
+		}
+		return opts, nil
+	}, func (c *MQTTClient) {
+		client = c
+		if node != nil {
+			c.Subscribe(node.topic("NCMD", ""), 0)
+			for _, m := range node.Births() {
+				c.Publish(m)
+			}
+		}
+		sm.mu.Lock()
+		defer sm.mu.Unlock()
+		// Set may have replaced the session while it was connecting.
+		select {
+		case <-stop:
+		default:
+			sm.client = c
+		}
+	}, stop)
+}
+
+// Run publishes every event the mqtt sink lets through.
+func (sm *SafeMQTT) Run() {
+	_, logs := Sinks.Subscribe("mqtt", 1000)
+	sm.mu.Lock()
+	sm.start()
+	sm.mu.Unlock()
+	for l := range logs {
+		sm.publish(l)
+	}
+}
+
+func (sm *SafeMQTT) publish(l Log) {
+	sm.mu.Lock()
+	client := sm.client
+	node := sm.node
+	t, ok := sm.routes[l.Level]
+	if !ok {
+		t, ok = sm.routes["*"]
+	}
+	if !ok {
+		t = sm.routes[""]
+	}
+	sm.mu.Unlock()
+	// Sparkplug state is kept up to date while disconnected, to be born on
+	// the next connection.
+	if node != nil {
+		for _, m := range node.Handle(l) {
+			if client != nil {
+				client.Publish(m)
+			}
+		}
+		return
+	}
+	if client == nil || t.route.Topic == "-" {
+		return
+	}
+	select {
+	case <-client.Done():
+		return
+	default:
+	}
+	m, err := t.Render(NewMQTTEvent(l))
+	if err != nil {
+		log.Printf("[ERROR] Could not render MQTT message for %v - %v", l.Level, err)
+		return
+	}
+	client.Publish(m)
+}
+
+// Publish sends a message of another sink through the broker, dropping it
+// while disconnected.
+func (sm *SafeMQTT) Publish(m MQTTMessage) {
+	sm.mu.Lock()
+	client := sm.client
+	sm.mu.Unlock()
+	if client == nil {
+		return
+	}
+	select {
+	case <-client.Done():
+		return
+	default:
+	}
+	client.Publish(m)
+}
+
+// Set validates and saves a new config, then reconnects with it. An empty
+// Password keeps the current one.
+func (sm *SafeMQTT) Set(config MQTTConfig) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if config.Password == "" {
+		config.Password = sm.Config.Password
+	}
+	routes, err := config.Compile()
+	if err != nil {
+		return err
+	}
+	err = SaveJSON(mqttFile, config)
+	if err != nil {
+		return err
+	}
+	if sm.stop != nil {
+		close(sm.stop)
+		sm.stop = nil
+	}
+	sm.client = nil
+	sm.Config = config
+	sm.routes = routes
+	sm.start()
+	return nil
+}
+
+func GetMQTTHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		MQTT.mu.Lock()
+		config := MQTT.Config
+		MQTT.mu.Unlock()
+		config.Password = ""
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(config)
+	}
+}
+
+func SetMQTTHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		config := MQTTConfig{}
+		err := json.NewDecoder(r.Body).Decode(&config)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = MQTT.Set(config)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(200)
+	}
+}
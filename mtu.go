@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// ATT MTUs range from the default every link starts with to the largest an
+// attribute value needs.
+const (
+	minATTMTU = 23
+	maxATTMTU = 517
+)
+
+type MTUStatus struct {
+	MTU int
+}
+
+// MTU returns the ATT MTU negotiated with a connected device.
+func (sa *SafeAdapter) MTU(address string) (int, error) {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	device, err := sa.connection(address)
+	if err != nil {
+		return 0, err
+	}
+	services, err := device.DiscoverServices(nil)
+	if err != nil {
+		return 0, err
+	}
+	for i := range services {
+		chars, err := services[i].DiscoverCharacteristics(nil)
+		if err != nil {
+			return 0, err
+		}
+		if len(chars) > 0 {
+			mtu, err := chars[0].GetMTU()
+			return int(mtu), err
+		}
+	}
+	return 0, errors.New("the device has no characteristics to get the MTU from")
+}
+
+// ReportMTU raises an MTU event (address;mtu) for a new connection.
+func ReportMTU(address string) {
+	mtu, err := Adapter.MTU(address)
+	if err != nil {
+		return
+	}
+	LogEvent("MTU", address + ";" + strconv.Itoa(mtu))
+}
+
+func GetMTUHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		mtu, err := Adapter.MTU(mux.Vars(r)["addr"])
+		if errors.Is(err, errNotConnectedTo) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(MTUStatus{mtu})
+	}
+}
+
+// RequestMTUHandler asks for at least the requested MTU. BlueZ exchanges
+// MTUs itself right after connecting, offering ExchangeMTU from its
+// main.conf, and doesn't let clients start another exchange, so this only
+// succeeds when the negotiated MTU is already large enough.
+func RequestMTUHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		req := MTUStatus{}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.MTU < minATTMTU || req.MTU > maxATTMTU {
+			http.Error(w, "MTU must be between " + strconv.Itoa(minATTMTU) + " and " + strconv.Itoa(maxATTMTU), http.StatusBadRequest)
+			return
+		}
+		mtu, err := Adapter.MTU(mux.Vars(r)["addr"])
+		if errors.Is(err, errNotConnectedTo) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		if mtu < req.MTU {
+			http.Error(w, "negotiated an MTU of " + strconv.Itoa(mtu) + " when connecting, the most the device and ExchangeMTU in /etc/bluetooth/main.conf allow", http.StatusConflict)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(MTUStatus{mtu})
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"tinygo.org/x/bluetooth"
+)
+
+const (
+	onboardingFile = "onboarding.json"
+	// maxPending bounds the devices waiting on approval, the one seen
+	// longest ago making way for a new one.
+	maxPending = 1000
+)
+
+// Lockdown holds devices seen for the first time back until an admin
+// approves them, instead of listing them right away.
+var Lockdown = false
+
+// PendingDevice is a device seen in lockdown waiting to be approved.
+type PendingDevice struct {
+	Address   string
+	Name      string `json:",omitempty"`
+	RSSI      int16
+	FirstSeen time.Time
+	LastSeen  time.Time
+	result    bluetooth.ScanResult
+}
+
+type onboardingDecisions struct {
+	Approved map[string]time.Time
+	Rejected map[string]time.Time
+}
+
+// SafeOnboarding holds the devices waiting on approval in lockdown, and the
+// decisions made on them by upper case address, kept in onboarding.json.
+type SafeOnboarding struct {
+	mu        sync.Mutex
+	decisions onboardingDecisions
+	pending   map[string]*PendingDevice
+}
+
+var Onboarding = SafeOnboarding{
+	decisions: onboardingDecisions{Approved: map[string]time.Time{}, Rejected: map[string]time.Time{}},
+	pending: map[string]*PendingDevice{},
+}
+
+func (so *SafeOnboarding) Load() error {
+	so.mu.Lock()
+	defer so.mu.Unlock()
+	err := LoadJSON(onboardingFile, &so.decisions)
+	if so.decisions.Approved == nil {
+		so.decisions.Approved = map[string]time.Time{}
+	}
+	if so.decisions.Rejected == nil {
+		so.decisions.Rejected = map[string]time.Time{}
+	}
+	return err
+}
+
+// Admit tells whether a scanned device may be listed, holding it back as
+// pending otherwise. A device is raised once as DEVICE_PENDING
+// (address;name) when it is first held back; rejected ones are ignored.
+func (so *SafeOnboarding) Admit(addr string, result bluetooth.ScanResult) bool {
+	if !Lockdown {
+		return true
+	}
+	so.mu.Lock()
+	defer so.mu.Unlock()
+	if _, ok := so.decisions.Approved[addr]; ok {
+		return true
+	}
+	if _, ok := so.decisions.Rejected[addr]; ok {
+		return false
+	}
+	now := time.Now()
+	pending, ok := so.pending[addr]
+	if !ok {
+		if len(so.pending) >= maxPending {
+			so.dropOldest()
+		}
+		pending = &PendingDevice{Address: addr, FirstSeen: now}
+		so.pending[addr] = pending
+		go LogEvent("DEVICE_PENDING", addr + ";" + result.LocalName())
+	}
+	if name := result.LocalName(); name != "" {
+		pending.Name = name
+	}
+	pending.RSSI = result.RSSI
+	pending.LastSeen = now
+	pending.result = result
+	return false
+}
+
+// dropOldest expects so.mu to be held.
+func (so *SafeOnboarding) dropOldest() {
+	oldest := ""
+	for addr, p := range so.pending {
+		if oldest == "" || p.LastSeen.Before(so.pending[oldest].LastSeen) {
+			oldest = addr
+		}
+	}
+	delete(so.pending, oldest)
+}
+
+func (so *SafeOnboarding) Pending() []PendingDevice {
+	so.mu.Lock()
+	defer so.mu.Unlock()
+	devices := []PendingDevice{}
+	for _, p := range so.pending {
+		devices = append(devices, *p)
+	}
+	sort.Slice(devices, func (i, j int) bool {
+		return devices[i].FirstSeen.Before(devices[j].FirstSeen)
+	})
+	return devices
+}
+
+// decide records a decision on a device, pending or not yet seen, and
+// returns what it last advertised if it was pending.
+func (so *SafeOnboarding) decide(addr string, approve bool) (*bluetooth.ScanResult, error) {
+	so.mu.Lock()
+	defer so.mu.Unlock()
+	decisions := onboardingDecisions{Approved: map[string]time.Time{}, Rejected: map[string]time.Time{}}
+	for a, at := range so.decisions.Approved {
+		decisions.Approved[a] = at
+	}
+	for a, at := range so.decisions.Rejected {
+		decisions.Rejected[a] = at
+	}
+	delete(decisions.Approved, addr)
+	delete(decisions.Rejected, addr)
+	if approve {
+		decisions.Approved[addr] = time.Now()
+	} else {
+		decisions.Rejected[addr] = time.Now()
+	}
+	err := SaveJSON(onboardingFile, decisions)
+	if err != nil {
+		return nil, err
+	}
+	so.decisions = decisions
+	pending, ok := so.pending[addr]
+	delete(so.pending, addr)
+	if !ok {
+		return nil, nil
+	}
+	return &pending.result, nil
+}
+
+// Approve lets a device be listed, raising DEVICE_APPROVED (address). One
+// that was pending shows up straight away with what it last advertised.
+func (so *SafeOnboarding) Approve(addr string) error {
+	result, err := so.decide(addr, true)
+	if err != nil {
+		return err
+	}
+	LogEvent("DEVICE_APPROVED", addr)
+	if result != nil {
+		go Adapter.handleScanResult(*result)
+	}
+	return nil
+}
+
+// Reject keeps ignoring a device, raising DEVICE_REJECTED (address).
+func (so *SafeOnboarding) Reject(addr string) error {
+	_, err := so.decide(addr, false)
+	if err != nil {
+		return err
+	}
+	LogEvent("DEVICE_REJECTED", addr)
+	return nil
+}
+
+func ListPendingHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Lockdown", strconv.FormatBool(Lockdown))
+		json.NewEncoder(w).Encode(Onboarding.Pending())
+	}
+}
+
+func ApprovePendingHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		err := Onboarding.Approve(strings.ToUpper(mux.Vars(r)["addr"]))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(200)
+	}
+}
+
+func RejectPendingHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		err := Onboarding.Reject(strings.ToUpper(mux.Vars(r)["addr"]))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(200)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OwnTracksConfig publishes BLE presence as OwnTracks region transitions,
+// the gateway's room being the Region devices enter and leave. Messages go
+// to the MQTT broker configured for the mqtt sink, under
+// owntracks/<User>/<device>, and are posted to URL when set (OwnTracks
+// Recorder's /pub, or any HTTP endpoint taking OwnTracks JSON).
+type OwnTracksConfig struct {
+	Region string
+	User   string
+	URL    string
+	Lat    float64
+	Lon    float64
+}
+
+// OwnTracksMessage is a transition or location, with only the fields
+// bluboi knows about.
+type OwnTracksMessage struct {
+	Type      string   `json:"_type"`
+	Event     string   `json:"event,omitempty"`
+	Desc      string   `json:"desc,omitempty"`
+	Trigger   string   `json:"t"`
+	TID       string   `json:"tid"`
+	Lat       float64  `json:"lat"`
+	Lon       float64  `json:"lon"`
+	Acc       int      `json:"acc"`
+	Tst       int64    `json:"tst"`
+	Wtst      int64    `json:"wtst,omitempty"`
+	InRegions []string `json:"inregions,omitempty"`
+}
+
+// ParseLocation reads "lat,lon".
+func ParseLocation(s string) (float64, float64, error) {
+	lat, lon, ok := strings.Cut(s, ",")
+	if !ok {
+		return 0, 0, errors.New("location must be lat,lon")
+	}
+	la, err := strconv.ParseFloat(strings.TrimSpace(lat), 64)
+	if err != nil || la < -90 || la > 90 {
+		return 0, 0, errors.New("latitude must be between -90 and 90")
+	}
+	lo, err := strconv.ParseFloat(strings.TrimSpace(lon), 64)
+	if err != nil || lo < -180 || lo > 180 {
+		return 0, 0, errors.New("longitude must be between -180 and 180")
+	}
+	return la, lo, nil
+}
+
+// presenceAddress finds the device an event is about: the first field of
+// DEVICE and DEVICE_GONE, in parentheses for SENSOR_DEAD and SENSOR_ALIVE.
+func presenceAddress(l Log) string {
+	if l.Level == "SENSOR_DEAD" || l.Level == "SENSOR_ALIVE" {
+		_, rest, ok := strings.Cut(l.Msg, "(")
+		addr, _, _ := strings.Cut(rest, ")")
+		if !ok {
+			return ""
+		}
+		return addr
+	}
+	addr, _, _ := strings.Cut(l.Msg, ";")
+	return addr
+}
+
+// transition builds the messages for a device entering or leaving the
+// region: the transition itself, published to the device's event topic, and
+// its location with the regions it is in now, retained on its own topic.
+func (oc OwnTracksConfig) transition(addr string, enter bool, since time.Time) []MQTTMessage {
+	device := strings.ToLower(strings.ReplaceAll(addr, ":", ""))
+	tid := device
+	if len(tid) > 2 {
+		tid = tid[len(tid) - 2:]
+	}
+	now := time.Now().Unix()
+	event := "leave"
+	regions := []string(nil)
+	if enter {
+		event = "enter"
+		regions = []string{oc.Region}
+	}
+	t := OwnTracksMessage{Type: "transition", Event: event, Desc: oc.Region, Trigger: "b", TID: tid, Lat: oc.Lat, Lon: oc.Lon, Tst: now, Wtst: since.Unix()}
+	l := OwnTracksMessage{Type: "location", Trigger: "b", TID: tid, Lat: oc.Lat, Lon: oc.Lon, Tst: now, InRegions: regions}
+	topic := "owntracks/" + oc.User + "/" + device
+	tb, _ := json.Marshal(t)
+	lb, _ := json.Marshal(l)
+	return []MQTTMessage{{topic + "/event", tb, 1, false}, {topic, lb, 1, true}}
+}
+
+// post sends a message to URL the way the OwnTracks apps do over HTTP,
+// naming the user and device in X-Limit-U and X-Limit-D.
+func (oc OwnTracksConfig) post(m MQTTMessage) error {
+	parts := strings.Split(m.Topic, "/")
+	req, err := http.NewRequest(http.MethodPost, oc.URL, bytes.NewReader(m.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Limit-U", oc.User)
+	req.Header.Set("X-Limit-D", parts[2])
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("OwnTracks endpoint responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// RunOwnTracks turns the events the owntracks sink lets through into
+// transitions: devices enter the region when discovered or reporting again,
+// and leave it when declared dead or forgotten.
+func RunOwnTracks(config OwnTracksConfig) {
+	_, logs := Sinks.Subscribe("owntracks", 100)
+	since := time.Now()
+	inside := map[string]bool{}
+	log.Printf("[INFO] Publishing presence in %v to OwnTracks", config.Region)
+	for l := range logs {
+		enter := false
+		switch l.Level {
+		case "DEVICE", "SENSOR_ALIVE":
+			enter = true
+		case "SENSOR_DEAD", "DEVICE_GONE":
+		default:
+			continue
+		}
+		addr := presenceAddress(l)
+		if addr == "" || inside[addr] == enter {
+			continue
+		}
+		if enter {
+			inside[addr] = true
+		} else {
+			delete(inside, addr)
+		}
+		for _, m := range config.transition(addr, enter, since) {
+			MQTT.Publish(m)
+			if config.URL == "" {
+				continue
+			}
+			err := config.post(m)
+			if err != nil {
+				log.Printf("[ERROR] Could not post to OwnTracks at %v - %v", config.URL, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// pairingPromptTimeout is how long a pairing waits on a response, as long as
+// BlueZ waits on its agent.
+const pairingPromptTimeout = 60 * time.Second
+
+// What a pairing device asks for when the PairRequest doesn't answer it.
+const (
+	promptPasskey = "passkey"
+	promptPIN     = "pin"
+	promptConfirm = "confirm"
+)
+
+// PairRequest answers what a device asks for while pairing: Passkey for
+// devices with a 6 digit key printed on them or shown on their display, PIN
+// for legacy ones. Whatever it doesn't answer is asked with a
+// PAIRING_REQUEST. Devices asking the gateway to display a key instead, like
+// keyboards to type it on, get it in a PAIRING_CODE event (address;code).
+type PairRequest struct {
+	Passkey *uint32 `json:",omitempty"`
+	PIN     string  `json:",omitempty"`
+}
+
+// PairingResponse answers a PAIRING_REQUEST: the Passkey or PIN asked for,
+// or nothing to confirm the key compared. Reject fails the pairing instead.
+type PairingResponse struct {
+	Passkey *uint32 `json:",omitempty"`
+	PIN     string  `json:",omitempty"`
+	Reject  bool    `json:",omitempty"`
+}
+
+type pairingPrompt struct {
+	kind     string
+	response chan PairingResponse
+}
+
+// SafePairings holds the pairings in progress by upper case address, and
+// the prompts they are waiting on a response to. The pairing agent only
+// answers for those, so no other device can pair itself.
+type SafePairings struct {
+	mu       sync.Mutex
+	requests map[string]PairRequest
+	prompts  map[string]pairingPrompt
+}
+
+var (
+	Pairings = SafePairings{requests: map[string]PairRequest{}, prompts: map[string]pairingPrompt{}}
+	errAlreadyPairing = errors.New("already pairing with that device")
+	errNoPrompt = errors.New("not waiting on a response from that device")
+)
+
+func (sp *SafePairings) start(addr string, req PairRequest) bool {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if _, ok := sp.requests[addr]; ok {
+		return false
+	}
+	sp.requests[addr] = req
+	return true
+}
+
+func (sp *SafePairings) end(addr string) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	delete(sp.requests, addr)
+}
+
+// Request returns what to answer a device pairing with, and whether it is
+// being paired with at all.
+func (sp *SafePairings) Request(addr string) (PairRequest, bool) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	req, ok := sp.requests[addr]
+	return req, ok
+}
+
+// Ask raises PAIRING_REQUEST (address;kind, and ;code to compare for
+// confirm) and waits for the response posted to /pair/<addr>/respond. ok is
+// false once it times out or BlueZ cancels it.
+func (sp *SafePairings) Ask(addr string, kind string, code string) (response PairingResponse, ok bool) {
+	prompt := pairingPrompt{kind, make(chan PairingResponse, 1)}
+	sp.mu.Lock()
+	sp.prompts[addr] = prompt
+	sp.mu.Unlock()
+	defer func () {
+		sp.mu.Lock()
+		defer sp.mu.Unlock()
+		if sp.prompts[addr].response == prompt.response {
+			delete(sp.prompts, addr)
+		}
+	} ()
+	msg := addr + ";" + kind
+	if code != "" {
+		msg += ";" + code
+	}
+	LogEvent("PAIRING_REQUEST", msg)
+	select {
+	case response, ok = <-prompt.response:
+		return response, ok
+	case <-time.After(pairingPromptTimeout):
+		return PairingResponse{}, false
+	}
+}
+
+// Respond hands a response to the prompt a device pairing is waiting on.
+func (sp *SafePairings) Respond(addr string, response PairingResponse) error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	prompt, ok := sp.prompts[addr]
+	if !ok {
+		return errNoPrompt
+	}
+	if !response.Reject {
+		if prompt.kind == promptPasskey && response.Passkey == nil {
+			return errors.New("the device asks for a Passkey")
+		}
+		if prompt.kind == promptPIN && response.PIN == "" {
+			return errors.New("the device asks for a PIN")
+		}
+	}
+	delete(sp.prompts, addr)
+	prompt.response <- response
+	return nil
+}
+
+// CancelPrompts gives up on every prompt, BlueZ only asking one at a time.
+func (sp *SafePairings) CancelPrompts() {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	for addr, prompt := range sp.prompts {
+		close(prompt.response)
+		delete(sp.prompts, addr)
+	}
+}
+
+// Pair pairs and bonds with a device, trusting it so BlueZ keeps the keys
+// and re-encrypts the link whenever it connects. It raises PAIRED (address)
+// or PAIRING_FAILED (address;reason).
+func Pair(address string, req PairRequest) (LinkSecurity, error) {
+	addr := strings.ToUpper(address)
+	if err := ConnectAllowed(); err != nil {
+		return LinkSecurity{}, err
+	}
+	if !Pairings.start(addr, req) {
+		return LinkSecurity{}, errAlreadyPairing
+	}
+	defer Pairings.end(addr)
+	err := pairDevice(addr)
+	if err != nil {
+		LogEvent("PAIRING_FAILED", addr + ";" + err.Error())
+		return LinkSecurity{}, err
+	}
+	LogEvent("PAIRED", addr)
+	return linkSecurity(addr)
+}
+
+// Unpair disconnects from a device and removes the bond with it, unless it
+// is being paired with. It raises UNPAIRED (address).
+func Unpair(address string) error {
+	addr := strings.ToUpper(address)
+	if _, ok := Pairings.Request(addr); ok {
+		return errAlreadyPairing
+	}
+	if Adapter.IsConnected(addr) {
+		Adapter.Disconnect(addr)
+	}
+	err := unpairDevice(addr)
+	if err != nil {
+		return err
+	}
+	LogEvent("UNPAIRED", addr)
+	return nil
+}
+
+// PairHandler pairs with a device, answering it with the optional
+// PairRequest body, and responds with the link security once bonded.
+func PairHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		req := PairRequest{}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Passkey != nil && *req.Passkey > 999999 {
+			http.Error(w, "Passkey must have at most 6 digits", http.StatusBadRequest)
+			return
+		}
+		security, err := Pair(mux.Vars(r)["addr"], req)
+		if errors.Is(err, errAlreadyPairing) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if errors.Is(err, errPassive) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(security)
+	}
+}
+
+// RespondPairingHandler answers the PAIRING_REQUEST a device is waiting on
+// with the PairingResponse body.
+func RespondPairingHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		response := PairingResponse{}
+		err := json.NewDecoder(r.Body).Decode(&response)
+		if err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if response.Passkey != nil && *response.Passkey > 999999 {
+			http.Error(w, "Passkey must have at most 6 digits", http.StatusBadRequest)
+			return
+		}
+		err = Pairings.Respond(strings.ToUpper(mux.Vars(r)["addr"]), response)
+		if errors.Is(err, errNoPrompt) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(200)
+	}
+}
+
+func UnpairHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		err := Unpair(mux.Vars(r)["addr"])
+		if errors.Is(err, errAlreadyPairing) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(200)
+	}
+}
@@ -0,0 +1,194 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/muka/go-bluetooth/api"
+	"github.com/muka/go-bluetooth/bluez/profile/agent"
+	"github.com/muka/go-bluetooth/bluez/profile/device"
+)
+
+const pairingAgentPath = dbus.ObjectPath("/bluboi/agent")
+
+// pairingAgent answers BlueZ on behalf of the pairings in progress,
+// rejecting every other device.
+type pairingAgent struct{}
+
+var (
+	agentOnce sync.Once
+	errAgent  error
+	errRejected = dbus.NewError("org.bluez.Error.Rejected", nil)
+)
+
+// pathAddress turns a BlueZ device path back into an address.
+func pathAddress(path dbus.ObjectPath) string {
+	_, dev, _ := strings.Cut(string(path), "/dev_")
+	return strings.ReplaceAll(dev, "_", ":")
+}
+
+func (pairingAgent) Path() dbus.ObjectPath { return pairingAgentPath }
+func (pairingAgent) Interface() string { return agent.Agent1Interface }
+func (pairingAgent) Release() *dbus.Error { return nil }
+
+// Cancel is called when BlueZ gives up on the request it made, or the
+// device does.
+func (pairingAgent) Cancel() *dbus.Error {
+	Pairings.CancelPrompts()
+	return nil
+}
+
+func (pairingAgent) RequestPinCode(path dbus.ObjectPath) (string, *dbus.Error) {
+	addr := pathAddress(path)
+	req, ok := Pairings.Request(addr)
+	if !ok {
+		return "", errRejected
+	}
+	if req.PIN != "" {
+		return req.PIN, nil
+	}
+	res, ok := Pairings.Ask(addr, promptPIN, "")
+	if !ok || res.Reject {
+		return "", errRejected
+	}
+	return res.PIN, nil
+}
+
+func (pairingAgent) DisplayPinCode(path dbus.ObjectPath, pin string) *dbus.Error {
+	addr := pathAddress(path)
+	if _, ok := Pairings.Request(addr); !ok {
+		return errRejected
+	}
+	LogEvent("PAIRING_CODE", addr + ";" + pin)
+	return nil
+}
+
+func (pairingAgent) RequestPasskey(path dbus.ObjectPath) (uint32, *dbus.Error) {
+	addr := pathAddress(path)
+	req, ok := Pairings.Request(addr)
+	if !ok {
+		return 0, errRejected
+	}
+	if req.Passkey != nil {
+		return *req.Passkey, nil
+	}
+	res, ok := Pairings.Ask(addr, promptPasskey, "")
+	if !ok || res.Reject {
+		return 0, errRejected
+	}
+	return *res.Passkey, nil
+}
+
+func (pairingAgent) DisplayPasskey(path dbus.ObjectPath, passkey uint32, entered uint16) *dbus.Error {
+	addr := pathAddress(path)
+	if _, ok := Pairings.Request(addr); !ok {
+		return errRejected
+	}
+	// BlueZ calls again for every key typed on the device.
+	if entered == 0 {
+		LogEvent("PAIRING_CODE", addr + ";" + fmt.Sprintf("%06d", passkey))
+	}
+	return nil
+}
+
+// RequestConfirmation accepts numeric comparison when the key matches the
+// Passkey given, or otherwise asks for it to be checked against the
+// device's display.
+func (pairingAgent) RequestConfirmation(path dbus.ObjectPath, passkey uint32) *dbus.Error {
+	addr := pathAddress(path)
+	req, ok := Pairings.Request(addr)
+	if !ok {
+		return errRejected
+	}
+	if req.Passkey != nil {
+		if *req.Passkey != passkey {
+			return errRejected
+		}
+		return nil
+	}
+	res, ok := Pairings.Ask(addr, promptConfirm, fmt.Sprintf("%06d", passkey))
+	if !ok || res.Reject {
+		return errRejected
+	}
+	return nil
+}
+
+func (pairingAgent) RequestAuthorization(path dbus.ObjectPath) *dbus.Error {
+	if _, ok := Pairings.Request(pathAddress(path)); !ok {
+		return errRejected
+	}
+	return nil
+}
+
+func (pairingAgent) AuthorizeService(path dbus.ObjectPath, uuid string) *dbus.Error {
+	if _, ok := Pairings.Request(pathAddress(path)); !ok {
+		return errRejected
+	}
+	return nil
+}
+
+// registerAgent makes bluboi the default pairing agent, the first time
+// something is paired with.
+func registerAgent() error {
+	agentOnce.Do(func () {
+		conn, err := dbus.SystemBus()
+		if err != nil {
+			errAgent = err
+			return
+		}
+		errAgent = agent.ExposeAgent(conn, pairingAgent{}, agent.CapKeyboardDisplay, true)
+	})
+	return errAgent
+}
+
+func pairDevice(address string) error {
+	err := registerAgent()
+	if err != nil {
+		return err
+	}
+	path, err := devicePath(address)
+	if err != nil {
+		return err
+	}
+	dev, err := device.NewDevice1(path)
+	if err != nil {
+		return err
+	}
+	if !dev.Properties.Paired {
+		err = dev.Pair()
+		if err != nil {
+			return err
+		}
+	}
+	return dev.SetTrusted(true)
+}
+
+// trustDevice sets whether BlueZ lets a device connect and use its services
+// without asking the agent.
+func trustDevice(address string, trusted bool) error {
+	path, err := devicePath(address)
+	if err != nil {
+		return err
+	}
+	dev, err := device.NewDevice1(path)
+	if err != nil {
+		return err
+	}
+	return dev.SetTrusted(trusted)
+}
+
+func unpairDevice(address string) error {
+	path, err := devicePath(address)
+	if err != nil {
+		return err
+	}
+	a, err := api.GetDefaultAdapter()
+	if err != nil {
+		return err
+	}
+	return a.RemoveDevice(path)
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+func pairDevice(address string) error {
+	return errUnsupported
+}
+
+func unpairDevice(address string) error {
+	return errUnsupported
+}
+
+func trustDevice(address string, trusted bool) error {
+	return errUnsupported
+}
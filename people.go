@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	peopleFile = "people.json"
+	// People are looked at every peopleCheckEvery, and their hosts probed
+	// every peopleProbeEvery.
+	peopleCheckEvery = 5 * time.Second
+	peopleProbeEvery = 30 * time.Second
+	defaultAway      = 5 * time.Minute
+	defaultThreshold = 0.5
+)
+
+// How a person's devices are combined into their BLE source.
+const (
+	personAny       = "any"
+	personAll       = "all"
+	personStrongest = "strongest"
+)
+
+// Person is someone whose presence is told from their BLE devices and from
+// network probes of their Hosts: IPv4 addresses looked up with ARP, or
+// hostnames, those ending in .local resolved with mDNS and the others
+// looked up then ARPed. Phones sleep their BLE radio, the network fills in.
+//
+// Each source counts once it was seen within Away (5m by default), and the
+// person is home once the weighted share of the sources counting reaches
+// Threshold (0.5 by default). Weights default to 1 each, so either source
+// is enough.
+//
+// A person owns their Devices, a device belonging to one person at most.
+// Mode combines them: with any (the default) the BLE source saw the person
+// when any device was heard from, with all only when every one was, and
+// with strongest it follows the device in range heard loudest, so the
+// person is placed by the one they carry.
+type Person struct {
+	Name          string
+	Devices       []string `json:",omitempty"`
+	Mode          string   `json:",omitempty"`
+	Hosts         []string `json:",omitempty"`
+	BLEWeight     float64  `json:",omitempty"`
+	NetworkWeight float64  `json:",omitempty"`
+	Threshold     float64  `json:",omitempty"`
+	Away          string   `json:",omitempty"`
+}
+
+// PersonState is where a person is at, with when each source last saw them
+// and the device the BLE source went by.
+type PersonState struct {
+	Name        string
+	Home        bool
+	Score       float64
+	Since       time.Time  `json:",omitempty"`
+	Device      string     `json:",omitempty"`
+	RSSI        int16      `json:",omitempty"`
+	BLESeen     *time.Time `json:",omitempty"`
+	NetworkSeen *time.Time `json:",omitempty"`
+}
+
+type SafePeople struct {
+	mu      sync.Mutex
+	People  []Person
+	states  map[string]*PersonState
+	// hosts holds when each host last answered a probe, and probing which
+	// are being probed.
+	hosts   map[string]time.Time
+	probing map[string]bool
+	probed  time.Time
+}
+
+var People = SafePeople{People: []Person{}, states: map[string]*PersonState{}, hosts: map[string]time.Time{}, probing: map[string]bool{}}
+
+func ValidatePeople(people []Person) error {
+	names := map[string]bool{}
+	owners := map[string]string{}
+	for _, p := range people {
+		if p.Name == "" || names[p.Name] {
+			return errors.New("people need distinct names")
+		}
+		names[p.Name] = true
+		if len(p.Devices) == 0 && len(p.Hosts) == 0 {
+			return errors.New(p.Name + ": needs Devices, Hosts or both")
+		}
+		for _, addr := range p.Devices {
+			if _, err := net.ParseMAC(addr); err != nil {
+				return errors.New(p.Name + ": " + addr + " is not a MAC address")
+			}
+			if owner, ok := owners[strings.ToUpper(addr)]; ok {
+				return errors.New(p.Name + ": " + addr + " is already " + owner + "'s")
+			}
+			owners[strings.ToUpper(addr)] = p.Name
+		}
+		for _, host := range p.Hosts {
+			if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+				return errors.New(p.Name + ": " + host + " is not an IPv4 address, ARP only works with those")
+			}
+		}
+		switch p.Mode {
+		case "", personAny, personAll, personStrongest:
+		default:
+			return errors.New(p.Name + ": mode must be any, all or strongest")
+		}
+		if p.BLEWeight < 0 || p.NetworkWeight < 0 {
+			return errors.New(p.Name + ": weights can't be negative")
+		}
+		if p.Threshold < 0 || p.Threshold > 1 {
+			return errors.New(p.Name + ": threshold must be between 0 and 1")
+		}
+		if p.Away != "" {
+			if d, err := time.ParseDuration(p.Away); err != nil || d <= 0 {
+				return errors.New(p.Name + ": away must be a duration, eg. 10m")
+			}
+		}
+	}
+	return nil
+}
+
+func (sp *SafePeople) Load() error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	err := LoadJSON(peopleFile, &sp.People)
+	if err != nil {
+		return err
+	}
+	return ValidatePeople(sp.People)
+}
+
+func (sp *SafePeople) List() []Person {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return sp.People
+}
+
+// Set replaces the people, whose presence is worked out again from scratch.
+func (sp *SafePeople) Set(people []Person) error {
+	err := ValidatePeople(people)
+	if err != nil {
+		return err
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	err = SaveJSON(peopleFile, people)
+	if err != nil {
+		return err
+	}
+	sp.People = people
+	sp.states = map[string]*PersonState{}
+	sp.probed = time.Time{}
+	return nil
+}
+
+func (sp *SafePeople) States() []PersonState {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	states := []PersonState{}
+	for _, p := range sp.People {
+		if state, ok := sp.states[p.Name]; ok {
+			states = append(states, *state)
+		} else {
+			states = append(states, PersonState{Name: p.Name})
+		}
+	}
+	return states
+}
+
+// Owners maps the devices people own, by upper case address, to their
+// names.
+func (sp *SafePeople) Owners() map[string]string {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	owners := map[string]string{}
+	for _, p := range sp.People {
+		for _, addr := range p.Devices {
+			owners[strings.ToUpper(addr)] = p.Name
+		}
+	}
+	return owners
+}
+
+// bleSeen is when a person's devices were last heard from as mode combines
+// them, with the device that decided: the latest heard from with any, the
+// earliest with all, and with strongest the loudest of those heard from
+// within away, falling back on the latest when none was.
+func bleSeen(addrs []string, mode string, now time.Time, away time.Duration) (time.Time, string) {
+	seen := map[string]time.Time{}
+	latest, earliest, strongest := "", "", ""
+	var loudest int16
+	for _, addr := range addrs {
+		addr = strings.ToUpper(addr)
+		device := Devices.Device(addr)
+		seen[addr] = device.LastSeen
+		if known, ok := Known.Get(addr); ok {
+			seen[addr] = maxTime(seen[addr], known.LastSeen)
+		}
+		if latest == "" || seen[addr].After(seen[latest]) {
+			latest = addr
+		}
+		if earliest == "" || seen[addr].Before(seen[earliest]) {
+			earliest = addr
+		}
+		if Devices.Exists(addr) && now.Sub(device.LastSeen) < away && (strongest == "" || device.RSSI > loudest) {
+			strongest, loudest = addr, device.RSSI
+		}
+	}
+	decided := latest
+	if mode == personAll {
+		decided = earliest
+	} else if mode == personStrongest && strongest != "" {
+		decided = strongest
+	}
+	if seen[decided].IsZero() {
+		return time.Time{}, ""
+	}
+	return seen[decided], decided
+}
+
+// fuse works out a person's score from when each source last saw them,
+// expecting sp.mu to be held.
+func (sp *SafePeople) fuse(p Person, now time.Time) PersonState {
+	away := defaultAway
+	if p.Away != "" {
+		away, _ = time.ParseDuration(p.Away)
+	}
+	threshold := p.Threshold
+	if threshold == 0 {
+		threshold = defaultThreshold
+	}
+	bleWeight, networkWeight := p.BLEWeight, p.NetworkWeight
+	if bleWeight == 0 && networkWeight == 0 {
+		bleWeight, networkWeight = 1, 1
+	}
+	state := PersonState{Name: p.Name}
+	total, score := 0.0, 0.0
+	if len(p.Devices) > 0 {
+		total += bleWeight
+		if seen, addr := bleSeen(p.Devices, p.Mode, now, away); !seen.IsZero() {
+			state.BLESeen = &seen
+			state.Device = addr
+			if Devices.Exists(addr) {
+				state.RSSI = Devices.Device(addr).RSSI
+			}
+			if now.Sub(seen) < away {
+				score += bleWeight
+			}
+		}
+	}
+	if len(p.Hosts) > 0 {
+		total += networkWeight
+		seen := time.Time{}
+		for _, host := range p.Hosts {
+			seen = maxTime(seen, sp.hosts[host])
+		}
+		if !seen.IsZero() {
+			state.NetworkSeen = &seen
+			if now.Sub(seen) < away {
+				score += networkWeight
+			}
+		}
+	}
+	if total > 0 {
+		state.Score = math.Round(100 * score / total) / 100
+	}
+	state.Home = state.Score > 0 && state.Score >= threshold
+	return state
+}
+
+// probe probes the hosts no probe is running for.
+func (sp *SafePeople) probe() {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if time.Since(sp.probed) < peopleProbeEvery {
+		return
+	}
+	sp.probed = time.Now()
+	for _, p := range sp.People {
+		for _, host := range p.Hosts {
+			if sp.probing[host] {
+				continue
+			}
+			sp.probing[host] = true
+			go func (host string) {
+				up, err := ProbeHost(host)
+				if err != nil {
+					log.Printf("[ERROR] Could not probe %v - %v", host, err)
+				}
+				sp.mu.Lock()
+				defer sp.mu.Unlock()
+				delete(sp.probing, host)
+				if up {
+					sp.hosts[host] = time.Now()
+				}
+			} (host)
+		}
+	}
+}
+
+// Run keeps people's presence up to date, raising PERSON (name;home|away;
+// score;device) as they come and go.
+func (sp *SafePeople) Run() {
+	for {
+		time.Sleep(peopleCheckEvery)
+		sp.probe()
+		changed := []PersonState{}
+		sp.mu.Lock()
+		now := time.Now()
+		for _, p := range sp.People {
+			state := sp.fuse(p, now)
+			previous, ok := sp.states[p.Name]
+			state.Since = now
+			if ok && previous.Home == state.Home {
+				state.Since = previous.Since
+			} else if ok || state.Home {
+				changed = append(changed, state)
+			}
+			sp.states[p.Name] = &state
+		}
+		sp.mu.Unlock()
+		for _, state := range changed {
+			where := "away"
+			if state.Home {
+				where = "home"
+			}
+			LogEvent("PERSON", strings.Join([]string{state.Name, where, formatFloat(state.Score), state.Device}, ";"))
+		}
+	}
+}
+
+func ListPeopleHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(People.States())
+	}
+}
+
+func GetPeopleHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(People.List())
+	}
+}
+
+func SetPeopleHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		people := []Person{}
+		err := json.NewDecoder(r.Body).Decode(&people)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = People.Set(people)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(200)
+	}
+}
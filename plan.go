@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// sensitiveFields are shown as changed in plans without their values.
+var sensitiveFields = []string{"Password", "SharedKey", "PrivateKey", "Token"}
+
+// GatewayConfig is the configuration of a gateway as a whole, for plan and
+// apply: the desired state of devices, and config sections replacing the
+// stored ones. Devices and sections left out are left alone.
+type GatewayConfig struct {
+	Devices map[string]DesiredState
+	Config  ConfigBundle
+}
+
+// SectionChange is how applying would change a config section, one Diff
+// line per field: "+ path: value" added, "- path: value" removed and
+// "~ path: old -> new" changed.
+type SectionChange struct {
+	Section string
+	Diff    []string
+}
+
+// GatewayPlan is what applying a GatewayConfig would change. ID identifies
+// the changes, so one reviewed can be applied only if nothing changed since.
+type GatewayPlan struct {
+	ID       string
+	Changed  bool
+	Devices  map[string]DesiredStateReport
+	Config   []SectionChange
+	Problems []ConfigProblem `json:",omitempty"`
+}
+
+var (
+	errPlanStale = errors.New("the gateway changed since the plan was made, review it again")
+	errDevicesFailed = errors.New("some devices could not be brought to their desired state")
+	// applying keeps plans from being applied at the same time.
+	applying sync.Mutex
+)
+
+func sensitive(path string) bool {
+	i := strings.LastIndexAny(path, ".[")
+	return slices.Contains(sensitiveFields, path[i + 1:])
+}
+
+func diffValue(path string, v any) string {
+	if sensitive(path) {
+		return "(sensitive)"
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// diffJSON appends the differences between two decoded JSON documents.
+func diffJSON(path string, before any, after any, diff *[]string) {
+	if _, ok := after.(map[string]any); ok && before == nil {
+		before = map[string]any{}
+	}
+	if before == nil && after != nil {
+		*diff = append(*diff, "+ " + path + ": " + diffValue(path, after))
+		return
+	}
+	b, bok := before.(map[string]any)
+	a, aok := after.(map[string]any)
+	if bok && aok {
+		keys := []string{}
+		for k := range b {
+			keys = append(keys, k)
+		}
+		for k := range a {
+			if _, ok := b[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			sub := k
+			if path != "" {
+				sub = path + "." + k
+			}
+			bv, inBefore := b[k]
+			av, inAfter := a[k]
+			switch {
+			case !inBefore:
+				*diff = append(*diff, "+ " + sub + ": " + diffValue(sub, av))
+			case !inAfter:
+				*diff = append(*diff, "- " + sub + ": " + diffValue(sub, bv))
+			default:
+				diffJSON(sub, bv, av, diff)
+			}
+		}
+		return
+	}
+	bl, bok := before.([]any)
+	al, aok := after.([]any)
+	if bok && aok {
+		for i := 0; i < max(len(bl), len(al)); i++ {
+			sub := fmt.Sprintf("%s[%d]", path, i)
+			switch {
+			case i >= len(bl):
+				*diff = append(*diff, "+ " + sub + ": " + diffValue(sub, al[i]))
+			case i >= len(al):
+				*diff = append(*diff, "- " + sub + ": " + diffValue(sub, bl[i]))
+			default:
+				diffJSON(sub, bl[i], al[i], diff)
+			}
+		}
+		return
+	}
+	bj, _ := json.Marshal(before)
+	aj, _ := json.Marshal(after)
+	if !bytes.Equal(bj, aj) {
+		*diff = append(*diff, "~ " + path + ": " + diffValue(path, before) + " -> " + diffValue(path, after))
+	}
+}
+
+// diffSection compares a stored config section with the one submitted,
+// nil when there's no difference.
+func diffSection(section string, stored json.RawMessage, submitted json.RawMessage) []string {
+	var before, after any
+	if stored != nil {
+		json.Unmarshal(stored, &before)
+	}
+	json.Unmarshal(submitted, &after)
+	diff := []string{}
+	diffJSON(section, before, after, &diff)
+	if len(diff) == 0 {
+		return nil
+	}
+	return diff
+}
+
+// Plan works out what applying gc would change without changing anything.
+// Submitted sections are checked along with the stored ones they'd sit next
+// to.
+func Plan(gc GatewayConfig) (GatewayPlan, error) {
+	plan := GatewayPlan{Devices: map[string]DesiredStateReport{}, Config: []SectionChange{}}
+	stored, err := StoredConfig()
+	if err != nil {
+		return plan, err
+	}
+	merged := ConfigBundle{}
+	for section, raw := range stored {
+		merged[section] = raw
+	}
+	sections := []string{}
+	for section, raw := range gc.Config {
+		merged[section] = raw
+		sections = append(sections, section)
+	}
+	plan.Problems = CheckConfig(merged)
+	slices.Sort(sections)
+	for _, section := range sections {
+		if diff := diffSection(section, stored[section], gc.Config[section]); diff != nil {
+			plan.Config = append(plan.Config, SectionChange{section, diff})
+			plan.Changed = true
+		}
+	}
+	addrs := []string{}
+	for addr := range gc.Devices {
+		addrs = append(addrs, addr)
+	}
+	slices.Sort(addrs)
+	for _, addr := range addrs {
+		report, err := Converge(addr, gc.Devices[addr], true)
+		if err != nil {
+			report.Error = err.Error()
+		}
+		plan.Devices[strings.ToUpper(addr)] = report
+		plan.Changed = plan.Changed || report.Changed
+	}
+	b, _ := json.Marshal(plan)
+	sum := sha256.Sum256(b)
+	plan.ID = hex.EncodeToString(sum[:8])
+	return plan, nil
+}
+
+// Apply makes the changes planned for gc, the config sections that differ
+// first, then the devices. With planID it refuses to unless the plan is
+// still the same.
+func Apply(gc GatewayConfig, planID string) (GatewayPlan, error) {
+	applying.Lock()
+	defer applying.Unlock()
+	plan, err := Plan(gc)
+	if err != nil {
+		return plan, err
+	}
+	if planID != "" && planID != plan.ID {
+		return plan, errPlanStale
+	}
+	if len(plan.Problems) > 0 {
+		return plan, errors.New("the config has problems")
+	}
+	changed := ConfigBundle{}
+	for _, change := range plan.Config {
+		changed[change.Section] = gc.Config[change.Section]
+	}
+	err = applyConfig(changed)
+	if err != nil {
+		return plan, err
+	}
+	for addr, desired := range gc.Devices {
+		report, err := Converge(addr, desired, false)
+		if err != nil {
+			report.Error = err.Error()
+		}
+		plan.Devices[strings.ToUpper(addr)] = report
+	}
+	for _, report := range plan.Devices {
+		if report.Error != "" {
+			return plan, errDevicesFailed
+		}
+	}
+	return plan, nil
+}
+
+// PlanHandler shows what applying the GatewayConfig body would change.
+func PlanHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		gc := GatewayConfig{}
+		err := json.NewDecoder(r.Body).Decode(&gc)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		plan, err := Plan(gc)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", "\"" + plan.ID + "\"")
+		if len(plan.Problems) > 0 {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+		}
+		json.NewEncoder(w).Encode(plan)
+	}
+}
+
+// ApplyHandler applies the GatewayConfig body and answers with the plan it
+// carried out, 502 if a device couldn't be converged. Send the plan's ETag
+// as If-Match to get a 412 instead if the gateway changed since it was
+// reviewed.
+func ApplyHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		gc := GatewayConfig{}
+		err := json.NewDecoder(r.Body).Decode(&gc)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		plan, err := Apply(gc, strings.Trim(r.Header.Get("If-Match"), "\""))
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case errors.Is(err, errPlanStale):
+			w.WriteHeader(http.StatusPreconditionFailed)
+		case errors.Is(err, errDevicesFailed):
+			w.WriteHeader(http.StatusBadGateway)
+		case err != nil && len(plan.Problems) > 0:
+			w.WriteHeader(http.StatusUnprocessableEntity)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(plan)
+	}
+}
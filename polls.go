@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const pollsFile = "polls.json"
+
+// Poll reads a characteristic of a device every Interval while connected
+// to it, for devices that can't notify. Values are logged like
+// notifications.
+type Poll struct {
+	Char     string
+	Interval string
+}
+
+type SafePolls struct {
+	mu    sync.Mutex
+	Polls map[string][]Poll
+	due   map[string]time.Time
+}
+
+var Polls = SafePolls{Polls: map[string][]Poll{}, due: map[string]time.Time{}}
+
+func ValidatePolls(polls []Poll) error {
+	chars := map[string]bool{}
+	for _, p := range polls {
+		id, err := ParseUUID(p.Char)
+		if err != nil {
+			return errors.New(p.Char + " is not a UUID")
+		}
+		if chars[id.String()] {
+			return errors.New(p.Char + " is polled more than once")
+		}
+		chars[id.String()] = true
+		interval, err := time.ParseDuration(p.Interval)
+		if err != nil || interval < time.Second {
+			return errors.New(p.Char + ": interval must be a duration of at least a second")
+		}
+	}
+	return nil
+}
+
+func (sp *SafePolls) Load() error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	err := LoadJSON(pollsFile, &sp.Polls)
+	if err != nil {
+		return err
+	}
+	for addr, polls := range sp.Polls {
+		if err := ValidatePolls(polls); err != nil {
+			return errors.New(addr + " " + err.Error())
+		}
+	}
+	return nil
+}
+
+func (sp *SafePolls) List(addr string) []Poll {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if polls, ok := sp.Polls[strings.ToUpper(addr)]; ok {
+		return polls
+	}
+	return []Poll{}
+}
+
+// Set replaces the polls of a device, an empty list removes them.
+func (sp *SafePolls) Set(addr string, polls []Poll) error {
+	err := ValidatePolls(polls)
+	if err != nil {
+		return err
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	addr = strings.ToUpper(addr)
+	all := map[string][]Poll{}
+	for a, p := range sp.Polls {
+		all[a] = p
+	}
+	if len(polls) == 0 {
+		delete(all, addr)
+	} else {
+		all[addr] = polls
+	}
+	err = SaveJSON(pollsFile, all)
+	if err != nil {
+		return err
+	}
+	sp.Polls = all
+	return nil
+}
+
+// pending returns the polls of the device that are due and schedules their
+// next reads.
+func (sp *SafePolls) pending(addr string) []Poll {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	now := time.Now()
+	due := []Poll{}
+	for _, p := range sp.Polls[strings.ToUpper(addr)] {
+		key := addr + ";" + p.Char
+		if now.Before(sp.due[key]) {
+			continue
+		}
+		interval, _ := time.ParseDuration(p.Interval)
+		sp.due[key] = now.Add(interval)
+		due = append(due, p)
+	}
+	return due
+}
+
+// Run reads the due characteristics of the connected devices. Polls start
+// over with every connection.
+func (sp *SafePolls) Run() {
+	connected := map[string]bool{}
+	for {
+		time.Sleep(time.Second)
+		addresses := Adapter.Addresses()
+		sp.mu.Lock()
+		for key := range sp.due {
+			addr, _, _ := strings.Cut(key, ";")
+			if !slices.Contains(addresses, addr) || !connected[addr] {
+				delete(sp.due, key)
+			}
+		}
+		sp.mu.Unlock()
+		connected = map[string]bool{}
+		for _, addr := range addresses {
+			connected[addr] = true
+			for _, p := range sp.pending(addr) {
+				value, err := Adapter.ReadCharacteristic(addr, p.Char)
+				if err != nil {
+					LogError("Could not poll", p.Char, "on", addr, "-", err.Error())
+					continue
+				}
+				HandleNotification(addr, p.Char, value)
+			}
+		}
+	}
+}
+
+func GetPollsHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Polls.List(mux.Vars(r)["addr"]))
+	}
+}
+
+func SetPollsHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		polls := []Poll{}
+		err := json.NewDecoder(r.Body).Decode(&polls)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = Polls.Set(mux.Vars(r)["addr"], polls)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(200)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// postgresMigrations is applied by CheckSchema or `bluboi migrate`, and
+// recorded in schema_migrations.
+const postgresMigrations = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+	version    integer PRIMARY KEY,
+	name       text NOT NULL,
+	applied_at timestamptz NOT NULL DEFAULT now()
+)`
+
+// PostgresBackend keeps documents and history in Postgres (or TimescaleDB),
+// for deployments outgrowing a local data directory.
+type PostgresBackend struct {
+	db         *sql.DB
+	migrations []Migration
+}
+
+func OpenPostgres(url string) (*PostgresBackend, error) {
+	migrations, err := LoadMigrations("postgres")
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(postgresMigrations)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &PostgresBackend{db, migrations}, nil
+}
+
+func (pb *PostgresBackend) Load(name string, v any) error {
+	data := []byte{}
+	err := pb.db.QueryRow("SELECT data FROM documents WHERE name = $1", name).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (pb *PostgresBackend) Save(name string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = pb.db.Exec(`INSERT INTO documents (name, data) VALUES ($1, $2)
+		ON CONFLICT (name) DO UPDATE SET data = EXCLUDED.data`, name, data)
+	return err
+}
+
+func (pb *PostgresBackend) Append(tier string, points []Aggregate) error {
+	tx, err := pb.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`INSERT INTO points
+		(tier, address, metric, start, resolution, min, max, avg, count, calibration)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, p := range points {
+		_, err := stmt.Exec(tier, p.Address, p.Metric, p.Start, p.Window, p.Min, p.Max, p.Avg, p.Count, p.Calibration)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (pb *PostgresBackend) Scan(tier string, since time.Time, callback func (Aggregate)) error {
+	rows, err := pb.db.Query(`SELECT address, metric, start, resolution, min, max, avg, count, calibration
+		FROM points WHERE tier = $1 AND start >= $2 ORDER BY start`, tier, since)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		p := Aggregate{}
+		err := rows.Scan(&p.Address, &p.Metric, &p.Start, &p.Window, &p.Min, &p.Max, &p.Avg, &p.Count, &p.Calibration)
+		if err != nil {
+			return err
+		}
+		callback(p)
+	}
+	return rows.Err()
+}
+
+func (pb *PostgresBackend) Prune(tier string, before time.Time) error {
+	_, err := pb.db.Exec("DELETE FROM points WHERE tier = $1 AND start < $2", tier, before)
+	return err
+}
+
+func (pb *PostgresBackend) Migrations() []Migration {
+	return pb.migrations
+}
+
+func (pb *PostgresBackend) SchemaVersion() (int, error) {
+	version := 0
+	err := pb.db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	return version, err
+}
+
+// ApplyMigration runs a migration and records it in one transaction, so a
+// failing script leaves the schema as it was.
+func (pb *PostgresBackend) ApplyMigration(m Migration, up bool) error {
+	tx, err := pb.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if up {
+		_, err = tx.Exec(m.Up)
+		if err == nil {
+			_, err = tx.Exec("INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", m.Version, m.Name)
+		}
+	} else {
+		_, err = tx.Exec(m.Down)
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM schema_migrations WHERE version = $1", m.Version)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+type postgresDocument struct {
+	Name string
+	Data json.RawMessage
+}
+
+type postgresPoint struct {
+	Tier string
+	Aggregate
+}
+
+// Snapshot dumps both tables as JSON lines.
+func (pb *PostgresBackend) Snapshot(tw *tar.Writer) error {
+	documents := bytes.Buffer{}
+	rows, err := pb.db.Query("SELECT name, data FROM documents ORDER BY name")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		d := postgresDocument{}
+		err := rows.Scan(&d.Name, &d.Data)
+		if err != nil {
+			return err
+		}
+		line, _ := json.Marshal(d)
+		documents.Write(append(line, '\n'))
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	err = writeTarFile(tw, "db/documents.jsonl", documents.Bytes())
+	if err != nil {
+		return err
+	}
+	tiers := []string{}
+	rows, err = pb.db.Query("SELECT DISTINCT tier FROM points")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		tier := ""
+		if err := rows.Scan(&tier); err != nil {
+			return err
+		}
+		tiers = append(tiers, tier)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	points := bytes.Buffer{}
+	for _, tier := range tiers {
+		err := pb.Scan(tier, time.Time{}, func (p Aggregate) {
+			line, _ := json.Marshal(postgresPoint{tier, p})
+			points.Write(append(line, '\n'))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return writeTarFile(tw, "db/points.jsonl", points.Bytes())
+}
+
+// Restore loads a table dumped by Snapshot into the database.
+func (pb *PostgresBackend) Restore(name string, r io.Reader) error {
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 16 << 20)
+	for s.Scan() {
+		switch name {
+		case "documents.jsonl":
+			d := postgresDocument{}
+			err := json.Unmarshal(s.Bytes(), &d)
+			if err != nil {
+				return err
+			}
+			err = pb.Save(d.Name, d.Data)
+			if err != nil {
+				return err
+			}
+		case "points.jsonl":
+			p := postgresPoint{}
+			err := json.Unmarshal(s.Bytes(), &p)
+			if err != nil {
+				return err
+			}
+			err = pb.Append(p.Tier, []Aggregate{p.Aggregate})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return s.Err()
+}
+
+func (pb *PostgresBackend) Close() error {
+	return pb.db.Close()
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	presenceAlpha   = 0.2
+	presenceSamples = 3
+)
+
+// presence learns how often a device advertises.
+type presence struct {
+	lastSeen    time.Time
+	interval    time.Duration
+	samples     int
+	dead        bool
+	advertising advertising
+}
+
+// SafePresence flags devices that miss DeadAfter of their usual advertising
+// intervals. Only time spent scanning counts, so devices aren't declared dead
+// just because nobody was listening.
+type SafePresence struct {
+	mu        sync.Mutex
+	DeadAfter int
+	devices   map[string]*presence
+	scanStart time.Time
+	scanning  bool
+}
+
+var Presence = SafePresence{DeadAfter: 5, devices: map[string]*presence{}}
+
+func (sp *SafePresence) Seen(addr string) {
+	wasDead, abnormal := sp.seen(addr)
+	if wasDead {
+		LogEvent("SENSOR_ALIVE", DisplayName(addr), "(" + addr + ") is reporting again.")
+	}
+	if abnormal != nil {
+		LogEvent("ADVERTISING_ABNORMAL", strings.Join([]string{addr, abnormal.Abnormal, abnormal.Interval, abnormal.Baseline}, ";"))
+	}
+}
+
+// Forget drops what was learned about a device that went away.
+func (sp *SafePresence) Forget(addr string) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	delete(sp.devices, addr)
+}
+
+// seen records an advertisement, returning whether the device was dead and
+// its advertising stats if they just turned abnormal.
+func (sp *SafePresence) seen(addr string) (bool, *AdvertisingStats) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	now := time.Now()
+	p, ok := sp.devices[addr]
+	if !ok {
+		sp.devices[addr] = &presence{lastSeen: now}
+		return false, nil
+	}
+	var abnormal *AdvertisingStats
+	// Gaps spanning a pause in scanning say nothing about the device.
+	if p.lastSeen.After(sp.scanStart) {
+		gap := now.Sub(p.lastSeen)
+		if p.samples == 0 {
+			p.interval = gap
+		} else {
+			p.interval += time.Duration(presenceAlpha * float64(gap - p.interval))
+		}
+		p.samples++
+		flagged := p.advertising.stats != nil && p.advertising.stats.Abnormal != ""
+		if p.advertising.add(gap) && !flagged && p.advertising.stats.Abnormal != "" {
+			abnormal = p.advertising.stats
+		}
+	}
+	p.lastSeen = now
+	wasDead := p.dead
+	p.dead = false
+	return wasDead, abnormal
+}
+
+// missed is how many expected intervals have passed without an
+// advertisement, expecting sp.mu to be held.
+func (sp *SafePresence) missed(p *presence) int {
+	if p.samples < presenceSamples || p.interval <= 0 || !sp.scanning {
+		return 0
+	}
+	since := p.lastSeen
+	if sp.scanStart.After(since) {
+		since = sp.scanStart
+	}
+	return int(time.Since(since) / p.interval)
+}
+
+func (sp *SafePresence) health(p *presence) string {
+	switch missed := sp.missed(p); {
+	case p.dead:
+		return "dead"
+	case p.samples < presenceSamples:
+		return "learning"
+	case missed > 0:
+		return "late"
+	}
+	return "ok"
+}
+
+// Health describes a device as learning, ok, late or dead.
+func (sp *SafePresence) Health(addr string) string {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	p, ok := sp.devices[addr]
+	if !ok {
+		return "learning"
+	}
+	return sp.health(p)
+}
+
+// WatchPresence raises SENSOR_DEAD once a device has missed DeadAfter
+// intervals, and SENSOR_ALIVE when it is heard from again.
+func (sp *SafePresence) WatchPresence() {
+	for {
+		time.Sleep(time.Second)
+		scanning := Adapter.scanning.Load()
+		dead := map[string]int{}
+		sp.mu.Lock()
+		if scanning && !sp.scanning {
+			sp.scanStart = time.Now()
+		}
+		sp.scanning = scanning
+		for addr, p := range sp.devices {
+			missed := sp.missed(p)
+			if sp.DeadAfter > 0 && !p.dead && missed >= sp.DeadAfter {
+				p.dead = true
+				dead[addr] = missed
+			}
+		}
+		sp.mu.Unlock()
+		for addr, missed := range dead {
+			LogEvent("SENSOR_DEAD", DisplayName(addr), "(" + addr + ") missed", strconv.Itoa(missed), "expected reports.")
+		}
+	}
+}
+
+type DeviceListing struct {
+	Address      string
+	Name         string
+	Alias        string             `json:",omitempty"`
+	Tags         []string           `json:",omitempty"`
+	Favorite     bool               `json:",omitempty"`
+	// Person is who owns the device, see People.
+	Person       string             `json:",omitempty"`
+	// InRange is false for favorites that aren't advertising, whose Health
+	// is gone, and composites none of whose members are.
+	InRange      bool
+	Health       string
+	Interval     string             `json:",omitempty"`
+	Members      []string           `json:",omitempty"`
+	RSSI         int16              `json:",omitempty"`
+	Manufacturer []ManufacturerData `json:",omitempty"`
+	Services     []string           `json:",omitempty"`
+	ServiceData  []ServiceData      `json:",omitempty"`
+	Advertising  *AdvertisingStats  `json:",omitempty"`
+	LastSeen     time.Time
+}
+
+// Listing returns every discovered device along with its health, the
+// favorites out of range as last known, then the composite devices.
+func (sp *SafePresence) Listing() []DeviceListing {
+	devices := []DeviceListing{}
+	Devices.ForEach(func (addr string, device Device) {
+		meta := Metadata.Get(addr)
+		devices = append(devices, DeviceListing{Address: addr, Name: device.Name, Alias: meta.Alias, Tags: meta.Tags, Favorite: meta.Favorite, InRange: true, RSSI: device.RSSI, Manufacturer: device.Manufacturer, Services: device.Services, ServiceData: device.ServiceData, LastSeen: device.LastSeen})
+	})
+	inRange := len(devices)
+	owners := People.Owners()
+	for _, addr := range Metadata.Favorites() {
+		if Devices.Exists(addr) {
+			continue
+		}
+		meta := Metadata.Get(addr)
+		listing := DeviceListing{Address: addr, Alias: meta.Alias, Tags: meta.Tags, Favorite: true, Health: "gone"}
+		if known, ok := Known.Get(addr); ok {
+			listing.Name, listing.Services, listing.LastSeen = known.Name, known.Services, known.LastSeen
+		}
+		devices = append(devices, listing)
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	for i, device := range devices[:inRange] {
+		p, ok := sp.devices[device.Address]
+		if !ok {
+			devices[i].Health = "learning"
+			continue
+		}
+		devices[i].Health = sp.health(p)
+		devices[i].Advertising = p.advertising.stats
+		if p.samples >= presenceSamples {
+			devices[i].Interval = p.interval.Round(time.Millisecond).String()
+		}
+	}
+	for i := range devices {
+		devices[i].Person = owners[devices[i].Address]
+	}
+	for _, c := range Composites.List() {
+		devices = append(devices, compositeListing(c, devices))
+	}
+	sort.Slice(devices, func (i, j int) bool {
+		return devices[i].Address < devices[j].Address
+	})
+	return devices
+}
+
+// advertises tells whether a device advertises a service, by its UUID in
+// any form.
+func (d DeviceListing) advertises(service string) bool {
+	for _, s := range d.Services {
+		if sameUUID(s, service) {
+			return true
+		}
+	}
+	for _, s := range d.ServiceData {
+		if sameUUID(s.UUID, service) {
+			return true
+		}
+	}
+	return false
+}
+
+// ListDevicesHandler lists the devices, only those advertising the service
+// query parameter when given, as JSON or, with format=known_devices or
+// format=monitor, as presence trackers take them.
+func ListDevicesHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		devices := Presence.Listing()
+		if service := r.URL.Query().Get("service"); service != "" {
+			if _, err := ParseUUID(service); err != nil {
+				http.Error(w, service + " is not a UUID", http.StatusBadRequest)
+				return
+			}
+			devices = slices.DeleteFunc(devices, func (d DeviceListing) bool { return !d.advertises(service) })
+		}
+		switch r.URL.Query().Get("format") {
+		case formatKnownDevices:
+			w.Header().Set("Content-Type", "application/yaml")
+			writeKnownDevices(w, devices)
+		case formatMonitor:
+			w.Header().Set("Content-Type", "text/plain")
+			writeMonitorAddresses(w, devices)
+		case "", "json":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(devices)
+		default:
+			http.Error(w, "format must be json, " + formatKnownDevices + " or " + formatMonitor, http.StatusBadRequest)
+		}
+	}
+}
+
+// DeviceHandler shows one device as /devices lists it.
+func DeviceHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		addr := strings.ToUpper(mux.Vars(r)["addr"])
+		for _, device := range Presence.Listing() {
+			if device.Address == addr {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(device)
+				return
+			}
+		}
+		http.Error(w, "device not found", http.StatusNotFound)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Preset tunes bluboi for one of the ways it's usually run. Flags holds
+// defaults for command line flags, which still win when given explicitly,
+// and stored retention tiers win over Retention. Disabled lists the endpoints
+// the preset doesn't expose.
+type Preset struct {
+	Description string
+	Flags       map[string]string
+	Retention   []RetentionTier
+	Disabled    []string
+}
+
+var (
+	Presets = map[string]Preset{
+		"presence-tracker": {
+			Description: "scans continuously and tracks which devices are around, without connecting to any",
+			Flags: map[string]string{"scan": "continuous", "scan-type": "passive", "aggregate": "rssi=1m", "dead-after": "3", "anomaly-z": "0"},
+			Retention: []RetentionTier{{"raw", 0, 6}, {"minute", 60, 7 * 24}},
+			Disabled: []string{"/connect", "/disconnect", "/connection", "/wedge", "/serial", "/bridges", "/captures", "/recordings"},
+		},
+		"sensor-gateway": {
+			Description: "scans continuously and keeps aggregated sensor history for exporting",
+			Flags: map[string]string{"scan": "continuous", "scan-type": "active", "aggregate": DefaultWindows, "dead-after": "5", "anomaly-z": "4"},
+			Retention: DefaultRetention,
+			Disabled: []string{"/wedge", "/serial", "/captures"},
+		},
+		"hacker-console": {
+			Description: "scans on demand and exposes everything for exploring devices, keeping little history",
+			Flags: map[string]string{"scan": "on-demand", "scan-type": "active", "aggregate": "", "dead-after": "0", "anomaly-z": "0"},
+			Retention: []RetentionTier{{"raw", 0, 24}},
+		},
+	}
+	ActivePreset Preset
+)
+
+func presetNames() string {
+	names := []string{}
+	for name := range Presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// UsePreset applies a preset to the flags that weren't given, expecting the
+// command line to have been parsed already. An empty name keeps the
+// defaults.
+func UsePreset(name string) error {
+	if name == "" {
+		return nil
+	}
+	preset, ok := Presets[name]
+	if !ok {
+		return errors.New("unknown preset " + name + ", expected one of " + presetNames())
+	}
+	explicit := map[string]bool{}
+	flag.Visit(func (f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	for flagName, value := range preset.Flags {
+		if explicit[flagName] {
+			continue
+		}
+		err := flag.Set(flagName, value)
+		if err != nil {
+			return err
+		}
+	}
+	if preset.Retention != nil {
+		DefaultRetention = preset.Retention
+	}
+	ActivePreset = preset
+	return nil
+}
+
+// PresetMiddleware hides the endpoints the active preset disables.
+func PresetMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+		for _, prefix := range ActivePreset.Disabled {
+			if r.URL.Path == prefix || strings.HasPrefix(r.URL.Path, prefix + "/") {
+				http.Error(w, "disabled by the preset", http.StatusNotFound)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
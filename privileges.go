@@ -0,0 +1,18 @@
+package main
+
+// Requirement documents what a backend needs from the host, so the minimum
+// privileges for a deployment can be derived from the features it uses.
+type Requirement struct {
+	Backend string
+	Needs   string
+}
+
+var Requirements = []Requirement{
+	{"Scanning and connections", "D-Bus access to org.bluez on the system bus (usually the bluetooth group); no capabilities"},
+	{"Adapter reset", "D-Bus access to org.bluez; rfkill needs CAP_NET_ADMIN or write access to /dev/rfkill"},
+	{"Hotplug", "A NETLINK_KOBJECT_UEVENT socket; no capabilities"},
+	{"Keyboard wedge", "Write access to /dev/uinput (input group or a udev rule)"},
+	{"Serial bridge", "Opening /dev/ptmx and writing the symlink location"},
+	{"HTTP, CoAP, SNMP and TCP bridges", "CAP_NET_BIND_SERVICE only for ports below 1024, bound before -user drops privileges"},
+	{"Health", "Reading the kernel log (dmesg), which may need CAP_SYSLOG when kernel.dmesg_restrict is set"},
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func DropPrivileges(name string) error {
+	return errors.New("dropping privileges is only supported on Linux")
+}
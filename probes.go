@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+// probeWait is how long a host has to answer a probe.
+const probeWait = 2 * time.Second
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// ProbeHost tells whether a host is on the network: IPv4 addresses by ARP,
+// names ending in .local by mDNS, and other names by ARPing what DNS
+// resolves them to.
+func ProbeHost(host string) (bool, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return arpProbe(ip.To4())
+	}
+	if strings.HasSuffix(strings.TrimSuffix(host, "."), ".local") {
+		return mdnsProbe(host)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), probeWait)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIP(ctx, "ip4", host)
+	if err != nil {
+		return false, err
+	}
+	for _, ip := range addrs {
+		if up, err := arpProbe(ip.To4()); up || err != nil {
+			return up, err
+		}
+	}
+	return false, nil
+}
+
+// mdnsQuery is a one-shot query for the A record of host. Sent from a port
+// other than 5353, responders answer it straight back.
+func mdnsQuery(id uint16, host string) ([]byte, error) {
+	query := binary.BigEndian.AppendUint16(nil, id)
+	// No flags, one question.
+	query = append(query, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0)
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if label == "" || len(label) > 63 {
+			return nil, errors.New(host + " is not a valid hostname")
+		}
+		query = append(query, byte(len(label)))
+		query = append(query, label...)
+	}
+	// Type A, class IN.
+	return append(query, 0, 0, 1, 0, 1), nil
+}
+
+// mdnsProbe asks the local network for host, which is up if anyone answers
+// with a record.
+func mdnsProbe(host string) (bool, error) {
+	b := make([]byte, 2)
+	rand.Read(b)
+	id := binary.BigEndian.Uint16(b)
+	query, err := mdnsQuery(id, host)
+	if err != nil {
+		return false, err
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	_, err = conn.WriteToUDP(query, mdnsGroup)
+	if err != nil {
+		return false, err
+	}
+	conn.SetReadDeadline(time.Now().Add(probeWait))
+	answer := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFromUDP(answer)
+		var timeout net.Error
+		if errors.As(err, &timeout) && timeout.Timeout() {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		// A response to this query, with answers.
+		if n >= 12 && binary.BigEndian.Uint16(answer) == id && answer[2] & 0x80 != 0 && binary.BigEndian.Uint16(answer[6:]) > 0 {
+			return true, nil
+		}
+	}
+}
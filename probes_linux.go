@@ -0,0 +1,40 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// arpProbe sends a datagram to ip for the kernel to resolve it, then looks
+// it up in the ARP cache. Entries stay a little while after a host leaves,
+// until the kernel fails to confirm them.
+func arpProbe(ip net.IP) (bool, error) {
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: ip, Port: 9})
+	if err != nil {
+		return false, err
+	}
+	conn.Write([]byte{0})
+	conn.Close()
+	time.Sleep(probeWait)
+	f, err := os.Open("/proc/net/arp")
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	// IP address, HW type, Flags, HW address, Mask, Device.
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 4 || fields[0] != ip.String() {
+			continue
+		}
+		// 0x2 is ATF_COM, the entry is complete.
+		return fields[2] != "0x0" && fields[3] != "00:00:00:00:00:00", nil
+	}
+	return false, s.Err()
+}
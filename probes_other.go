@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+func arpProbe(ip net.IP) (bool, error) {
+	return false, errUnsupported
+}
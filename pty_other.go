@@ -0,0 +1,26 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// PTY is only implemented on Linux.
+type PTY struct {
+	Name string
+}
+
+func OpenPTY() (*PTY, error) {
+	return nil, errors.New("pty bridging is only supported on Linux")
+}
+
+func (p *PTY) Read(b []byte) (int, error) {
+	return 0, errors.New("pty bridging is only supported on Linux")
+}
+
+func (p *PTY) Write(b []byte) (int, error) {
+	return 0, errors.New("pty bridging is only supported on Linux")
+}
+
+func (p *PTY) Close() error {
+	return nil
+}
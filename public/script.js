@@ -3,10 +3,12 @@ const scanBtn = document.getElementById("scan");
 const disonnectBtn = document.getElementById("disonnect");
 const clearBtn = document.getElementById("clear");
 const stopBtn = document.getElementById("stop");
+const notifyBtn = document.getElementById("notify");
 
 const events = document.getElementById("events");
 const evtSource = new EventSource("http://" + document.location.host + "/events");
 const devicesMap = new Map()
+let stateVersion = 0;
 
 const appendLog = (text) => {
 	const p = document.createElement("p");
@@ -21,25 +23,108 @@ const appendLog = (text) => {
 
 appendLog("Logs:")
 
-const appendDevice = (name, addr) => {
+// sortDevices orders the device rows by RSSI, nearest first, with the
+// devices without one at the end.
+const sortDevices = () => {
+	const rows = Array.from(devices.children);
+	rows.sort((a, b) => Number(b.dataset.rssi || -1000) - Number(a.dataset.rssi || -1000));
+	rows.forEach(tr => devices.appendChild(tr));
+}
+
+const setRSSI = (addr, rssi) => {
+	const tr = devicesMap.get(addr);
+	if (!tr || !rssi || rssi === "0") {
+		return;
+	}
+	tr.dataset.rssi = rssi;
+	tr.children[2].innerText = rssi + " dBm";
+	sortDevices();
+}
+
+const appendDevice = (name, addr, composite) => {
 	const tr = document.createElement("tr");
 	const tn = document.createElement("td");
-	tn.innerText = name;
+	// Beacons and sensors may only advertise manufacturer data.
+	tn.innerText = name || "(unnamed)";
 	const ta = document.createElement("td");
 	ta.innerText = addr;
+	const tr2 = document.createElement("td");
 	const tb = document.createElement("td");
-	const btn = document.createElement("button");
-	btn.innerText = "Connect"
-	Object.assign(btn.style, {
-		"margin": "0px 5px",
-	});
-	btn.setAttribute("data-href", `/connect/${addr}`)
-	addHrefListener(btn);
-	tb.appendChild(btn);
+	// Composite devices can't be connected to.
+	if (!composite) {
+		const btn = document.createElement("button");
+		btn.innerText = "Connect"
+		Object.assign(btn.style, {
+			"margin": "0px 5px",
+		});
+		btn.setAttribute("data-href", `/connect/${addr}`)
+		addHrefListener(btn);
+		tb.appendChild(btn);
+	}
 	tr.appendChild(tn);
 	tr.appendChild(ta);
+	tr.appendChild(tr2);
 	tr.appendChild(tb);
 	devices.appendChild(tr);
+	devicesMap.set(addr, tr);
+}
+
+// resync replaces the device list with the server's, after missing events
+// or reconnecting.
+const resync = async () => {
+	const res = await fetch("/state");
+	if (!res.ok) {
+		return;
+	}
+	const state = await res.json();
+	devices.innerHTML = "";
+	devicesMap.clear();
+	state.Devices.forEach(d => {
+		appendDevice(d.Alias || d.Name, d.Address, d.Members);
+		setRSSI(d.Address, String(d.RSSI || ""));
+	});
+	stateVersion = state.Version;
+}
+
+// showAdapter shows which adapter the gateway is using under the title.
+const showAdapter = async () => {
+	const res = await fetch("/adapter");
+	if (!res.ok) {
+		return;
+	}
+	const a = await res.json();
+	document.getElementById("adapter").textContent = [a.ID, a.Alias || a.Name, a.Address].filter(Boolean).join(" · ");
+}
+
+showAdapter();
+
+// catchUp replays the events missed since version but the one with the
+// version seen, falling back on resyncing when too many were missed.
+const catchUp = async (version, seen) => {
+	if (!version) {
+		return resync();
+	}
+	const res = await fetch(`/state/changes?since=${version}`);
+	if (!res.ok) {
+		return resync();
+	}
+	const changes = await res.json();
+	changes.Events.filter(l => l.Version !== seen).forEach(l => {
+		evtSource.dispatchEvent(new MessageEvent(l.Level, {data: `"${l.Msg}"`, lastEventId: String(l.Version)}));
+	});
+	stateVersion = Math.max(stateVersion, changes.Version);
+}
+
+// track notices a gap in event versions and catches up.
+const track = (e) => {
+	const version = Number(e.lastEventId);
+	if (!version) {
+		return;
+	}
+	if (stateVersion && version > stateVersion + 1) {
+		catchUp(stateVersion, version);
+	}
+	stateVersion = Math.max(stateVersion, version);
 }
 
 evtSource.onmessage = (e) => {
@@ -47,33 +132,118 @@ evtSource.onmessage = (e) => {
 };
 
 evtSource.addEventListener("DEVICE", (e) => {
+	track(e);
 	const d = e.data.replaceAll('"','').split(";")
 	if (d.length < 2) {
 		console.log("[ERROR] Not enough device info -", d);
 		return ;
 	}
-	const [addr, name] = d;
-	if (devicesMap.get(addr)) {
-		return;
+	// Aliases given to devices come last, and replace the name they advertise.
+	const [addr, advertised, rssi, , , alias] = d;
+	const name = alias || advertised;
+	if (!devicesMap.get(addr)) {
+		appendDevice(name, addr);
+	} else if (name) {
+		devicesMap.get(addr).children[0].innerText = name;
+	}
+	setRSSI(addr, rssi);
+})
+
+evtSource.addEventListener("DEVICE_GONE", (e) => {
+	track(e);
+	const [addr] = e.data.replaceAll('"','').split(";");
+	const tr = devicesMap.get(addr);
+	if (tr) {
+		tr.remove();
+		devicesMap.delete(addr);
 	}
-	devicesMap.set(addr, true)
-	appendDevice(name, addr);
 })
 
 evtSource.addEventListener("INFO", (e) => {
+	track(e);
 	appendLog(e.data.replaceAll('"', ''));
 })
 
 evtSource.addEventListener("ERROR", (e) => {
+	track(e);
 	appendLog(e.data.replaceAll('"', ''));
 })
 
+const logEvents = [
+	"CONNECTED",
+	"DISCONNECTED",
+	"CONNECT_ATTEMPT",
+	"CONNECT_RETRY",
+	"CONNECT_FAILED",
+	"CONNECTION_LOST",
+	"RECONNECTING",
+	"RECONNECTED",
+	"PAIRED",
+	"PAIRING_FAILED",
+	"PAIRING_CODE",
+	"UNPAIRED",
+	"ADAPTER_ADDED",
+	"ADAPTER_REMOVED",
+	"ADAPTER_RECOVERED",
+	"ADAPTER_FAILED",
+	"ADAPTER_SELECTED",
+	"ADAPTER_POWERED_OFF",
+	"ADAPTER_POWERED_ON",
+	"SENSOR_DEAD",
+	"SENSOR_ALIVE",
+	"DEVICE_PENDING",
+	"DEVICE_APPROVED",
+	"DEVICE_REJECTED",
+	"ADVERTISING_ABNORMAL",
+	"PERSON",
+	"MODE",
+];
+
+logEvents.forEach(level => {
+	evtSource.addEventListener(level, (e) => {
+		track(e);
+		appendLog(e.data.replaceAll('"', ''));
+	})
+})
+
+evtSource.addEventListener("ADAPTER_SELECTED", showAdapter);
+
+// A device being paired with asks for its passkey or PIN, or for the key
+// it shows to be confirmed.
+evtSource.addEventListener("PAIRING_REQUEST", async (e) => {
+	track(e);
+	const [addr, kind, code] = e.data.replaceAll('"', '').split(";");
+	const response = {};
+	if (kind === "confirm") {
+		response.Reject = !window.confirm(`Does ${addr} show ${code}?`);
+	} else {
+		const answer = window.prompt(`${kind === "pin" ? "PIN" : "Passkey"} for ${addr}:`);
+		if (answer === null) {
+			response.Reject = true;
+		} else if (kind === "pin") {
+			response.PIN = answer;
+		} else {
+			response.Passkey = Number(answer);
+		}
+	}
+	const res = await fetch(`/pair/${addr}/respond`, {
+		method: "POST",
+		headers: {"Content-Type": "application/json"},
+		body: JSON.stringify(response),
+	});
+	if (!res.ok) {
+		appendLog(`Could not answer ${addr} - ${await res.text()}`);
+	}
+})
+
 evtSource.onerror = (e) => {
 	console.log("[ERROR] ", e)
 }
 
 evtSource.onopen = (e) => {
 	console.log("[INFO] ", e)
+	catchUp(stateVersion);
+	flushQueued();
 }
 
 clearBtn.addEventListener("click", () => {
@@ -81,13 +251,66 @@ clearBtn.addEventListener("click", () => {
 	appendLog("Logs:")
 })
 
+// subscribePush has the browser receive bluboi's alerts while the UI is
+// closed.
+const subscribePush = async () => {
+	if (!("serviceWorker" in navigator) || !("PushManager" in window)) {
+		appendLog("This browser can't receive push notifications, which also need https.");
+		return
+	}
+	const res = await fetch("/webpush/key");
+	if (!res.ok) {
+		appendLog("Push notifications are not set up on this gateway.");
+		return
+	}
+	const key = await res.text();
+	if (await Notification.requestPermission() !== "granted") {
+		return
+	}
+	const registration = await navigator.serviceWorker.ready;
+	const subscription = await registration.pushManager.subscribe({
+		userVisibleOnly: true,
+		applicationServerKey: key,
+	});
+	const saved = await fetch("/webpush/subscriptions", {
+		method: "POST",
+		headers: {"Content-Type": "application/json"},
+		body: JSON.stringify(subscription),
+	});
+	appendLog(saved.ok ? "Push notifications enabled." : "Could not enable push notifications.");
+}
+
+notifyBtn.addEventListener("click", subscribePush)
+
+// The service worker caches the UI so it opens offline, and queues the
+// commands sent while offline.
+if ("serviceWorker" in navigator) {
+	navigator.serviceWorker.register("./sw.js");
+	navigator.serviceWorker.addEventListener("message", (e) => {
+		(e.data.Sent || []).forEach(r => appendLog(`Sent queued ${r.Path} - ${r.Status} ${r.Body || ""}`));
+	});
+}
+
+// flushQueued has the service worker send the queued commands, for
+// browsers that don't do it on their own once back online.
+const flushQueued = () => {
+	if (navigator.serviceWorker && navigator.serviceWorker.controller) {
+		navigator.serviceWorker.controller.postMessage("flush");
+	}
+}
+
+window.addEventListener("online", flushQueued);
+
 const addHrefListener = (btn) => {
 	btn.addEventListener("click", async () => {
 		const url = btn.getAttribute("data-href")
 		if (!url) {
 			return
 		}
-		await fetch(url)
+		const res = await fetch(url, {method: "POST"})
+		if (res.headers.get("X-Queued-Command")) {
+			appendLog(`Offline, ${url} will be sent once back.`)
+		}
 	})
 }
 
@@ -0,0 +1,167 @@
+// The service worker shows the alerts bluboi pushes, with the UI closed. It
+// also keeps the UI's shell cached so it opens without a connection, and
+// queues the commands sent while offline, sending them to /commands once
+// back.
+
+const shell = "bluboi-shell-v1";
+const shellFiles = ["./", "./script.js", "./style.css", "./bluetooth.png", "./manifest.webmanifest"];
+const shellPaths = shellFiles.map(f => new URL(f, self.location).pathname);
+// Sent by the gateway straight away, never queued.
+const unqueued = ["/commands", "/webpush/subscriptions"];
+const maxBatch = 100;
+
+self.addEventListener("install", (e) => {
+	e.waitUntil(caches.open(shell).then(c => c.addAll(shellFiles)).then(() => self.skipWaiting()));
+})
+
+self.addEventListener("activate", (e) => {
+	e.waitUntil(caches.keys()
+		.then(keys => Promise.all(keys.filter(k => k !== shell).map(k => caches.delete(k))))
+		.then(() => self.clients.claim()));
+})
+
+// fromShell prefers the network so updates show up, falling back on the
+// cached shell.
+const fromShell = async (req) => {
+	const cache = await caches.open(shell);
+	try {
+		const res = await fetch(req);
+		if (res.ok) {
+			cache.put(req, res.clone());
+		}
+		return res;
+	} catch (err) {
+		const cached = await cache.match(req);
+		if (!cached) {
+			throw err;
+		}
+		return cached;
+	}
+}
+
+const openQueue = () => new Promise((resolve, reject) => {
+	const req = indexedDB.open("bluboi", 1);
+	req.onupgradeneeded = () => req.result.createObjectStore("commands", {keyPath: "seq", autoIncrement: true});
+	req.onsuccess = () => resolve(req.result);
+	req.onerror = () => reject(req.error);
+})
+
+// withQueue runs f on the queued commands in a transaction, resolving
+// with the result of the request it returns, if any.
+const withQueue = async (mode, f) => {
+	const db = await openQueue();
+	return new Promise((resolve, reject) => {
+		const tx = db.transaction("commands", mode);
+		const req = f(tx.objectStore("commands"));
+		tx.oncomplete = () => resolve(req && req.result);
+		tx.onerror = () => reject(tx.error);
+	});
+}
+
+// sendOrQueue sends a command with an Idempotency-Key, queuing it with the
+// same key when the gateway can't be reached so sending it again can't
+// carry it out twice.
+const sendOrQueue = async (req) => {
+	const id = req.headers.get("Idempotency-Key") || crypto.randomUUID();
+	const body = await req.clone().text();
+	const headers = new Headers(req.headers);
+	headers.set("Idempotency-Key", id);
+	try {
+		return await fetch(req.url, {method: req.method, headers, body: body || undefined, credentials: "same-origin"});
+	} catch (err) {
+		let parsed;
+		try {
+			parsed = body ? JSON.parse(body) : undefined;
+		} catch {
+			throw err;
+		}
+		const url = new URL(req.url);
+		await withQueue("readwrite", s => s.add({ID: id, Method: req.method, Path: url.pathname + url.search, Body: parsed, QueuedAt: Date.now()}));
+		if (self.registration.sync) {
+			await self.registration.sync.register("commands").catch(() => {});
+		}
+		return new Response(JSON.stringify({Queued: id}), {
+			status: 202,
+			headers: {"Content-Type": "application/json", "X-Queued-Command": id},
+		});
+	}
+}
+
+// sendQueued sends the queued commands in the order they were queued,
+// telling the open UIs how each went.
+const sendQueued = async () => {
+	const queued = (await withQueue("readonly", s => s.getAll())).slice(0, maxBatch);
+	if (!queued.length) {
+		return;
+	}
+	const now = Date.now();
+	const res = await fetch("/commands", {
+		method: "POST",
+		headers: {"Content-Type": "application/json"},
+		credentials: "same-origin",
+		body: JSON.stringify(queued.map(c => ({ID: c.ID, Method: c.Method, Path: c.Path, Body: c.Body, Age: (now - c.QueuedAt) / 1000}))),
+	});
+	if (!res.ok) {
+		throw new Error("could not send the queued commands - " + res.status);
+	}
+	const results = await res.json();
+	await withQueue("readwrite", s => queued.forEach(c => s.delete(c.seq)));
+	const clients = await self.clients.matchAll();
+	clients.forEach(c => c.postMessage({Sent: results.map((r, i) => ({...r, Path: queued[i].Path}))}));
+	if (queued.length === maxBatch) {
+		await sendQueued();
+	}
+}
+
+let sending = null;
+
+const flush = () => {
+	sending = sending || sendQueued().finally(() => {
+		sending = null;
+	});
+	return sending;
+}
+
+self.addEventListener("fetch", (e) => {
+	const url = new URL(e.request.url);
+	if (url.origin !== self.location.origin) {
+		return;
+	}
+	if (e.request.method === "GET") {
+		if (shellPaths.includes(url.pathname)) {
+			e.respondWith(fromShell(e.request));
+		}
+		return;
+	}
+	if (!unqueued.includes(url.pathname)) {
+		e.respondWith(sendOrQueue(e.request));
+	}
+})
+
+self.addEventListener("sync", (e) => {
+	if (e.tag === "commands") {
+		e.waitUntil(flush());
+	}
+})
+
+// Browsers without background sync are asked to flush by the UI once back
+// online.
+self.addEventListener("message", (e) => {
+	if (e.data === "flush") {
+		e.waitUntil(flush().catch(() => {}));
+	}
+})
+
+self.addEventListener("push", (e) => {
+	const alert = e.data ? e.data.json() : {Title: "bluboi", Body: ""};
+	e.waitUntil(self.registration.showNotification(alert.Title, {
+		body: alert.Body,
+		tag: alert.Tag,
+		icon: "./bluetooth.png",
+	}));
+})
+
+self.addEventListener("notificationclick", (e) => {
+	e.notification.close();
+	e.waitUntil(self.clients.openWindow("/"));
+})
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// Reconnect is whether to get devices that drop back, unless their
+// metadata says otherwise.
+var Reconnect = false
+
+// wantsReconnect tells whether a device that dropped should be reconnected
+// to.
+func wantsReconnect(key string) bool {
+	if r := Metadata.Get(key).Reconnect; r != nil {
+		return *r
+	}
+	return Reconnect
+}
+
+// handleConnect is the adapter's connect handler. Disconnecting, resetting
+// and losing the adapter forget connections before BlueZ reports them gone,
+// so a connection still held here is one the device dropped: it is
+// forgotten, so the device can be connected to again, with DISCONNECTED and
+// CONNECTION_LOST (address;name) events.
+func (sa *SafeAdapter) handleConnect(address bluetooth.Address, connected bool) {
+	if connected {
+		return
+	}
+	key := strings.ToUpper(address.String())
+	sa.mu.Lock()
+	_, ok := sa.connections[key]
+	if ok {
+		sa.forget(key)
+	}
+	sa.mu.Unlock()
+	if !ok {
+		return
+	}
+	LogEvent("DISCONNECTED", "Lost connection to", key)
+	LogEvent("CONNECTION_LOST", key + ";" + DisplayName(key))
+	if wantsReconnect(key) {
+		go sa.reconnect(key, address)
+	}
+}
+
+// reconnect gets a dropped device back, raising RECONNECTING
+// (address;round) before every round of ConnectPolicy.Attempts attempts and
+// RECONNECTED (address;rounds) once connected. Rounds are spaced out like
+// attempts, so a device out of range for a while is retried every 30s at
+// most. It stops when cancelled like a connection attempt, or once the
+// device's metadata turns reconnecting off.
+func (sa *SafeAdapter) reconnect(key string, address bluetooth.Address) {
+	cancel, ok := sa.startAttempt(key)
+	if !ok {
+		return
+	}
+	defer sa.endAttempt(key, cancel)
+	for round := 1; ; round++ {
+		LogEvent("RECONNECTING", key + ";" + strconv.Itoa(round))
+		err := sa.connect(key, address, cancel)
+		if err == nil {
+			LogEvent("RECONNECTED", key + ";" + strconv.Itoa(round))
+			return
+		}
+		if errors.Is(err, errConnectCancelled) || !wantsReconnect(key) {
+			LogEvent("CONNECT_FAILED", key + ";" + err.Error())
+			return
+		}
+		select {
+		case <-time.After(ConnectPolicy.delay(round)):
+		case <-cancel:
+			LogEvent("CONNECT_FAILED", key + ";" + errConnectCancelled.Error())
+			return
+		}
+	}
+}
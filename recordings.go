@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const (
+	recordingsFile = "recordings.json"
+	recordingsDir  = "recordings"
+	// Notifications buffered between the BLE callbacks and the writer, which
+	// syncs the file every recordingSyncBatch notifications and at least
+	// every recordingSyncEvery.
+	recordingQueue     = 8192
+	recordingSyncBatch = 1024
+	recordingSyncEvery = time.Second
+)
+
+// Recording is a file of the notifications from one device, one
+// time;uuid;hex line each, written apart from the event stream so high
+// rates don't stall it. Dropped counts the notifications lost because the
+// disk fell behind.
+type Recording struct {
+	ID      string
+	Address string
+	Chars   []string  `json:",omitempty"`
+	Quiet   bool      `json:",omitempty"`
+	Started time.Time
+	Ended   time.Time `json:",omitempty"`
+	Running bool
+	Error   string    `json:",omitempty"`
+	Count   uint64
+	Dropped uint64
+	Size    int64
+}
+
+// RecordingRequest starts recording the notifications of Chars, or of every
+// characteristic when empty, for Seconds unless 0. Quiet recordings keep
+// the notifications they take out of the event stream.
+type RecordingRequest struct {
+	Address string
+	Chars   []string `json:",omitempty"`
+	Seconds int      `json:",omitempty"`
+	Quiet   bool     `json:",omitempty"`
+}
+
+type recordedNotification struct {
+	at    time.Time
+	uuid  string
+	value []byte
+}
+
+type recorder struct {
+	id      string
+	address string
+	chars   map[string]bool
+	quiet   bool
+	queue   chan recordedNotification
+	stop    chan struct{}
+	count   atomic.Uint64
+	dropped atomic.Uint64
+}
+
+// SafeRecordings holds the recording index and the recorders running, at
+// most Limit of them unless 0.
+type SafeRecordings struct {
+	mu         sync.Mutex
+	Recordings []Recording
+	Limit      int
+	active     map[string]*recorder
+}
+
+var (
+	Recordings = SafeRecordings{Recordings: []Recording{}, active: map[string]*recorder{}}
+	errRecordingRunning = errors.New("a recording of that device is already running")
+	errUnknownRecording = errors.New("no such recording")
+	errTooManyRecordings = errors.New("the memory budget doesn't allow another recording")
+)
+
+// Load reads the recording index. Recordings that were running when
+// bluboi stopped are marked as interrupted.
+func (sr *SafeRecordings) Load() error {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	err := LoadJSON(recordingsFile, &sr.Recordings)
+	if err != nil {
+		return err
+	}
+	for i := range sr.Recordings {
+		if sr.Recordings[i].Running {
+			sr.Recordings[i].Running = false
+			sr.Recordings[i].Error = "interrupted"
+		}
+	}
+	return nil
+}
+
+func recordingPath(id string) string {
+	return filepath.Join(DataDir, recordingsDir, id + ".txt")
+}
+
+// find expects sr.mu to be held.
+func (sr *SafeRecordings) find(id string) int {
+	for i, r := range sr.Recordings {
+		if r.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (sr *SafeRecordings) Start(req RecordingRequest) (Recording, error) {
+	if _, err := net.ParseMAC(req.Address); err != nil {
+		return Recording{}, errors.New(req.Address + " is not a device address")
+	}
+	chars := map[string]bool{}
+	for _, c := range req.Chars {
+		id, err := ParseUUID(c)
+		if err != nil {
+			return Recording{}, errors.New(c + " is not a UUID")
+		}
+		chars[id.String()] = true
+	}
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	address := strings.ToUpper(req.Address)
+	for _, rec := range sr.active {
+		if rec.address == address {
+			return Recording{}, errRecordingRunning
+		}
+	}
+	if sr.Limit > 0 && len(sr.active) >= sr.Limit {
+		return Recording{}, errTooManyRecordings
+	}
+	err := os.MkdirAll(filepath.Join(DataDir, recordingsDir), 0o755)
+	if err != nil {
+		return Recording{}, err
+	}
+	r := Recording{ID: uuid.NewString(), Address: address, Chars: req.Chars, Quiet: req.Quiet, Started: time.Now().UTC(), Running: true}
+	f, err := os.OpenFile(recordingPath(r.ID), os.O_CREATE | os.O_WRONLY | os.O_TRUNC, 0o644)
+	if err != nil {
+		return Recording{}, err
+	}
+	rec := &recorder{
+		id: r.ID,
+		address: address,
+		chars: chars,
+		quiet: req.Quiet,
+		queue: make(chan recordedNotification, recordingQueue),
+		stop: make(chan struct{}),
+	}
+	sr.active[r.ID] = rec
+	sr.Recordings = append(sr.Recordings, r)
+	SaveJSON(recordingsFile, sr.Recordings)
+	go sr.write(rec, f)
+	if req.Seconds > 0 {
+		time.AfterFunc(time.Duration(req.Seconds) * time.Second, func () {
+			sr.Stop(r.ID)
+		})
+	}
+	LogInfo("Recording notifications of", address, "as", r.ID)
+	return r, nil
+}
+
+// Offer queues a notification for the recordings of its device without
+// blocking, counting it as dropped when a queue is full. It returns whether
+// a quiet recording took it.
+func (sr *SafeRecordings) Offer(address string, uuid string, value []byte) bool {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	if len(sr.active) == 0 {
+		return false
+	}
+	address = strings.ToUpper(address)
+	normalized := ""
+	quiet := false
+	for _, rec := range sr.active {
+		if rec.address != address {
+			continue
+		}
+		if len(rec.chars) > 0 {
+			if normalized == "" {
+				id, err := ParseUUID(uuid)
+				if err != nil {
+					continue
+				}
+				normalized = id.String()
+			}
+			if !rec.chars[normalized] {
+				continue
+			}
+		}
+		select {
+		case rec.queue <- recordedNotification{time.Now().UTC(), uuid, append([]byte{}, value...)}:
+		default:
+			rec.dropped.Add(1)
+		}
+		quiet = quiet || rec.quiet
+	}
+	return quiet
+}
+
+// write appends queued notifications to the file until the recording is
+// stopped, syncing them in batches.
+func (sr *SafeRecordings) write(rec *recorder, f *os.File) {
+	w := bufio.NewWriterSize(f, 64 * 1024)
+	ticker := time.NewTicker(recordingSyncEvery)
+	defer ticker.Stop()
+	var failed error
+	pending := 0
+	// Writes hold Quiesce so a snapshot doesn't take a line half written.
+	flush := func () {
+		if pending == 0 || failed != nil {
+			return
+		}
+		Quiesce.RLock()
+		defer Quiesce.RUnlock()
+		if failed = w.Flush(); failed == nil {
+			failed = f.Sync()
+		}
+		pending = 0
+	}
+	put := func (n recordedNotification) {
+		if failed != nil {
+			rec.dropped.Add(1)
+			return
+		}
+		// A full buffer is written out right away.
+		Quiesce.RLock()
+		w.WriteString(n.at.Format(time.RFC3339Nano) + ";" + n.uuid + ";" + hex.EncodeToString(n.value) + "\n")
+		Quiesce.RUnlock()
+		rec.count.Add(1)
+		pending++
+		if pending >= recordingSyncBatch {
+			flush()
+		}
+	}
+	for running := true; running; {
+		select {
+		case n := <-rec.queue:
+			put(n)
+		case <-ticker.C:
+			flush()
+		case <-rec.stop:
+			running = false
+		}
+	}
+	// Offer stops queueing once the recorder is inactive, so what's left is
+	// all there is.
+	for drained := false; !drained; {
+		select {
+		case n := <-rec.queue:
+			put(n)
+		default:
+			drained = true
+		}
+	}
+	flush()
+	if err := f.Close(); failed == nil {
+		failed = err
+	}
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	i := sr.find(rec.id)
+	if i < 0 {
+		return
+	}
+	r := &sr.Recordings[i]
+	r.Running = false
+	r.Ended = time.Now().UTC()
+	r.Count, r.Dropped = rec.count.Load(), rec.dropped.Load()
+	if failed != nil {
+		r.Error = failed.Error()
+	}
+	if info, err := os.Stat(recordingPath(rec.id)); err == nil {
+		r.Size = info.Size()
+	}
+	SaveJSON(recordingsFile, sr.Recordings)
+	LogInfo("Recording", rec.id, "ended with", plural(int(r.Count), "notification") + ",", strconv.FormatUint(r.Dropped, 10), "dropped.")
+}
+
+func (sr *SafeRecordings) Stop(id string) error {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	if sr.find(id) < 0 {
+		return errUnknownRecording
+	}
+	rec, ok := sr.active[id]
+	if !ok {
+		return errors.New("recording isn't running")
+	}
+	delete(sr.active, id)
+	close(rec.stop)
+	return nil
+}
+
+func (sr *SafeRecordings) Delete(id string) error {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	i := sr.find(id)
+	if i < 0 {
+		return errUnknownRecording
+	}
+	if sr.Recordings[i].Running {
+		return errRecordingRunning
+	}
+	err := os.Remove(recordingPath(id))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	sr.Recordings = append(sr.Recordings[:i], sr.Recordings[i+1:]...)
+	return SaveJSON(recordingsFile, sr.Recordings)
+}
+
+// List returns the recordings, with the counts so far of running ones.
+func (sr *SafeRecordings) List() []Recording {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	list := append([]Recording{}, sr.Recordings...)
+	for i := range list {
+		if rec, ok := sr.active[list[i].ID]; ok {
+			list[i].Count, list[i].Dropped = rec.count.Load(), rec.dropped.Load()
+		}
+	}
+	return list
+}
+
+func (sr *SafeRecordings) Get(id string) (Recording, bool) {
+	for _, r := range sr.List() {
+		if r.ID == id {
+			return r, true
+		}
+	}
+	return Recording{}, false
+}
+
+func ListRecordingsHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Recordings.List())
+	}
+}
+
+func StartRecordingHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		req := RecordingRequest{}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rec, err := Recordings.Start(req)
+		if errors.Is(err, errRecordingRunning) || errors.Is(err, errTooManyRecordings) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(201)
+		json.NewEncoder(w).Encode(rec)
+	}
+}
+
+// DownloadRecordingHandler serves a recording's notifications, so far when
+// it is still running.
+func DownloadRecordingHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		rec, ok := Recordings.Get(mux.Vars(r)["id"])
+		if !ok {
+			http.Error(w, errUnknownRecording.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"" + rec.ID + ".txt\"")
+		http.ServeFile(w, r, recordingPath(rec.ID))
+	}
+}
+
+func StopRecordingHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		err := Recordings.Stop(mux.Vars(r)["id"])
+		if errors.Is(err, errUnknownRecording) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(200)
+	}
+}
+
+func DeleteRecordingHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		err := Recordings.Delete(mux.Vars(r)["id"])
+		if errors.Is(err, errUnknownRecording) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, errRecordingRunning) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(200)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	replicaHeartbeat = 30 * time.Second
+	replicaDebounce  = 2 * time.Second
+)
+
+// ReplicaSnapshot is the read-only copy of a gateway's device store pushed
+// to replicas.
+type ReplicaSnapshot struct {
+	Gateway  string
+	Seq      int64
+	Time     time.Time
+	Devices  []DeviceListing
+	Received time.Time `json:",omitempty"`
+}
+
+// ReplicaConfig mirrors the device store with PUT to URL, which may be
+// another bluboi's /replicas/{gateway}, authenticating with Token.
+type ReplicaConfig struct {
+	URL   string
+	Token string
+}
+
+// RunReplication pushes the device store whenever it changes, and on a
+// heartbeat so replicas can tell a quiet gateway from a dead one.
+func RunReplication(config ReplicaConfig) {
+	gateway, _ := os.Hostname()
+	_, logs := Sinks.Subscribe("replica", 100)
+	snapshot := ReplicaSnapshot{Gateway: gateway}
+	push := func () {
+		snapshot.Seq++
+		snapshot.Time = time.Now().UTC()
+		snapshot.Devices = Presence.Listing()
+		err := SendJSON(http.MethodPut, config.URL, config.Token, snapshot)
+		if err != nil {
+			log.Printf("[ERROR] Could not push to replica %v - %v", config.URL, err)
+		}
+	}
+	log.Printf("[INFO] Replicating devices to %v", config.URL)
+	push()
+	heartbeat := time.NewTicker(replicaHeartbeat)
+	defer heartbeat.Stop()
+	var debounce <-chan time.Time
+	for {
+		select {
+		case l := <-logs:
+			switch l.Level {
+			case "DEVICE", "DEVICE_GONE", "SENSOR_DEAD", "SENSOR_ALIVE":
+				if debounce == nil {
+					debounce = time.After(replicaDebounce)
+				}
+			}
+		case <-debounce:
+			debounce = nil
+			push()
+		case <-heartbeat.C:
+			push()
+		}
+	}
+}
+
+// SafeReplicas holds the snapshots other gateways push to this one.
+type SafeReplicas struct {
+	mu        sync.Mutex
+	Snapshots map[string]ReplicaSnapshot
+}
+
+var Replicas = SafeReplicas{Snapshots: map[string]ReplicaSnapshot{}}
+
+var errStaleSnapshot = errors.New("snapshot is older than the one held")
+
+func (sr *SafeReplicas) Put(snapshot ReplicaSnapshot) error {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	held, ok := sr.Snapshots[snapshot.Gateway]
+	// A restarted gateway starts counting again.
+	if ok && snapshot.Seq <= held.Seq && !snapshot.Time.After(held.Time) {
+		return errStaleSnapshot
+	}
+	snapshot.Received = time.Now().UTC()
+	sr.Snapshots[snapshot.Gateway] = snapshot
+	return nil
+}
+
+func (sr *SafeReplicas) List() []ReplicaSnapshot {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	list := []ReplicaSnapshot{}
+	for _, snapshot := range sr.Snapshots {
+		list = append(list, snapshot)
+	}
+	sort.Slice(list, func (i, j int) bool {
+		return list[i].Gateway < list[j].Gateway
+	})
+	return list
+}
+
+func (sr *SafeReplicas) Get(gateway string) (ReplicaSnapshot, bool) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	snapshot, ok := sr.Snapshots[gateway]
+	return snapshot, ok
+}
+
+func ListReplicasHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Replicas.List())
+	}
+}
+
+func GetReplicaHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		snapshot, ok := Replicas.Get(mux.Vars(r)["gateway"])
+		if !ok {
+			http.Error(w, "unknown gateway", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(snapshot)
+	}
+}
+
+func PutReplicaHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		snapshot := ReplicaSnapshot{}
+		err := json.NewDecoder(r.Body).Decode(&snapshot)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		snapshot.Gateway = mux.Vars(r)["gateway"]
+		err = Replicas.Put(snapshot)
+		if errors.Is(err, errStaleSnapshot) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(204)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// ScanFilter limits a scan to the devices whose name starts with Name
+// (ignoring case), heard at RSSI dBm or stronger, and advertising Service.
+// Zero fields don't filter.
+type ScanFilter struct {
+	Name       string
+	RSSI       int16
+	Service    bluetooth.UUID
+	hasService bool
+}
+
+func (f *ScanFilter) Matches(result bluetooth.ScanResult) bool {
+	if f == nil {
+		return true
+	}
+	if f.RSSI != 0 && result.RSSI < f.RSSI {
+		return false
+	}
+	if f.Name != "" {
+		name := result.LocalName()
+		if len(name) < len(f.Name) || !strings.EqualFold(name[:len(f.Name)], f.Name) {
+			return false
+		}
+	}
+	return !f.hasService || result.HasServiceUUID(f.Service)
+}
+
+func (f *ScanFilter) String() string {
+	parts := []string{}
+	if f.Name != "" {
+		parts = append(parts, "named " + f.Name + "*")
+	}
+	if f.RSSI != 0 {
+		parts = append(parts, "at " + strconv.Itoa(int(f.RSSI)) + " dBm or stronger")
+	}
+	if f.hasService {
+		parts = append(parts, "advertising " + f.Service.String())
+	}
+	return strings.Join(parts, ", ")
+}
+
+// parseScan parses a SCAN event: the query of /scan (seconds, name, rssi and
+// uuid), or for cloud commands just the seconds. The filter is nil when
+// nothing is filtered.
+func parseScan(data string) (time.Duration, *ScanFilter, error) {
+	if !strings.Contains(data, "=") {
+		seconds, err := scanSeconds(data)
+		return seconds, nil, err
+	}
+	query, err := url.ParseQuery(data)
+	if err != nil {
+		return 0, nil, err
+	}
+	seconds, err := scanSeconds(query.Get("seconds"))
+	if err != nil {
+		return 0, nil, err
+	}
+	filter := &ScanFilter{Name: query.Get("name")}
+	if rssi := query.Get("rssi"); rssi != "" {
+		value, err := strconv.ParseInt(rssi, 10, 16)
+		if err != nil || value >= 0 {
+			return 0, nil, errors.New("rssi must be a negative number of dBm")
+		}
+		filter.RSSI = int16(value)
+	}
+	if service := query.Get("uuid"); service != "" {
+		filter.Service, err = ParseUUID(service)
+		if err != nil {
+			return 0, nil, errors.New(service + " is not a UUID")
+		}
+		filter.hasService = true
+	}
+	if filter.Name == "" && filter.RSSI == 0 && !filter.hasService {
+		return seconds, nil, nil
+	}
+	return seconds, filter, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"runtime"
+	"strings"
+)
+
+// LinkSecurity describes how well a connection is protected. BlueZ doesn't
+// expose the negotiated security level, so it is derived from the bond: LE
+// links to a paired device are re-encrypted with the stored keys on connect,
+// unpaired ones are not.
+type LinkSecurity struct {
+	Level   string
+	Paired  bool
+	Trusted bool
+}
+
+type ConnectionStatus struct {
+	Address   string
+	Connected bool
+	Security  *LinkSecurity `json:",omitempty"`
+	MTU       int           `json:",omitempty"`
+}
+
+// RequireEncryption refuses writes to characteristics that demand an
+// encrypted link while the link isn't. Only BlueZ tells the flags, so it is
+// off by default elsewhere instead of refusing every write.
+var RequireEncryption = runtime.GOOS == "linux"
+
+var writeSecurityFlags = []string{"encrypt-write", "encrypt-authenticated-write", "secure-write"}
+
+func (ls *LinkSecurity) Encrypted() bool {
+	return ls.Level != "unencrypted"
+}
+
+func securityLevel(paired bool) string {
+	if paired {
+		return "encrypted"
+	}
+	return "unencrypted"
+}
+
+// CheckWriteSecurity returns an error when writing to the characteristic on
+// a connected device should be refused.
+func CheckWriteSecurity(address string, uuid string) error {
+	if !RequireEncryption {
+		return nil
+	}
+	address = strings.ToUpper(address)
+	if !Adapter.IsConnected(address) {
+		return nil
+	}
+	// Writes are refused when the flags can't be told, rather than let
+	// through unchecked.
+	flags, err := characteristicFlags(address, uuid)
+	if err != nil {
+		return errors.New("could not tell whether characteristic " + uuid + " requires encryption - " + err.Error())
+	}
+	sensitive := false
+	for _, flag := range flags {
+		for _, f := range writeSecurityFlags {
+			sensitive = sensitive || flag == f
+		}
+	}
+	if !sensitive {
+		return nil
+	}
+	security, err := linkSecurity(address)
+	if err != nil {
+		return err
+	}
+	if !security.Encrypted() {
+		return errors.New("characteristic " + uuid + " requires an encrypted link, pair with the device first")
+	}
+	return nil
+}
+
+// CurrentConnection reports on the device connected last.
+func CurrentConnection() ConnectionStatus {
+	return connectionStatus(Adapter.DeviceAddress())
+}
+
+func Connections() []ConnectionStatus {
+	connections := []ConnectionStatus{}
+	for _, address := range Adapter.Addresses() {
+		connections = append(connections, connectionStatus(address))
+	}
+	return connections
+}
+
+func connectionStatus(address string) ConnectionStatus {
+	status := ConnectionStatus{Address: address, Connected: address != ""}
+	if status.Connected {
+		if security, err := linkSecurity(address); err == nil {
+			status.Security = &security
+		}
+		status.MTU, _ = Adapter.MTU(address)
+	}
+	return status
+}
+
+func ConnectionHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(CurrentConnection())
+	}
+}
+
+func ListConnectionsHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Connections())
+	}
+}
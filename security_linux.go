@@ -0,0 +1,84 @@
+//go:build linux
+
+package main
+
+import (
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/muka/go-bluetooth/api"
+	"github.com/muka/go-bluetooth/bluez"
+	"github.com/muka/go-bluetooth/bluez/profile/device"
+)
+
+func devicePath(address string) (dbus.ObjectPath, error) {
+	a, err := api.GetDefaultAdapter()
+	if err != nil {
+		return "", err
+	}
+	return dbus.ObjectPath(string(a.Path()) + "/dev_" + strings.ReplaceAll(address, ":", "_")), nil
+}
+
+func linkSecurity(address string) (LinkSecurity, error) {
+	path, err := devicePath(address)
+	if err != nil {
+		return LinkSecurity{}, err
+	}
+	dev, err := device.NewDevice1(path)
+	if err != nil {
+		return LinkSecurity{}, err
+	}
+	return LinkSecurity{
+		Level: securityLevel(dev.Properties.Paired),
+		Paired: dev.Properties.Paired,
+		Trusted: dev.Properties.Trusted,
+	}, nil
+}
+
+// characteristicFlags returns the BlueZ flags (read, write, encrypt-write,
+// ...) of a characteristic of a connected device.
+func characteristicFlags(address string, uuid string) ([]string, error) {
+	id, err := ParseUUID(uuid)
+	if err != nil {
+		return nil, err
+	}
+	flags, err := deviceCharacteristicFlags(address)
+	if err != nil {
+		return nil, err
+	}
+	f, ok := flags[id.String()]
+	if !ok {
+		return nil, errCharacteristicNotFound
+	}
+	return f, nil
+}
+
+// deviceCharacteristicFlags returns the BlueZ flags of every characteristic
+// of a connected device by UUID.
+func deviceCharacteristicFlags(address string) (map[string][]string, error) {
+	path, err := devicePath(address)
+	if err != nil {
+		return nil, err
+	}
+	om, err := bluez.GetObjectManager()
+	if err != nil {
+		return nil, err
+	}
+	objects, err := om.GetManagedObjects()
+	if err != nil {
+		return nil, err
+	}
+	flags := map[string][]string{}
+	for objectPath, ifaces := range objects {
+		if !strings.HasPrefix(string(objectPath), string(path) + "/") {
+			continue
+		}
+		props, ok := ifaces["org.bluez.GattCharacteristic1"]
+		if !ok {
+			continue
+		}
+		u, _ := props["UUID"].Value().(string)
+		flags[u], _ = props["Flags"].Value().([]string)
+	}
+	return flags, nil
+}
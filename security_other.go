@@ -0,0 +1,19 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+var errUnsupported = errors.New("only supported on Linux")
+
+func linkSecurity(address string) (LinkSecurity, error) {
+	return LinkSecurity{}, errUnsupported
+}
+
+func characteristicFlags(address string, uuid string) ([]string, error) {
+	return nil, errUnsupported
+}
+
+func deviceCharacteristicFlags(address string) (map[string][]string, error) {
+	return nil, errUnsupported
+}
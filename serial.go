@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// SerialConfig controls the pty bridged to a Nordic UART device. Link is the
+// stable path symlinked to the allocated /dev/pts/N; it defaults to a
+// per-device name in the temp directory.
+type SerialConfig struct {
+	Link string
+}
+
+type SafeSerial struct {
+	mu     sync.Mutex
+	Config SerialConfig
+	link   string
+	port   *PTY
+	bridge *Bridge
+}
+
+var Serial = SafeSerial{}
+
+func DefaultSerialLink(address string) string {
+	return filepath.Join(os.TempDir(), "bluboi-" + strings.ReplaceAll(address, ":", ""))
+}
+
+func (ss *SafeSerial) Configure(config SerialConfig) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.Config = config
+}
+
+func (ss *SafeSerial) Start() {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.port != nil {
+		LogError("Serial bridge is already running on", ss.link)
+		return
+	}
+	address := Adapter.DeviceAddress()
+	link := ss.Config.Link
+	if link == "" {
+		link = DefaultSerialLink(address)
+	}
+	port, err := OpenPTY()
+	if err != nil {
+		LogError("Could not open pty -", err.Error())
+		return
+	}
+	bridge, err := NewBridge(address, NUSRX, NUSTX, port)
+	if err != nil {
+		port.Close()
+		LogError("Could not bridge Nordic UART -", err.Error())
+		return
+	}
+	if fi, err := os.Lstat(link); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		os.Remove(link)
+	}
+	err = os.Symlink(port.Name, link)
+	if err != nil {
+		bridge.Close()
+		port.Close()
+		LogError("Could not link pty -", err.Error())
+		return
+	}
+	ss.port = port
+	ss.bridge = bridge
+	ss.link = link
+	go func () {
+		err := bridge.Pump(port)
+		ss.mu.Lock()
+		defer ss.mu.Unlock()
+		if ss.port == port {
+			LogError("Serial bridge stopped -", err.Error())
+			ss.close()
+		}
+	} ()
+	LogInfo("Serial bridge available at", link, "->", port.Name)
+}
+
+// close tears down the bridge, expecting ss.mu to be held.
+func (ss *SafeSerial) close() {
+	ss.bridge.Close()
+	ss.port.Close()
+	os.Remove(ss.link)
+	ss.port = nil
+	ss.bridge = nil
+	ss.link = ""
+}
+
+func (ss *SafeSerial) Stop() {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.port == nil {
+		LogError("Serial bridge is not running.")
+		return
+	}
+	ss.close()
+	LogInfo("Serial bridge stopped.")
+}
+
+func SerialHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		config := SerialConfig{}
+		if r.ContentLength != 0 {
+			err := json.NewDecoder(r.Body).Decode(&config)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		Serial.Configure(config)
+		EventQueue <- Event {
+			Type: "SERIAL",
+		}
+		w.WriteHeader(200)
+	}
+}
+
+func StopSerialHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		EventQueue <- Event {
+			Type: "STOP_SERIAL",
+		}
+		w.WriteHeader(200)
+	}
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+const setupFile = "setup.json"
+
+// SetupConfig is what the first-run setup wrote. Flags take precedence
+// over it. Only a hash of the generated admin token is kept.
+type SetupConfig struct {
+	Listen    string    `json:",omitempty"`
+	Adapter   string    `json:",omitempty"`
+	TokenHash string    `json:",omitempty"`
+	Completed time.Time
+}
+
+type AdapterInfo struct {
+	ID      string
+	Address string `json:",omitempty"`
+	Powered bool
+	InUse   bool
+}
+
+// SetupStatus is everything the frontend needs to offer the setup steps.
+type SetupStatus struct {
+	Complete  bool
+	Adapters  []AdapterInfo
+	Listen    string
+	Addresses []string
+	Sinks     []string
+	Sections  []string
+}
+
+// SetupRequest finishes setup. Empty fields keep the defaults, Config holds
+// the sink configs to start with, in the format `bluboi config check` takes.
+type SetupRequest struct {
+	Adapter       string
+	Listen        string
+	GenerateToken bool
+	Config        ConfigBundle
+}
+
+type SetupResult struct {
+	AdminToken string `json:",omitempty"`
+	Restart    bool
+}
+
+type SafeSetup struct {
+	mu     sync.Mutex
+	Config SetupConfig
+}
+
+var (
+	Setup = SafeSetup{}
+	errSetupComplete = errors.New("setup was already completed")
+)
+
+func (ss *SafeSetup) Load() error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return LoadJSON(setupFile, &ss.Config)
+}
+
+// SetAdapter remembers the adapter to use from the next start on.
+func (ss *SafeSetup) SetAdapter(id string) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	config := ss.Config
+	config.Adapter = id
+	err := SaveJSON(setupFile, config)
+	if err != nil {
+		return err
+	}
+	ss.Config = config
+	return nil
+}
+
+func (ss *SafeSetup) Complete() bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return !ss.Config.Completed.IsZero()
+}
+
+func (ss *SafeSetup) HasToken() bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.Config.TokenHash != ""
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CheckToken reports whether token is the admin token generated during
+// setup.
+func (ss *SafeSetup) CheckToken(token string) bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.Config.TokenHash == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(ss.Config.TokenHash)) == 1
+}
+
+// bindAddresses suggests every interface the HTTP server could listen on,
+// all of them first.
+func bindAddresses() []string {
+	_, port, _ := net.SplitHostPort(HTTPAddr)
+	addresses := []string{":" + port}
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ip, ok := addr.(*net.IPNet); ok && !ip.IP.IsLinkLocalUnicast() {
+			addresses = append(addresses, net.JoinHostPort(ip.IP.String(), port))
+		}
+	}
+	return addresses
+}
+
+func (ss *SafeSetup) Status() (SetupStatus, error) {
+	adapters, err := listAdapters()
+	if err != nil {
+		return SetupStatus{}, err
+	}
+	sections := []string{}
+	for section := range configSections {
+		sections = append(sections, section)
+	}
+	slices.Sort(sections)
+	return SetupStatus{
+		Complete: ss.Complete(),
+		Adapters: adapters,
+		Listen: HTTPAddr,
+		Addresses: bindAddresses(),
+		Sinks: SinkNames,
+		Sections: sections,
+	}, nil
+}
+
+// applyConfig saves and starts every section of a checked bundle, each
+// replacing what was there: devices left out of the per device sections
+// lose their thresholds, deadbands, polls or machine, and bridges left out are closed.
+func applyConfig(bundle ConfigBundle) error {
+	if raw, ok := bundle["sinks"]; ok {
+		profiles := map[string]ThrottleProfile{}
+		if err := json.Unmarshal(raw, &profiles); err != nil {
+			return err
+		}
+		if err := Sinks.SetProfiles(profiles); err != nil {
+			return err
+		}
+	}
+	if raw, ok := bundle["mqtt"]; ok {
+		config := MQTTConfig{}
+		if err := json.Unmarshal(raw, &config); err != nil {
+			return err
+		}
+		if err := MQTT.Set(config); err != nil {
+			return err
+		}
+	}
+	if raw, ok := bundle["cloud"]; ok {
+		config := CloudConfig{}
+		if err := json.Unmarshal(raw, &config); err != nil {
+			return err
+		}
+		if err := Cloud.Set(config); err != nil {
+			return err
+		}
+	}
+	if raw, ok := bundle["retention"]; ok {
+		tiers := []RetentionTier{}
+		if err := json.Unmarshal(raw, &tiers); err != nil {
+			return err
+		}
+		if err := History.SetTiers(tiers); err != nil {
+			return err
+		}
+	}
+	if raw, ok := bundle["virtual"]; ok {
+		metrics := []VirtualMetric{}
+		if err := json.Unmarshal(raw, &metrics); err != nil {
+			return err
+		}
+		if err := VirtualMetrics.Set(metrics); err != nil {
+			return err
+		}
+	}
+	if raw, ok := bundle["composites"]; ok {
+		composites := []CompositeDevice{}
+		if err := json.Unmarshal(raw, &composites); err != nil {
+			return err
+		}
+		if err := Composites.Set(composites); err != nil {
+			return err
+		}
+	}
+	if raw, ok := bundle["thresholds"]; ok {
+		thresholds := map[string][]Threshold{}
+		if err := json.Unmarshal(raw, &thresholds); err != nil {
+			return err
+		}
+		Thresholds.mu.Lock()
+		stale := removedKeys(Thresholds.Thresholds, thresholds)
+		Thresholds.mu.Unlock()
+		for _, addr := range stale {
+			thresholds[addr] = nil
+		}
+		for addr, t := range thresholds {
+			if err := Thresholds.Set(addr, t); err != nil {
+				return err
+			}
+		}
+	}
+	if raw, ok := bundle["deadbands"]; ok {
+		deadbands := map[string][]Deadband{}
+		if err := json.Unmarshal(raw, &deadbands); err != nil {
+			return err
+		}
+		Deadbands.mu.Lock()
+		stale := removedKeys(Deadbands.Deadbands, deadbands)
+		Deadbands.mu.Unlock()
+		for _, addr := range stale {
+			deadbands[addr] = nil
+		}
+		for addr, d := range deadbands {
+			if err := Deadbands.Set(addr, d); err != nil {
+				return err
+			}
+		}
+	}
+	if raw, ok := bundle["devicelists"]; ok {
+		lists := DeviceLists{}
+		if err := json.Unmarshal(raw, &lists); err != nil {
+			return err
+		}
+		if err := DeviceAccess.Set(lists); err != nil {
+			return err
+		}
+	}
+	if raw, ok := bundle["people"]; ok {
+		people := []Person{}
+		if err := json.Unmarshal(raw, &people); err != nil {
+			return err
+		}
+		if err := People.Set(people); err != nil {
+			return err
+		}
+	}
+	if raw, ok := bundle["modes"]; ok {
+		modes := ModeConfig{}
+		if err := json.Unmarshal(raw, &modes); err != nil {
+			return err
+		}
+		if err := Modes.Set(modes); err != nil {
+			return err
+		}
+	}
+	if raw, ok := bundle["polls"]; ok {
+		polls := map[string][]Poll{}
+		if err := json.Unmarshal(raw, &polls); err != nil {
+			return err
+		}
+		Polls.mu.Lock()
+		stale := removedKeys(Polls.Polls, polls)
+		Polls.mu.Unlock()
+		for _, addr := range stale {
+			if err := Polls.Set(addr, nil); err != nil {
+				return err
+			}
+		}
+		for addr, p := range polls {
+			if err := Polls.Set(addr, p); err != nil {
+				return err
+			}
+		}
+	}
+	if raw, ok := bundle["machines"]; ok {
+		machines := map[string]StateMachine{}
+		if err := json.Unmarshal(raw, &machines); err != nil {
+			return err
+		}
+		Machines.mu.Lock()
+		stale := removedKeys(Machines.Machines, machines)
+		Machines.mu.Unlock()
+		for _, addr := range stale {
+			if err := Machines.Delete(addr); err != nil {
+				return err
+			}
+		}
+		for addr, m := range machines {
+			if err := Machines.Set(addr, m); err != nil {
+				return err
+			}
+		}
+	}
+	if raw, ok := bundle["bridges"]; ok {
+		bridges := []BridgeConfig{}
+		if err := json.Unmarshal(raw, &bridges); err != nil {
+			return err
+		}
+		for _, running := range Bridges.List() {
+			if slices.Contains(bridges, running) {
+				continue
+			}
+			if err := Bridges.Remove(running.Port); err != nil {
+				return err
+			}
+		}
+		running := Bridges.List()
+		for _, bridge := range bridges {
+			if slices.Contains(running, bridge) {
+				continue
+			}
+			if err := Bridges.Add(bridge); err != nil {
+				return err
+			}
+		}
+	}
+	if raw, ok := bundle["webpush"]; ok {
+		config := WebPushConfig{}
+		if err := json.Unmarshal(raw, &config); err != nil {
+			return err
+		}
+		if err := WebPush.Set(config); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removedKeys lists the keys of current missing from replacement.
+func removedKeys[V any, W any](current map[string]V, replacement map[string]W) []string {
+	removed := []string{}
+	for key := range current {
+		if _, ok := replacement[key]; !ok {
+			removed = append(removed, key)
+		}
+	}
+	return removed
+}
+
+// Finish checks and applies a setup request and writes out the setup
+// config. Config problems are returned rather than an error so they can be
+// reported like `bluboi config check` does.
+func (ss *SafeSetup) Finish(req SetupRequest) (SetupResult, []ConfigProblem, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if !ss.Config.Completed.IsZero() {
+		return SetupResult{}, nil, errSetupComplete
+	}
+	config := SetupConfig{Listen: req.Listen, Adapter: req.Adapter}
+	result := SetupResult{}
+	if req.Adapter != "" {
+		adapters, err := listAdapters()
+		if err != nil {
+			return SetupResult{}, nil, err
+		}
+		if !slices.ContainsFunc(adapters, func (a AdapterInfo) bool { return a.ID == req.Adapter }) {
+			return SetupResult{}, nil, errors.New("no adapter is called " + req.Adapter)
+		}
+		result.Restart = true
+	}
+	if req.Listen != "" && req.Listen != HTTPAddr {
+		host, port, err := net.SplitHostPort(req.Listen)
+		if err != nil {
+			return SetupResult{}, nil, err
+		}
+		if host != "" && net.ParseIP(host) == nil {
+			return SetupResult{}, nil, errors.New(host + " is not an IP address")
+		}
+		// The current port is taken by this server, others can be tried.
+		if _, current, _ := net.SplitHostPort(HTTPAddr); port != current {
+			l, err := net.Listen("tcp", req.Listen)
+			if err != nil {
+				return SetupResult{}, nil, err
+			}
+			l.Close()
+		}
+		result.Restart = true
+	}
+	if problems := CheckConfig(req.Config); len(problems) > 0 {
+		return SetupResult{}, problems, nil
+	}
+	if req.GenerateToken {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return SetupResult{}, nil, err
+		}
+		result.AdminToken = base64.RawURLEncoding.EncodeToString(b)
+		config.TokenHash = hashToken(result.AdminToken)
+	}
+	err := applyConfig(req.Config)
+	if err != nil {
+		return SetupResult{}, nil, err
+	}
+	config.Completed = time.Now().UTC()
+	err = SaveJSON(setupFile, config)
+	if err != nil {
+		return SetupResult{}, nil, err
+	}
+	ss.Config = config
+	return result, nil, nil
+}
+
+func GetSetupHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		status, err := Setup.Status()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	}
+}
+
+// FinishSetupHandler completes setup, answering with the generated admin
+// token. It's the only time the token is shown.
+func FinishSetupHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		req := SetupRequest{}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result, problems, err := Setup.Finish(req)
+		if errors.Is(err, errSetupComplete) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if problems != nil {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode(ConfigReport{false, problems})
+			return
+		}
+		json.NewEncoder(w).Encode(result)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	signingFile = "signing.json"
+	// Retired keys still verify for a while so receivers can roll over.
+	signingKeysKept = 3
+	signatureMaxAge = 5 * time.Minute
+
+	HeaderKeyID     = "X-Bluboi-Key-Id"
+	HeaderTimestamp = "X-Bluboi-Timestamp"
+	HeaderSignature = "X-Bluboi-Signature"
+)
+
+type SigningKey struct {
+	ID      string
+	Secret  string
+	Created time.Time
+}
+
+// SafeSigningKeys holds the HMAC keys used to sign outbound webhook and
+// federation payloads, newest first.
+type SafeSigningKeys struct {
+	mu   sync.Mutex
+	Keys []SigningKey
+}
+
+var SigningKeys = SafeSigningKeys{}
+
+func newSigningKey() (SigningKey, error) {
+	id := make([]byte, 4)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return SigningKey{}, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return SigningKey{}, err
+	}
+	return SigningKey{hex.EncodeToString(id), hex.EncodeToString(secret), time.Now().UTC()}, nil
+}
+
+func (sk *SafeSigningKeys) Load() error {
+	sk.mu.Lock()
+	defer sk.mu.Unlock()
+	err := LoadJSON(signingFile, &sk.Keys)
+	if err != nil || len(sk.Keys) > 0 {
+		return err
+	}
+	return sk.rotate()
+}
+
+// rotate puts a new key in front, expecting sk.mu to be held.
+func (sk *SafeSigningKeys) rotate() error {
+	key, err := newSigningKey()
+	if err != nil {
+		return err
+	}
+	sk.Keys = append([]SigningKey{key}, sk.Keys...)
+	if len(sk.Keys) > signingKeysKept {
+		sk.Keys = sk.Keys[:signingKeysKept]
+	}
+	return SaveJSON(signingFile, sk.Keys)
+}
+
+func (sk *SafeSigningKeys) Rotate() error {
+	sk.mu.Lock()
+	defer sk.mu.Unlock()
+	return sk.rotate()
+}
+
+func (sk *SafeSigningKeys) List() []SigningKey {
+	sk.mu.Lock()
+	defer sk.mu.Unlock()
+	return append([]SigningKey{}, sk.Keys...)
+}
+
+func signature(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Sign adds signature headers for body with the current key. Receivers
+// recompute HMAC-SHA256(secret, timestamp + "." + body).
+func (sk *SafeSigningKeys) Sign(h http.Header, body []byte) {
+	sk.mu.Lock()
+	defer sk.mu.Unlock()
+	if len(sk.Keys) == 0 {
+		return
+	}
+	key := sk.Keys[0]
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	h.Set(HeaderKeyID, key.ID)
+	h.Set(HeaderTimestamp, timestamp)
+	h.Set(HeaderSignature, signature(key.Secret, timestamp, body))
+}
+
+// Verify checks an inbound signed payload against any key still kept, and
+// rejects stale timestamps to limit replays.
+func (sk *SafeSigningKeys) Verify(h http.Header, body []byte) error {
+	timestamp := h.Get(HeaderTimestamp)
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("missing or invalid signature timestamp")
+	}
+	age := time.Since(time.Unix(ts, 0))
+	if age > signatureMaxAge || age < -signatureMaxAge {
+		return errors.New("signature timestamp out of range")
+	}
+	sk.mu.Lock()
+	defer sk.mu.Unlock()
+	for _, key := range sk.Keys {
+		if key.ID != h.Get(HeaderKeyID) {
+			continue
+		}
+		if hmac.Equal([]byte(signature(key.Secret, timestamp, body)), []byte(h.Get(HeaderSignature))) {
+			return nil
+		}
+		return errors.New("signature mismatch")
+	}
+	return errors.New("unknown signing key")
+}
+
+func ListSigningKeysHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(SigningKeys.List())
+	}
+}
+
+func RotateSigningKeyHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		err := SigningKeys.Rotate()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		LogInfo("Rotated signing key.")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(SigningKeys.List()[0])
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ThrottleProfile controls what a sink gets to see. Mode is one of
+// "passthrough" (everything), "dedupe" (identical events are dropped for
+// WindowSeconds) or "aggregate" (only the latest event per key is delivered
+// every WindowSeconds, keyed by device address for DEVICE events). Levels,
+// when set, drops every other event type, and SilentIn drops every event
+// while one of the modes it lists is active, eg. quiet or vacation.
+type ThrottleProfile struct {
+	Mode          string
+	WindowSeconds int      `json:",omitempty"`
+	Levels        []string `json:",omitempty"`
+	SilentIn      []string `json:",omitempty"`
+}
+
+// Throttle applies a profile on behalf of one sink instance.
+type Throttle struct {
+	profile ThrottleProfile
+	levels  map[string]bool
+	last    map[string]time.Time
+	pending map[string]Log
+	order   []string
+	flushed time.Time
+}
+
+type Sink struct {
+	Name     string
+	deliver  func (Log)
+	throttle *Throttle
+	// queue is the channel of sinks added with Subscribe.
+	queue    chan Log
+}
+
+type SafeSinks struct {
+	mu       sync.Mutex
+	next     uint32
+	sinks    map[uint32]*Sink
+	Profiles map[string]ThrottleProfile
+}
+
+const sinksFile = "sinks.json"
+
+var Sinks = SafeSinks{sinks: map[uint32]*Sink{}, Profiles: map[string]ThrottleProfile{}}
+
+func (tp *ThrottleProfile) Validate() error {
+	for _, mode := range tp.SilentIn {
+		if err := ValidateMode(mode); err != nil {
+			return err
+		}
+	}
+	switch tp.Mode {
+	case "", "passthrough":
+		return nil
+	case "dedupe", "aggregate":
+		if tp.WindowSeconds < 1 {
+			return errors.New(tp.Mode + " needs a positive WindowSeconds")
+		}
+		return nil
+	}
+	return errors.New("mode must be passthrough, dedupe or aggregate")
+}
+
+func NewThrottle(profile ThrottleProfile) *Throttle {
+	t := &Throttle{
+		profile: profile,
+		last: map[string]time.Time{},
+		pending: map[string]Log{},
+		flushed: time.Now(),
+	}
+	if len(profile.Levels) > 0 {
+		t.levels = map[string]bool{}
+		for _, level := range profile.Levels {
+			t.levels[level] = true
+		}
+	}
+	return t
+}
+
+func (t *Throttle) window() time.Duration {
+	return time.Duration(t.profile.WindowSeconds) * time.Second
+}
+
+func throttleKey(l Log, mode string) string {
+	if mode == "aggregate" && l.Level == "DEVICE" {
+		addr, _, _ := strings.Cut(l.Msg, ";")
+		return l.Level + "\x00" + addr
+	}
+	return l.Level + "\x00" + l.Msg
+}
+
+// Offer returns the events to deliver right away.
+func (t *Throttle) Offer(l Log) []Log {
+	if t.levels != nil && !t.levels[l.Level] || Modes.In(t.profile.SilentIn) {
+		return nil
+	}
+	key := throttleKey(l, t.profile.Mode)
+	switch t.profile.Mode {
+	case "dedupe":
+		if time.Since(t.last[key]) < t.window() {
+			return nil
+		}
+		t.last[key] = time.Now()
+	case "aggregate":
+		if _, ok := t.pending[key]; !ok {
+			t.order = append(t.order, key)
+		}
+		t.pending[key] = l
+		return nil
+	}
+	return []Log{l}
+}
+
+// Flush returns aggregated events once the window has passed.
+func (t *Throttle) Flush() []Log {
+	if t.profile.Mode != "aggregate" || time.Since(t.flushed) < t.window() {
+		return nil
+	}
+	t.flushed = time.Now()
+	logs := []Log{}
+	for _, key := range t.order {
+		logs = append(logs, t.pending[key])
+	}
+	t.pending = map[string]Log{}
+	t.order = nil
+	return logs
+}
+
+func (ss *SafeSinks) Load() error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return LoadJSON(sinksFile, &ss.Profiles)
+}
+
+// Register adds a sink delivering through a callback. Sinks sharing a name
+// share a profile, but each keeps its own throttling state.
+func (ss *SafeSinks) Register(name string, deliver func (Log)) uint32 {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.next++
+	ss.sinks[ss.next] = &Sink{name, deliver, NewThrottle(ss.Profiles[name]), nil}
+	return ss.next
+}
+
+// Subscribe adds a sink delivering to a buffered channel. Slow consumers
+// lose logs rather than holding up the broadcast.
+func (ss *SafeSinks) Subscribe(name string, size int) (uint32, <-chan Log) {
+	ch := make(chan Log, size)
+	id := ss.Register(name, func (l Log) {
+		select {
+		case ch <- l:
+		default:
+		}
+	})
+	ss.mu.Lock()
+	ss.sinks[id].queue = ch
+	ss.mu.Unlock()
+	return id, ch
+}
+
+// Queues returns how many logs wait in the channels of the sinks added with
+// Subscribe, by sink name.
+func (ss *SafeSinks) Queues() map[string]QueueDepth {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	queues := map[string]QueueDepth{}
+	for _, sink := range ss.sinks {
+		if sink.queue == nil {
+			continue
+		}
+		q := queues[sink.Name]
+		q.Length += len(sink.queue)
+		q.Capacity += cap(sink.queue)
+		queues[sink.Name] = q
+	}
+	return queues
+}
+
+func (ss *SafeSinks) Unregister(id uint32) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	delete(ss.sinks, id)
+}
+
+func (ss *SafeSinks) Dispatch(l Log) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for _, sink := range ss.sinks {
+		for _, out := range sink.throttle.Offer(l) {
+			sink.deliver(out)
+		}
+	}
+}
+
+// RunFlusher delivers aggregated events as their windows close.
+func (ss *SafeSinks) RunFlusher() {
+	for {
+		time.Sleep(time.Second)
+		ss.mu.Lock()
+		for _, sink := range ss.sinks {
+			for _, out := range sink.throttle.Flush() {
+				sink.deliver(out)
+			}
+		}
+		ss.mu.Unlock()
+	}
+}
+
+func (ss *SafeSinks) SetProfiles(profiles map[string]ThrottleProfile) error {
+	for name, profile := range profiles {
+		if err := profile.Validate(); err != nil {
+			return errors.New(name + ": " + err.Error())
+		}
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.Profiles = profiles
+	for _, sink := range ss.sinks {
+		sink.throttle = NewThrottle(profiles[sink.Name])
+	}
+	return SaveJSON(sinksFile, profiles)
+}
+
+type SinksView struct {
+	Sinks    []string
+	Profiles map[string]ThrottleProfile
+}
+
+func (ss *SafeSinks) View() SinksView {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	names := map[string]bool{}
+	for _, sink := range ss.sinks {
+		names[sink.Name] = true
+	}
+	view := SinksView{Sinks: []string{}, Profiles: ss.Profiles}
+	for name := range names {
+		view.Sinks = append(view.Sinks, name)
+	}
+	sort.Strings(view.Sinks)
+	return view
+}
+
+func GetSinksHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Sinks.View())
+	}
+}
+
+func SetSinksHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		profiles := map[string]ThrottleProfile{}
+		err := json.NewDecoder(r.Body).Decode(&profiles)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = Sinks.SetProfiles(profiles)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(200)
+	}
+}
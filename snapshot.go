@@ -0,0 +1,227 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Quiesce is held for reading by everything bluboi writes persistent state
+// with, and for writing while a snapshot is taken so it is consistent. The
+// pcap of a running capture is written by the sniffer, so it may end in the
+// middle of a packet.
+var Quiesce sync.RWMutex
+
+type SnapshotManifest struct {
+	Created time.Time
+	Schema  int
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name: name,
+		Mode: 0o600,
+		Size: int64(len(data)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+// Snapshot writes a gzipped tarball of the data directory under data/, and
+// of the database under db/ when it lives elsewhere.
+func Snapshot(w io.Writer) error {
+	History.Flush()
+	Quiesce.Lock()
+	defer Quiesce.Unlock()
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	schema, err := Store.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	manifest, _ := json.MarshalIndent(SnapshotManifest{time.Now().UTC(), schema}, "", "\t")
+	err = writeTarFile(tw, "manifest.json", manifest)
+	if err != nil {
+		return err
+	}
+	err = filepath.WalkDir(DataDir, func (p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasSuffix(p, ".tmp") {
+			return err
+		}
+		rel, err := filepath.Rel(DataDir, p)
+		if err != nil {
+			return err
+		}
+		// The SQLite backend adds a consistent copy of its database.
+		if strings.HasPrefix(rel, sqliteFile) {
+			return nil
+		}
+		data, err := os.ReadFile(p)
+		// Recordings and captures can be deleted meanwhile.
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return writeTarFile(tw, path.Join("data", filepath.ToSlash(rel)), data)
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	err = Store.Snapshot(tw)
+	if err != nil {
+		return err
+	}
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// Restore unpacks a snapshot into an empty data directory and the opened
+// Store. bluboi must not be running against either.
+func Restore(r io.Reader) error {
+	entries, err := os.ReadDir(DataDir)
+	if err == nil && len(entries) > 0 {
+		return errors.New(DataDir + " is not empty")
+	}
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean(h.Name)
+		if h.Typeflag != tar.TypeReg || strings.HasPrefix(name, "../") || path.IsAbs(name) {
+			continue
+		}
+		top, rest, _ := strings.Cut(name, "/")
+		switch top {
+		case "data":
+			target := filepath.Join(DataDir, filepath.FromSlash(rest))
+			err = os.MkdirAll(filepath.Dir(target), 0o755)
+			if err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		case "db":
+			err = Store.Restore(rest, tr)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// SnapshotHandler builds the snapshot into a temporary file before sending
+// it, so a slow download doesn't hold up writers for as long as it takes.
+func SnapshotHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		f, err := os.CreateTemp("", "bluboi-snapshot-*.tar.gz")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		err = Snapshot(f)
+		if err == nil {
+			_, err = f.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			LogError("Snapshot failed -", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		name := "bluboi-" + time.Now().UTC().Format("20060102-150405") + ".tar.gz"
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"" + name + "\"")
+		io.Copy(w, f)
+	}
+}
+
+// RestoreCommand implements `bluboi restore [-data dir] [-db url] <snapshot>`.
+func RestoreCommand(args []string) int {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	flags.StringVar(&DataDir, "data", DataDir, "directory bluboi persists its state in")
+	db := flags.String("db", "sqlite", "where state and history are stored: \"sqlite\" for bluboi.db in the data directory, \"file\" for JSON files in it, or a postgres:// URL")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Println("Usage: bluboi restore [-data dir] [-db url] <snapshot.tar.gz>")
+		return 2
+	}
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer f.Close()
+	// A database needs its tables before rows can be restored into it, while
+	// the data directory, SQLite database included, has to start out empty.
+	if !LocalStore(*db) {
+		err = OpenStore(*db)
+		if err != nil {
+			fmt.Println("Could not open the database -", err)
+			return 1
+		}
+		defer Store.Close()
+		err = CheckSchema()
+		if err != nil {
+			fmt.Println("Could not migrate the database -", err)
+			return 1
+		}
+	}
+	err = Restore(f)
+	if err != nil {
+		fmt.Println("Restore failed -", err)
+		return 1
+	}
+	if LocalStore(*db) {
+		err = OpenStore(*db)
+		if err != nil {
+			fmt.Println("Could not open the database -", err)
+			return 1
+		}
+		defer Store.Close()
+	}
+	err = CheckSchema()
+	if err != nil {
+		fmt.Println("Could not migrate the restored state -", err)
+		return 1
+	}
+	fmt.Println("Restored into", DataDir)
+	return 0
+}
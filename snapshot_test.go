@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	base := time.Date(2026, 10, 14, 6, 30, 0, 0, time.UTC)
+	for _, db := range []string{"file", "sqlite"} {
+		t.Run(db, func (t *testing.T) {
+			if db == "sqlite" {
+				useSQLite(t, nil)
+			} else {
+				useDataDir(t)
+				if err := CheckSchema(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := SaveJSON("known.json", map[string]string{"AA": "sensor"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := Store.Append("raw", []Aggregate{{Address: "AA", Metric: "rssi", Start: base, Window: "0s", Avg: -60, Count: 1}}); err != nil {
+				t.Fatal(err)
+			}
+			os.MkdirAll(filepath.Join(DataDir, recordingsDir), 0o755)
+			os.WriteFile(filepath.Join(DataDir, recordingsDir, "rec.txt"), []byte("line\n"), 0o644)
+			os.WriteFile(filepath.Join(DataDir, "half.json.tmp"), []byte("{"), 0o644)
+			snapshot := bytes.Buffer{}
+			if err := Snapshot(&snapshot); err != nil {
+				t.Fatal(err)
+			}
+			if err := Restore(bytes.NewReader(snapshot.Bytes())); err == nil {
+				t.Errorf("restored into a data directory in use")
+			}
+
+			Store.Close()
+			DataDir = t.TempDir()
+			if err := Restore(bytes.NewReader(snapshot.Bytes())); err != nil {
+				t.Fatal(err)
+			}
+			if err := OpenStore(db); err != nil {
+				t.Fatal(err)
+			}
+			if err := CheckSchema(); err != nil {
+				t.Fatal(err)
+			}
+			known := map[string]string{}
+			if err := LoadJSON("known.json", &known); err != nil || known["AA"] != "sensor" {
+				t.Errorf("got %v, %v, want known.json back", known, err)
+			}
+			points := []Aggregate{}
+			Store.Scan("raw", time.Time{}, func (p Aggregate) { points = append(points, p) })
+			if len(points) != 1 || points[0].Avg != -60 || !points[0].Start.Equal(base) {
+				t.Errorf("got history %+v, want the point back", points)
+			}
+			if data, err := os.ReadFile(filepath.Join(DataDir, recordingsDir, "rec.txt")); err != nil || string(data) != "line\n" {
+				t.Errorf("got recording %q, %v", data, err)
+			}
+			if _, err := os.Stat(filepath.Join(DataDir, "half.json.tmp")); err == nil {
+				t.Errorf("a temporary file was restored")
+			}
+		})
+	}
+}
+
+func TestSnapshotWaitsForRecordings(t *testing.T) {
+	useDataDir(t)
+	t.Cleanup(func () { Recordings = SafeRecordings{Recordings: []Recording{}, active: map[string]*recorder{}} })
+	Recordings = SafeRecordings{Recordings: []Recording{}, active: map[string]*recorder{}}
+	r, err := Recordings.Start(RecordingRequest{Address: "AA:BB:CC:DD:EE:FF"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	Recordings.Offer("AA:BB:CC:DD:EE:FF", "2a37", []byte{0x01})
+	Quiesce.Lock()
+	Recordings.Stop(r.ID)
+	time.Sleep(50 * time.Millisecond)
+	info, err := os.Stat(recordingPath(r.ID))
+	Quiesce.Unlock()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if r, _ = Recordings.Get(r.ID); !r.Running {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the recording didn't end")
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 0 {
+		t.Errorf("%d bytes were written to the recording while quiesced", info.Size())
+	}
+	if r.Count != 1 || r.Size == 0 {
+		t.Errorf("got %+v, want the notification written once resumed", r)
+	}
+}
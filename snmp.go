@@ -0,0 +1,423 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal SNMP v1/v2c agent answering GET, GETNEXT and GETBULK for a
+// read-only MIB describing the gateway and the devices it has seen. The MIB
+// lives under NET-SNMP's playpen (1.3.6.1.4.1.8072.9999.9999) as bluboi has
+// no enterprise number of its own:
+//
+//	.1.1.0      uptime (TimeTicks)
+//	.1.2.0      connected to a device (TruthValue)
+//	.1.3.0      number of known devices (Gauge32)
+//	.1.4.0      number of event stream clients (Gauge32)
+//	.2.1.1.N    device address
+//	.2.1.2.N    device name
+//	.2.1.3.N    device present (TruthValue)
+//	.2.1.4.N    device battery level in percent, when known (Gauge32)
+
+const (
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berNull        = 0x05
+	berOID         = 0x06
+	berSequence    = 0x30
+	berGauge32     = 0x42
+	berTimeTicks   = 0x43
+
+	snmpGet      = 0xa0
+	snmpGetNext  = 0xa1
+	snmpResponse = 0xa2
+	snmpGetBulk  = 0xa5
+
+	snmpNoSuchObject = 0x80
+	snmpEndOfMibView = 0x82
+
+	snmpErrNoSuchName = 2
+)
+
+var (
+	snmpBase = OID{1, 3, 6, 1, 4, 1, 8072, 9999, 9999}
+	errBER = errors.New("malformed BER encoding")
+)
+
+type OID []uint32
+
+func (o OID) String() string {
+	parts := make([]string, len(o))
+	for i, n := range o {
+		parts[i] = strconv.FormatUint(uint64(n), 10)
+	}
+	return strings.Join(parts, ".")
+}
+
+func (o OID) Compare(other OID) int {
+	for i := 0; i < len(o) && i < len(other); i++ {
+		if o[i] != other[i] {
+			if o[i] < other[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(o) - len(other)
+}
+
+func (o OID) Append(n ...uint32) OID {
+	return append(append(OID{}, o...), n...)
+}
+
+func berRead(data []byte) (byte, []byte, []byte, error) {
+	if len(data) < 2 {
+		return 0, nil, nil, errBER
+	}
+	tag := data[0]
+	length := int(data[1])
+	data = data[2:]
+	if length & 0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 4 || len(data) < n {
+			return 0, nil, nil, errBER
+		}
+		length = 0
+		for _, b := range data[:n] {
+			length = length << 8 | int(b)
+		}
+		data = data[n:]
+	}
+	if length > len(data) {
+		return 0, nil, nil, errBER
+	}
+	return tag, data[:length], data[length:], nil
+}
+
+func berWrite(tag byte, value []byte) []byte {
+	out := []byte{tag}
+	n := len(value)
+	switch {
+	case n < 0x80:
+		out = append(out, byte(n))
+	case n <= 0xff:
+		out = append(out, 0x81, byte(n))
+	default:
+		out = append(out, 0x82, byte(n >> 8), byte(n))
+	}
+	return append(out, value...)
+}
+
+func berInt(n int64) []byte {
+	b := binary.BigEndian.AppendUint64(nil, uint64(n))
+	for len(b) > 1 && ((b[0] == 0 && b[1] & 0x80 == 0) || (b[0] == 0xff && b[1] & 0x80 != 0)) {
+		b = b[1:]
+	}
+	return b
+}
+
+func berUint(n uint32) []byte {
+	return berInt(int64(n))
+}
+
+func berParseInt(value []byte) int64 {
+	if len(value) == 0 {
+		return 0
+	}
+	n := int64(int8(value[0]))
+	for _, b := range value[1:] {
+		n = n << 8 | int64(b)
+	}
+	return n
+}
+
+func berEncodeOID(o OID) []byte {
+	if len(o) < 2 {
+		return []byte{0}
+	}
+	out := []byte{byte(o[0] * 40 + o[1])}
+	for _, n := range o[2:] {
+		chunk := []byte{byte(n & 0x7f)}
+		for n >>= 7; n > 0; n >>= 7 {
+			chunk = append([]byte{byte(n & 0x7f | 0x80)}, chunk...)
+		}
+		out = append(out, chunk...)
+	}
+	return out
+}
+
+func berParseOID(value []byte) (OID, error) {
+	if len(value) == 0 {
+		return nil, errBER
+	}
+	o := OID{uint32(value[0]) / 40, uint32(value[0]) % 40}
+	n := uint32(0)
+	for _, b := range value[1:] {
+		n = n << 7 | uint32(b & 0x7f)
+		if b & 0x80 == 0 {
+			o = append(o, n)
+			n = 0
+		}
+	}
+	return o, nil
+}
+
+// snmpVar is an already BER encoded value bound to an OID.
+type snmpVar struct {
+	oid   OID
+	value []byte
+}
+
+type SafeBatteries struct {
+	mu     sync.Mutex
+	Levels map[string]uint8
+}
+
+// Batteries remembers the last battery level read from each device.
+var Batteries = SafeBatteries{Levels: map[string]uint8{}}
+
+func (sb *SafeBatteries) Set(addr string, level uint8) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	sb.Levels[addr] = level
+}
+
+func (sb *SafeBatteries) Get(addr string) (uint8, bool) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	level, ok := sb.Levels[addr]
+	return level, ok
+}
+
+// ReadBattery reads the standard Battery Level characteristic of a newly
+// connected device, if it has one.
+func ReadBattery(addr string) {
+	char, err := Adapter.Characteristic(addr, "2a19")
+	if err != nil {
+		return
+	}
+	buf := make([]byte, 1)
+	n, err := char.Read(buf)
+	if err != nil || n < 1 {
+		return
+	}
+	Batteries.Set(addr, buf[0])
+	Telemetry.Record(addr, "battery", float64(buf[0]))
+}
+
+func snmpTruth(b bool) []byte {
+	if b {
+		return berWrite(berInteger, berInt(1))
+	}
+	return berWrite(berInteger, berInt(2))
+}
+
+// snmpMIB takes a sorted snapshot of every variable the agent exposes.
+func snmpMIB() []snmpVar {
+	connected := Adapter.DeviceAddress()
+	uptime := uint32(time.Since(StartedAt) / (10 * time.Millisecond))
+	vars := []snmpVar{
+		{snmpBase.Append(1, 1, 0), berWrite(berTimeTicks, berUint(uptime))},
+		{snmpBase.Append(1, 2, 0), snmpTruth(connected != "")},
+		{snmpBase.Append(1, 3, 0), berWrite(berGauge32, berUint(uint32(Devices.Length())))},
+		{snmpBase.Append(1, 4, 0), berWrite(berGauge32, berUint(uint32(Clients.Length())))},
+	}
+	type entry struct {
+		addr string
+		name string
+	}
+	devices := []entry{}
+	Devices.ForEach(func (addr string, device Device) {
+		devices = append(devices, entry{addr, device.Name})
+	})
+	sort.Slice(devices, func (i, j int) bool {
+		return devices[i].addr < devices[j].addr
+	})
+	for i, d := range devices {
+		index := uint32(i + 1)
+		vars = append(vars,
+			snmpVar{snmpBase.Append(2, 1, 1, index), berWrite(berOctetString, []byte(d.addr))},
+			snmpVar{snmpBase.Append(2, 1, 2, index), berWrite(berOctetString, []byte(d.name))},
+			snmpVar{snmpBase.Append(2, 1, 3, index), snmpTruth(true)},
+		)
+		if level, ok := Batteries.Get(d.addr); ok {
+			vars = append(vars, snmpVar{snmpBase.Append(2, 1, 4, index), berWrite(berGauge32, berUint(uint32(level)))})
+		}
+	}
+	sort.Slice(vars, func (i, j int) bool {
+		return vars[i].oid.Compare(vars[j].oid) < 0
+	})
+	return vars
+}
+
+func snmpLookup(mib []snmpVar, oid OID) ([]byte, bool) {
+	for _, v := range mib {
+		if v.oid.Compare(oid) == 0 {
+			return v.value, true
+		}
+	}
+	return nil, false
+}
+
+func snmpNext(mib []snmpVar, oid OID) (snmpVar, bool) {
+	for _, v := range mib {
+		if v.oid.Compare(oid) > 0 {
+			return v, true
+		}
+	}
+	return snmpVar{}, false
+}
+
+type SNMPAgent struct {
+	Community string
+	conn      *net.UDPConn
+}
+
+func (sa *SNMPAgent) Listen(addr string) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	sa.conn, err = net.ListenUDP("udp", udpAddr)
+	return err
+}
+
+func (sa *SNMPAgent) Serve() error {
+	log.Printf("[INFO] Starting SNMP agent on %v", sa.conn.LocalAddr())
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := sa.conn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+		res, err := sa.handle(buf[:n])
+		if err != nil {
+			continue
+		}
+		sa.conn.WriteToUDP(res, from)
+	}
+}
+
+func (sa *SNMPAgent) handle(packet []byte) ([]byte, error) {
+	tag, msg, _, err := berRead(packet)
+	if err != nil || tag != berSequence {
+		return nil, errBER
+	}
+	tag, version, msg, err := berRead(msg)
+	if err != nil || tag != berInteger {
+		return nil, errBER
+	}
+	v := berParseInt(version)
+	if v != 0 && v != 1 {
+		return nil, errBER
+	}
+	tag, community, msg, err := berRead(msg)
+	if err != nil || tag != berOctetString || string(community) != sa.Community {
+		return nil, errBER
+	}
+	pduType, pdu, _, err := berRead(msg)
+	if err != nil {
+		return nil, errBER
+	}
+	fields := [][]byte{}
+	for i := 0; i < 3; i++ {
+		var field []byte
+		tag, field, pdu, err = berRead(pdu)
+		if err != nil || tag != berInteger {
+			return nil, errBER
+		}
+		fields = append(fields, field)
+	}
+	tag, list, _, err := berRead(pdu)
+	if err != nil || tag != berSequence {
+		return nil, errBER
+	}
+	oids := []OID{}
+	for len(list) > 0 {
+		var bind []byte
+		tag, bind, list, err = berRead(list)
+		if err != nil || tag != berSequence {
+			return nil, errBER
+		}
+		tag, raw, _, err := berRead(bind)
+		if err != nil || tag != berOID {
+			return nil, errBER
+		}
+		oid, err := berParseOID(raw)
+		if err != nil {
+			return nil, err
+		}
+		oids = append(oids, oid)
+	}
+
+	mib := snmpMIB()
+	errStatus, errIndex := int64(0), int64(0)
+	binds := []snmpVar{}
+	switch pduType {
+	case snmpGet:
+		for i, oid := range oids {
+			value, ok := snmpLookup(mib, oid)
+			if !ok {
+				value = []byte{snmpNoSuchObject, 0}
+				if v == 0 && errStatus == 0 {
+					errStatus, errIndex = snmpErrNoSuchName, int64(i + 1)
+				}
+			}
+			binds = append(binds, snmpVar{oid, value})
+		}
+	case snmpGetNext:
+		for i, oid := range oids {
+			next, ok := snmpNext(mib, oid)
+			if !ok {
+				next = snmpVar{oid, []byte{snmpEndOfMibView, 0}}
+				if v == 0 && errStatus == 0 {
+					errStatus, errIndex = snmpErrNoSuchName, int64(i + 1)
+				}
+			}
+			binds = append(binds, next)
+		}
+	case snmpGetBulk:
+		nonRepeaters := int(min(max(berParseInt(fields[1]), 0), int64(len(oids))))
+		repetitions := int(min(max(berParseInt(fields[2]), 0), 50))
+		for _, oid := range oids[:nonRepeaters] {
+			next, ok := snmpNext(mib, oid)
+			if !ok {
+				next = snmpVar{oid, []byte{snmpEndOfMibView, 0}}
+			}
+			binds = append(binds, next)
+		}
+		for _, oid := range oids[nonRepeaters:] {
+			for r := 0; r < repetitions; r++ {
+				next, ok := snmpNext(mib, oid)
+				if !ok {
+					binds = append(binds, snmpVar{oid, []byte{snmpEndOfMibView, 0}})
+					break
+				}
+				binds = append(binds, next)
+				oid = next.oid
+			}
+		}
+	default:
+		return nil, errBER
+	}
+
+	varbinds := []byte{}
+	for _, b := range binds {
+		varbinds = append(varbinds, berWrite(berSequence, append(berWrite(berOID, berEncodeOID(b.oid)), b.value...))...)
+	}
+	body := berWrite(berInteger, fields[0])
+	body = append(body, berWrite(berInteger, berInt(errStatus))...)
+	body = append(body, berWrite(berInteger, berInt(errIndex))...)
+	body = append(body, berWrite(berSequence, varbinds)...)
+	res := berWrite(berInteger, berInt(v))
+	res = append(res, berWrite(berOctetString, community)...)
+	res = append(res, berWrite(snmpResponse, body)...)
+	return berWrite(berSequence, res), nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"tinygo.org/x/bluetooth"
+)
+
+const (
+	// soakTick is how often the load generator hands out advertisements
+	// when holding a rate.
+	soakTick = 10 * time.Millisecond
+	// Growth tolerated between the end of the warm up and the end of the run.
+	soakGoroutineSlack = 20
+	soakHeapSlack      = 8 << 20
+)
+
+// syntheticAdvertisement is what a soak test device advertises.
+type syntheticAdvertisement struct {
+	name         string
+	manufacturer map[uint16][]byte
+}
+
+func (a syntheticAdvertisement) LocalName() string { return a.name }
+func (a syntheticAdvertisement) HasServiceUUID(bluetooth.UUID) bool { return false }
+func (a syntheticAdvertisement) Bytes() []byte { return nil }
+func (a syntheticAdvertisement) ManufacturerData() map[uint16][]byte { return a.manufacturer }
+
+// discardClient is an event stream client that throws events away, counting
+// what it was sent.
+type discardClient struct {
+	header  http.Header
+	written atomic.Int64
+}
+
+func (c *discardClient) Header() http.Header { return c.header }
+func (c *discardClient) WriteHeader(int) {}
+func (c *discardClient) Flush() {}
+
+func (c *discardClient) Write(b []byte) (int, error) {
+	c.written.Add(int64(len(b)))
+	return len(b), nil
+}
+
+type soakSample struct {
+	goroutines int
+	heap       uint64
+}
+
+func takeSoakSample() soakSample {
+	runtime.GC()
+	stats := runtime.MemStats{}
+	runtime.ReadMemStats(&stats)
+	return soakSample{runtime.NumGoroutine(), stats.HeapAlloc}
+}
+
+// SoakCommand feeds synthetic advertisements from many devices through the
+// whole scan pipeline (device list, presence, telemetry, history, sinks and
+// event streams) for a long time, reporting throughput and failing if
+// goroutines or memory keep growing after the warm up.
+func SoakCommand(args []string) int {
+	flags := flag.NewFlagSet("soak", flag.ExitOnError)
+	devices := flags.Int("devices", 200, "synthetic devices advertising")
+	rate := flags.Float64("rate", 10, "advertisements per second of each device, 0 for as fast as possible")
+	clients := flags.Int("clients", 4, "event stream clients receiving every event")
+	duration := flags.Duration("duration", time.Hour, "how long to run for")
+	warmup := flags.Duration("warmup", 5 * time.Minute, "how long to let buffers and windows fill before measuring growth")
+	every := flags.Duration("sample", time.Minute, "how often to report")
+	data := flags.String("data", "", "data directory to use, a temporary one when empty")
+	budget := flags.Int("memory-budget", 0, "MiB of memory to stay within, as with bluboi -memory-budget")
+	flags.Parse(args)
+	if *devices < 1 || *rate < 0 || *warmup >= *duration || *every <= 0 {
+		fmt.Println("Usage: bluboi soak [-devices n] [-rate n] [-clients n] [-duration d] [-warmup d] [-sample d] [-data dir] [-memory-budget mib]")
+		fmt.Println("-warmup has to be shorter than -duration.")
+		return 2
+	}
+	if *data == "" {
+		dir, err := os.MkdirTemp("", "bluboi-soak-")
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		defer os.RemoveAll(dir)
+		*data = dir
+	}
+	DataDir = *data
+	log.SetOutput(io.Discard)
+	err := OpenStore("file")
+	if err == nil {
+		err = CheckSchema()
+	}
+	if err != nil {
+		fmt.Println("Could not set up the data directory -", err)
+		return 1
+	}
+	windows, _ := ParseWindows(DefaultWindows)
+	Telemetry.Windows = windows
+	ApplyMemoryBudget(*budget)
+
+	sinks := []*discardClient{}
+	for i := 0; i < *clients; i++ {
+		client := &discardClient{header: http.Header{}}
+		r, _ := http.NewRequest("GET", "/events", nil)
+		Clients.AddClient(Client{id: uint32(i + 1), w: client, r: r})
+		sinks = append(sinks, client)
+	}
+	Adapter.scanning.Store(true)
+	go BroadcastLogs()
+	go DeviceReports.Run()
+	go Telemetry.RunAggregation()
+	go Presence.WatchPresence()
+	go History.RunCompaction()
+	go History.RunFlushes()
+
+	results := make([]bluetooth.ScanResult, *devices)
+	for i := range results {
+		results[i].Address.MAC = bluetooth.MAC{byte(i), byte(i >> 8), byte(i >> 16), 0x50, 0xa4, 0x5e}
+		results[i].RSSI = int16(-40 - rand.Intn(50))
+		results[i].AdvertisementPayload = syntheticAdvertisement{
+			name: fmt.Sprintf("soak-%d", i),
+			manufacturer: map[uint16][]byte{0xffff: {byte(i), 0x64}},
+		}
+	}
+	var sent atomic.Uint64
+	stop := make(chan struct{})
+	go func () {
+		next := 0
+		advertise := func () {
+			result := &results[next]
+			result.RSSI = min(max(result.RSSI + int16(rand.Intn(5) - 2), -100), -30)
+			Adapter.handleScanResult(*result)
+			sent.Add(1)
+			next = (next + 1) % len(results)
+		}
+		if *rate == 0 {
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				for i := 0; i < 1024; i++ {
+					advertise()
+				}
+			}
+		}
+		ticker := time.NewTicker(soakTick)
+		defer ticker.Stop()
+		due := 0.0
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			for due += float64(*devices) * *rate * soakTick.Seconds(); due >= 1; due-- {
+				advertise()
+			}
+		}
+	} ()
+
+	pace := fmt.Sprintf("%g advertisements/s each", *rate)
+	if *rate == 0 {
+		pace = "as fast as possible"
+	}
+	fmt.Printf("Soaking %d devices advertising %s, %d clients, for %v (warm up %v) in %s\n", *devices, pace, *clients, *duration, *warmup, DataDir)
+	fmt.Printf("%-10s %12s %10s %10s %12s\n", "elapsed", "adv/s", "goroutines", "heap MiB", "client KiB/s")
+	started := time.Now()
+	baseline, last := soakSample{}, soakSample{}
+	measuring := false
+	lastSent, lastWritten, lastAt := uint64(0), int64(0), started
+	for elapsed := time.Duration(0); elapsed < *duration; {
+		time.Sleep(min(*every, *duration - elapsed))
+		now := time.Now()
+		elapsed = now.Sub(started)
+		last = takeSoakSample()
+		if !measuring && elapsed >= *warmup {
+			baseline, measuring = last, true
+		}
+		written := int64(0)
+		for _, client := range sinks {
+			written += client.written.Load()
+		}
+		seconds := now.Sub(lastAt).Seconds()
+		total := sent.Load()
+		fmt.Printf("%-10v %12.0f %10d %10.1f %12.1f\n", elapsed.Round(time.Second), float64(total - lastSent) / seconds, last.goroutines, float64(last.heap) / (1 << 20), float64(written - lastWritten) / 1024 / seconds / float64(max(len(sinks), 1)))
+		lastSent, lastWritten, lastAt = total, written, now
+	}
+	close(stop)
+
+	failed := false
+	if last.goroutines > baseline.goroutines + soakGoroutineSlack {
+		fmt.Printf("FAIL: goroutines grew from %d to %d\n", baseline.goroutines, last.goroutines)
+		failed = true
+	}
+	if last.heap > baseline.heap + baseline.heap / 2 + soakHeapSlack {
+		fmt.Printf("FAIL: heap grew from %.1f MiB to %.1f MiB\n", float64(baseline.heap) / (1 << 20), float64(last.heap) / (1 << 20))
+		failed = true
+	}
+	fmt.Printf("%d advertisements in %v, %d devices listed\n", sent.Load(), time.Since(started).Round(time.Second), Devices.Length())
+	if failed {
+		return 1
+	}
+	fmt.Println("PASS")
+	return 0
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sparkplug B publishing. The gateway is an edge node and every BLE device a
+// Sparkplug device under it, named by its address without colons. Payloads
+// are encoded by hand; only the fields bluboi uses are supported.
+
+const (
+	spNamespace = "spBv1.0"
+
+	spInt64   = 4
+	spUInt64  = 8
+	spDouble  = 10
+	spBoolean = 11
+	spString  = 12
+
+	spRebirth = "Node Control/Rebirth"
+	spBdSeq   = "bdSeq"
+	// The node metrics have aliases of their own, device metrics being
+	// numbered after them, as aliases have to be unique across the node.
+	spBdSeqAlias   = 1
+	spRebirthAlias = 2
+	spNodeAliases  = 2
+)
+
+type SparkplugConfig struct {
+	GroupID string
+	NodeID  string `json:",omitempty"`
+}
+
+type SparkplugMetric struct {
+	Name     string
+	Alias    uint64
+	DataType uint32
+	Value    any
+}
+
+func protoKey(field int, wire int) []byte {
+	return binary.AppendUvarint(nil, uint64(field << 3 | wire))
+}
+
+func protoVarint(b []byte, field int, v uint64) []byte {
+	b = append(b, protoKey(field, 0)...)
+	return binary.AppendUvarint(b, v)
+}
+
+func protoBytes(b []byte, field int, v []byte) []byte {
+	b = append(b, protoKey(field, 2)...)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// encode writes a Metric, with its name only when birth is set: data
+// messages refer to metrics by alias.
+func (m SparkplugMetric) encode(birth bool, timestamp uint64) []byte {
+	b := []byte{}
+	if birth {
+		b = protoBytes(b, 1, []byte(m.Name))
+	}
+	b = protoVarint(b, 2, m.Alias)
+	b = protoVarint(b, 3, timestamp)
+	b = protoVarint(b, 4, uint64(m.DataType))
+	switch v := m.Value.(type) {
+	case nil:
+		b = protoVarint(b, 7, 1)
+	case uint64:
+		b = protoVarint(b, 11, v)
+	case float64:
+		b = append(b, protoKey(13, 1)...)
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+	case bool:
+		flag := uint64(0)
+		if v {
+			flag = 1
+		}
+		b = protoVarint(b, 14, flag)
+	case string:
+		b = protoBytes(b, 15, []byte(v))
+	}
+	return b
+}
+
+func EncodeSparkplug(metrics []SparkplugMetric, seq uint64, birth bool) []byte {
+	return protoVarint(encodeSparkplugMetrics(metrics, birth), 3, seq)
+}
+
+// encodeSparkplugMetrics writes a payload without a sequence number, as the
+// NDEATH must be.
+func encodeSparkplugMetrics(metrics []SparkplugMetric, birth bool) []byte {
+	timestamp := uint64(time.Now().UnixMilli())
+	b := protoVarint(nil, 1, timestamp)
+	for _, m := range metrics {
+		b = protoBytes(b, 2, m.encode(birth, timestamp))
+	}
+	return b
+}
+
+// protoFields calls back with each field of a message, values being the
+// varint or the bytes of a length delimited field.
+func protoFields(b []byte, callback func (field int, varint uint64, data []byte)) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errMQTTPacket
+		}
+		b = b[n:]
+		field := int(key >> 3)
+		switch key & 7 {
+		case 0:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				return errMQTTPacket
+			}
+			callback(field, v, nil)
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				return errMQTTPacket
+			}
+			callback(field, binary.LittleEndian.Uint64(b), nil)
+			b = b[8:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b) - n) < l {
+				return errMQTTPacket
+			}
+			callback(field, 0, b[n:n + int(l)])
+			b = b[n + int(l):]
+		case 5:
+			if len(b) < 4 {
+				return errMQTTPacket
+			}
+			callback(field, uint64(binary.LittleEndian.Uint32(b)), nil)
+			b = b[4:]
+		default:
+			return errors.New("unsupported protobuf wire type")
+		}
+	}
+	return nil
+}
+
+// DecodeSparkplugMetrics extracts name or alias, and the value of boolean and
+// string metrics, which is all commands need.
+func DecodeSparkplugMetrics(payload []byte) ([]SparkplugMetric, error) {
+	metrics := []SparkplugMetric{}
+	var inner error
+	err := protoFields(payload, func (field int, _ uint64, data []byte) {
+		if field != 2 {
+			return
+		}
+		m := SparkplugMetric{}
+		inner = protoFields(data, func (field int, v uint64, data []byte) {
+			switch field {
+			case 1:
+				m.Name = string(data)
+			case 2:
+				m.Alias = v
+			case 4:
+				m.DataType = uint32(v)
+			case 14:
+				m.Value = v != 0
+			case 15:
+				m.Value = string(data)
+			}
+		})
+		metrics = append(metrics, m)
+	})
+	if err == nil {
+		err = inner
+	}
+	return metrics, err
+}
+
+// SparkplugNode tracks the session state Sparkplug requires: the sequence
+// number, the birth/death sequence and metric aliases.
+type SparkplugNode struct {
+	mu      sync.Mutex
+	config  SparkplugConfig
+	seq     uint64
+	bdSeq   uint64
+	aliases map[string]uint64
+	values  map[string]map[string]any
+	born    map[string]bool
+}
+
+func NewSparkplugNode(config SparkplugConfig) *SparkplugNode {
+	return &SparkplugNode{
+		config: config,
+		aliases: map[string]uint64{},
+		values: map[string]map[string]any{},
+		born: map[string]bool{},
+	}
+}
+
+func sparkplugDevice(addr string) string {
+	return strings.ReplaceAll(addr, ":", "")
+}
+
+func (sn *SparkplugNode) topic(kind string, device string) string {
+	topic := spNamespace + "/" + sn.config.GroupID + "/" + kind + "/" + sn.config.NodeID
+	if device != "" {
+		topic += "/" + device
+	}
+	return topic
+}
+
+// alias expects sn.mu to be held. Aliases are unique across the node.
+func (sn *SparkplugNode) alias(device string, name string) uint64 {
+	key := device + "/" + name
+	if a, ok := sn.aliases[key]; ok {
+		return a
+	}
+	a := uint64(spNodeAliases + len(sn.aliases) + 1)
+	sn.aliases[key] = a
+	return a
+}
+
+// nextSeq expects sn.mu to be held.
+func (sn *SparkplugNode) nextSeq() uint64 {
+	seq := sn.seq
+	sn.seq = (sn.seq + 1) % 256
+	return seq
+}
+
+func sparkplugType(v any) uint32 {
+	switch v.(type) {
+	case float64:
+		return spDouble
+	case bool:
+		return spBoolean
+	case uint64:
+		return spUInt64
+	}
+	return spString
+}
+
+// Will starts a new session and returns the NDEATH the broker should
+// publish when it drops.
+func (sn *SparkplugNode) Will() *MQTTMessage {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	sn.bdSeq = (sn.bdSeq + 1) % 256
+	payload := encodeSparkplugMetrics([]SparkplugMetric{{spBdSeq, spBdSeqAlias, spInt64, sn.bdSeq}}, true)
+	return &MQTTMessage{sn.topic("NDEATH", ""), payload, 1, false}
+}
+
+// Births returns the NBIRTH and a DBIRTH for every device, sent on connect
+// and whenever a rebirth is requested.
+func (sn *SparkplugNode) Births() []MQTTMessage {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	sn.seq = 0
+	node := []SparkplugMetric{
+		{spBdSeq, spBdSeqAlias, spInt64, sn.bdSeq},
+		{spRebirth, spRebirthAlias, spBoolean, false},
+	}
+	messages := []MQTTMessage{{sn.topic("NBIRTH", ""), EncodeSparkplug(node, sn.nextSeq(), true), 0, false}}
+	devices := []string{}
+	for device := range sn.values {
+		devices = append(devices, device)
+	}
+	sort.Strings(devices)
+	for _, device := range devices {
+		messages = append(messages, sn.birth(device))
+	}
+	return messages
+}
+
+// birth expects sn.mu to be held.
+func (sn *SparkplugNode) birth(device string) MQTTMessage {
+	names := []string{}
+	for name := range sn.values[device] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	metrics := []SparkplugMetric{}
+	for _, name := range names {
+		v := sn.values[device][name]
+		metrics = append(metrics, SparkplugMetric{name, sn.alias(device, name), sparkplugType(v), v})
+	}
+	sn.born[device] = true
+	return MQTTMessage{sn.topic("DBIRTH", device), EncodeSparkplug(metrics, sn.nextSeq(), true), 0, false}
+}
+
+// set expects sn.mu to be held, and returns the DBIRTH or DDATA to send.
+// New metrics can only be announced in a birth.
+func (sn *SparkplugNode) set(device string, name string, v any) MQTTMessage {
+	values, ok := sn.values[device]
+	if !ok {
+		values = map[string]any{}
+		sn.values[device] = values
+	}
+	_, known := values[name]
+	values[name] = v
+	if !known || !sn.born[device] {
+		return sn.birth(device)
+	}
+	metric := SparkplugMetric{name, sn.alias(device, name), sparkplugType(v), v}
+	return MQTTMessage{sn.topic("DDATA", device), EncodeSparkplug([]SparkplugMetric{metric}, sn.nextSeq(), false), 0, false}
+}
+
+// Handle maps an event to Sparkplug messages: discovered devices are born,
+// AGG averages become data, and dead sensors die until heard again.
+func (sn *SparkplugNode) Handle(l Log) []MQTTMessage {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	fields := strings.Split(l.Msg, ";")
+	switch l.Level {
+	case "DEVICE":
+		if len(fields) < 2 {
+			return nil
+		}
+		device := sparkplugDevice(fields[0])
+		if _, ok := sn.values[device]; ok {
+			return nil
+		}
+		return []MQTTMessage{sn.set(device, "Name", fields[1])}
+	case "AGG":
+		if len(fields) < 6 {
+			return nil
+		}
+		avg, err := strconv.ParseFloat(fields[5], 64)
+		if err != nil {
+			return nil
+		}
+		return []MQTTMessage{sn.set(sparkplugDevice(fields[0]), fields[1], avg)}
+	case "SENSOR_DEAD", "SENSOR_ALIVE":
+		for device := range sn.values {
+			if !strings.Contains(sparkplugDevice(l.Msg), device) {
+				continue
+			}
+			if l.Level == "SENSOR_ALIVE" {
+				return []MQTTMessage{sn.birth(device)}
+			}
+			sn.born[device] = false
+			return []MQTTMessage{{sn.topic("DDEATH", device), EncodeSparkplug(nil, sn.nextSeq(), false), 0, false}}
+		}
+	}
+	return nil
+}
+
+// Rebirth reports whether an NCMD payload asks for births to be resent,
+// naming the metric or giving its alias.
+func (sn *SparkplugNode) Rebirth(payload []byte) bool {
+	metrics, err := DecodeSparkplugMetrics(payload)
+	if err != nil {
+		return false
+	}
+	for _, m := range metrics {
+		if (m.Name == spRebirth || m.Name == "" && m.Alias == spRebirthAlias) && m.Value == true {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+// sparkplugFields decodes a payload's metrics and whether it had a
+// sequence number, with values of any type.
+func sparkplugFields(t *testing.T, payload []byte) (metrics []SparkplugMetric, seq uint64, hasSeq bool) {
+	err := protoFields(payload, func (field int, v uint64, data []byte) {
+		switch field {
+		case 2:
+			m := SparkplugMetric{}
+			err := protoFields(data, func (field int, v uint64, data []byte) {
+				switch field {
+				case 1:
+					m.Name = string(data)
+				case 2:
+					m.Alias = v
+				case 4:
+					m.DataType = uint32(v)
+				case 7:
+					m.Value = nil
+				case 11:
+					m.Value = v
+				case 13:
+					m.Value = math.Float64frombits(v)
+				case 14:
+					m.Value = v != 0
+				case 15:
+					m.Value = string(data)
+				}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			metrics = append(metrics, m)
+		case 3:
+			seq, hasSeq = v, true
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return metrics, seq, hasSeq
+}
+
+func TestEncodeSparkplug(t *testing.T) {
+	metrics := []SparkplugMetric{
+		{"temperature", 3, spDouble, 21.5},
+		{"count", 4, spUInt64, uint64(300)},
+		{"open", 5, spBoolean, true},
+		{"Name", 6, spString, "Ruuvi 1234"},
+		{"unknown", 7, spString, nil},
+	}
+	tests := []struct {
+		birth bool
+		seq   uint64
+	}{
+		{true, 0},
+		{false, 255},
+	}
+	for _, test := range tests {
+		got, seq, hasSeq := sparkplugFields(t, EncodeSparkplug(metrics, test.seq, test.birth))
+		if !hasSeq || seq != test.seq {
+			t.Errorf("seq %v (%v), want %v", seq, hasSeq, test.seq)
+		}
+		if len(got) != len(metrics) {
+			t.Fatalf("got %d metrics, want %d", len(got), len(metrics))
+		}
+		for i, m := range got {
+			want := metrics[i]
+			if !test.birth {
+				// Data messages refer to metrics by alias only.
+				want.Name = ""
+			}
+			if m != want {
+				t.Errorf("birth %v: got %+v, want %+v", test.birth, m, want)
+			}
+		}
+	}
+}
+
+func TestDecodeSparkplugMetrics(t *testing.T) {
+	payload := EncodeSparkplug([]SparkplugMetric{{spRebirth, spRebirthAlias, spBoolean, true}, {"label", 9, spString, "hello"}}, 1, true)
+	metrics, err := DecodeSparkplugMetrics(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []SparkplugMetric{{spRebirth, spRebirthAlias, spBoolean, true}, {"label", 9, spString, "hello"}}
+	if !slices.Equal(metrics, want) {
+		t.Errorf("got %+v, want %+v", metrics, want)
+	}
+	malformed := []struct {
+		name    string
+		payload []byte
+	}{
+		{"cut varint", []byte{0x08, 0x80}},
+		{"cut key", []byte{0x80}},
+		{"length past the end", []byte{0x12, 0x05, 0x01}},
+		{"cut fixed64", []byte{0x09, 0x01, 0x02}},
+		{"cut fixed32", []byte{0x0d, 0x01}},
+		{"unsupported wire type", []byte{0x0b}},
+		{"malformed metric", []byte{0x12, 0x02, 0x10, 0x80}},
+	}
+	for _, test := range malformed {
+		if _, err := DecodeSparkplugMetrics(test.payload); err == nil {
+			t.Errorf("%v: decoded without an error", test.name)
+		}
+	}
+}
+
+func TestSparkplugRebirth(t *testing.T) {
+	sn := NewSparkplugNode(SparkplugConfig{GroupID: "g", NodeID: "n"})
+	tests := []struct {
+		name    string
+		metrics []SparkplugMetric
+		want    bool
+	}{
+		{"by name", []SparkplugMetric{{spRebirth, 0, spBoolean, true}}, true},
+		{"by alias", []SparkplugMetric{{"", spRebirthAlias, spBoolean, true}}, true},
+		{"false", []SparkplugMetric{{spRebirth, 0, spBoolean, false}}, false},
+		{"other alias", []SparkplugMetric{{"", spBdSeqAlias, spBoolean, true}}, false},
+		{"other metric", []SparkplugMetric{{"Node Control/Reboot", 0, spBoolean, true}}, false},
+	}
+	for _, test := range tests {
+		payload := protoVarint(nil, 1, 0)
+		for _, m := range test.metrics {
+			payload = protoBytes(payload, 2, m.encode(m.Name != "", 0))
+		}
+		if got := sn.Rebirth(payload); got != test.want {
+			t.Errorf("%v: got %v, want %v", test.name, got, test.want)
+		}
+	}
+	if sn.Rebirth([]byte{0x12, 0x05, 0x01}) {
+		t.Errorf("a malformed payload asked for a rebirth")
+	}
+}
+
+func TestSparkplugSession(t *testing.T) {
+	sn := NewSparkplugNode(SparkplugConfig{GroupID: "g", NodeID: "n"})
+	will := sn.Will()
+	if will.Topic != "spBv1.0/g/NDEATH/n" {
+		t.Errorf("NDEATH topic %v", will.Topic)
+	}
+	death, _, hasSeq := sparkplugFields(t, will.Payload)
+	if hasSeq {
+		t.Errorf("NDEATH carries a sequence number")
+	}
+	if len(death) != 1 || death[0] != (SparkplugMetric{spBdSeq, spBdSeqAlias, spInt64, uint64(1)}) {
+		t.Errorf("NDEATH metrics %+v", death)
+	}
+
+	sn.Handle(Log{Level: "DEVICE", Msg: "AA:BB:CC:DD:EE:FF;sensor"})
+	sn.Handle(Log{Level: "AGG", Msg: "AA:BB:CC:DD:EE:FF;temperature;1m;20;22;21"})
+	data := sn.Handle(Log{Level: "AGG", Msg: "AA:BB:CC:DD:EE:FF;temperature;1m;20;22;21.5"})
+	if len(data) != 1 || data[0].Topic != "spBv1.0/g/DDATA/n/AABBCCDDEEFF" {
+		t.Fatalf("got %+v, want a DDATA", data)
+	}
+	births := sn.Births()
+	if len(births) != 2 || births[0].Topic != "spBv1.0/g/NBIRTH/n" || births[1].Topic != "spBv1.0/g/DBIRTH/n/AABBCCDDEEFF" {
+		t.Fatalf("got births %+v", births)
+	}
+	aliases := map[uint64]string{}
+	for i, birth := range births {
+		metrics, seq, hasSeq := sparkplugFields(t, birth.Payload)
+		if !hasSeq || seq != uint64(i) {
+			t.Errorf("%v has seq %v (%v), want %d", birth.Topic, seq, hasSeq, i)
+		}
+		for _, m := range metrics {
+			if other, ok := aliases[m.Alias]; ok || m.Alias == 0 {
+				t.Errorf("%v has alias %d, as does %q", m.Name, m.Alias, other)
+			}
+			aliases[m.Alias] = m.Name
+		}
+	}
+	if len(aliases) != 4 {
+		t.Errorf("got aliases %v, want bdSeq, rebirth, Name and temperature", aliases)
+	}
+
+	// The sequence number follows the births, and wraps at 256.
+	for i := 0; i < 300; i++ {
+		data := sn.Handle(Log{Level: "AGG", Msg: "AA:BB:CC:DD:EE:FF;temperature;1m;20;22;21"})
+		_, seq, _ := sparkplugFields(t, data[0].Payload)
+		if want := uint64(2 + i) % 256; seq != want {
+			t.Fatalf("DDATA %d has seq %d, want %d", i, seq, want)
+		}
+	}
+	dead := sn.Handle(Log{Level: "SENSOR_DEAD", Msg: "AA:BB:CC:DD:EE:FF;sensor"})
+	if len(dead) != 1 || dead[0].Topic != "spBv1.0/g/DDEATH/n/AABBCCDDEEFF" {
+		t.Errorf("got %+v, want a DDEATH", dead)
+	}
+	if _, _, hasSeq := sparkplugFields(t, dead[0].Payload); !hasSeq {
+		t.Errorf("DDEATH has no sequence number")
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"archive/tar"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteFile is the database of the default backend, in the data
+// directory.
+const sqliteFile = "bluboi.db"
+
+const sqliteMigrations = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+	version    integer PRIMARY KEY,
+	name       text NOT NULL,
+	applied_at text NOT NULL DEFAULT CURRENT_TIMESTAMP
+)`
+
+// SQLiteBackend keeps documents and history in a SQLite file in the data
+// directory, the default. Points are indexed by tier and time, so
+// compaction only reads what it hasn't rolled up yet.
+type SQLiteBackend struct {
+	db         *sql.DB
+	migrations []Migration
+	// imports is set when the database was created next to the files of a
+	// data directory, which are imported by the first migration.
+	imports bool
+}
+
+func OpenSQLite(path string) (*SQLiteBackend, error) {
+	migrations, err := LoadMigrations("sqlite")
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return nil, err
+	}
+	_, err = os.Stat(path)
+	created := errors.Is(err, fs.ErrNotExist)
+	_, err = os.Stat(filepath.Join(filepath.Dir(path), schemaFile))
+	imports := created && err == nil
+	// WAL lets the history be read while samples are written, and
+	// busy_timeout has writers wait for each other rather than fail.
+	db, err := sql.Open("sqlite", "file:" + filepath.ToSlash(path) + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(sqliteMigrations)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteBackend{db, migrations, imports}, nil
+}
+
+// sqliteTime is how points are timed in the database, nanoseconds since
+// the epoch.
+func sqliteTime(t time.Time) int64 {
+	if t.IsZero() {
+		return math.MinInt64
+	}
+	return t.UnixNano()
+}
+
+func (sb *SQLiteBackend) Load(name string, v any) error {
+	data := ""
+	err := sb.db.QueryRow("SELECT data FROM documents WHERE name = ?", name).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(data), v)
+}
+
+func (sb *SQLiteBackend) Save(name string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = sb.db.Exec(`INSERT INTO documents (name, data) VALUES (?, ?)
+		ON CONFLICT (name) DO UPDATE SET data = excluded.data`, name, string(data))
+	return err
+}
+
+type sqlExecer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func sqliteAppend(db sqlExecer, tier string, points []Aggregate) error {
+	for _, p := range points {
+		_, err := db.Exec(`INSERT INTO points
+			(tier, address, metric, start, resolution, min, max, avg, count, calibration)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			tier, p.Address, p.Metric, sqliteTime(p.Start), p.Window, p.Min, p.Max, p.Avg, p.Count, p.Calibration)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sb *SQLiteBackend) Append(tier string, points []Aggregate) error {
+	tx, err := sb.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = sqliteAppend(tx, tier, points)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (sb *SQLiteBackend) Scan(tier string, since time.Time, callback func (Aggregate)) error {
+	rows, err := sb.db.Query(`SELECT address, metric, start, resolution, min, max, avg, count, calibration
+		FROM points WHERE tier = ? AND start >= ? ORDER BY start`, tier, sqliteTime(since))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		p := Aggregate{}
+		start := int64(0)
+		err := rows.Scan(&p.Address, &p.Metric, &start, &p.Window, &p.Min, &p.Max, &p.Avg, &p.Count, &p.Calibration)
+		if err != nil {
+			return err
+		}
+		p.Start = time.Unix(0, start).UTC()
+		callback(p)
+	}
+	return rows.Err()
+}
+
+func (sb *SQLiteBackend) Prune(tier string, before time.Time) error {
+	_, err := sb.db.Exec("DELETE FROM points WHERE tier = ? AND start < ?", tier, sqliteTime(before))
+	return err
+}
+
+func (sb *SQLiteBackend) Migrations() []Migration {
+	return sb.migrations
+}
+
+func (sb *SQLiteBackend) SchemaVersion() (int, error) {
+	version := 0
+	err := sb.db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	return version, err
+}
+
+// ApplyMigration runs a migration and records it in one transaction, so a
+// failing script leaves the schema as it was. The first one also imports
+// the data directory kept as files before, if any.
+func (sb *SQLiteBackend) ApplyMigration(m Migration, up bool) error {
+	tx, err := sb.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if up {
+		_, err = tx.Exec(m.Up)
+		if err == nil && m.Version == 1 && sb.imports {
+			err = importDataDir(tx)
+		}
+		if err == nil {
+			_, err = tx.Exec("INSERT INTO schema_migrations (version, name) VALUES (?, ?)", m.Version, m.Name)
+		}
+	} else {
+		_, err = tx.Exec(m.Down)
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM schema_migrations WHERE version = ?", m.Version)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err == nil && up && m.Version == 1 {
+		sb.imports = false
+	}
+	return err
+}
+
+// importDataDir copies the documents and history of a data directory kept
+// as files into the database, leaving the files as they are.
+func importDataDir(tx *sql.Tx) error {
+	entries, err := os.ReadDir(DataDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") || entry.Name() == schemaFile {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(DataDir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		if !json.Valid(data) {
+			return errors.New(entry.Name() + " is not valid JSON")
+		}
+		_, err = tx.Exec("INSERT INTO documents (name, data) VALUES (?, ?)", entry.Name(), string(data))
+		if err != nil {
+			return err
+		}
+	}
+	// Schema 1 of the data directory kept a file per tier, schema 2 a
+	// directory of segments.
+	fb := &FileBackend{}
+	root := filepath.Join(DataDir, historyDir)
+	entries, err = os.ReadDir(root)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		points := []Aggregate{}
+		collect := func (p Aggregate) { points = append(points, p) }
+		tier, file := strings.CutSuffix(entry.Name(), ".jsonl")
+		switch {
+		case entry.IsDir() && !strings.HasSuffix(tier, ".tmp"):
+			err = fb.Scan(tier, time.Time{}, collect)
+		case file && !entry.IsDir():
+			err = scanFile(filepath.Join(root, entry.Name()), collect)
+		}
+		if err == nil {
+			err = sqliteAppend(tx, tier, points)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Snapshot writes a consistent copy of the database under data/, where
+// the copy in the data directory, which Snapshot skips, would be.
+func (sb *SQLiteBackend) Snapshot(tw *tar.Writer) error {
+	dir, err := os.MkdirTemp("", "bluboi-snapshot-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, sqliteFile)
+	_, err = sb.db.Exec("VACUUM INTO ?", path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return writeTarFile(tw, "data/" + sqliteFile, data)
+}
+
+// Restore has nothing to do, the database is restored with the data
+// directory.
+func (sb *SQLiteBackend) Restore(name string, r io.Reader) error {
+	return nil
+}
+
+func (sb *SQLiteBackend) Close() error {
+	return sb.db.Close()
+}
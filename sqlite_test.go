@@ -0,0 +1,146 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// useSQLite opens a SQLite backend in a fresh data directory, after
+// setup has put files in it.
+func useSQLite(t *testing.T, setup func ()) *SQLiteBackend {
+	dataDir, store := DataDir, Store
+	log.SetOutput(io.Discard)
+	t.Cleanup(func () {
+		Store.Close()
+		DataDir, Store = dataDir, store
+		log.SetOutput(os.Stderr)
+	})
+	DataDir = t.TempDir()
+	if setup != nil {
+		setup()
+	}
+	if err := OpenStore("sqlite"); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckSchema(); err != nil {
+		t.Fatal(err)
+	}
+	return Store.(*SQLiteBackend)
+}
+
+func TestSQLiteBackend(t *testing.T) {
+	sb := useSQLite(t, nil)
+	doc := map[string]int{}
+	if err := sb.Load("missing.json", &doc); err != nil || len(doc) != 0 {
+		t.Fatalf("loading a missing document: %v, %v", doc, err)
+	}
+	if err := sb.Save("doc.json", map[string]int{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sb.Save("doc.json", map[string]int{"a": 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sb.Load("doc.json", &doc); err != nil || doc["a"] != 2 {
+		t.Fatalf("got %v, %v, want the document saved last", doc, err)
+	}
+
+	base := time.Date(2026, 10, 14, 6, 30, 0, 0, time.UTC)
+	points := []Aggregate{}
+	for i := 0; i < 4; i++ {
+		points = append(points, Aggregate{Address: "AA", Metric: "rssi", Start: base.Add(time.Duration(i) * time.Hour), Window: "0s", Min: -1, Max: 1, Avg: float64(i), Count: 1, Calibration: 2})
+	}
+	points[1], points[2] = points[2], points[1]
+	if err := sb.Append("raw", points); err != nil {
+		t.Fatal(err)
+	}
+	sb.Append("minute", []Aggregate{{Address: "AA", Metric: "rssi", Start: base, Window: "1m0s", Avg: 10}})
+	scan := func (since time.Time) []Aggregate {
+		got := []Aggregate{}
+		if err := sb.Scan("raw", since, func (p Aggregate) { got = append(got, p) }); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+	all := scan(time.Time{})
+	if len(all) != 4 {
+		t.Fatalf("got %d points, want 4", len(all))
+	}
+	for i, p := range all {
+		if !p.Start.Equal(base.Add(time.Duration(i) * time.Hour)) || p.Avg != float64(i) || p.Min != -1 || p.Max != 1 || p.Count != 1 || p.Calibration != 2 || p.Window != "0s" || p.Address != "AA" || p.Metric != "rssi" {
+			t.Errorf("point %d is %+v", i, p)
+		}
+	}
+	if got := scan(base.Add(90 * time.Minute)); len(got) != 2 || got[0].Avg != 2 {
+		t.Errorf("since 08:00 got %+v, want the last 2", got)
+	}
+	if err := sb.Prune("raw", base.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if got := scan(time.Time{}); len(got) != 3 || got[0].Avg != 1 {
+		t.Errorf("after pruning got %+v, want the last 3", got)
+	}
+	minute := 0
+	sb.Scan("minute", time.Time{}, func (p Aggregate) { minute++ })
+	if minute != 1 {
+		t.Errorf("pruning raw left %d minute points, want 1", minute)
+	}
+}
+
+func TestSQLiteImportsDataDir(t *testing.T) {
+	base := time.Date(2026, 10, 14, 6, 30, 0, 0, time.UTC)
+	sb := useSQLite(t, func () {
+		fb := &FileBackend{}
+		fb.Save(schemaFile, fileSchema{2})
+		fb.Save("known.json", map[string]string{"AA": "sensor"})
+		fb.Append("raw", []Aggregate{{Address: "AA", Metric: "rssi", Start: base, Window: "0s", Avg: 1, Count: 1}})
+		// Schema 1 kept tiers as one file each.
+		os.WriteFile(filepath.Join(DataDir, historyDir, "minute.jsonl"), []byte(`{"Address":"AA","Metric":"rssi","Start":"2026-10-14T06:30:00Z","Window":"1m0s","Avg":2,"Count":1}` + "\n"), 0o644)
+	})
+	known := map[string]string{}
+	if err := sb.Load("known.json", &known); err != nil || known["AA"] != "sensor" {
+		t.Errorf("got %v, %v, want known.json imported", known, err)
+	}
+	schema := fileSchema{}
+	sb.Load(schemaFile, &schema)
+	if schema.Version != 0 {
+		t.Errorf("schema.json was imported")
+	}
+	for tier, avg := range map[string]float64{"raw": 1, "minute": 2} {
+		got := []float64{}
+		sb.Scan(tier, time.Time{}, func (p Aggregate) { got = append(got, p.Avg) })
+		if !slices.Equal(got, []float64{avg}) {
+			t.Errorf("%v: got %v, want %v", tier, got, avg)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(DataDir, "known.json")); err != nil {
+		t.Errorf("the imported files were removed")
+	}
+}
+
+func TestSQLiteDoesNotImportAgain(t *testing.T) {
+	sb := useSQLite(t, func () {
+		(&FileBackend{}).Save(schemaFile, fileSchema{2})
+		(&FileBackend{}).Save("known.json", map[string]string{"AA": "old"})
+	})
+	sb.Save("known.json", map[string]string{"AA": "new"})
+	sb.Close()
+	if err := OpenStore("sqlite"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Migrate(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckSchema(); err != nil {
+		t.Fatal(err)
+	}
+	known := map[string]string{}
+	Store.Load("known.json", &known)
+	if len(known) != 0 {
+		t.Errorf("got %v, want the files left alone once imported", known)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// changesKept is how many events at least are kept for clients catching up
+// with /state/changes instead of fetching the whole state again.
+const changesKept = 1024
+
+// StateVersion counts the events broadcast so far. Every event carries the
+// version it bumped the state to, so a client seeing a gap knows it missed
+// something and should fetch /state again.
+var StateVersion atomic.Uint64
+
+// SafeChanges keeps the latest events broadcast, in version order.
+type SafeChanges struct {
+	mu     sync.Mutex
+	events []Log
+}
+
+var Changes = SafeChanges{}
+
+func (sc *SafeChanges) Record(l Log) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	// Trimming only once twice as many are kept saves shifting them every
+	// time.
+	if len(sc.events) >= changesKept * 2 {
+		sc.events = append(sc.events[:0], sc.events[len(sc.events) - changesKept:]...)
+	}
+	sc.events = append(sc.events, l)
+}
+
+// Since returns the events after version, with only the latest DEVICE
+// event of each device since those replace each other, and the version
+// they bring a client to. ok is false when events after version have been
+// dropped already, or version is from before a restart.
+func (sc *SafeChanges) Since(version uint64) (StateChanges, bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	// Events are kept before being dispatched, so any version a client has
+	// seen is here unless dropped.
+	changes := StateChanges{Version: version, Events: []Log{}}
+	if len(sc.events) > 0 {
+		changes.Version = sc.events[len(sc.events) - 1].Version
+	}
+	if version > changes.Version || version < changes.Version && sc.events[0].Version > version + 1 {
+		return StateChanges{}, false
+	}
+	latest := map[string]uint64{}
+	for _, l := range sc.events {
+		if l.Level == "DEVICE" {
+			latest[presenceAddress(l)] = l.Version
+		}
+	}
+	for _, l := range sc.events {
+		if l.Version <= version || l.Level == "DEVICE" && latest[presenceAddress(l)] != l.Version {
+			continue
+		}
+		changes.Events = append(changes.Events, l)
+	}
+	return changes, true
+}
+
+// StateChanges is what happened since the version a client had.
+type StateChanges struct {
+	Version uint64
+	Events  []Log
+}
+
+type Operations struct {
+	Scanning    bool
+	Connecting  bool
+	Connections int
+	Wedge       bool
+	Serial      string `json:",omitempty"`
+	Bridges     []BridgeConfig
+	Latencies   map[string]LatencySummary
+}
+
+// State is everything the UI renders. Version is read before the rest, so
+// the snapshot includes at least every event up to it; replaying later
+// events on top of it is safe since applying them is idempotent.
+type State struct {
+	Version    uint64
+	Connection ConnectionStatus
+	Operations Operations
+	Devices    []DeviceListing
+}
+
+func (sw *SafeWedge) Running() bool {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.char != nil
+}
+
+// Link is the PTY the serial bridge is running on, or "" when it isn't.
+func (ss *SafeSerial) Link() string {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.link
+}
+
+func CurrentState() State {
+	return State{
+		Version: StateVersion.Load(),
+		Connection: CurrentConnection(),
+		Operations: Operations{
+			Scanning: Adapter.scanning.Load(),
+			Connecting: Adapter.Attempts() > 0,
+			Connections: len(Adapter.Addresses()),
+			Wedge: Wedge.Running(),
+			Serial: Serial.Link(),
+			Bridges: Bridges.List(),
+			Latencies: Latencies.Summaries(),
+		},
+		Devices: Presence.Listing(),
+	}
+}
+
+func StateHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		json.NewEncoder(w).Encode(CurrentState())
+	}
+}
+
+// StateChangesHandler serves the events after the since query parameter,
+// so a client that was briefly offline can catch up without fetching all of
+// /state. It answers 410 when that's too far back, and then /state has to be
+// fetched.
+func StateChangesHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		since, err := strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+		if err != nil {
+			http.Error(w, "since must be the version to catch up from", http.StatusBadRequest)
+			return
+		}
+		changes, ok := Changes.Since(since)
+		if !ok {
+			http.Error(w, "too far behind, fetch /state instead", http.StatusGone)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		json.NewEncoder(w).Encode(changes)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// QueueDepth is how many items wait in a queue, out of how many it holds.
+type QueueDepth struct {
+	Length   int
+	Capacity int
+}
+
+type AdapterStatus struct {
+	Address    string `json:",omitempty"`
+	Present    bool
+	Detached   bool
+	PoweredOff bool
+	ScanMode   string
+	Scanning   bool
+	Resets     int64
+}
+
+// AdapterDetails is who the local adapter is and what it can do, for
+// telling adapters apart on hosts with several. Capabilities lists le when
+// it has BLE roles and bredr when it has a class of device, ie. classic
+// Bluetooth.
+type AdapterDetails struct {
+	ID           string
+	Address      string   `json:",omitempty"`
+	AddressType  string   `json:",omitempty"`
+	Name         string   `json:",omitempty"`
+	Alias        string   `json:",omitempty"`
+	Class        uint32   `json:",omitempty"`
+	Modalias     string   `json:",omitempty"`
+	Powered      bool
+	Discoverable bool
+	Pairable     bool
+	Discovering  bool
+	Roles        []string `json:",omitempty"`
+	UUIDs        []string `json:",omitempty"`
+	Capabilities []string
+}
+
+// Queues are the queues events wait in: commands for the adapter, events
+// to broadcast, and events for each sink, full ones dropping events.
+type Queues struct {
+	Events QueueDepth
+	Logs   QueueDepth
+	Sinks  map[string]QueueDepth
+}
+
+// Status is what the gateway is doing right now, for clients that just
+// (re)loaded.
+type Status struct {
+	Adapter    AdapterStatus
+	Connecting int
+	Connected  []ConnectionStatus
+	Queues     Queues
+}
+
+func CurrentStatus() Status {
+	status := Status{
+		Adapter: AdapterStatus{
+			Detached: Adapter.detached.Load(),
+			PoweredOff: Adapter.poweredOff.Load(),
+			ScanMode: Adapter.ScanMode(),
+			Scanning: Adapter.scanning.Load(),
+			Resets: AdapterResets.Load(),
+		},
+		Connecting: Adapter.Attempts(),
+		Connected: Connections(),
+		Queues: Queues{
+			Events: QueueDepth{len(EventQueue), cap(EventQueue)},
+			Logs: QueueDepth{len(Logs), cap(Logs)},
+			Sinks: Sinks.Queues(),
+		},
+	}
+	addr, err := adapterAddress()
+	status.Adapter.Present = err == nil && !status.Adapter.Detached
+	status.Adapter.Address = addr
+	return status
+}
+
+// StatusHandler tells what the adapter is doing, what's connected and how
+// full the queues are.
+func StatusHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		json.NewEncoder(w).Encode(CurrentStatus())
+	}
+}
+
+func AdapterHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		details, err := adapterDetails()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(details)
+	}
+}
+
+// AdapterPowerHandler powers the adapter on, or off.
+func AdapterPowerHandler(on bool) http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		power := Adapter.PowerOff
+		if on {
+			power = Adapter.PowerOn
+		}
+		err := power()
+		if errors.Is(err, errAdapterUnavailable) {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(200)
+	}
+}
+
+func ListAdaptersHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		adapters, err := listAdapters()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(adapters)
+	}
+}
+
+// SelectAdapterHandler switches to another adapter and keeps using it after
+// restarts, unless -adapter says otherwise.
+func SelectAdapterHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		err := Adapter.Switch(id)
+		if errors.Is(err, errAdapterUnavailable) {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = Setup.SetAdapter(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(200)
+	}
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DataDir is where bluboi keeps its local files: keys, the audit log and,
+// with the default backend, its state and telemetry history.
+var DataDir = defaultDataDir()
+
+func defaultDataDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "."
+	}
+	return filepath.Join(dir, "bluboi")
+}
+
+// Backend persists bluboi's state, one JSON document per subsystem, and the
+// telemetry history, a series of Aggregate points per retention tier.
+type Backend interface {
+	Load(name string, v any) error
+	Save(name string, v any) error
+	Append(tier string, points []Aggregate) error
+	Scan(tier string, since time.Time, callback func (Aggregate)) error
+	Prune(tier string, before time.Time) error
+	Migrations() []Migration
+	SchemaVersion() (int, error)
+	ApplyMigration(m Migration, up bool) error
+	Snapshot(tw *tar.Writer) error
+	Restore(name string, r io.Reader) error
+	Close() error
+}
+
+// LocalStore tells whether a -db value keeps everything in the data
+// directory.
+func LocalStore(db string) bool {
+	return db == "" || db == "sqlite" || db == "file"
+}
+
+// Store is the backend selected with -db.
+var Store Backend = &FileBackend{}
+
+// OpenStore selects the backend for a -db value: empty or "sqlite" for a
+// SQLite database in the data directory, "file" for JSON files in it, or a
+// postgres:// URL.
+func OpenStore(db string) error {
+	switch {
+	case db == "" || db == "sqlite":
+		backend, err := OpenSQLite(filepath.Join(DataDir, sqliteFile))
+		if err != nil {
+			return err
+		}
+		Store = backend
+		return nil
+	case db == "file":
+		Store = &FileBackend{}
+		return nil
+	case strings.HasPrefix(db, "postgres://") || strings.HasPrefix(db, "postgresql://"):
+		backend, err := OpenPostgres(db)
+		if err != nil {
+			return err
+		}
+		Store = backend
+		return nil
+	}
+	return errors.New("unsupported database " + db)
+}
+
+// LoadJSON reads the named document into v. A missing document leaves v
+// untouched.
+func LoadJSON(name string, v any) error {
+	return Store.Load(name, v)
+}
+
+// SaveJSON replaces the named document with v.
+func SaveJSON(name string, v any) error {
+	Quiesce.RLock()
+	defer Quiesce.RUnlock()
+	return Store.Save(name, v)
+}
+
+const (
+	historyDir = "history"
+	schemaFile = "schema.json"
+)
+
+// fileMigrations versions the data directory layout. Its changes are made by
+// code rather than scripts, so these only record the version.
+var fileMigrations = []Migration{
+	{Version: 1, Name: "init"},
+	{Version: 2, Name: "segment_history"},
+}
+
+type fileSchema struct {
+	Version int
+}
+
+// Tier files are split into segments by the time of their points, a day
+// long for points of an hour or more and an hour long for finer ones,
+// so scanning since a recent time or pruning only opens the segments
+// concerned.
+const (
+	hourSegment = "2006-01-02T15"
+	daySegment  = "2006-01-02"
+)
+
+// FileBackend keeps documents as JSON files in DataDir, and history tiers
+// as JSON lines segments under DataDir/history/<tier>.
+type FileBackend struct {
+	mu sync.RWMutex
+}
+
+func (fb *FileBackend) Load(name string, v any) error {
+	data, err := os.ReadFile(filepath.Join(DataDir, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Save atomically replaces the file.
+func (fb *FileBackend) Save(name string, v any) error {
+	data, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(DataDir, 0o755)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(DataDir, name)
+	err = os.WriteFile(path + ".tmp", data, 0o644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path + ".tmp", path)
+}
+
+func (fb *FileBackend) dir(tier string) string {
+	return filepath.Join(DataDir, historyDir, tier)
+}
+
+// segment names the file a point is stored in.
+func segment(p Aggregate) string {
+	window, _ := time.ParseDuration(p.Window)
+	if window >= time.Hour {
+		return p.Start.UTC().Format(daySegment) + ".jsonl"
+	}
+	return p.Start.UTC().Format(hourSegment) + ".jsonl"
+}
+
+type tierSegment struct {
+	path  string
+	start time.Time
+	end   time.Time
+}
+
+// segments lists the segments of a tier, oldest first.
+func (fb *FileBackend) segments(dir string) ([]tierSegment, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	segments := []tierSegment{}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".jsonl")
+		if !ok {
+			continue
+		}
+		if start, err := time.Parse(hourSegment, name); err == nil {
+			segments = append(segments, tierSegment{filepath.Join(dir, entry.Name()), start, start.Add(time.Hour)})
+		} else if start, err := time.Parse(daySegment, name); err == nil {
+			segments = append(segments, tierSegment{filepath.Join(dir, entry.Name()), start, start.AddDate(0, 0, 1)})
+		}
+	}
+	sort.Slice(segments, func (i, j int) bool { return segments[i].start.Before(segments[j].start) })
+	return segments, nil
+}
+
+// appendTo appends points to the segments of dir, expecting fb.mu to be
+// held.
+func (fb *FileBackend) appendTo(dir string, points []Aggregate) error {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return err
+	}
+	bySegment := map[string][]Aggregate{}
+	order := []string{}
+	for _, p := range points {
+		name := segment(p)
+		if _, ok := bySegment[name]; !ok {
+			order = append(order, name)
+		}
+		bySegment[name] = append(bySegment[name], p)
+	}
+	for _, name := range order {
+		f, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			return err
+		}
+		w := bufio.NewWriter(f)
+		for _, p := range bySegment[name] {
+			line, _ := json.Marshal(p)
+			w.Write(append(line, '\n'))
+		}
+		err = w.Flush()
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fb *FileBackend) Append(tier string, points []Aggregate) error {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	return fb.appendTo(fb.dir(tier), points)
+}
+
+func scanFile(path string, callback func (Aggregate)) error {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		p := Aggregate{}
+		if json.Unmarshal(s.Bytes(), &p) == nil {
+			callback(p)
+		}
+	}
+	return s.Err()
+}
+
+// Scan skips the segments ending before since, and only holds fb.mu while
+// reading one segment so appends don't wait for a whole tier to be read.
+func (fb *FileBackend) Scan(tier string, since time.Time, callback func (Aggregate)) error {
+	fb.mu.RLock()
+	segments, err := fb.segments(fb.dir(tier))
+	fb.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	for _, seg := range segments {
+		if !seg.end.After(since) {
+			continue
+		}
+		points := []Aggregate{}
+		fb.mu.RLock()
+		err := scanFile(seg.path, func (p Aggregate) {
+			if !p.Start.Before(since) {
+				points = append(points, p)
+			}
+		})
+		fb.mu.RUnlock()
+		if err != nil {
+			return err
+		}
+		for _, p := range points {
+			callback(p)
+		}
+	}
+	return nil
+}
+
+// Prune removes the segments ending before before, and rewrites the one
+// before falls in without the points older than it.
+func (fb *FileBackend) Prune(tier string, before time.Time) error {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	segments, err := fb.segments(fb.dir(tier))
+	if err != nil {
+		return err
+	}
+	for _, seg := range segments {
+		if !seg.end.After(before) {
+			err = os.Remove(seg.path)
+		} else if seg.start.Before(before) {
+			err = pruneFile(seg.path, before)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneFile rewrites a segment without the points older than before,
+// leaving it alone when there are none.
+func pruneFile(path string, before time.Time) error {
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	dropped := 0
+	err = scanFile(path, func (p Aggregate) {
+		if p.Start.Before(before) {
+			dropped++
+			return
+		}
+		line, _ := json.Marshal(p)
+		w.Write(append(line, '\n'))
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	f.Close()
+	if err != nil || dropped == 0 {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	return os.Rename(path + ".tmp", path)
+}
+
+// segmentHistory splits the tier files of schema 1, history/<tier>.jsonl,
+// into segments. They are written to history/<tier>.tmp first so a
+// migration cut short can run again without duplicating points.
+func (fb *FileBackend) segmentHistory() error {
+	root := filepath.Join(DataDir, historyDir)
+	entries, err := os.ReadDir(root)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		tier, ok := strings.CutSuffix(entry.Name(), ".jsonl")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		file, dir := filepath.Join(root, entry.Name()), filepath.Join(root, tier)
+		if _, err := os.Stat(dir); err != nil {
+			os.RemoveAll(dir + ".tmp")
+			points := []Aggregate{}
+			err = scanFile(file, func (p Aggregate) { points = append(points, p) })
+			if err == nil {
+				err = fb.appendTo(dir + ".tmp", points)
+			}
+			if err == nil {
+				err = os.Rename(dir + ".tmp", dir)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		err = os.Remove(file)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// joinHistory puts the segments of every tier back into one file, as
+// schema 1 keeps them.
+func (fb *FileBackend) joinHistory() error {
+	root := filepath.Join(DataDir, historyDir)
+	entries, err := os.ReadDir(root)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasSuffix(entry.Name(), ".tmp") {
+			continue
+		}
+		dir, file := filepath.Join(root, entry.Name()), filepath.Join(root, entry.Name() + ".jsonl")
+		if _, err := os.Stat(file); err != nil {
+			segments, err := fb.segments(dir)
+			if err != nil {
+				return err
+			}
+			f, err := os.Create(file + ".tmp")
+			if err != nil {
+				return err
+			}
+			w := bufio.NewWriter(f)
+			for _, seg := range segments {
+				if err == nil {
+					err = scanFile(seg.path, func (p Aggregate) {
+						line, _ := json.Marshal(p)
+						w.Write(append(line, '\n'))
+					})
+				}
+			}
+			if err == nil {
+				err = w.Flush()
+			}
+			f.Close()
+			if err == nil {
+				err = os.Rename(file + ".tmp", file)
+			}
+			if err != nil {
+				os.Remove(file + ".tmp")
+				return err
+			}
+		}
+		err = os.RemoveAll(dir)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fb *FileBackend) Migrations() []Migration {
+	return fileMigrations
+}
+
+func (fb *FileBackend) SchemaVersion() (int, error) {
+	schema := fileSchema{}
+	err := fb.Load(schemaFile, &schema)
+	return schema.Version, err
+}
+
+func (fb *FileBackend) ApplyMigration(m Migration, up bool) error {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	version := m.Version
+	var err error
+	switch {
+	case m.Version == 2 && up:
+		err = fb.segmentHistory()
+	case m.Version == 2:
+		err = fb.joinHistory()
+	}
+	if err != nil {
+		return err
+	}
+	if !up {
+		version--
+	}
+	return fb.Save(schemaFile, fileSchema{version})
+}
+
+// Snapshot has nothing to add, the files are snapshotted with the rest of
+// the data directory.
+func (fb *FileBackend) Snapshot(tw *tar.Writer) error {
+	return nil
+}
+
+func (fb *FileBackend) Restore(name string, r io.Reader) error {
+	return nil
+}
+
+func (fb *FileBackend) Close() error {
+	return nil
+}
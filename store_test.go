@@ -0,0 +1,149 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// useDataDir points DataDir and Store at a fresh file backend for the
+// test.
+func useDataDir(t *testing.T) *FileBackend {
+	dataDir, store := DataDir, Store
+	t.Cleanup(func () {
+		DataDir, Store = dataDir, store
+	})
+	DataDir = t.TempDir()
+	fb := &FileBackend{}
+	Store = fb
+	return fb
+}
+
+func segmentNames(t *testing.T, tier string) []string {
+	entries, err := os.ReadDir(filepath.Join(DataDir, historyDir, tier))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func TestFileBackendSegments(t *testing.T) {
+	fb := useDataDir(t)
+	base := time.Date(2026, 10, 14, 6, 30, 0, 0, time.UTC)
+	raw := []Aggregate{}
+	for i := 0; i < 6; i++ {
+		raw = append(raw, Aggregate{Address: "AA", Metric: "rssi", Start: base.Add(time.Duration(i) * 30 * time.Minute), Window: "0s", Avg: float64(i), Count: 1})
+	}
+	hourly := []Aggregate{
+		{Address: "AA", Metric: "rssi", Start: base.Truncate(time.Hour), Window: "1h0m0s", Count: 1},
+		{Address: "AA", Metric: "rssi", Start: base.AddDate(0, 0, 1).Truncate(time.Hour), Window: "1h0m0s", Count: 1},
+	}
+	if err := fb.Append("raw", raw[:3]); err != nil {
+		t.Fatal(err)
+	}
+	if err := fb.Append("raw", raw[3:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := fb.Append("hourly", hourly); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := segmentNames(t, "raw"), []string{"2026-10-14T06.jsonl", "2026-10-14T07.jsonl", "2026-10-14T08.jsonl", "2026-10-14T09.jsonl"}; !slices.Equal(got, want) {
+		t.Errorf("raw segments %v, want %v", got, want)
+	}
+	if got, want := segmentNames(t, "hourly"), []string{"2026-10-14.jsonl", "2026-10-15.jsonl"}; !slices.Equal(got, want) {
+		t.Errorf("hourly segments %v, want %v", got, want)
+	}
+
+	tests := []struct {
+		since time.Time
+		want  []float64
+	}{
+		{time.Time{}, []float64{0, 1, 2, 3, 4, 5}},
+		{base.Add(time.Hour), []float64{2, 3, 4, 5}},
+		{base.Add(time.Hour + time.Minute), []float64{3, 4, 5}},
+		{base.Add(4 * time.Hour), []float64{}},
+	}
+	for _, test := range tests {
+		got := []float64{}
+		err := fb.Scan("raw", test.since, func (p Aggregate) { got = append(got, p.Avg) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("since %v: got %v, want %v", test.since, got, test.want)
+		}
+	}
+
+	// The first segment goes whole, the one before falls in is rewritten.
+	if err := fb.Prune("raw", base.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := segmentNames(t, "raw"), []string{"2026-10-14T07.jsonl", "2026-10-14T08.jsonl", "2026-10-14T09.jsonl"}; !slices.Equal(got, want) {
+		t.Errorf("pruned segments %v, want %v", got, want)
+	}
+	got := []float64{}
+	fb.Scan("raw", time.Time{}, func (p Aggregate) { got = append(got, p.Avg) })
+	if want := []float64{2, 3, 4, 5}; !slices.Equal(got, want) {
+		t.Errorf("after pruning got %v, want %v", got, want)
+	}
+}
+
+func TestFileBackendSegmentMigration(t *testing.T) {
+	fb := useDataDir(t)
+	base := time.Date(2026, 10, 14, 6, 30, 0, 0, time.UTC)
+	root := filepath.Join(DataDir, historyDir)
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	lines := ""
+	for i := 0; i < 4; i++ {
+		lines += `{"Address":"AA","Metric":"rssi","Start":"` + base.Add(time.Duration(i) * time.Hour).Format(time.RFC3339) + `","Window":"0s","Avg":` + strconv.Itoa(i) + `,"Count":1}` + "\n"
+	}
+	if err := os.WriteFile(filepath.Join(root, "raw.jsonl"), []byte(lines), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fb.Save(schemaFile, fileSchema{1})
+	if err := Migrate(2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "raw.jsonl")); err == nil {
+		t.Errorf("raw.jsonl was left behind")
+	}
+	if got := segmentNames(t, "raw"); len(got) != 4 {
+		t.Errorf("got segments %v, want 4", got)
+	}
+	scan := func () []float64 {
+		got := []float64{}
+		if err := fb.Scan("raw", time.Time{}, func (p Aggregate) { got = append(got, p.Avg) }); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+	if got, want := scan(), []float64{0, 1, 2, 3}; !slices.Equal(got, want) {
+		t.Errorf("after migrating got %v, want %v", got, want)
+	}
+
+	if err := Migrate(1); err != nil {
+		t.Fatal(err)
+	}
+	points := []float64{}
+	if err := scanFile(filepath.Join(root, "raw.jsonl"), func (p Aggregate) { points = append(points, p.Avg) }); err != nil {
+		t.Fatal(err)
+	}
+	if want := []float64{0, 1, 2, 3}; !slices.Equal(points, want) {
+		t.Errorf("after reverting got %v, want %v", points, want)
+	}
+	if _, err := os.Stat(filepath.Join(root, "raw")); err == nil {
+		t.Errorf("segments were left behind")
+	}
+	if version, _ := fb.SchemaVersion(); version != 1 {
+		t.Errorf("schema version %d, want 1", version)
+	}
+}
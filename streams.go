@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// SafeDeviceStreams routes events to the clients following a single device,
+// by upper case address.
+type SafeDeviceStreams struct {
+	mu      sync.Mutex
+	next    uint32
+	streams map[string]map[uint32]chan Log
+}
+
+var DeviceStreams = SafeDeviceStreams{streams: map[string]map[uint32]chan Log{}}
+
+// logAddress finds the device an event is about: the first field of
+// address;... events, or else the first address in the message.
+func logAddress(l Log) string {
+	if first, _, ok := strings.Cut(l.Msg, ";"); ok && first != "" && !strings.Contains(first, " ") {
+		return strings.ToUpper(first)
+	}
+	for _, token := range strings.FieldsFunc(l.Msg, func (r rune) bool { return r == ' ' || r == '(' || r == ')' }) {
+		if _, err := net.ParseMAC(token); err == nil && strings.Count(token, ":") == 5 {
+			return strings.ToUpper(token)
+		}
+	}
+	return ""
+}
+
+func (sd *SafeDeviceStreams) Open(addr string) (uint32, <-chan Log) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	addr = strings.ToUpper(addr)
+	if sd.streams[addr] == nil {
+		sd.streams[addr] = map[uint32]chan Log{}
+	}
+	sd.next++
+	ch := make(chan Log, 100)
+	sd.streams[addr][sd.next] = ch
+	return sd.next, ch
+}
+
+func (sd *SafeDeviceStreams) Close(addr string, id uint32) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	addr = strings.ToUpper(addr)
+	delete(sd.streams[addr], id)
+	if len(sd.streams[addr]) == 0 {
+		delete(sd.streams, addr)
+	}
+}
+
+// Publish delivers an event to the clients following addr. Slow clients
+// lose events rather than holding up the others.
+func (sd *SafeDeviceStreams) Publish(addr string, l Log) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	for _, ch := range sd.streams[strings.ToUpper(addr)] {
+		select {
+		case ch <- l:
+		default:
+		}
+	}
+}
+
+// Route publishes an event to the clients following the device it is about.
+func (sd *SafeDeviceStreams) Route(l Log) {
+	if addr := logAddress(l); addr != "" {
+		sd.Publish(addr, l)
+	}
+}
+
+// PublishRSSI sends a scanned RSSI to the clients following the device as an
+// RSSI event (address;rssi). It's too frequent for the global stream.
+func (sd *SafeDeviceStreams) PublishRSSI(addr string, rssi int16) {
+	sd.mu.Lock()
+	followed := len(sd.streams[strings.ToUpper(addr)]) > 0
+	sd.mu.Unlock()
+	if followed {
+		sd.Publish(addr, Log{Level: "RSSI", Msg: addr + ";" + strconv.Itoa(int(rssi))})
+	}
+}
+
+// DeviceEventsHandler streams the events about one device.
+func DeviceEventsHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		addr := mux.Vars(r)["addr"]
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		id, events := DeviceStreams.Open(addr)
+		defer DeviceStreams.Close(addr, id)
+		flusher, _ := w.(http.Flusher)
+		if Devices.Exists(strings.ToUpper(addr)) {
+			device := Devices.Device(strings.ToUpper(addr))
+			w.Write(LogToSSE(&Log{Level: "DEVICE", Msg: strings.Join(device.DeviceInfo(), ";")}))
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		ticker := time.NewTicker(sseFlushEvery)
+		defer ticker.Stop()
+		dirty := false
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case l := <-events:
+				_, err := w.Write(LogToSSE(&l))
+				if err != nil {
+					return
+				}
+				dirty = true
+			case <-ticker.C:
+				if dirty && flusher != nil {
+					flusher.Flush()
+				}
+				dirty = false
+			}
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"tinygo.org/x/bluetooth"
+)
+
+// SafeSubscriptions holds the characteristics of connected devices whose
+// notifications are logged as NOTIFY events (address;uuid;hex), by upper
+// case address and lower case UUID.
+type SafeSubscriptions struct {
+	mu    sync.Mutex
+	chars map[string]map[string]*bluetooth.DeviceCharacteristic
+}
+
+var Subscriptions = SafeSubscriptions{chars: map[string]map[string]*bluetooth.DeviceCharacteristic{}}
+
+var errNotSubscribed = errors.New("not subscribed to that characteristic")
+
+// LogNotification raises the NOTIFY event for a value received from a
+// device.
+func LogNotification(address string, uuid string, value []byte) {
+	LogEvent("NOTIFY", strings.Join([]string{address, uuid, hex.EncodeToString(value)}, ";"))
+	Machines.Notify(address, uuid, value)
+}
+
+// HandleNotification records a value received from a device and logs it,
+// unless a quiet recording took it.
+func HandleNotification(address string, uuid string, value []byte) {
+	start := time.Now()
+	defer func () {
+		Latencies.Observe("notify", time.Since(start), nil)
+	} ()
+	if Recordings.Offer(address, uuid, value) {
+		Machines.Notify(address, uuid, value)
+		return
+	}
+	LogNotification(address, uuid, value)
+}
+
+func (ss *SafeSubscriptions) Subscribe(address string, uuid string) error {
+	char, err := Adapter.Characteristic(address, uuid)
+	if err != nil {
+		return err
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	address = strings.ToUpper(address)
+	err = char.EnableNotifications(func (buf []byte) {
+		HandleNotification(address, uuid, buf)
+	})
+	if err != nil {
+		return err
+	}
+	if ss.chars[address] == nil {
+		ss.chars[address] = map[string]*bluetooth.DeviceCharacteristic{}
+	}
+	ss.chars[address][strings.ToLower(uuid)] = char
+	return nil
+}
+
+func (ss *SafeSubscriptions) Unsubscribe(address string, uuid string) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	chars := ss.chars[strings.ToUpper(address)]
+	char, ok := chars[strings.ToLower(uuid)]
+	if !ok {
+		return errNotSubscribed
+	}
+	delete(chars, strings.ToLower(uuid))
+	return char.EnableNotifications(nil)
+}
+
+// List returns the UUIDs of the characteristics of a device subscribed to.
+func (ss *SafeSubscriptions) List(address string) []string {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	uuids := []string{}
+	for uuid := range ss.chars[strings.ToUpper(address)] {
+		uuids = append(uuids, uuid)
+	}
+	return uuids
+}
+
+// Clear forgets the subscriptions to a device once it is disconnected, or
+// every subscription when address is empty.
+func (ss *SafeSubscriptions) Clear(address string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if address == "" {
+		ss.chars = map[string]map[string]*bluetooth.DeviceCharacteristic{}
+		return
+	}
+	delete(ss.chars, strings.ToUpper(address))
+}
+
+func SubscribeHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		err := Subscriptions.Subscribe(vars["addr"], vars["uuid"])
+		if errors.Is(err, errNotConnectedTo) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if errors.Is(err, errCharacteristicNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(200)
+	}
+}
+
+func UnsubscribeHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		err := Subscriptions.Unsubscribe(vars["addr"], vars["uuid"])
+		if errors.Is(err, errNotSubscribed) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(200)
+	}
+}
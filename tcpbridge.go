@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// BridgeConfig maps a (write, notify) characteristic pair to a listening TCP
+// port. When Address is set, clients are only bridged while connected to that
+// device. Protocol is empty for a raw byte stream, or "modbus" to serve
+// Modbus TCP to clients while speaking Modbus RTU to the device.
+type BridgeConfig struct {
+	Port     int
+	Write    string
+	Notify   string
+	Address  string `json:",omitempty"`
+	Protocol string `json:",omitempty"`
+}
+
+type TCPBridge struct {
+	mu       sync.Mutex
+	Config   BridgeConfig
+	listener net.Listener
+	conn     net.Conn
+}
+
+type SafeBridges struct {
+	mu      sync.Mutex
+	Bridges map[int]*TCPBridge
+}
+
+const bridgesFile = "bridges.json"
+
+var (
+	Bridges = SafeBridges{Bridges: map[int]*TCPBridge{}}
+	errBridgeExists = errors.New("a bridge is already configured on that port")
+	errBridgeNotFound = errors.New("no bridge is configured on that port")
+)
+
+func (bc *BridgeConfig) Validate() error {
+	if bc.Port < 1 || bc.Port > 65535 {
+		return errors.New("port must be between 1 and 65535")
+	}
+	if _, err := ParseUUID(bc.Write); err != nil {
+		return err
+	}
+	if _, err := ParseUUID(bc.Notify); err != nil {
+		return err
+	}
+	if bc.Protocol != "" && bc.Protocol != "modbus" {
+		return errors.New("protocol must be empty or modbus")
+	}
+	return nil
+}
+
+func ListenBridge(config BridgeConfig) (*TCPBridge, error) {
+	l, err := net.Listen("tcp", ":" + strconv.Itoa(config.Port))
+	if err != nil {
+		return nil, err
+	}
+	tb := &TCPBridge{Config: config, listener: l}
+	go tb.serve()
+	return tb, nil
+}
+
+func (tb *TCPBridge) serve() {
+	for {
+		conn, err := tb.listener.Accept()
+		if err != nil {
+			return
+		}
+		go tb.handle(conn)
+	}
+}
+
+func (tb *TCPBridge) handle(conn net.Conn) {
+	defer conn.Close()
+	port := strconv.Itoa(tb.Config.Port)
+	// A notify characteristic can only be subscribed once, so bridges serve
+	// one client at a time.
+	tb.mu.Lock()
+	if tb.conn != nil {
+		tb.mu.Unlock()
+		LogError("Bridge on port", port, "is busy.")
+		return
+	}
+	tb.conn = conn
+	tb.mu.Unlock()
+	defer func () {
+		tb.mu.Lock()
+		tb.conn = nil
+		tb.mu.Unlock()
+	} ()
+	address := tb.Config.Address
+	if address == "" {
+		address = Adapter.DeviceAddress()
+	} else if !Adapter.IsConnected(address) {
+		LogError("Bridge on port", port, "requires a connection to", tb.Config.Address)
+		return
+	}
+	var out io.Writer = conn
+	var frames *RTUBuffer
+	if tb.Config.Protocol == "modbus" {
+		frames = NewRTUBuffer()
+		out = frames
+	}
+	bridge, err := NewBridge(address, tb.Config.Write, tb.Config.Notify, out)
+	if err != nil {
+		LogError("Could not open bridge on port", port, "-", err.Error())
+		return
+	}
+	defer bridge.Close()
+	LogInfo("Bridge client connected on port", port)
+	if frames != nil {
+		ServeModbus(conn, bridge, frames)
+	} else {
+		bridge.Pump(conn)
+	}
+	LogInfo("Bridge client disconnected from port", port)
+}
+
+func (tb *TCPBridge) Close() {
+	tb.listener.Close()
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.conn != nil {
+		tb.conn.Close()
+	}
+}
+
+// Load starts listening for every persisted bridge.
+func (sb *SafeBridges) Load() error {
+	configs := []BridgeConfig{}
+	err := LoadJSON(bridgesFile, &configs)
+	if err != nil {
+		return err
+	}
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	for _, config := range configs {
+		tb, err := ListenBridge(config)
+		if err != nil {
+			LogError("Could not restore bridge on port", strconv.Itoa(config.Port), "-", err.Error())
+			continue
+		}
+		sb.Bridges[config.Port] = tb
+	}
+	return nil
+}
+
+func (sb *SafeBridges) List() []BridgeConfig {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.list()
+}
+
+func (sb *SafeBridges) list() []BridgeConfig {
+	configs := []BridgeConfig{}
+	for _, tb := range sb.Bridges {
+		configs = append(configs, tb.Config)
+	}
+	sort.Slice(configs, func (i, j int) bool {
+		return configs[i].Port < configs[j].Port
+	})
+	return configs
+}
+
+func (sb *SafeBridges) Add(config BridgeConfig) error {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if _, ok := sb.Bridges[config.Port]; ok {
+		return errBridgeExists
+	}
+	tb, err := ListenBridge(config)
+	if err != nil {
+		return err
+	}
+	sb.Bridges[config.Port] = tb
+	return SaveJSON(bridgesFile, sb.list())
+}
+
+func (sb *SafeBridges) Remove(port int) error {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	tb, ok := sb.Bridges[port]
+	if !ok {
+		return errBridgeNotFound
+	}
+	tb.Close()
+	delete(sb.Bridges, port)
+	return SaveJSON(bridgesFile, sb.list())
+}
+
+func ListBridgesHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Bridges.List())
+	}
+}
+
+func AddBridgeHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		config := BridgeConfig{}
+		err := json.NewDecoder(r.Body).Decode(&config)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = config.Validate()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = Bridges.Add(config)
+		if errors.Is(err, errBridgeExists) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		LogInfo("Bridge listening on port", strconv.Itoa(config.Port))
+		w.WriteHeader(201)
+	}
+}
+
+func RemoveBridgeHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		port, err := strconv.Atoi(mux.Vars(r)["port"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = Bridges.Remove(port)
+		if errors.Is(err, errBridgeNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		LogInfo("Bridge on port", strconv.Itoa(port), "removed.")
+		w.WriteHeader(200)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const telemetryHistory = 1000
+
+// DefaultWindows are the aggregation windows used unless -aggregate says
+// otherwise.
+const DefaultWindows = "rssi=1m,battery=5m"
+
+// Aggregate summarizes the samples of one metric of one device over a
+// window, all taken under the same calibration version.
+type Aggregate struct {
+	Address     string
+	Metric      string
+	Start       time.Time
+	Window      string
+	Min         float64
+	Max         float64
+	Avg         float64
+	Count       int
+	Calibration int
+}
+
+type telemetryBucket struct {
+	start       time.Time
+	min         float64
+	max         float64
+	sum         float64
+	count       int
+	calibration int
+}
+
+type SafeTelemetry struct {
+	mu      sync.Mutex
+	Windows map[string]time.Duration
+	buckets map[string]*telemetryBucket
+	closed  []Aggregate
+	history []Aggregate
+}
+
+var Telemetry = SafeTelemetry{Windows: map[string]time.Duration{}, buckets: map[string]*telemetryBucket{}}
+
+// ParseWindows parses a comma separated list of metric=duration pairs.
+func ParseWindows(s string) (map[string]time.Duration, error) {
+	windows := map[string]time.Duration{}
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		metric, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, errors.New("expected metric=duration, got " + pair)
+		}
+		window, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, err
+		}
+		if window < time.Second {
+			return nil, errors.New(metric + " window is shorter than a second")
+		}
+		windows[strings.TrimSpace(metric)] = window
+	}
+	return windows, nil
+}
+
+// Record calibrates a raw sample, stores it unless its deadband holds it
+// back, checks it for anomalies and thresholds, computes the virtual metrics
+// and composite devices depending on it and adds it to its window. Metrics without a window are not aggregated.
+func (st *SafeTelemetry) Record(addr string, metric string, raw float64) {
+	value, calibration := Calibrations.Apply(addr, metric, raw)
+	if Deadbands.Pass(streamHistory, addr, metric, value) {
+		History.Append(addr, metric, value, calibration)
+	}
+	if anomaly := Anomalies.Observe(addr, metric, value); anomaly != "" {
+		LogEvent("ANOMALY", anomaly)
+	}
+	if breach := Thresholds.Observe(addr, metric, value); breach != "" {
+		LogEvent("THRESHOLD_BREACH", breach)
+	}
+	for _, sample := range VirtualMetrics.Observe(addr, metric, value) {
+		st.Record(addr, sample.Metric, sample.Value)
+	}
+	for _, sample := range Composites.Observe(addr, metric, value) {
+		st.Record(sample.Address, sample.Metric, sample.Value)
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.Windows[metric] == 0 {
+		return
+	}
+	key := addr + ";" + metric
+	b, ok := st.buckets[key]
+	// A new calibration closes the window early rather than mixing values.
+	if ok && b.calibration != calibration {
+		st.closed = append(st.closed, st.aggregate(key, b))
+		ok = false
+	}
+	if !ok {
+		b = &telemetryBucket{start: time.Now(), min: value, max: value, calibration: calibration}
+		st.buckets[key] = b
+	}
+	b.min = min(b.min, value)
+	b.max = max(b.max, value)
+	b.sum += value
+	b.count++
+}
+
+// SetWindow changes how a metric is aggregated, 0 stops aggregating it.
+func (st *SafeTelemetry) SetWindow(metric string, window time.Duration) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if window == 0 {
+		delete(st.Windows, metric)
+		return
+	}
+	st.Windows[metric] = window
+}
+
+// aggregate summarizes a bucket, expecting st.mu to be held.
+func (st *SafeTelemetry) aggregate(key string, b *telemetryBucket) Aggregate {
+	addr, metric, _ := strings.Cut(key, ";")
+	return Aggregate{
+		Address: addr,
+		Metric: metric,
+		Start: b.start,
+		Window: st.Windows[metric].String(),
+		Min: b.min,
+		Max: b.max,
+		Avg: b.sum / float64(b.count),
+		Count: b.count,
+		Calibration: b.calibration,
+	}
+}
+
+// flush closes every bucket whose window has passed.
+func (st *SafeTelemetry) flush() []Aggregate {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	closed := st.closed
+	st.closed = nil
+	for key, b := range st.buckets {
+		_, metric, _ := strings.Cut(key, ";")
+		if time.Since(b.start) < st.Windows[metric] {
+			continue
+		}
+		delete(st.buckets, key)
+		closed = append(closed, st.aggregate(key, b))
+	}
+	st.history = append(st.history, closed...)
+	if len(st.history) > telemetryHistory {
+		st.history = st.history[len(st.history) - telemetryHistory:]
+	}
+	return closed
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// RunAggregation emits an AGG event for every closed window its deadband
+// lets through, as address;metric;window;min;max;avg;count;calibration.
+func (st *SafeTelemetry) RunAggregation() {
+	for {
+		time.Sleep(time.Second)
+		for _, agg := range st.flush() {
+			if !Deadbands.Pass(streamAggregates, agg.Address, agg.Metric, agg.Avg) {
+				continue
+			}
+			LogEvent("AGG", strings.Join([]string{
+				agg.Address, agg.Metric, agg.Window,
+				formatFloat(agg.Min), formatFloat(agg.Max), formatFloat(agg.Avg),
+				strconv.Itoa(agg.Count), strconv.Itoa(agg.Calibration),
+			}, ";"))
+		}
+	}
+}
+
+// Aggregates returns the kept aggregates, oldest first, optionally limited
+// to one device or metric.
+func (st *SafeTelemetry) Aggregates(addr string, metric string) []Aggregate {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	aggs := []Aggregate{}
+	for _, agg := range st.history {
+		if (addr == "" || agg.Address == addr) && (metric == "" || agg.Metric == metric) {
+			aggs = append(aggs, agg)
+		}
+	}
+	return aggs
+}
+
+// ExportAggregatesHandler exports the recent aggregates, or a stored
+// retention tier, as JSON or CSV with format=csv.
+func ExportAggregatesHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		aggs := Telemetry.Aggregates(query.Get("address"), query.Get("metric"))
+		if tier := query.Get("tier"); tier != "" {
+			var err error
+			aggs, err = History.Points(tier, query.Get("address"), query.Get("metric"))
+			if errors.Is(err, errUnknownTier) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		if query.Get("format") != "csv" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(aggs)
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv")
+		out := csv.NewWriter(w)
+		out.Write([]string{"address", "metric", "start", "window", "min", "max", "avg", "count", "calibration"})
+		for _, agg := range aggs {
+			out.Write([]string{
+				agg.Address, agg.Metric, agg.Start.UTC().Format(time.RFC3339), agg.Window,
+				formatFloat(agg.Min), formatFloat(agg.Max), formatFloat(agg.Avg),
+				strconv.Itoa(agg.Count), strconv.Itoa(agg.Calibration),
+			})
+		}
+		out.Flush()
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const thresholdsFile = "thresholds.json"
+
+var errReplayStorage = errors.New("could not read the history")
+
+// Threshold raises a THRESHOLD_BREACH event (address;metric;low|high;value;limit)
+// when a metric of a device goes below Min or above Max. It's armed again
+// once the value is back within the limit by Hysteresis, and breaches within
+// Cooldown of the last event are not reported. With Modes, breaches are
+// only reported while one of those modes is active, eg. away.
+type Threshold struct {
+	Metric     string
+	Min        *float64 `json:",omitempty"`
+	Max        *float64 `json:",omitempty"`
+	Hysteresis float64  `json:",omitempty"`
+	Cooldown   string   `json:",omitempty"`
+	Modes      []string `json:",omitempty"`
+}
+
+type thresholdState struct {
+	breached string
+	reported time.Time
+}
+
+type SafeThresholds struct {
+	mu         sync.Mutex
+	Thresholds map[string][]Threshold
+	states     map[string]*thresholdState
+}
+
+var Thresholds = SafeThresholds{Thresholds: map[string][]Threshold{}, states: map[string]*thresholdState{}}
+
+func ValidateThresholds(thresholds []Threshold) error {
+	metrics := map[string]bool{}
+	for _, t := range thresholds {
+		if t.Metric == "" || metrics[t.Metric] {
+			return errors.New("thresholds need distinct metrics")
+		}
+		metrics[t.Metric] = true
+		if t.Min == nil && t.Max == nil {
+			return errors.New(t.Metric + ": needs Min, Max or both")
+		}
+		if t.Min != nil && t.Max != nil && *t.Min >= *t.Max {
+			return errors.New(t.Metric + ": Min must be below Max")
+		}
+		if t.Hysteresis < 0 {
+			return errors.New(t.Metric + ": hysteresis can't be negative")
+		}
+		if t.Cooldown != "" {
+			if d, err := time.ParseDuration(t.Cooldown); err != nil || d < 0 {
+				return errors.New(t.Metric + ": cooldown must be a duration, eg. 10m")
+			}
+		}
+		for _, mode := range t.Modes {
+			if err := ValidateMode(mode); err != nil {
+				return errors.New(t.Metric + ": " + err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+func (st *SafeThresholds) Load() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	err := LoadJSON(thresholdsFile, &st.Thresholds)
+	if err != nil {
+		return err
+	}
+	for addr, thresholds := range st.Thresholds {
+		if err := ValidateThresholds(thresholds); err != nil {
+			return errors.New(addr + " " + err.Error())
+		}
+	}
+	return nil
+}
+
+// Observe checks a recorded value against the device's threshold for the
+// metric, returning the event to raise if any.
+func (st *SafeThresholds) Observe(addr string, metric string, value float64) string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var t *Threshold
+	for i := range st.Thresholds[addr] {
+		if st.Thresholds[addr][i].Metric == metric {
+			t = &st.Thresholds[addr][i]
+		}
+	}
+	if t == nil {
+		return ""
+	}
+	key := addr + ";" + metric
+	state, ok := st.states[key]
+	if !ok {
+		state = &thresholdState{}
+		st.states[key] = state
+	}
+	breach, limit, suppressed := t.check(state, value, time.Now(), Modes.Active())
+	if breach == "" || suppressed != "" {
+		return ""
+	}
+	return strings.Join([]string{addr, metric, breach, formatFloat(value), formatFloat(limit)}, ";")
+}
+
+// check runs a value through the threshold as of at, with the modes active
+// then, returning the limit it broke (low or high) and, when the breach
+// isn't to be reported, why: cooldown or mode.
+func (t Threshold) check(state *thresholdState, value float64, at time.Time, active []string) (string, float64, string) {
+	if state.breached == "low" && value >= *t.Min + t.Hysteresis || state.breached == "high" && value <= *t.Max - t.Hysteresis {
+		state.breached = ""
+	}
+	if state.breached != "" {
+		return "", 0, ""
+	}
+	limit := 0.0
+	switch {
+	case t.Min != nil && value < *t.Min:
+		state.breached, limit = "low", *t.Min
+	case t.Max != nil && value > *t.Max:
+		state.breached, limit = "high", *t.Max
+	default:
+		return "", 0, ""
+	}
+	cooldown, _ := time.ParseDuration(t.Cooldown)
+	if at.Sub(state.reported) < cooldown {
+		return state.breached, limit, "cooldown"
+	}
+	if len(t.Modes) > 0 && !slices.ContainsFunc(active, func (mode string) bool { return slices.Contains(t.Modes, mode) }) {
+		return state.breached, limit, "mode"
+	}
+	state.reported = at
+	return state.breached, limit, ""
+}
+
+func (st *SafeThresholds) List(addr string) []Threshold {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if thresholds, ok := st.Thresholds[strings.ToUpper(addr)]; ok {
+		return thresholds
+	}
+	return []Threshold{}
+}
+
+// Set replaces the thresholds of a device, an empty list removes them.
+func (st *SafeThresholds) Set(addr string, thresholds []Threshold) error {
+	err := ValidateThresholds(thresholds)
+	if err != nil {
+		return err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	addr = strings.ToUpper(addr)
+	all := map[string][]Threshold{}
+	for a, t := range st.Thresholds {
+		all[a] = t
+	}
+	if len(thresholds) == 0 {
+		delete(all, addr)
+	} else {
+		all[addr] = thresholds
+	}
+	err = SaveJSON(thresholdsFile, all)
+	if err != nil {
+		return err
+	}
+	st.Thresholds = all
+	for key := range st.states {
+		if strings.HasPrefix(key, addr + ";") {
+			delete(st.states, key)
+		}
+	}
+	return nil
+}
+
+func GetThresholdsHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Thresholds.List(mux.Vars(r)["addr"]))
+	}
+}
+
+func SetThresholdsHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		thresholds := []Threshold{}
+		err := json.NewDecoder(r.Body).Decode(&thresholds)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = Thresholds.Set(mux.Vars(r)["addr"], thresholds)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(200)
+	}
+}
+
+// ReplayRequest replays the stored samples of a device from From to To (now
+// when zero) through its thresholds, or through Thresholds when given to try
+// them out.
+type ReplayRequest struct {
+	From       time.Time
+	To         time.Time   `json:",omitempty"`
+	Thresholds []Threshold `json:",omitempty"`
+}
+
+// ReplayedBreach is a breach replaying history found, with the event it
+// would raise unless Suppressed says why it wouldn't be reported: cooldown
+// or mode.
+type ReplayedBreach struct {
+	Time       time.Time
+	Metric     string
+	Breach     string
+	Value      float64
+	Limit      float64
+	Event      string
+	Suppressed string `json:",omitempty"`
+}
+
+// ThresholdReplay is what a replay found, Samples being how many stored
+// samples had a threshold to go through.
+type ThresholdReplay struct {
+	Samples  int
+	Breaches []ReplayedBreach
+}
+
+// ReplayThresholds runs the stored samples of a device through thresholds
+// all armed to start with, in a dry run raising nothing. Samples are checked
+// with the quiet hours as of when they were taken, in the current mode.
+func ReplayThresholds(addr string, req ReplayRequest) (ThresholdReplay, error) {
+	thresholds := req.Thresholds
+	if thresholds == nil {
+		thresholds = Thresholds.List(addr)
+	}
+	err := ValidateThresholds(thresholds)
+	if err != nil {
+		return ThresholdReplay{}, err
+	}
+	samples, err := History.Samples(addr, req.From, req.To)
+	if err != nil {
+		return ThresholdReplay{}, fmt.Errorf("%w - %v", errReplayStorage, err)
+	}
+	replay := ThresholdReplay{Breaches: []ReplayedBreach{}}
+	states := map[string]*thresholdState{}
+	for _, p := range samples {
+		i := slices.IndexFunc(thresholds, func (t Threshold) bool { return t.Metric == p.Metric })
+		if i < 0 {
+			continue
+		}
+		replay.Samples++
+		state, ok := states[p.Metric]
+		if !ok {
+			state = &thresholdState{}
+			states[p.Metric] = state
+		}
+		breach, limit, suppressed := thresholds[i].check(state, p.Avg, p.Start, Modes.ActiveAt(p.Start))
+		if breach == "" {
+			continue
+		}
+		replay.Breaches = append(replay.Breaches, ReplayedBreach{
+			Time: p.Start,
+			Metric: p.Metric,
+			Breach: breach,
+			Value: p.Avg,
+			Limit: limit,
+			Event: strings.Join([]string{addr, p.Metric, breach, formatFloat(p.Avg), formatFloat(limit)}, ";"),
+			Suppressed: suppressed,
+		})
+	}
+	return replay, nil
+}
+
+func ReplayThresholdsHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		req := ReplayRequest{}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		replay, err := ReplayThresholds(strings.ToUpper(mux.Vars(r)["addr"]), req)
+		if errors.Is(err, errReplayStorage) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(replay)
+	}
+}
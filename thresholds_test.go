@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestThresholdsAddressCase(t *testing.T) {
+	useDataDir(t)
+	t.Cleanup(func () { Thresholds = SafeThresholds{Thresholds: map[string][]Threshold{}, states: map[string]*thresholdState{}} })
+	Thresholds = SafeThresholds{Thresholds: map[string][]Threshold{}, states: map[string]*thresholdState{}}
+	max := 30.0
+	if err := Thresholds.Set("aa:bb:cc:dd:ee:ff", []Threshold{{Metric: "temperature", Max: &max}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []string{"aa:bb:cc:dd:ee:ff", "AA:BB:CC:DD:EE:FF"} {
+		if got := Thresholds.List(addr); len(got) != 1 {
+			t.Errorf("%v: got %v, want the threshold", addr, got)
+		}
+	}
+	if got, want := Thresholds.Observe("AA:BB:CC:DD:EE:FF", "temperature", 31), "AA:BB:CC:DD:EE:FF;temperature;high;31;30"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if err := Thresholds.Set("AA:BB:CC:DD:EE:FF", nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(Thresholds.Thresholds) != 0 || len(Thresholds.states) != 0 {
+		t.Errorf("removing with another case left %v, %v", Thresholds.Thresholds, Thresholds.states)
+	}
+}
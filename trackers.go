@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Export formats of presence trackers, so setups built on them can be fed
+// from bluboi.
+const (
+	// Home Assistant's known_devices.yaml, as written by its Bluetooth LE
+	// tracker.
+	formatKnownDevices = "known_devices"
+	// monitor.sh's known_static_addresses.
+	formatMonitor = "monitor"
+)
+
+// trackerName is how trackers should call a device.
+func trackerName(d DeviceListing) string {
+	if d.Alias != "" {
+		return d.Alias
+	}
+	if d.Name != "" {
+		return d.Name
+	}
+	return d.Address
+}
+
+// trackerID slugs a name the way Home Assistant does for entity IDs.
+func trackerID(name string) string {
+	b := strings.Builder{}
+	underscore := true
+	for _, c := range strings.ToLower(name) {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') {
+			b.WriteRune(c)
+			underscore = false
+		} else if !underscore {
+			b.WriteByte('_')
+			underscore = true
+		}
+	}
+	return strings.TrimSuffix(b.String(), "_")
+}
+
+// writeKnownDevices writes devices as known_devices.yaml. Entries are keyed
+// by the slug of their alias or name, numbered when several share one, and
+// their MAC carries the tracker's BLE_ prefix. Composite devices, having no
+// address of their own, are left out.
+func writeKnownDevices(w io.Writer, devices []DeviceListing) {
+	ids := map[string]int{}
+	for _, d := range devices {
+		if len(d.Members) > 0 {
+			continue
+		}
+		name := trackerName(d)
+		id := trackerID(name)
+		if id == "" || name == d.Address {
+			id = "ble_" + trackerID(d.Address)
+		}
+		ids[id]++
+		if n := ids[id]; n > 1 {
+			id += "_" + strconv.Itoa(n)
+		}
+		fmt.Fprintf(w, "%s:\n  name: %s\n  mac: BLE_%s\n  icon:\n  picture:\n  track: true\n", id, strconv.Quote(name), d.Address)
+	}
+}
+
+// writeMonitorAddresses writes devices as monitor.sh's
+// known_static_addresses, an address and a name per line.
+func writeMonitorAddresses(w io.Writer, devices []DeviceListing) {
+	for _, d := range devices {
+		if len(d.Members) > 0 {
+			continue
+		}
+		name := strings.Join(strings.Fields(trackerName(d)), " ")
+		if len(d.Tags) > 0 {
+			name += " # " + strings.Join(d.Tags, ", ")
+		}
+		fmt.Fprintf(w, "%s %s\n", d.Address, name)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"log"
+	"os/exec"
+	"strings"
+)
+
+// TTSConfig selects which events are announced and how. Command is run once
+// per announcement with the text replacing a "{}" argument, or on stdin when
+// there is none. URL receives the text as a signed JSON webhook instead.
+type TTSConfig struct {
+	Command string
+	URL     string
+	Events  []string
+}
+
+type TTSAnnouncement struct {
+	Level string
+	Text  string
+}
+
+// ttsText turns a log into what should be said, or "" to stay quiet.
+func ttsText(l Log, seen map[string]bool) string {
+	if l.Level != "DEVICE" {
+		return l.Msg
+	}
+	fields := strings.Split(l.Msg, ";")
+	addr, name := fields[0], ""
+	if len(fields) > 1 {
+		name = fields[1]
+	}
+	if len(fields) > 5 && fields[5] != "" {
+		name = fields[5]
+	}
+	// Known devices are replayed to every new event stream client, and
+	// devices without a name wait until they have one.
+	if seen[addr] || name == "" {
+		return ""
+	}
+	seen[addr] = true
+	return "New device " + name
+}
+
+func speak(config TTSConfig, level string, text string) error {
+	if config.URL != "" {
+		return PostJSON(config.URL, TTSAnnouncement{level, text})
+	}
+	args := strings.Fields(config.Command)
+	stdin := true
+	for i, arg := range args {
+		if arg == "{}" {
+			args[i] = text
+			stdin = false
+		}
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	if stdin {
+		cmd.Stdin = strings.NewReader(text + "\n")
+	}
+	return cmd.Run()
+}
+
+// RunTTS announces selected events one after another. Announcements that
+// pile up while speaking are dropped by the subscription buffer.
+func RunTTS(config TTSConfig) {
+	if config.Command == "" && config.URL == "" {
+		return
+	}
+	selected := map[string]bool{}
+	for _, level := range config.Events {
+		selected[strings.TrimSpace(level)] = true
+	}
+	seen := map[string]bool{}
+	Devices.ForEach(func (addr string, _ Device) {
+		seen[addr] = true
+	})
+	_, logs := Sinks.Subscribe("tts", 10)
+	log.Printf("[INFO] Announcing %v", strings.Join(config.Events, ", "))
+	for l := range logs {
+		if !selected[l.Level] {
+			continue
+		}
+		text := ttsText(l, seen)
+		if text == "" {
+			continue
+		}
+		if err := speak(config, l.Level, text); err != nil {
+			log.Printf("[ERROR] Could not announce event - %v", err)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const virtualFile = "virtual.json"
+
+// VirtualMetric is computed from other metrics of the same device whenever
+// one of them is recorded, using the latest value of each, and is then
+// recorded like a native metric. Window, when set, aggregates it into AGG
+// events.
+type VirtualMetric struct {
+	Name       string
+	Expression string
+	Window     string `json:",omitempty"`
+}
+
+type compiledMetric struct {
+	VirtualMetric
+	expr   Expr
+	inputs []string
+	window time.Duration
+}
+
+type VirtualSample struct {
+	Metric string
+	Value  float64
+}
+
+type SafeVirtualMetrics struct {
+	mu       sync.Mutex
+	Metrics  []VirtualMetric
+	compiled []compiledMetric
+	latest   map[string]map[string]float64
+}
+
+var (
+	VirtualMetrics = SafeVirtualMetrics{Metrics: []VirtualMetric{}, latest: map[string]map[string]float64{}}
+	nativeMetrics  = []string{"rssi", "battery"}
+)
+
+// CompileVirtual checks every definition. Virtual metrics can only be
+// computed from recorded metrics, not from each other.
+func CompileVirtual(metrics []VirtualMetric) ([]compiledMetric, error) {
+	compiled := []compiledMetric{}
+	names := map[string]bool{}
+	for _, m := range metrics {
+		if m.Name == "" || strings.IndexFunc(m.Name, func (r rune) bool { return !isIdent(r) }) >= 0 {
+			return nil, errors.New("names can only hold letters, digits and _, got " + m.Name)
+		}
+		if names[m.Name] || slices.Contains(nativeMetrics, m.Name) {
+			return nil, errors.New(m.Name + " is already a metric")
+		}
+		names[m.Name] = true
+		expr, inputs, err := ParseExpr(m.Expression)
+		if err != nil {
+			return nil, errors.New(m.Name + ": " + err.Error())
+		}
+		if len(inputs) == 0 {
+			return nil, errors.New(m.Name + ": the expression doesn't use any metric")
+		}
+		c := compiledMetric{m, expr, inputs, 0}
+		if m.Window != "" {
+			c.window, err = time.ParseDuration(m.Window)
+			if err != nil || c.window < time.Second {
+				return nil, errors.New(m.Name + ": window must be a duration of at least a second")
+			}
+		}
+		compiled = append(compiled, c)
+	}
+	for _, c := range compiled {
+		for _, input := range c.inputs {
+			if names[input] {
+				return nil, errors.New(c.Name + ": can't be computed from the virtual metric " + input)
+			}
+		}
+	}
+	return compiled, nil
+}
+
+func (sv *SafeVirtualMetrics) Load() error {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	err := LoadJSON(virtualFile, &sv.Metrics)
+	if err != nil {
+		return err
+	}
+	sv.compiled, err = CompileVirtual(sv.Metrics)
+	if err != nil {
+		return err
+	}
+	sv.setWindows(nil)
+	return nil
+}
+
+// setWindows replaces the aggregation windows of the previous definitions,
+// expecting sv.mu to be held.
+func (sv *SafeVirtualMetrics) setWindows(previous []compiledMetric) {
+	for _, c := range previous {
+		Telemetry.SetWindow(c.Name, 0)
+	}
+	for _, c := range sv.compiled {
+		Telemetry.SetWindow(c.Name, c.window)
+	}
+}
+
+// Observe remembers a recorded value and returns the virtual metrics of the
+// device it lets be computed.
+func (sv *SafeVirtualMetrics) Observe(addr string, metric string, value float64) []VirtualSample {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	if len(sv.compiled) == 0 || slices.ContainsFunc(sv.compiled, func (c compiledMetric) bool { return c.Name == metric }) {
+		return nil
+	}
+	latest, ok := sv.latest[addr]
+	if !ok {
+		latest = map[string]float64{}
+		sv.latest[addr] = latest
+	}
+	latest[metric] = value
+	samples := []VirtualSample{}
+	for _, c := range sv.compiled {
+		if !slices.Contains(c.inputs, metric) {
+			continue
+		}
+		complete := !slices.ContainsFunc(c.inputs, func (input string) bool {
+			_, ok := latest[input]
+			return !ok
+		})
+		if !complete {
+			continue
+		}
+		v := c.expr(latest)
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			continue
+		}
+		samples = append(samples, VirtualSample{c.Name, v})
+	}
+	return samples
+}
+
+func (sv *SafeVirtualMetrics) List() []VirtualMetric {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	return sv.Metrics
+}
+
+func (sv *SafeVirtualMetrics) Set(metrics []VirtualMetric) error {
+	compiled, err := CompileVirtual(metrics)
+	if err != nil {
+		return err
+	}
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	err = SaveJSON(virtualFile, metrics)
+	if err != nil {
+		return err
+	}
+	previous := sv.compiled
+	sv.Metrics = metrics
+	sv.compiled = compiled
+	sv.setWindows(previous)
+	return nil
+}
+
+func GetVirtualMetricsHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(VirtualMetrics.List())
+	}
+}
+
+func SetVirtualMetricsHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		metrics := []VirtualMetric{}
+		err := json.NewDecoder(r.Body).Decode(&metrics)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = VirtualMetrics.Set(metrics)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(200)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	watchdogInterval = 10 * time.Second
+	// A scan that hasn't produced a single advertisement for this long is
+	// assumed to be running on a wedged adapter.
+	scanStallTimeout = 30 * time.Second
+	recoveryBackoff  = time.Minute
+)
+
+// WatchAdapter periodically checks that the adapter is still powered and
+// delivering scan results, and tries to bring it back with a reset cycle when
+// it isn't.
+func WatchAdapter() {
+	lastRecovery := time.Time{}
+	for {
+		time.Sleep(watchdogInterval)
+		if Adapter.detached.Load() {
+			continue
+		}
+		reason := adapterProblem()
+		if reason == "" || time.Since(lastRecovery) < recoveryBackoff {
+			continue
+		}
+		lastRecovery = time.Now()
+		log.Printf("[ERROR] Adapter looks wedged - %v", reason)
+		LogError("Adapter looks wedged -", reason, "- resetting.")
+		Audit.Record("system", "adapter_reset", reason)
+		err := Adapter.Reset()
+		if err != nil {
+			LogEvent("ADAPTER_FAILED", "Could not recover adapter -", err.Error())
+			continue
+		}
+		if reason := adapterProblem(); reason != "" {
+			LogEvent("ADAPTER_FAILED", "Adapter still wedged after reset -", reason)
+			continue
+		}
+		AdapterResets.Add(1)
+		LogEvent("ADAPTER_RECOVERED", "Adapter recovered.")
+	}
+}
+
+func adapterProblem() string {
+	powered, err := adapterPowered()
+	if err != nil {
+		return "adapter unavailable: " + err.Error()
+	}
+	if !powered {
+		return "adapter is powered off"
+	}
+	if Adapter.scanning.Load() {
+		last := time.Unix(0, Adapter.lastResult.Load())
+		if time.Since(last) > scanStallTimeout {
+			return "no scan results for " + time.Since(last).Round(time.Second).String()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var webhookClient = &http.Client{Timeout: 5 * time.Second}
+
+// PostJSON sends v as a signed JSON body to url and treats any non-2xx
+// response as an error.
+func PostJSON(url string, v any) error {
+	return SendJSON(http.MethodPost, url, "", v)
+}
+
+// SendJSON is PostJSON with any method, and a bearer token when the
+// receiver is another bluboi.
+func SendJSON(method string, url string, token string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer " + token)
+	}
+	SigningKeys.Sign(req.Header, body)
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	webPushFile              = "webpush.json"
+	webPushSubscriptionsFile = "webpush-subscriptions.json"
+	// How long push services keep an alert for a browser that is offline.
+	webPushTTL       = 24 * time.Hour
+	vapidLifetime    = 12 * time.Hour
+	webPushRecordSize = 4096
+)
+
+// WebPushConfig pushes Events to the browsers that subscribed, even with the
+// UI closed. Subject is the contact push services get in the VAPID claims,
+// a mailto: or https: URL, and push is off until it is set. The VAPID keys
+// are generated when missing; PrivateKey is never served back.
+type WebPushConfig struct {
+	Subject    string
+	Events     []string `json:",omitempty"`
+	PublicKey  string   `json:",omitempty"`
+	PrivateKey string   `json:",omitempty"`
+}
+
+// PushSubscription is what the browser's PushManager hands out.
+type PushSubscription struct {
+	Endpoint string
+	Keys     struct {
+		P256dh string
+		Auth   string
+	}
+	Subscribed time.Time
+}
+
+// PushAlert is the payload the UI's service worker shows.
+type PushAlert struct {
+	Title string
+	Body  string
+	Tag   string
+}
+
+type SafeWebPush struct {
+	mu            sync.Mutex
+	Config        WebPushConfig
+	key           *ecdsa.PrivateKey
+	Subscriptions []PushSubscription
+}
+
+var (
+	WebPush = SafeWebPush{Subscriptions: []PushSubscription{}}
+	DefaultWebPushEvents = []string{"SENSOR_DEAD", "CONNECTION_LOST", "THRESHOLD_BREACH", "ANOMALY", "ADAPTER_FAILED"}
+	errWebPushOff = errors.New("push notifications need a Subject in the webpush config")
+	webPushClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+var b64 = base64.RawURLEncoding
+
+// vapidKey reads a raw P-256 private key, as web push libraries store them.
+func vapidKey(private string) (*ecdsa.PrivateKey, error) {
+	d, err := b64.DecodeString(strings.TrimRight(private, "="))
+	if err != nil || len(d) != 32 {
+		return nil, errors.New("PrivateKey must be a base64url P-256 private key")
+	}
+	curve := elliptic.P256()
+	key := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(d)}
+	key.PublicKey.Curve = curve
+	key.PublicKey.X, key.PublicKey.Y = curve.ScalarBaseMult(d)
+	return key, nil
+}
+
+func newVAPIDKeys() (string, string, error) {
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return b64.EncodeToString(key.PublicKey().Bytes()), b64.EncodeToString(key.Bytes()), nil
+}
+
+// withKeys fills in the VAPID keys: generated when there is no PrivateKey,
+// the PublicKey derived from it otherwise.
+func (wc WebPushConfig) withKeys() (WebPushConfig, *ecdsa.PrivateKey, error) {
+	if wc.PrivateKey == "" {
+		var err error
+		wc.PublicKey, wc.PrivateKey, err = newVAPIDKeys()
+		if err != nil {
+			return wc, nil, err
+		}
+	}
+	key, err := vapidKey(wc.PrivateKey)
+	if err != nil {
+		return wc, nil, err
+	}
+	ecdhKey, err := key.ECDH()
+	if err != nil {
+		return wc, nil, err
+	}
+	wc.PublicKey = b64.EncodeToString(ecdhKey.PublicKey().Bytes())
+	return wc, key, nil
+}
+
+func (wc WebPushConfig) Validate() error {
+	if wc.Subject != "" && !strings.HasPrefix(wc.Subject, "mailto:") && !strings.HasPrefix(wc.Subject, "https://") {
+		return errors.New("Subject must be a mailto: or https:// URL")
+	}
+	if wc.PrivateKey != "" {
+		_, err := vapidKey(wc.PrivateKey)
+		return err
+	}
+	return nil
+}
+
+func (wc WebPushConfig) events() []string {
+	if len(wc.Events) == 0 {
+		return DefaultWebPushEvents
+	}
+	return wc.Events
+}
+
+func (sw *SafeWebPush) Load() error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	err := LoadJSON(webPushFile, &sw.Config)
+	if err != nil {
+		return err
+	}
+	err = sw.Config.Validate()
+	if err != nil {
+		return err
+	}
+	generate := sw.Config.PrivateKey == ""
+	sw.Config, sw.key, err = sw.Config.withKeys()
+	if err != nil {
+		return err
+	}
+	if generate {
+		err = SaveJSON(webPushFile, sw.Config)
+		if err != nil {
+			return err
+		}
+	}
+	return LoadJSON(webPushSubscriptionsFile, &sw.Subscriptions)
+}
+
+// Set validates and saves a new config. An empty PrivateKey keeps the
+// current keys; new keys drop every subscription, which browsers made for
+// the old ones.
+func (sw *SafeWebPush) Set(config WebPushConfig) error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	err := config.Validate()
+	if err != nil {
+		return err
+	}
+	if config.PrivateKey == "" {
+		config.PrivateKey = sw.Config.PrivateKey
+	}
+	config, key, err := config.withKeys()
+	if err != nil {
+		return err
+	}
+	err = SaveJSON(webPushFile, config)
+	if err != nil {
+		return err
+	}
+	if config.PrivateKey != sw.Config.PrivateKey {
+		sw.Subscriptions = []PushSubscription{}
+		SaveJSON(webPushSubscriptionsFile, sw.Subscriptions)
+	}
+	sw.Config, sw.key = config, key
+	return nil
+}
+
+// RotateKeys replaces the VAPID keys, dropping every subscription.
+func (sw *SafeWebPush) RotateKeys() error {
+	sw.mu.Lock()
+	config := sw.Config
+	sw.mu.Unlock()
+	public, private, err := newVAPIDKeys()
+	if err != nil {
+		return err
+	}
+	config.PublicKey, config.PrivateKey = public, private
+	return sw.Set(config)
+}
+
+// PublicKey returns the key browsers subscribe with, once push is on.
+func (sw *SafeWebPush) PublicKey() (string, error) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if sw.Config.Subject == "" {
+		return "", errWebPushOff
+	}
+	return sw.Config.PublicKey, nil
+}
+
+func (sw *SafeWebPush) Subscribe(sub PushSubscription) error {
+	u, err := url.Parse(sub.Endpoint)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return errors.New("endpoint must be an https URL")
+	}
+	if p256dh, err := b64.DecodeString(strings.TrimRight(sub.Keys.P256dh, "=")); err != nil || len(p256dh) != 65 {
+		return errors.New("keys.p256dh must be a base64url P-256 public key")
+	}
+	if auth, err := b64.DecodeString(strings.TrimRight(sub.Keys.Auth, "=")); err != nil || len(auth) != 16 {
+		return errors.New("keys.auth must be a base64url 16 byte secret")
+	}
+	sub.Subscribed = time.Now().UTC()
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if sw.Config.Subject == "" {
+		return errWebPushOff
+	}
+	subscriptions := slices.DeleteFunc(slices.Clone(sw.Subscriptions), func (s PushSubscription) bool {
+		return s.Endpoint == sub.Endpoint
+	})
+	subscriptions = append(subscriptions, sub)
+	err = SaveJSON(webPushSubscriptionsFile, subscriptions)
+	if err != nil {
+		return err
+	}
+	sw.Subscriptions = subscriptions
+	return nil
+}
+
+func (sw *SafeWebPush) Unsubscribe(endpoint string) error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	subscriptions := slices.DeleteFunc(slices.Clone(sw.Subscriptions), func (s PushSubscription) bool {
+		return s.Endpoint == endpoint
+	})
+	err := SaveJSON(webPushSubscriptionsFile, subscriptions)
+	if err != nil {
+		return err
+	}
+	sw.Subscriptions = subscriptions
+	return nil
+}
+
+// hkdf is HKDF-SHA256 with output no longer than a hash, all web push
+// needs.
+func hkdf(salt []byte, ikm []byte, info []byte, length int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(ikm)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write(info)
+	expand.Write([]byte{1})
+	return expand.Sum(nil)[:length]
+}
+
+// encryptPush encrypts a payload for a subscription with aes128gcm, as in
+// RFC 8291.
+func encryptPush(sub PushSubscription, payload []byte) ([]byte, error) {
+	uaPublic, err := b64.DecodeString(strings.TrimRight(sub.Keys.P256dh, "="))
+	if err != nil {
+		return nil, err
+	}
+	auth, err := b64.DecodeString(strings.TrimRight(sub.Keys.Auth, "="))
+	if err != nil {
+		return nil, err
+	}
+	ua, err := ecdh.P256().NewPublicKey(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+	as, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := as.ECDH(ua)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := as.PublicKey().Bytes()
+	info := append(append([]byte("WebPush: info\x00"), uaPublic...), asPublic...)
+	ikm := hkdf(auth, secret, info, 32)
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	cek := hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	body := append(salt, binary.BigEndian.AppendUint32(nil, webPushRecordSize)...)
+	body = append(body, byte(len(asPublic)))
+	body = append(body, asPublic...)
+	// A single record, ended by the 0x02 delimiter.
+	return gcm.Seal(body, nonce, append(slices.Clone(payload), 2), nil), nil
+}
+
+// vapid signs the Authorization header for a push service, RFC 8292.
+func vapid(endpoint string, subject string, public string, key *ecdsa.PrivateKey) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	header := b64.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`))
+	claims, err := json.Marshal(map[string]any{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": time.Now().Add(vapidLifetime).Unix(),
+		"sub": subject,
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := header + "." + b64.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		return "", err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return "vapid t=" + unsigned + "." + b64.EncodeToString(sig) + ", k=" + public, nil
+}
+
+// errSubscriptionGone is a push service saying the browser unsubscribed.
+var errSubscriptionGone = errors.New("subscription is gone")
+
+func (sw *SafeWebPush) send(sub PushSubscription, config WebPushConfig, key *ecdsa.PrivateKey, payload []byte) error {
+	body, err := encryptPush(sub, payload)
+	if err != nil {
+		return err
+	}
+	authorization, err := vapid(sub.Endpoint, config.Subject, config.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("TTL", strconv.Itoa(int(webPushTTL.Seconds())))
+	req.Header.Set("Urgency", "high")
+	req.Header.Set("Authorization", authorization)
+	resp, err := webPushClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		return errSubscriptionGone
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("push service responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// Push sends an event to every subscribed browser, forgetting those whose
+// push service says they unsubscribed.
+func (sw *SafeWebPush) Push(l Log) {
+	sw.mu.Lock()
+	config, key, subscriptions := sw.Config, sw.key, sw.Subscriptions
+	sw.mu.Unlock()
+	if config.Subject == "" || !slices.Contains(config.events(), l.Level) {
+		return
+	}
+	payload, _ := json.Marshal(PushAlert{Title: "bluboi: " + l.Level, Body: strings.ReplaceAll(l.Msg, ";", " "), Tag: l.Level})
+	for _, sub := range subscriptions {
+		err := sw.send(sub, config, key, payload)
+		if errors.Is(err, errSubscriptionGone) {
+			sw.Unsubscribe(sub.Endpoint)
+			continue
+		}
+		if err != nil {
+			u, _ := url.Parse(sub.Endpoint)
+			log.Printf("[ERROR] Could not push %v to %v - %v", l.Level, u.Host, err)
+		}
+	}
+}
+
+// Run pushes every event the webpush sink lets through.
+func (sw *SafeWebPush) Run() {
+	_, logs := Sinks.Subscribe("webpush", 100)
+	for l := range logs {
+		sw.Push(l)
+	}
+}
+
+func GetWebPushHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		WebPush.mu.Lock()
+		config := WebPush.Config
+		WebPush.mu.Unlock()
+		config.PrivateKey = ""
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(config)
+	}
+}
+
+func SetWebPushHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		config := WebPushConfig{}
+		err := json.NewDecoder(r.Body).Decode(&config)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = WebPush.Set(config)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(200)
+	}
+}
+
+func RotateWebPushKeysHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		err := WebPush.RotateKeys()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(200)
+	}
+}
+
+// WebPushKeyHandler serves the VAPID public key the UI subscribes with.
+func WebPushKeyHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		key, err := WebPush.PublicKey()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(key))
+	}
+}
+
+func SubscribePushHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		sub := PushSubscription{}
+		err := json.NewDecoder(r.Body).Decode(&sub)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = WebPush.Subscribe(sub)
+		if errors.Is(err, errWebPushOff) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(201)
+	}
+}
+
+func UnsubscribePushHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		sub := PushSubscription{}
+		err := json.NewDecoder(r.Body).Decode(&sub)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = WebPush.Unsubscribe(sub.Endpoint)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(200)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// WedgeConfig describes how scans coming from a BLE barcode scanner are
+// forwarded. Mode is either "webhook" or "keyboard".
+type WedgeConfig struct {
+	Char    string
+	Mode    string
+	Webhook string
+	Prefix  string
+	Suffix  string
+}
+
+type WedgeScan struct {
+	Address string
+	Char    string
+	Data    string
+}
+
+type SafeWedge struct {
+	mu       sync.Mutex
+	Config   WedgeConfig
+	char     *bluetooth.DeviceCharacteristic
+	keyboard *Keyboard
+}
+
+var (
+	Wedge = SafeWedge{}
+	errInvalidWebhook = errors.New("webhook must be an http(s) URL")
+	errInvalidWedgeMode = errors.New("mode must be either webhook or keyboard")
+)
+
+func (wc *WedgeConfig) Validate() error {
+	if _, err := ParseUUID(wc.Char); err != nil {
+		return err
+	}
+	switch wc.Mode {
+	case "keyboard":
+		return nil
+	case "webhook":
+		u, err := url.Parse(wc.Webhook)
+		if err != nil {
+			return err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return errInvalidWebhook
+		}
+		return nil
+	}
+	return errInvalidWedgeMode
+}
+
+func (sw *SafeWedge) Configure(config WedgeConfig) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	sw.Config = config
+}
+
+func (sw *SafeWedge) Start() {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if sw.char != nil {
+		LogError("Wedge is already running.")
+		return
+	}
+	config := sw.Config
+	address := Adapter.DeviceAddress()
+	char, err := Adapter.Characteristic(address, config.Char)
+	if err != nil {
+		LogError("Could not start wedge -", err.Error())
+		return
+	}
+	var keyboard *Keyboard
+	if config.Mode == "keyboard" {
+		keyboard, err = NewKeyboard()
+		if err != nil {
+			LogError("Could not create virtual keyboard -", err.Error())
+			return
+		}
+	}
+	err = char.EnableNotifications(func (buf []byte) {
+		scan := strings.TrimRight(string(buf), "\r\n")
+		if scan == "" {
+			return
+		}
+		text := config.Prefix + scan + config.Suffix
+		LogInfo("Scanned", scan)
+		if keyboard != nil {
+			if err := keyboard.Type(text); err != nil {
+				LogError("Could not type scan -", err.Error())
+			}
+			return
+		}
+		err := PostJSON(config.Webhook, WedgeScan{
+			Address: address,
+			Char: config.Char,
+			Data: text,
+		})
+		if err != nil {
+			LogError("Could not forward scan -", err.Error())
+		}
+	})
+	if err != nil {
+		if keyboard != nil {
+			keyboard.Close()
+		}
+		LogError("Could not subscribe to scanner -", err.Error())
+		return
+	}
+	sw.char = char
+	sw.keyboard = keyboard
+	LogInfo("Wedge started in", config.Mode, "mode.")
+}
+
+func (sw *SafeWedge) Stop() {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if sw.char == nil {
+		LogError("Wedge is not running.")
+		return
+	}
+	err := sw.char.EnableNotifications(nil)
+	if err != nil {
+		LogError("Could not unsubscribe from scanner -", err.Error())
+	}
+	if sw.keyboard != nil {
+		sw.keyboard.Close()
+	}
+	sw.char = nil
+	sw.keyboard = nil
+	LogInfo("Wedge stopped.")
+}
+
+func WedgeHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		config := WedgeConfig{}
+		err := json.NewDecoder(r.Body).Decode(&config)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = config.Validate()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		Wedge.Configure(config)
+		EventQueue <- Event {
+			Type: "WEDGE",
+		}
+		w.WriteHeader(200)
+	}
+}
+
+func StopWedgeHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		EventQueue <- Event {
+			Type: "STOP_WEDGE",
+		}
+		w.WriteHeader(200)
+	}
+}
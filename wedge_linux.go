@@ -0,0 +1,165 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Constants from linux/uinput.h and linux/input-event-codes.h.
+const (
+	uiSetEvBit   = 0x40045564
+	uiSetKeyBit  = 0x40045565
+	uiDevCreate  = 0x5501
+	uiDevDestroy = 0x5502
+
+	evSyn     = 0x00
+	evKey     = 0x01
+	synReport = 0
+
+	keyLeftShift = 42
+)
+
+type keyStroke struct {
+	code  uint16
+	shift bool
+}
+
+var keymap = map[rune]keyStroke{}
+
+func init() {
+	rows := []struct {
+		base    string
+		shifted string
+		first   uint16
+	}{
+		{"1234567890-=", "!@#$%^&*()_+", 2},
+		{"qwertyuiop[]", "QWERTYUIOP{}", 16},
+		{"asdfghjkl;'`", "ASDFGHJKL:\"~", 30},
+		{"\\zxcvbnm,./", "|ZXCVBNM<>?", 43},
+	}
+	for _, row := range rows {
+		shifted := []rune(row.shifted)
+		for i, c := range []rune(row.base) {
+			keymap[c] = keyStroke{row.first + uint16(i), false}
+			keymap[shifted[i]] = keyStroke{row.first + uint16(i), true}
+		}
+	}
+	keymap['\t'] = keyStroke{15, false}
+	keymap['\n'] = keyStroke{28, false}
+	keymap['\r'] = keyStroke{28, false}
+	keymap[' '] = keyStroke{57, false}
+}
+
+type uinputUserDev struct {
+	Name         [80]byte
+	Bustype      uint16
+	Vendor       uint16
+	Product      uint16
+	Version      uint16
+	FFEffectsMax uint32
+	Absmax       [64]int32
+	Absmin       [64]int32
+	Absfuzz      [64]int32
+	Absflat      [64]int32
+}
+
+type inputEvent struct {
+	Time  unix.Timeval
+	Type  uint16
+	Code  uint16
+	Value int32
+}
+
+// Keyboard is a virtual keyboard backed by /dev/uinput, used to type scans
+// into whatever window currently has focus.
+type Keyboard struct {
+	f *os.File
+}
+
+func NewKeyboard() (*Keyboard, error) {
+	f, err := os.OpenFile("/dev/uinput", os.O_WRONLY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	fd := int(f.Fd())
+	if err := unix.IoctlSetInt(fd, uiSetEvBit, evKey); err != nil {
+		f.Close()
+		return nil, err
+	}
+	codes := map[uint16]bool{keyLeftShift: true}
+	for _, ks := range keymap {
+		codes[ks.code] = true
+	}
+	for code := range codes {
+		if err := unix.IoctlSetInt(fd, uiSetKeyBit, int(code)); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	dev := uinputUserDev{Bustype: 0x06, Vendor: 0x1209, Product: 0xb10b, Version: 1}
+	copy(dev.Name[:], "bluboi barcode wedge")
+	if err := binary.Write(f, binary.NativeEndian, &dev); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := unix.IoctlSetInt(fd, uiDevCreate, 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	// Give the input subsystem a moment to pick up the new device before the
+	// first keystrokes are sent.
+	time.Sleep(200 * time.Millisecond)
+	return &Keyboard{f: f}, nil
+}
+
+func (k *Keyboard) emit(typ uint16, code uint16, value int32) error {
+	return binary.Write(k.f, binary.NativeEndian, &inputEvent{Type: typ, Code: code, Value: value})
+}
+
+func (k *Keyboard) press(code uint16, value int32) error {
+	if err := k.emit(evKey, code, value); err != nil {
+		return err
+	}
+	return k.emit(evSyn, synReport, 0)
+}
+
+// Type sends the keystrokes for s. Characters without a key on a US layout
+// are rejected before anything is typed.
+func (k *Keyboard) Type(s string) error {
+	for _, c := range s {
+		if _, ok := keymap[c]; !ok {
+			return fmt.Errorf("no key for character %q", c)
+		}
+	}
+	for _, c := range s {
+		ks := keymap[c]
+		if ks.shift {
+			if err := k.press(keyLeftShift, 1); err != nil {
+				return err
+			}
+		}
+		if err := k.press(ks.code, 1); err != nil {
+			return err
+		}
+		if err := k.press(ks.code, 0); err != nil {
+			return err
+		}
+		if ks.shift {
+			if err := k.press(keyLeftShift, 0); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (k *Keyboard) Close() error {
+	unix.IoctlSetInt(int(k.f.Fd()), uiDevDestroy, 0)
+	return k.f.Close()
+}
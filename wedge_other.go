@@ -0,0 +1,21 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// Keyboard is only implemented on Linux, where scans are typed through
+// /dev/uinput.
+type Keyboard struct{}
+
+func NewKeyboard() (*Keyboard, error) {
+	return nil, errors.New("keyboard mode is only supported on Linux")
+}
+
+func (k *Keyboard) Type(s string) error {
+	return nil
+}
+
+func (k *Keyboard) Close() error {
+	return nil
+}
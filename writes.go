@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// WriteStep is one write of a sequence. If a later write fails, Rollback
+// (encoded like Value) is written back, or else the value read before the
+// write when the characteristic can be read.
+type WriteStep struct {
+	CharacteristicValue
+	Rollback string `json:",omitempty"`
+}
+
+// WriteReport tells how far a sequence of writes got and, when one failed,
+// which of the earlier ones were restored.
+type WriteReport struct {
+	Written        int
+	Failed         string   `json:",omitempty"`
+	Error          string   `json:",omitempty"`
+	RolledBack     []string `json:",omitempty"`
+	RollbackFailed []string `json:",omitempty"`
+}
+
+type plannedWrite struct {
+	uuid     string
+	value    []byte
+	mask     []byte
+	verify   bool
+	rollback []byte
+}
+
+type doneWrite struct {
+	uuid     string
+	rollback []byte
+}
+
+func planWrites(steps []WriteStep) ([]plannedWrite, error) {
+	if len(steps) == 0 {
+		return nil, errors.New("no writes given")
+	}
+	planned := []plannedWrite{}
+	for _, s := range steps {
+		value, mask, err := s.decodeWrite()
+		if err != nil {
+			return nil, errors.New(s.UUID + ": " + err.Error())
+		}
+		p := plannedWrite{uuid: s.UUID, value: value, mask: mask, verify: s.Verify}
+		if s.Rollback != "" {
+			p.rollback, err = DecodeValue(s.Encoding, s.Rollback)
+			if err != nil {
+				return nil, errors.New(s.UUID + ": rollback " + err.Error())
+			}
+		}
+		planned = append(planned, p)
+	}
+	return planned, nil
+}
+
+// WriteSequence writes the steps in order. When one fails, the ones written
+// before it are restored, newest first, and the error is returned along
+// with the report.
+func (sa *SafeAdapter) WriteSequence(address string, steps []plannedWrite) (WriteReport, error) {
+	report := WriteReport{}
+	done := []doneWrite{}
+	for _, s := range steps {
+		rollback := s.rollback
+		if rollback == nil {
+			if previous, err := sa.ReadCharacteristic(address, s.uuid); err == nil {
+				rollback = previous
+			}
+		}
+		err := sa.WriteCharacteristic(address, s.uuid, s.value)
+		if err == nil && s.verify {
+			err = sa.VerifyCharacteristic(address, s.uuid, s.value, s.mask)
+		}
+		if err != nil {
+			report.Failed = s.uuid
+			report.Error = err.Error()
+			// A write that failed verification may still have changed the value.
+			if errors.Is(err, errNotVerified) {
+				done = append(done, doneWrite{s.uuid, rollback})
+			}
+			sa.rollback(address, done, &report)
+			return report, err
+		}
+		done = append(done, doneWrite{s.uuid, rollback})
+		report.Written++
+	}
+	return report, nil
+}
+
+func (sa *SafeAdapter) rollback(address string, done []doneWrite, report *WriteReport) {
+	for i := len(done) - 1; i >= 0; i-- {
+		d := done[i]
+		if d.rollback == nil {
+			report.RollbackFailed = append(report.RollbackFailed, d.uuid)
+			continue
+		}
+		err := sa.WriteCharacteristic(address, d.uuid, d.rollback)
+		if err != nil {
+			LogError("Could not roll back", d.uuid, "on", address, "-", err.Error())
+			report.RollbackFailed = append(report.RollbackFailed, d.uuid)
+			continue
+		}
+		report.RolledBack = append(report.RolledBack, d.uuid)
+	}
+}
+
+// WriteSequenceHandler writes a list of WriteSteps to the connected device,
+// all or nothing as far as the device allows.
+func WriteSequenceHandler() http.HandlerFunc {
+	return func (w http.ResponseWriter, r *http.Request) {
+		steps := []WriteStep{}
+		err := json.NewDecoder(r.Body).Decode(&steps)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		planned, err := planWrites(steps)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		report, err := Adapter.WriteSequence(mux.Vars(r)["addr"], planned)
+		w.Header().Set("Content-Type", "application/json")
+		if errors.Is(err, errNotConnectedTo) {
+			w.WriteHeader(http.StatusConflict)
+		} else if errors.Is(err, errCharacteristicNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+		} else if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+		json.NewEncoder(w).Encode(report)
+	}
+}